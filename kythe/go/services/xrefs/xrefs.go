@@ -29,6 +29,7 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"kythe.io/kythe/go/services/web"
@@ -108,6 +109,13 @@ func InSpanBounds(kind xpb.DecorationsRequest_SpanKind, start, end, startBoundar
 	return false
 }
 
+// SpansOverlap reports whether [start,end) overlaps the specified
+// [startBoundary,endBoundary) span.  The overlap is inclusive: a span partially
+// within the window, or merely touching either of its boundaries, overlaps it.
+func SpansOverlap(start, end, startBoundary, endBoundary int32) bool {
+	return start <= endBoundary && end >= startBoundary
+}
+
 // IsDefKind reports whether the given edgeKind matches the requested
 // definition kind.
 func IsDefKind(requestedKind xpb.CrossReferencesRequest_DefinitionKind, edgeKind string, incomplete bool) bool {
@@ -380,6 +388,32 @@ func NodesMap(nodes map[string]*cpb.NodeInfo) map[string]map[string][]byte {
 	return m
 }
 
+// MergeNodeInfo merges the facts and definition of src into dst.  Facts and
+// definitions present in only one of the two are kept.  If both dst and src
+// have a fact with different values, or different non-empty definitions, an
+// error is returned and dst is left unmodified.
+func MergeNodeInfo(dst, src *cpb.NodeInfo) error {
+	for name, value := range src.Facts {
+		if old, ok := dst.Facts[name]; ok && !bytes.Equal(old, value) {
+			return fmt.Errorf("conflicting values for fact %q: %q vs. %q", name, old, value)
+		}
+	}
+	if dst.Definition != "" && src.Definition != "" && dst.Definition != src.Definition {
+		return fmt.Errorf("conflicting definitions: %q vs. %q", dst.Definition, src.Definition)
+	}
+
+	if dst.Facts == nil && len(src.Facts) > 0 {
+		dst.Facts = make(map[string][]byte, len(src.Facts))
+	}
+	for name, value := range src.Facts {
+		dst.Facts[name] = value
+	}
+	if dst.Definition == "" {
+		dst.Definition = src.Definition
+	}
+	return nil
+}
+
 func nodesMapInto(nodes map[string]*cpb.NodeInfo, m map[string]map[string][]byte) {
 	for ticket, n := range nodes {
 		facts, ok := m[ticket]
@@ -497,6 +531,28 @@ func NewNormalizer(text []byte) *Normalizer {
 	return &Normalizer{int32(len(text)), lineLen, prefixLen}
 }
 
+// NewLineIndexNormalizer returns a Normalizer for Locations within a text with
+// the given line lengths (as parsed by facts.ParseLineIndex), without
+// requiring the text itself.
+func NewLineIndexNormalizer(lines []int) *Normalizer {
+	if len(lines) == 0 {
+		lines = []int{0}
+	}
+	lineLen := make([]int32, len(lines))
+	prefixLen := make([]int32, len(lines))
+	var textLen int32
+	for i, n := range lines {
+		lineLen[i] = int32(n)
+		if i > 0 {
+			prefixLen[i] = prefixLen[i-1] + lineLen[i-1]
+		}
+		textLen += int32(n)
+	}
+	// As in NewNormalizer, the final line is counted as if it were terminated.
+	lineLen[len(lines)-1] += int32(len(lineEnd))
+	return &Normalizer{textLen, lineLen, prefixLen}
+}
+
 // Location returns a normalized location within the Normalizer's text.
 // Normalized FILE locations have no start/end points.  Normalized SPAN
 // locations have fully populated start/end points clamped in the range [0,
@@ -528,6 +584,34 @@ func (n *Normalizer) Location(loc *xpb.Location) (*xpb.Location, error) {
 	return nl, nil
 }
 
+// LineSpan returns a normalized SPAN location covering the whole of the lines
+// between loc's start and end points, inclusive.  Each point must be specified
+// by its LineNumber alone.  Lines past the end of the Normalizer's text are
+// clamped to its bounds.
+func (n *Normalizer) LineSpan(loc *xpb.Location) (*xpb.Location, error) {
+	if loc == nil || loc.Kind != xpb.Location_SPAN {
+		return nil, errors.New("invalid line span: location is not a SPAN")
+	} else if loc.Start == nil || loc.End == nil {
+		return nil, errors.New("invalid line span: missing start/end point")
+	}
+	for _, p := range []*xpb.Location_Point{loc.Start, loc.End} {
+		if p.LineNumber <= 0 {
+			return nil, fmt.Errorf("invalid line span: non-positive line number %d", p.LineNumber)
+		} else if p.ByteOffset != 0 || p.ColumnOffset != 0 {
+			return nil, fmt.Errorf("invalid line span: point on line %d has an offset", p.LineNumber)
+		}
+	}
+
+	// The span ends at the start of the line following the end line (or at
+	// the end of the text).
+	return n.Location(&xpb.Location{
+		Ticket: loc.Ticket,
+		Kind:   xpb.Location_SPAN,
+		Start:  &xpb.Location_Point{LineNumber: loc.Start.LineNumber},
+		End:    &xpb.Location_Point{LineNumber: loc.End.LineNumber + 1},
+	})
+}
+
 var lineEnd = []byte("\n")
 
 // Point returns a normalized point within the Normalizer's text.  A normalized
@@ -627,6 +711,40 @@ func MatchesAny(str string, patterns []*regexp.Regexp) bool {
 	return false
 }
 
+// A FactFilter selects fact names based on a set of filter globs.  A glob with
+// a leading "-" excludes facts whose entire name it matches; exclusions are
+// applied after all inclusions.  If only exclusions are given, every other
+// fact is included.
+type FactFilter struct {
+	include, exclude []*regexp.Regexp
+}
+
+// NewFactFilter returns a FactFilter for the given filter globs.
+func NewFactFilter(filters []string) *FactFilter {
+	f := &FactFilter{}
+	for _, filter := range filters {
+		if strings.HasPrefix(filter, "-") {
+			re := filterToRegexp(filter[1:])
+			f.exclude = append(f.exclude, regexp.MustCompile("^(?:"+re.String()+")$"))
+		} else {
+			f.include = append(f.include, filterToRegexp(filter))
+		}
+	}
+	if len(f.include) == 0 && len(f.exclude) > 0 {
+		f.include = []*regexp.Regexp{filterToRegexp("**")}
+	}
+	return f
+}
+
+// Empty reports whether f was constructed without any filters.
+func (f *FactFilter) Empty() bool { return len(f.include) == 0 }
+
+// Matches reports whether the given fact name is selected by f.  An empty
+// FactFilter matches nothing.
+func (f *FactFilter) Matches(name string) bool {
+	return MatchesAny(name, f.include) && !MatchesAny(name, f.exclude)
+}
+
 func forAllEdges(ctx context.Context, service Service, source stringset.Set, edge []string, f func(source, target, targetKind, edgeKind string) error) error {
 	if source.Empty() {
 		return nil
@@ -67,6 +67,128 @@ func TestFilterRegexp(t *testing.T) {
 	}
 }
 
+func TestFactFilter(t *testing.T) {
+	tests := []struct {
+		filters []string
+		matches []string
+		skips   []string
+	}{
+		{nil, nil, []string{facts.NodeKind, facts.Text}},
+		{[]string{"/kythe/**"}, []string{facts.NodeKind, facts.Text}, nil},
+		{[]string{"/kythe/**", "-/kythe/text"}, []string{facts.NodeKind}, []string{facts.Text}},
+		{[]string{"-/kythe/text"}, []string{facts.NodeKind, "/other"}, []string{facts.Text}},
+		{[]string{facts.NodeKind, "-/kythe/*/kind"}, nil, []string{facts.NodeKind, facts.Text}},
+	}
+
+	for _, test := range tests {
+		f := NewFactFilter(test.filters)
+		for _, name := range test.matches {
+			if !f.Matches(name) {
+				t.Errorf("NewFactFilter(%q).Matches(%q) = false; expected true", test.filters, name)
+			}
+		}
+		for _, name := range test.skips {
+			if f.Matches(name) {
+				t.Errorf("NewFactFilter(%q).Matches(%q) = true; expected false", test.filters, name)
+			}
+		}
+	}
+}
+
+func TestMergeNodeInfo(t *testing.T) {
+	info := func(def string, kvs ...string) *cpb.NodeInfo {
+		n := &cpb.NodeInfo{Definition: def}
+		for i := 0; i+1 < len(kvs); i += 2 {
+			if n.Facts == nil {
+				n.Facts = make(map[string][]byte)
+			}
+			n.Facts[kvs[i]] = []byte(kvs[i+1])
+		}
+		return n
+	}
+
+	tests := []struct {
+		dst, src *cpb.NodeInfo
+		expected *cpb.NodeInfo // nil if an error is expected
+	}{
+		{ // identical
+			info("def", facts.NodeKind, "function"),
+			info("def", facts.NodeKind, "function"),
+			info("def", facts.NodeKind, "function"),
+		},
+		{ // disjoint
+			info("", facts.NodeKind, "function"),
+			info("def", facts.Subkind, "method"),
+			info("def", facts.NodeKind, "function", facts.Subkind, "method"),
+		},
+		{ // empty dst
+			info(""),
+			info("", facts.NodeKind, "function"),
+			info("", facts.NodeKind, "function"),
+		},
+		{ // conflicting facts
+			info("", facts.NodeKind, "function", facts.Subkind, "method"),
+			info("", facts.NodeKind, "variable"),
+			nil,
+		},
+		{ // conflicting definitions
+			info("def1"),
+			info("def2"),
+			nil,
+		},
+	}
+
+	for i, test := range tests {
+		orig := proto.Clone(test.dst)
+		err := MergeNodeInfo(test.dst, test.src)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("Test %d: expected error; found %v", i, test.dst)
+			} else if !proto.Equal(orig, test.dst) {
+				t.Errorf("Test %d: dst modified on error: %v", i, test.dst)
+			}
+		} else if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+		} else if !proto.Equal(test.expected, test.dst) {
+			t.Errorf("Test %d: expected %v; found %v", i, test.expected, test.dst)
+		}
+	}
+}
+
+func TestInSpanBounds(t *testing.T) {
+	const startBoundary, endBoundary = 10, 20
+	tests := []struct {
+		start, end              int32
+		within, around, overlap bool
+	}{
+		{10, 20, true, true, true},
+		{12, 18, true, false, true},
+		{5, 25, false, true, true},
+		{5, 15, false, false, true},  // cuts through startBoundary
+		{15, 25, false, false, true}, // cuts through endBoundary
+		{5, 10, false, false, true},  // touches startBoundary
+		{20, 25, false, false, true}, // touches endBoundary
+		{10, 10, true, false, true},
+		{20, 20, true, false, true},
+		{0, 9, false, false, false},
+		{21, 30, false, false, false},
+	}
+
+	for _, test := range tests {
+		for kind, expected := range map[xpb.DecorationsRequest_SpanKind]bool{
+			xpb.DecorationsRequest_WITHIN_SPAN: test.within,
+			xpb.DecorationsRequest_AROUND_SPAN: test.around,
+		} {
+			if found := InSpanBounds(kind, test.start, test.end, startBoundary, endBoundary); found != expected {
+				t.Errorf("InSpanBounds(%v, %d, %d, %d, %d): expected %v; found %v", kind, test.start, test.end, startBoundary, endBoundary, expected, found)
+			}
+		}
+		if found := SpansOverlap(test.start, test.end, startBoundary, endBoundary); found != test.overlap {
+			t.Errorf("SpansOverlap(%d, %d, %d, %d): expected %v; found %v", test.start, test.end, startBoundary, endBoundary, test.overlap, found)
+		}
+	}
+}
+
 func TestNormalizerPoint(t *testing.T) {
 	const text = `line 1
 line 2
@@ -155,6 +277,71 @@ last line without newline`
 	}
 }
 
+func TestNewLineIndexNormalizer(t *testing.T) {
+	for _, test := range []struct {
+		text  string
+		lines []int
+	}{
+		{"", []int{0}},
+		{"", nil},
+		{"ab", []int{2}},
+		{"ab\ncd\n", []int{3, 3, 0}},
+		{"line 1\nline 2\nlast line without newline", []int{7, 7, 25}},
+	} {
+		expected, found := NewNormalizer([]byte(test.text)), NewLineIndexNormalizer(test.lines)
+		if !reflect.DeepEqual(expected, found) {
+			t.Errorf("NewLineIndexNormalizer(%v): expected %+v; found %+v", test.lines, expected, found)
+		}
+	}
+}
+
+func TestNormalizerLineSpan(t *testing.T) {
+	const text = `line 1
+line 2
+last line without newline`
+
+	tests := []struct {
+		start, end             int32
+		startOffset, endOffset int32
+	}{
+		{1, 1, 0, 7},
+		{1, 2, 0, 14},
+		{2, 3, 7, 39},
+		{3, 3, 14, 39},
+		{2, 10, 7, 39}, // past end of text
+		{5, 10, 39, 39},
+	}
+
+	n := NewNormalizer([]byte(text))
+	for _, test := range tests {
+		loc, err := n.LineSpan(&xpb.Location{
+			Kind:  xpb.Location_SPAN,
+			Start: &xpb.Location_Point{LineNumber: test.start},
+			End:   &xpb.Location_Point{LineNumber: test.end},
+		})
+		if err != nil {
+			t.Errorf("LineSpan(%d, %d) error: %v", test.start, test.end, err)
+		} else if loc.Start.ByteOffset != test.startOffset || loc.End.ByteOffset != test.endOffset {
+			t.Errorf("LineSpan(%d, %d): expected [%d, %d); found [%d, %d)", test.start, test.end,
+				test.startOffset, test.endOffset, loc.Start.ByteOffset, loc.End.ByteOffset)
+		}
+	}
+
+	for _, loc := range []*xpb.Location{
+		nil,
+		{Kind: xpb.Location_FILE},
+		{Kind: xpb.Location_SPAN, Start: &xpb.Location_Point{LineNumber: 1}},
+		{Kind: xpb.Location_SPAN, Start: &xpb.Location_Point{LineNumber: 0}, End: &xpb.Location_Point{LineNumber: 1}},
+		{Kind: xpb.Location_SPAN, Start: &xpb.Location_Point{LineNumber: 1, ColumnOffset: 2}, End: &xpb.Location_Point{LineNumber: 1}},
+		{Kind: xpb.Location_SPAN, Start: &xpb.Location_Point{LineNumber: 2}, End: &xpb.Location_Point{LineNumber: 1, ByteOffset: 3}},
+		{Kind: xpb.Location_SPAN, Start: &xpb.Location_Point{LineNumber: 3}, End: &xpb.Location_Point{LineNumber: 1}},
+	} {
+		if found, err := n.LineSpan(loc); err == nil {
+			t.Errorf("LineSpan({%v}): expected error; found {%v}", loc, found)
+		}
+	}
+}
+
 func TestPatcher(t *testing.T) {
 	tests := []struct {
 		oldText, newText string
@@ -117,7 +117,7 @@ func main() {
 			log.Printf("Using %T directly as xrefs service", gs)
 			xs = x
 		} else {
-			if err := xstore.EnsureReverseEdges(ctx, gs); err != nil {
+			if _, err := xstore.EnsureReverseEdges(ctx, gs); err != nil {
 				log.Fatalf("Error ensuring reverse edges in GraphStore: %v", err)
 			}
 			xs = xstore.NewGraphStoreService(gs)
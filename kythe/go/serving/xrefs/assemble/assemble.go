@@ -520,8 +520,10 @@ func (b *CrossReferencesBuilder) constructPager() *pager.SetPager {
 			n := hd.(*srvpb.Node)
 			var incomplete bool
 			for _, f := range n.Fact {
-				if f.Name == facts.Complete && string(f.Value) != "definition" {
-					incomplete = true
+				if f.Name == facts.Complete {
+					if c, err := facts.ParseComplete(f.Value); err != nil || c != facts.CompletenessDefinition {
+						incomplete = true
+					}
 				}
 			}
 			return &srvpb.PagedCrossReferences{
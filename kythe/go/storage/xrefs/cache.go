@@ -0,0 +1,204 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/xrefs"
+	"kythe.io/kythe/go/util/kytheuri"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// readCache memoizes the results of complete GraphStore Read calls for the
+// duration of a single top-level GraphStoreService call.
+type readCache struct {
+	mu      sync.Mutex
+	entries map[readKey][]*spb.Entry
+}
+
+type readKey struct{ source, edgeKind string }
+
+type readCacheKey struct{}
+
+// withReadCache returns a context carrying a new readCache if g.CacheReads is
+// set and ctx does not already carry one.  Nested calls made with the returned
+// context share its cache, which is dropped along with the context.
+func (g *GraphStoreService) withReadCache(ctx context.Context) context.Context {
+	if !g.CacheReads {
+		return ctx
+	}
+	return newReadCache(ctx)
+}
+
+// newReadCache returns a context carrying a new readCache, regardless of
+// g.CacheReads, unless ctx already carries one.
+func newReadCache(ctx context.Context) context.Context {
+	if ctx.Value(readCacheKey{}) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, readCacheKey{}, &readCache{
+		entries: make(map[readKey][]*spb.Entry),
+	})
+}
+
+// cachingGraphStore is a graphstore.Service that serves Read calls from the
+// readCache carried by their context, if any.  Without one, Read calls are
+// passed through uncached.
+type cachingGraphStore struct{ graphstore.Service }
+
+// Read implements part of the graphstore.Service interface.
+func (c cachingGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	cache, ok := ctx.Value(readCacheKey{}).(*readCache)
+	if !ok {
+		return c.Service.Read(ctx, req, f)
+	}
+	key := readKey{kytheuri.ToString(req.Source), req.EdgeKind}
+
+	cache.mu.Lock()
+	entries, ok := cache.entries[key]
+	cache.mu.Unlock()
+	if ok {
+		for _, e := range entries {
+			if err := f(e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Only cache the results of a Read that was not stopped early.
+	var stopped bool
+	if err := c.Service.Read(ctx, req, func(e *spb.Entry) error {
+		entries = append(entries, e)
+		err := f(e)
+		if err == io.EOF {
+			stopped = true
+		}
+		return err
+	}); err != nil {
+		return err
+	} else if !stopped {
+		cache.mu.Lock()
+		cache.entries[key] = entries
+		cache.mu.Unlock()
+	}
+	return nil
+}
+
+// fileCache is a concurrency-safe cache of the parent files of anchors.
+// Concurrent requests for the same uncached file share a single fetch.
+type fileCache struct {
+	mu    sync.Mutex
+	files map[string]*cachedFile
+}
+
+// A cachedFile is a file fetch, complete once done is closed.
+type cachedFile struct {
+	done chan struct{}
+	file *fileNode
+	err  error
+}
+
+func newFileCache() *fileCache {
+	return &fileCache{files: make(map[string]*cachedFile)}
+}
+
+// get returns the file with the given ticket, calling fetch to retrieve it if
+// it is not already cached or being fetched.  A failed fetch is cached along
+// with its error.
+func (c *fileCache) get(ticket string, fetch func() (*fileNode, error)) (*fileNode, error) {
+	c.mu.Lock()
+	f, ok := c.files[ticket]
+	if !ok {
+		f = &cachedFile{done: make(chan struct{})}
+		c.files[ticket] = f
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-f.done
+	} else {
+		f.file, f.err = fetch()
+		close(f.done)
+	}
+	return f.file, f.err
+}
+
+// filterCache is a concurrency-safe LRU cache of the xrefs.FactFilter compiled
+// for each distinct list of filter globs.
+type filterCache struct {
+	mu      sync.Mutex
+	lru     *list.List // of *cachedFilter; most recently used first
+	filters map[string]*list.Element
+}
+
+type cachedFilter struct {
+	key    string
+	filter *xrefs.FactFilter
+}
+
+func newFilterCache() *filterCache {
+	return &filterCache{
+		lru:     list.New(),
+		filters: make(map[string]*list.Element),
+	}
+}
+
+// get returns the FactFilter for the given filter globs, compiling it if it is
+// not already cached.  At most max FactFilters are retained, evicting the least
+// recently used.  If c is nil or max <= 0, nothing is cached.
+func (c *filterCache) get(filters []string, max int) *xrefs.FactFilter {
+	if c == nil || max <= 0 || len(filters) == 0 {
+		return xrefs.NewFactFilter(filters)
+	}
+	key := fmt.Sprintf("%q", filters)
+
+	c.mu.Lock()
+	if e, ok := c.filters[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*cachedFilter).filter
+	}
+	c.mu.Unlock()
+
+	// Compile outside of the lock; a concurrent miss for the same key merely
+	// duplicates the work.
+	f := xrefs.NewFactFilter(filters)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.filters[key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedFilter).filter
+	}
+	c.filters[key] = c.lru.PushFront(&cachedFilter{key, f})
+	for c.lru.Len() > max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.filters, e.Value.(*cachedFilter).key)
+	}
+	return f
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/xrefs"
+	"kythe.io/kythe/go/test/testutil"
+	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema/facts"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+	xpb "kythe.io/kythe/proto/xref_proto"
+)
+
+// countingGraphStore is a graphstore.Service that counts its Read calls, in
+// total and, if sources is non-nil, by source ticket.
+type countingGraphStore struct {
+	graphstore.Service
+	reads   int
+	sources map[string]int
+}
+
+func (c *countingGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	c.reads++
+	if c.sources != nil {
+		c.sources[kytheuri.ToString(req.Source)]++
+	}
+	return c.Service.Read(ctx, req, f)
+}
+
+func TestCacheReads(t *testing.T) {
+	req := &xpb.CrossReferencesRequest{
+		Ticket:         []string{kytheuri.ToString(federatedTarget)},
+		DefinitionKind: xpb.CrossReferencesRequest_ALL_DEFINITIONS,
+		ReferenceKind:  xpb.CrossReferencesRequest_ALL_REFERENCES,
+		Filter:         []string{"**"},
+	}
+
+	uncachedStore := &countingGraphStore{Service: NewMemGraphStore(federatedEntries("file")...)}
+	expected, err := NewGraphStoreService(uncachedStore).CrossReferences(ctx, req)
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+
+	gs := &countingGraphStore{Service: NewMemGraphStore(federatedEntries("file")...)}
+	xs := NewGraphStoreService(gs)
+	xs.CacheReads = true
+	for i := 0; i < 2; i++ {
+		gs.reads = 0
+		reply, err := xs.CrossReferences(ctx, req)
+		if err != nil {
+			t.Fatalf("CrossReferences error: %v", err)
+		} else if err := testutil.DeepEqual(expected, reply); err != nil {
+			t.Error(err)
+		}
+		if gs.reads >= uncachedStore.reads {
+			t.Errorf("Call %d: found %d cached reads; expected fewer than %d uncached reads", i, gs.reads, uncachedStore.reads)
+		} else if gs.reads == 0 {
+			t.Errorf("Call %d: found no reads; cache leaked across calls", i)
+		}
+	}
+}
+
+func TestCacheReadsStoppedEarly(t *testing.T) {
+	ctx := (&GraphStoreService{CacheReads: true}).withReadCache(ctx)
+	gs := &countingGraphStore{Service: NewMemGraphStore(testEntries...)}
+	cached := cachingGraphStore{gs}
+	req := &spb.ReadRequest{Source: testFileVName}
+
+	// A Read stopped early must not be cached.
+	if err := cached.Read(ctx, req, func(*spb.Entry) error { return io.EOF }); err != nil {
+		t.Fatalf("Read error: %v", err)
+	}
+	var entries int
+	for i := 0; i < 2; i++ {
+		entries = 0
+		if err := cached.Read(ctx, req, func(*spb.Entry) error {
+			entries++
+			return nil
+		}); err != nil {
+			t.Fatalf("Read error: %v", err)
+		}
+	}
+	if gs.reads != 2 {
+		t.Errorf("Found %d GraphStore reads; expected 2", gs.reads)
+	} else if entries == 0 {
+		t.Error("No entries read")
+	}
+}
+
+func TestDecorationsBatchSharesReads(t *testing.T) {
+	entries := append(federatedEntries("a"), federatedEntries("b")...)
+	var reqs []*xpb.DecorationsRequest
+	for _, path := range []string{"a", "b"} {
+		reqs = append(reqs, &xpb.DecorationsRequest{
+			Location:   &xpb.Location{Ticket: kytheuri.ToString(fileVName(path))},
+			References: true,
+			Filter:     []string{"**"},
+		})
+	}
+
+	// Each file's Decorations reads the shared target separately.
+	separate := &countingGraphStore{Service: NewMemGraphStore(entries...)}
+	xs := NewGraphStoreService(separate)
+	var expected []*DecorationsResult
+	for _, req := range reqs {
+		reply, err := xs.Decorations(ctx, req)
+		if err != nil {
+			t.Fatalf("Decorations error: %v", err)
+		}
+		expected = append(expected, &DecorationsResult{Reply: reply})
+	}
+
+	// CacheReads is unset, but the batch shares its reads nonetheless.
+	batched := &countingGraphStore{
+		Service: NewMemGraphStore(entries...),
+		sources: make(map[string]int),
+	}
+	results, err := NewGraphStoreService(batched).DecorationsBatch(ctx, reqs)
+	if err != nil {
+		t.Fatalf("DecorationsBatch error: %v", err)
+	} else if err := testutil.DeepEqual(expected, results); err != nil {
+		t.Error(err)
+	}
+	if target := kytheuri.ToString(federatedTarget); batched.sources[target] != 1 {
+		t.Errorf("Found %d reads of shared target %q; expected 1", batched.sources[target], target)
+	}
+	if batched.reads >= separate.reads {
+		t.Errorf("Found %d batched reads; expected fewer than %d separate reads", batched.reads, separate.reads)
+	}
+}
+
+func TestFileCacheConcurrent(t *testing.T) {
+	c := newFileCache()
+	var fetches int32
+	fetch := func(ticket string) func() (*fileNode, error) {
+		return func() (*fileNode, error) {
+			atomic.AddInt32(&fetches, 1)
+			if ticket == "bad" {
+				return nil, errors.New("sentinel fetch error")
+			}
+			text := []byte(ticket)
+			return &fileNode{text: text, norm: xrefs.NewNormalizer(text)}, nil
+		}
+	}
+
+	tickets := []string{"a", "b", "bad"}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, ticket := range tickets {
+			wg.Add(1)
+			go func(ticket string) {
+				defer wg.Done()
+				file, err := c.get(ticket, fetch(ticket))
+				if ticket == "bad" {
+					if err == nil {
+						t.Errorf("Expected error for %q; found %v", ticket, file)
+					}
+				} else if err != nil {
+					t.Errorf("Error fetching %q: %v", ticket, err)
+				} else if string(file.text) != ticket {
+					t.Errorf("Found text %q for %q", file.text, ticket)
+				}
+			}(ticket)
+		}
+	}
+	wg.Wait()
+
+	if found := atomic.LoadInt32(&fetches); int(found) != len(tickets) {
+		t.Errorf("Found %d fetches; expected %d", found, len(tickets))
+	}
+}
+
+func TestFilterCache(t *testing.T) {
+	c := newFilterCache()
+	a, b, d := []string{"a/**"}, []string{"b", "-b/c"}, []string{"d*"}
+
+	fa := c.get(a, 2)
+	if found := c.get([]string{"a/**"}, 2); found != fa {
+		t.Errorf("Expected cached FactFilter for %q", a)
+	}
+	if !fa.Matches("a/b") || fa.Matches("b") {
+		t.Errorf("Cached FactFilter for %q matches incorrectly", a)
+	}
+
+	fb := c.get(b, 2)
+	c.get(a, 2) // a is now more recently used than b
+	c.get(d, 2) // evicts b
+	if found := c.get(b, 2); found == fb {
+		t.Errorf("Expected %q to be evicted", b)
+	}
+	if found := c.get(d, 2); c.lru.Len() != 2 || found == nil {
+		t.Errorf("Cache holds %d FactFilters; expected 2", c.lru.Len())
+	}
+
+	// Differently split globs must not share a FactFilter.
+	if c.get([]string{"x", "y"}, 2) == c.get([]string{"x\", \"y"}, 2) {
+		t.Error("Distinct filter lists share a cached FactFilter")
+	}
+
+	if c.get(a, 0) == c.get(a, 0) {
+		t.Error("Expected no caching with a max size of 0")
+	}
+	var nilCache *filterCache
+	if f := nilCache.get(a, 2); !f.Matches("a/b") {
+		t.Errorf("Uncached FactFilter for %q matches incorrectly", a)
+	}
+}
+
+func BenchmarkFactFilterUncached(b *testing.B) {
+	benchmarkFactFilter(b, 0)
+}
+
+func BenchmarkFactFilterCached(b *testing.B) {
+	benchmarkFactFilter(b, DefaultFilterCacheSize)
+}
+
+func benchmarkFactFilter(b *testing.B, size int) {
+	xs := NewGraphStoreService(nil)
+	xs.FilterCacheSize = size
+	filters := []string{facts.NodeKind, "/kythe/text/*", "/kythe/loc/**", "-/kythe/text/encoding"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !xs.factFilter(filters).Matches(facts.NodeKind) {
+			b.Fatal("FactFilter does not match node kind")
+		}
+	}
+}
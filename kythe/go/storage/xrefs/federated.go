@@ -0,0 +1,374 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/xrefs"
+	"kythe.io/kythe/go/util/schema/facts"
+
+	"bitbucket.org/creachadair/stringset"
+
+	cpb "kythe.io/kythe/proto/common_proto"
+	gpb "kythe.io/kythe/proto/graph_proto"
+	ipb "kythe.io/kythe/proto/internal_proto"
+	xpb "kythe.io/kythe/proto/xref_proto"
+)
+
+// A FederatedService implements the xrefs.Service interface by merging the
+// results of a GraphStoreService for each of several independent GraphStores.
+// Each GraphStore must separately satisfy the requirements of a
+// GraphStoreService, including containing its own reverse edges (see
+// EnsureReverseEdges).
+type FederatedService struct {
+	services []*GraphStoreService
+
+	// SkipErrors determines whether a request failing for a single backend is
+	// logged and skipped rather than failing the entire request.  A request
+	// failing for every backend always fails.
+	SkipErrors bool
+
+	// Logger, if non-nil, receives the message logged for each skipped
+	// backend.  If nil, the standard log package is used.  Each backend's
+	// GraphStoreService has its own Logger.
+	Logger Logger
+}
+
+// NewFederatedGraphStoreService returns a FederatedService over the given
+// GraphStores.
+func NewFederatedGraphStoreService(gs ...graphstore.Service) *FederatedService {
+	f := &FederatedService{}
+	for _, s := range gs {
+		f.services = append(f.services, NewGraphStoreService(s))
+	}
+	return f
+}
+
+// Services returns the GraphStoreService used for each backend, in order.
+// Each may be configured independently.
+func (f *FederatedService) Services() []*GraphStoreService { return f.services }
+
+// logger returns f.Logger, if set, or a Logger writing to the standard log
+// package.
+func (f *FederatedService) logger() Logger {
+	if f.Logger != nil {
+		return f.Logger
+	}
+	return stdLogger{}
+}
+
+// each calls fn for each backend service in order.  An error returned by fn
+// fails the entire call unless f.SkipErrors is set.
+func (f *FederatedService) each(fn func(i int, g *GraphStoreService) error) error {
+	if len(f.services) == 0 {
+		return errors.New("no GraphStores to query")
+	}
+	var failed int
+	var lastErr error
+	for i, g := range f.services {
+		if err := fn(i, g); err != nil {
+			err = errorf(err, "GraphStore %d: %v", i, err)
+			if !f.SkipErrors {
+				return err
+			}
+			f.logger().Printf("Skipping failed backend: %v", err)
+			failed++
+			lastErr = err
+		}
+	}
+	if failed == len(f.services) {
+		return lastErr
+	}
+	return nil
+}
+
+// Nodes implements part of the xrefs.Service interface.  The facts of a node
+// found in several GraphStores are merged using xrefs.MergeNodeInfo.
+func (f *FederatedService) Nodes(ctx context.Context, req *gpb.NodesRequest) (*gpb.NodesReply, error) {
+	reply := &gpb.NodesReply{Nodes: make(map[string]*cpb.NodeInfo)}
+	if err := f.each(func(_ int, g *GraphStoreService) error {
+		r, err := g.Nodes(ctx, req)
+		if err != nil {
+			return err
+		}
+		return mergeNodes(reply.Nodes, r.Nodes)
+	}); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Edges implements part of the xrefs.Service interface.  Edges are paged in
+// the same order as GraphStoreService.Edges, and an edge found in several
+// GraphStores is returned once.  Each page merges up to PageSize edges from
+// each GraphStore, resuming after the last edge of the previous page, so no
+// GraphStore is read past the requested page; the MaxEdgesPerKind of each
+// backend is ignored.  TotalEdgesByKind sums the totals of each GraphStore,
+// and so counts an edge found in several GraphStores more than once.
+func (f *FederatedService) Edges(ctx context.Context, req *gpb.EdgesRequest) (*gpb.EdgesReply, error) {
+	if len(req.Ticket) == 0 {
+		return nil, ErrNoTickets
+	} else if req.PageSize < 0 {
+		return nil, errorf(ErrInvalidArgument, "%v: invalid page_size %d", ErrInvalidArgument, req.PageSize)
+	}
+	pageSize := int(req.PageSize)
+	if pageSize == 0 {
+		pageSize = defaultEdgesPageSize
+	}
+	if req.PageToken != "" {
+		// The token is passed to each backend as is, so it is only validated
+		// once here.
+		t, err := decodePageToken(req.PageToken)
+		if err != nil {
+			return nil, err
+		} else if _, err := decodeEdgeKey(t); err != nil {
+			return nil, errorf(ErrInvalidPageToken, "%v: %q", ErrInvalidPageToken, req.PageToken)
+		}
+	}
+
+	reply := &gpb.EdgesReply{
+		EdgeSets:         make(map[string]*gpb.EdgeSet),
+		Nodes:            make(map[string]*cpb.NodeInfo),
+		TotalEdgesByKind: make(map[string]int64),
+	}
+	var more bool
+	page := make(map[edgeKey]*gpb.EdgeSet_Group_Edge)
+	if err := f.each(func(_ int, g *GraphStoreService) error {
+		// Each backend is paged by edgeKey so that every backend resumes after
+		// the same edge.
+		backendReq := *req
+		backendReq.PageSize = int32(pageSize)
+		r, err := g.edges(ctx, &backendReq, &edgesOptions{byEdgeKey: true})
+		if err != nil {
+			return err
+		}
+		more = more || r.NextPageToken != ""
+		for i, ticket := range req.Ticket {
+			for kind, grp := range r.EdgeSets[ticket].GetGroups() {
+				for _, e := range grp.Edge {
+					page[edgeKey{i, kind, e.Ordinal, e.TargetTicket}] = e
+				}
+			}
+		}
+		for kind, n := range r.TotalEdgesByKind {
+			reply.TotalEdgesByKind[kind] += n
+		}
+		return mergeNodes(reply.Nodes, r.Nodes)
+	}); err != nil {
+		return nil, err
+	}
+
+	// Each backend returned its first pageSize edges after the token, so the
+	// first pageSize of the merged edges are exactly those of the page.
+	keys := make([]edgeKey, 0, len(page))
+	for k := range page {
+		keys = append(keys, k)
+	}
+	sort.Sort(byEdgeKey(keys))
+	if len(keys) > pageSize {
+		keys, more = keys[:pageSize], true
+	}
+
+	inPage := stringset.New(req.Ticket...)
+	for _, k := range keys {
+		ticket := req.Ticket[k.ticket]
+		set, ok := reply.EdgeSets[ticket]
+		if !ok {
+			set = &gpb.EdgeSet{Groups: make(map[string]*gpb.EdgeSet_Group)}
+			reply.EdgeSets[ticket] = set
+		}
+		grp, ok := set.Groups[k.kind]
+		if !ok {
+			grp = &gpb.EdgeSet_Group{}
+			set.Groups[k.kind] = grp
+		}
+		grp.Edge = append(grp.Edge, page[k])
+		inPage.Add(k.target)
+	}
+	// Drop the nodes of targets beyond the page.
+	for ticket := range reply.Nodes {
+		if !inPage.Contains(ticket) {
+			delete(reply.Nodes, ticket)
+		}
+	}
+
+	if more && len(keys) > 0 {
+		token, err := encodePageToken(keys[len(keys)-1].pageToken())
+		if err != nil {
+			return nil, err
+		}
+		reply.NextPageToken = token
+	}
+	return reply, nil
+}
+
+// Decorations implements part of the xrefs.Service interface.  Only the
+// GraphStores containing the requested file's node are used or, if the
+// request's SourceText is set, only those also containing the file's text.  If
+// there are none, the first GraphStore is used.
+func (f *FederatedService) Decorations(ctx context.Context, req *xpb.DecorationsRequest) (*xpb.DecorationsReply, error) {
+	if req.GetLocation() == nil {
+		return nil, errorf(ErrInvalidArgument, "%v: missing location", ErrInvalidArgument)
+	}
+
+	filter := []string{facts.NodeKind}
+	if req.SourceText {
+		filter = []string{facts.Text, facts.TextRef}
+	}
+	var reply *xpb.DecorationsReply
+	if err := f.each(func(_ int, g *GraphStoreService) error {
+		files, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: []string{req.Location.Ticket},
+			Filter: filter,
+		})
+		if err != nil {
+			return err
+		}
+		var hasFile bool
+		for _, file := range files.Nodes {
+			hasFile = !req.SourceText || file.Facts[facts.Text] != nil || (g.TextResolver != nil && file.Facts[facts.TextRef] != nil)
+		}
+		if !hasFile {
+			return nil
+		}
+
+		r, err := g.Decorations(ctx, req)
+		if err != nil {
+			return err
+		} else if reply == nil {
+			reply = r
+			return nil
+		}
+		reply.Reference = append(reply.Reference, r.Reference...)
+		for ticket, anchor := range r.DefinitionLocations {
+			if reply.DefinitionLocations == nil {
+				reply.DefinitionLocations = make(map[string]*xpb.Anchor)
+			}
+			reply.DefinitionLocations[ticket] = anchor
+		}
+		return mergeNodes(reply.Nodes, r.Nodes)
+	}); err != nil {
+		return nil, err
+	}
+
+	if reply == nil {
+		return f.services[0].Decorations(ctx, req)
+	}
+	sort.Sort(bySpan(reply.Reference))
+	return reply, nil
+}
+
+// CrossReferences implements part of the xrefs.Service interface.  The
+// GraphStores are paged through in order; each page contains the results of
+// the first GraphStore, from the page token onwards, having any results.
+func (f *FederatedService) CrossReferences(ctx context.Context, req *xpb.CrossReferencesRequest) (*xpb.CrossReferencesReply, error) {
+	start, token := 0, ""
+	if req.PageToken != "" {
+		t, err := decodePageToken(req.PageToken)
+		if err != nil {
+			return nil, err
+		} else if int(t.Index) >= len(f.services) {
+			return nil, errorf(ErrInvalidPageToken, "%v: %q", ErrInvalidPageToken, req.PageToken)
+		}
+		start, token = int(t.Index), t.SecondaryToken
+	}
+
+	reply := &xpb.CrossReferencesReply{
+		CrossReferences: make(map[string]*xpb.CrossReferencesReply_CrossReferenceSet),
+	}
+	if len(req.Filter) > 0 {
+		reply.Nodes = make(map[string]*cpb.NodeInfo)
+	}
+	if err := f.each(func(i int, g *GraphStoreService) error {
+		if i < start || reply.NextPageToken != "" {
+			return nil
+		}
+
+		backendReq := *req
+		backendReq.PageToken = ""
+		if i == start {
+			backendReq.PageToken = token
+		}
+		r, err := g.CrossReferences(ctx, &backendReq)
+		if err != nil {
+			return err
+		}
+		mergeCrossReferences(reply, r)
+		if err := mergeNodes(reply.Nodes, r.Nodes); err != nil {
+			return err
+		}
+
+		// Each page holds the results of a single GraphStore so that the
+		// requested PageSize is respected.
+		next := &ipb.PageToken{Index: int32(i), SecondaryToken: r.NextPageToken}
+		if r.NextPageToken == "" {
+			if len(r.CrossReferences) == 0 || i+1 == len(f.services) {
+				return nil
+			}
+			next = &ipb.PageToken{Index: int32(i + 1)}
+		}
+		reply.NextPageToken, err = encodePageToken(next)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Documentation implements part of the xrefs.Service interface.
+func (f *FederatedService) Documentation(ctx context.Context, req *xpb.DocumentationRequest) (*xpb.DocumentationReply, error) {
+	return xrefs.SlowDocumentation(ctx, f, req)
+}
+
+// mergeNodes merges each NodeInfo in src into dst.
+func mergeNodes(dst, src map[string]*cpb.NodeInfo) error {
+	for ticket, info := range src {
+		if old, ok := dst[ticket]; !ok {
+			dst[ticket] = info
+		} else if err := xrefs.MergeNodeInfo(old, info); err != nil {
+			return errorf(err, "node %q: %v", ticket, err)
+		}
+	}
+	return nil
+}
+
+// mergeCrossReferences appends the cross-references of src to dst.
+func mergeCrossReferences(dst, src *xpb.CrossReferencesReply) {
+	for ticket, set := range src.CrossReferences {
+		old, ok := dst.CrossReferences[ticket]
+		if !ok {
+			dst.CrossReferences[ticket] = set
+			continue
+		}
+		old.Definition = append(old.Definition, set.Definition...)
+		old.Declaration = append(old.Declaration, set.Declaration...)
+		old.Reference = append(old.Reference, set.Reference...)
+		old.Documentation = append(old.Documentation, set.Documentation...)
+		old.Caller = append(old.Caller, set.Caller...)
+		old.RelatedNode = append(old.RelatedNode, set.RelatedNode...)
+	}
+	for ticket, anchor := range src.DefinitionLocations {
+		if dst.DefinitionLocations == nil {
+			dst.DefinitionLocations = make(map[string]*xpb.Anchor)
+		}
+		dst.DefinitionLocations[ticket] = anchor
+	}
+}
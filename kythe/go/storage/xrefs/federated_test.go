@@ -0,0 +1,292 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"kythe.io/kythe/go/test/testutil"
+	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema/edges"
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
+
+	cpb "kythe.io/kythe/proto/common_proto"
+	gpb "kythe.io/kythe/proto/graph_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+	xpb "kythe.io/kythe/proto/xref_proto"
+)
+
+var federatedTarget = &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+
+// federatedEntries returns the entries for a file containing a single anchor
+// referencing federatedTarget.  Each set of entries contains its own reverse
+// edge.
+func federatedEntries(path string) []*spb.Entry {
+	file := fileVName(path)
+	anchor := anchorVName(file, "anchor")
+	return append(nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "some text\n",
+		), nil},
+		{anchor, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref:     {federatedTarget},
+			edges.ChildOf: {file},
+		}},
+		{federatedTarget, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {anchor},
+		}},
+	}), edgeFact(file, revChildOfEdgeKind, 0, anchor))
+}
+
+func TestFederatedNodes(t *testing.T) {
+	a, b := sig("a"), sig("b")
+	xs := NewFederatedGraphStoreService(
+		NewMemGraphStore(nodeFact(a, facts.NodeKind, nodes.Function)),
+		NewMemGraphStore(
+			nodeFact(a, facts.Text, "text"),
+			nodeFact(b, facts.NodeKind, nodes.Variable),
+		),
+	)
+
+	reply, err := xs.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: []string{kytheuri.ToString(a), kytheuri.ToString(b)},
+	})
+	if err != nil {
+		t.Fatalf("Nodes error: %v", err)
+	}
+	expected := map[string]*cpb.NodeInfo{
+		kytheuri.ToString(a): {Facts: map[string][]byte{
+			facts.NodeKind: []byte(nodes.Function),
+			facts.Text:     []byte("text"),
+		}},
+		kytheuri.ToString(b): {Facts: map[string][]byte{
+			facts.NodeKind: []byte(nodes.Variable),
+		}},
+	}
+	if err := testutil.DeepEqual(expected, reply.Nodes); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFederatedEdges(t *testing.T) {
+	source, x, y := sig("source"), sig("x"), sig("y")
+	xs := NewFederatedGraphStoreService(
+		NewMemGraphStore(edgeFact(source, edges.Param, 0, x)),
+		NewMemGraphStore(
+			edgeFact(source, edges.Param, 0, x),
+			edgeFact(source, edges.Param, 1, y),
+		),
+	)
+
+	ticket := kytheuri.ToString(source)
+	reply, err := xs.Edges(ctx, &gpb.EdgesRequest{Ticket: []string{ticket}})
+	if err != nil {
+		t.Fatalf("Edges error: %v", err)
+	}
+	expected := map[string]*gpb.EdgeSet{
+		ticket: {Groups: map[string]*gpb.EdgeSet_Group{
+			edges.Param: {Edge: []*gpb.EdgeSet_Group_Edge{
+				{TargetTicket: kytheuri.ToString(x), Ordinal: NoOrdinal},
+				{TargetTicket: kytheuri.ToString(y), Ordinal: 1},
+			}},
+		}},
+	}
+	if err := testutil.DeepEqual(expected, reply.EdgeSets); err != nil {
+		t.Error(err)
+	}
+	// The shared edge is counted by each GraphStore.
+	if err := testutil.DeepEqual(map[string]int64{edges.Param: 3}, reply.TotalEdgesByKind); err != nil {
+		t.Errorf("TotalEdgesByKind: %v", err)
+	}
+}
+
+func TestFederatedEdgesPaging(t *testing.T) {
+	source := sig("source")
+	param := func(i int) *spb.Entry { return edgeFact(source, edges.Param, i, sig(fmt.Sprintf("param%d", i))) }
+	xs := NewFederatedGraphStoreService(
+		NewMemGraphStore(param(1), param(2), param(4)),
+		NewMemGraphStore(param(1), param(3), param(4), param(5)),
+	)
+
+	ticket := kytheuri.ToString(source)
+	req := &gpb.EdgesRequest{Ticket: []string{ticket}, PageSize: 2}
+	var pages [][]int32
+	for {
+		reply, err := xs.Edges(ctx, req)
+		if err != nil {
+			t.Fatalf("Edges error: %v", err)
+		}
+		var page []int32
+		for _, e := range reply.EdgeSets[ticket].GetGroups()[edges.Param].GetEdge() {
+			page = append(page, e.Ordinal)
+		}
+		pages = append(pages, page)
+		if reply.NextPageToken == "" {
+			break
+		} else if len(pages) > 5 {
+			t.Fatalf("Too many pages: %v", pages)
+		}
+		req.PageToken = reply.NextPageToken
+	}
+
+	expected := [][]int32{{1, 2}, {3, 4}, {5}}
+	if err := testutil.DeepEqual(expected, pages); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFederatedDecorations(t *testing.T) {
+	xs := NewFederatedGraphStoreService(
+		NewMemGraphStore(federatedEntries("other")...),
+		NewMemGraphStore(testEntries...),
+	)
+	req := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(testFileVName)},
+		SourceText: true,
+		References: true,
+		Filter:     []string{"**"},
+	}
+
+	reply, err := xs.Decorations(ctx, req)
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	}
+	expected, err := newService(t, testEntries).Decorations(ctx, req)
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	}
+	if err := testutil.DeepEqual(expected, reply); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFederatedDecorationsWithoutText(t *testing.T) {
+	file := fileVName("generated")
+	anchor := anchorVName(file, "untexted")
+	xs := NewFederatedGraphStoreService(
+		NewMemGraphStore(federatedEntries("generated")...),
+		NewMemGraphStore(append(nodesToEntries([]*node{
+			{file, newFacts(facts.NodeKind, nodes.File), nil},
+			{anchor, newFacts(
+				facts.AnchorStart, "5",
+				facts.AnchorEnd, "9",
+				facts.NodeKind, nodes.Anchor,
+			), map[string][]*spb.VName{
+				edges.Ref:     {federatedTarget},
+				edges.ChildOf: {file},
+			}},
+		}), edgeFact(file, revChildOfEdgeKind, 0, anchor))...),
+	)
+
+	tests := []struct {
+		sourceText bool
+		expected   []string
+	}{
+		// The text-less GraphStore's references are only dropped when the
+		// text is requested.
+		{false, []string{"0-4", "5-9"}},
+		{true, []string{"0-4"}},
+	}
+	for _, test := range tests {
+		reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+			Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+			SourceText: test.sourceText,
+			References: true,
+		})
+		if err != nil {
+			t.Fatalf("Decorations(SourceText: %v) error: %v", test.sourceText, err)
+		}
+		var spans []string
+		for _, ref := range reply.Reference {
+			spans = append(spans, fmt.Sprintf("%d-%d", ref.AnchorStart.ByteOffset, ref.AnchorEnd.ByteOffset))
+		}
+		if err := testutil.DeepEqual(test.expected, spans); err != nil {
+			t.Errorf("Decorations(SourceText: %v): %v", test.sourceText, err)
+		}
+	}
+}
+
+func TestFederatedCrossReferences(t *testing.T) {
+	xs := NewFederatedGraphStoreService(
+		NewMemGraphStore(federatedEntries("first")...),
+		NewMemGraphStore(),
+		NewMemGraphStore(federatedEntries("second")...),
+	)
+
+	ticket := kytheuri.ToString(federatedTarget)
+	req := &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+	}
+	var files []string
+	for {
+		reply, err := xs.CrossReferences(ctx, req)
+		if err != nil {
+			t.Fatalf("CrossReferences error: %v", err)
+		}
+		for _, ref := range reply.CrossReferences[ticket].GetReference() {
+			files = append(files, ref.Anchor.Parent)
+		}
+		if reply.NextPageToken == "" {
+			break
+		}
+		req.PageToken = reply.NextPageToken
+	}
+
+	expected := []string{
+		kytheuri.ToString(fileVName("first")),
+		kytheuri.ToString(fileVName("second")),
+	}
+	if err := testutil.DeepEqual(expected, files); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFederatedErrors(t *testing.T) {
+	readErr := errors.New("sentinel read error")
+	xs := NewFederatedGraphStoreService(
+		errorGraphStore{readErr},
+		NewMemGraphStore(testEntries...),
+	)
+	req := &gpb.NodesRequest{Ticket: nodesToTickets(testNodes)}
+
+	if reply, err := xs.Nodes(ctx, req); err == nil {
+		t.Errorf("Expected error; found %v", reply)
+	}
+
+	xs.SkipErrors = true
+	reply, err := xs.Nodes(ctx, req)
+	if err != nil {
+		t.Fatalf("Nodes error: %v", err)
+	} else if err := testutil.DeepEqual(nodesToInfos(testNodes), reply.Nodes); err != nil {
+		t.Error(err)
+	}
+
+	xs = NewFederatedGraphStoreService(errorGraphStore{readErr}, errorGraphStore{readErr})
+	xs.SkipErrors = true
+	if reply, err := xs.Nodes(ctx, req); err == nil {
+		t.Errorf("Expected error when all GraphStores fail; found %v", reply)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Limits bound the work done by each GraphStoreService call made with a
+// context carrying them (see WithLimits).  They allow middleware to restrict
+// individual requests without changing any call sites.  Zero values impose no
+// limit.
+type Limits struct {
+	// MaxEntries is the maximum number of entries read from the GraphStore.
+	// Entries served from the read cache (see CacheReads) are not counted.
+	MaxEntries int
+
+	// MaxFiles is the maximum number of files whose text is read.
+	MaxFiles int
+
+	// DeadlineMargin is the time reserved before the context's deadline, if
+	// any, for a call to assemble its reply.  No GraphStore entries are read
+	// once less than DeadlineMargin remains.
+	DeadlineMargin time.Duration
+}
+
+// A LimitError is returned when a GraphStoreService call exceeds one of the
+// Limits carried by its context or the service's MaxScanResults.
+type LimitError struct {
+	// Limit is the name of the exceeded Limits or GraphStoreService field.
+	Limit string
+
+	// Max is the value of the exceeded limit.
+	Max int
+}
+
+// Error implements the error interface.
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("request exceeded %s limit of %d", e.Limit, e.Max)
+}
+
+// limitsKey is the type of the context key for the *limitState stored by
+// WithLimits.  Being unexported, it cannot collide with keys of other
+// packages.
+type limitsKey struct{}
+
+// limitState tracks the work done against a context's Limits.
+type limitState struct {
+	Limits
+
+	mu             sync.Mutex
+	entries, files int
+}
+
+// WithLimits returns a copy of ctx carrying the given limits.  The limits apply
+// to all GraphStoreService calls made with the returned context combined, so a
+// new context should be derived for each request.
+func WithLimits(ctx context.Context, limits Limits) context.Context {
+	return context.WithValue(ctx, limitsKey{}, &limitState{Limits: limits})
+}
+
+// limitsFrom returns the limitState carried by ctx, or nil.
+func limitsFrom(ctx context.Context) *limitState {
+	l, _ := ctx.Value(limitsKey{}).(*limitState)
+	return l
+}
+
+// addEntry records the reading of an entry, returning an error if it exceeds
+// the limits or, caused by context.DeadlineExceeded, if the context's deadline
+// is too near.  A nil *limitState imposes no limits.
+func (l *limitState) addEntry(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && l.DeadlineMargin > 0 && deadline.Sub(time.Now()) < l.DeadlineMargin {
+		return errorf(context.DeadlineExceeded, "request deadline is within %v: %v", l.DeadlineMargin, context.DeadlineExceeded)
+	}
+	if l.MaxEntries <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.entries >= l.MaxEntries {
+		return &LimitError{Limit: "MaxEntries", Max: l.MaxEntries}
+	}
+	l.entries++
+	return nil
+}
+
+// addFile records the reading of a file's text, returning an error if it
+// exceeds the limits.  A nil *limitState imposes no limits.
+func (l *limitState) addFile() error {
+	if l == nil || l.MaxFiles <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.files >= l.MaxFiles {
+		return &LimitError{Limit: "MaxFiles", Max: l.MaxFiles}
+	}
+	l.files++
+	return nil
+}
+
+// limitedGraphStore is a graphstore.Service that enforces the Limits carried
+// by the context of each Read and Scan call.
+type limitedGraphStore struct{ graphstore.Service }
+
+// Read implements part of the graphstore.Service interface.
+func (s limitedGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	l := limitsFrom(ctx)
+	if l == nil {
+		return s.Service.Read(ctx, req, f)
+	}
+	return s.Service.Read(ctx, req, func(e *spb.Entry) error {
+		if err := l.addEntry(ctx); err != nil {
+			return err
+		}
+		return f(e)
+	})
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (s limitedGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	l := limitsFrom(ctx)
+	if l == nil {
+		return s.Service.Scan(ctx, req, f)
+	}
+	return s.Service.Scan(ctx, req, func(e *spb.Entry) error {
+		if err := l.addEntry(ctx); err != nil {
+			return err
+		}
+		return f(e)
+	})
+}
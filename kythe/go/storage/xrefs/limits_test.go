@@ -0,0 +1,75 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/util/kytheuri"
+
+	xpb "kythe.io/kythe/proto/xref_proto"
+)
+
+func TestLimits(t *testing.T) {
+	xs := newService(t, federatedEntries("file"))
+	req := &xpb.CrossReferencesRequest{
+		Ticket:        []string{kytheuri.ToString(federatedTarget)},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+	}
+
+	tests := []struct {
+		limits Limits
+		err    string
+	}{
+		{Limits{}, ""},
+		{Limits{MaxEntries: 100, MaxFiles: 1, DeadlineMargin: time.Millisecond}, ""},
+		{Limits{MaxEntries: 1}, "MaxEntries limit of 1"},
+		{Limits{MaxFiles: -1}, ""},
+	}
+	for _, test := range tests {
+		reply, err := xs.CrossReferences(WithLimits(ctx, test.limits), req)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("CrossReferences with %+v error: %v", test.limits, err)
+			} else if len(reply.CrossReferences) != 1 {
+				t.Errorf("CrossReferences with %+v: unexpected reply %v", test.limits, reply)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("CrossReferences with %+v: found error %v; expected %q", test.limits, err, test.err)
+		}
+	}
+
+	// The limits are shared by every call made with the same context.
+	limited := WithLimits(ctx, Limits{MaxFiles: 1})
+	decorReq := &xpb.DecorationsRequest{Location: &xpb.Location{Ticket: kytheuri.ToString(fileVName("file"))}}
+	if _, err := xs.Decorations(limited, decorReq); err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	} else if _, err := xs.Decorations(limited, decorReq); err == nil {
+		t.Error("Expected MaxFiles error from second Decorations")
+	} else if limitErr, ok := Cause(err).(*LimitError); !ok || limitErr.Limit != "MaxFiles" || limitErr.Max != 1 {
+		t.Errorf("Unexpected error: %#v", err)
+	}
+
+	deadline, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+	if _, err := xs.CrossReferences(WithLimits(deadline, Limits{DeadlineMargin: 2 * time.Hour}), req); err == nil {
+		t.Error("Expected error within DeadlineMargin")
+	}
+}
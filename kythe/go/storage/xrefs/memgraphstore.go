@@ -0,0 +1,166 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// MemGraphStore is a simple in-memory graphstore.Service for testing a
+// GraphStoreService against test-sized data only: each Write or Load copies
+// the whole store.  Unlike inmemory.GraphStore, its Read and Scan calls
+// iterate over a snapshot of the store, so entries may be written from within
+// their callbacks (as done by EnsureReverseEdges).  It can also be populated
+// directly from a fixture of entries with any mix of sources (see
+// NewMemGraphStore and Load) and its contents inspected with Entries, which a
+// test of inmemory.GraphStore must instead do through per-source Write
+// requests and a Scan.  A zero MemGraphStore is ready for use and is safe for
+// concurrent use.
+type MemGraphStore struct {
+	mu      sync.RWMutex
+	entries []*spb.Entry // sorted in compare.Entries order; never modified in-place
+}
+
+// NewMemGraphStore returns a MemGraphStore containing the given entries.
+func NewMemGraphStore(entries ...*spb.Entry) *MemGraphStore {
+	m := &MemGraphStore{}
+	m.Load(entries...)
+	return m
+}
+
+// Load adds each of the given entries to the store.  An entry replaces any
+// existing entry differing only by its fact value, as does a later entry in
+// entries.  Only the given entries are sorted; they are then merged with the
+// store's, which are already sorted.
+func (m *MemGraphStore) Load(entries ...*spb.Entry) {
+	batch := make([]*spb.Entry, len(entries))
+	for i, e := range entries {
+		batch[i] = proto.Clone(e).(*spb.Entry)
+	}
+	sort.Stable(compare.ByEntries(batch))
+	batch = dedupLast(batch)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The existing slice may be held by a snapshot, so the merge is written to
+	// a new one.
+	merged := make([]*spb.Entry, 0, len(m.entries)+len(batch))
+	old := m.entries
+	for len(old) > 0 && len(batch) > 0 {
+		switch compare.Entries(old[0], batch[0]) {
+		case compare.LT:
+			merged, old = append(merged, old[0]), old[1:]
+		case compare.GT:
+			merged, batch = append(merged, batch[0]), batch[1:]
+		default:
+			merged, old, batch = append(merged, batch[0]), old[1:], batch[1:]
+		}
+	}
+	merged = append(merged, old...)
+	m.entries = append(merged, batch...)
+}
+
+// dedupLast removes all but the last of each run of equivalent entries in the
+// given sorted slice, in place.
+func dedupLast(entries []*spb.Entry) []*spb.Entry {
+	deduped := entries[:0]
+	for _, e := range entries {
+		if n := len(deduped); n > 0 && compare.Entries(deduped[n-1], e) == compare.EQ {
+			deduped[n-1] = e
+		} else {
+			deduped = append(deduped, e)
+		}
+	}
+	return deduped
+}
+
+// Entries returns a copy of all entries in the store in compare.Entries order.
+func (m *MemGraphStore) Entries() []*spb.Entry {
+	return append([]*spb.Entry(nil), m.snapshot()...)
+}
+
+func (m *MemGraphStore) snapshot() []*spb.Entry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.entries
+}
+
+// Read implements part of the graphstore.Service interface.
+func (m *MemGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	entries := m.snapshot()
+	start := sort.Search(len(entries), func(i int) bool {
+		return compare.VNames(entries[i].Source, req.Source) != compare.LT
+	})
+	for _, e := range entries[start:] {
+		if !compare.VNamesEqual(e.Source, req.Source) {
+			break
+		} else if req.EdgeKind != "*" && e.EdgeKind != req.EdgeKind {
+			continue
+		}
+		if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (m *MemGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	for _, e := range m.snapshot() {
+		if !graphstore.EntryMatchesScan(req, e) {
+			continue
+		} else if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write implements part of the graphstore.Service interface.
+func (m *MemGraphStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	entries := make([]*spb.Entry, len(req.Update))
+	for i, u := range req.Update {
+		entries[i] = &spb.Entry{
+			Source:    req.Source,
+			EdgeKind:  u.EdgeKind,
+			Target:    u.Target,
+			FactName:  u.FactName,
+			FactValue: u.FactValue,
+		}
+	}
+	m.Load(entries...)
+	return nil
+}
+
+// Close implements part of the graphstore.Service interface.  It never
+// returns an error.
+func (m *MemGraphStore) Close(ctx context.Context) error { return nil }
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"testing"
+
+	"kythe.io/kythe/go/test/testutil"
+	"kythe.io/kythe/go/util/schema/edges"
+	"kythe.io/kythe/go/util/schema/facts"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func TestMemGraphStoreRead(t *testing.T) {
+	a, b := sig("a"), sig("b")
+	kind := nodeFact(a, facts.NodeKind, "test")
+	text := nodeFact(a, facts.Text, "text")
+	ref := edgeFact(a, edges.Ref, 0, b)
+	param := edgeFact(a, edges.Param, 0, b)
+	other := nodeFact(b, facts.NodeKind, "test")
+	gs := NewMemGraphStore(other, ref, text, param, kind)
+
+	tests := []struct {
+		kind     string
+		expected []*spb.Entry
+	}{
+		{"", []*spb.Entry{kind, text}},
+		{"*", []*spb.Entry{kind, text, param, ref}},
+		{edges.Ref, []*spb.Entry{ref}},
+		{edges.Typed, nil},
+	}
+	for _, test := range tests {
+		var found []*spb.Entry
+		if err := gs.Read(ctx, &spb.ReadRequest{Source: a, EdgeKind: test.kind}, func(e *spb.Entry) error {
+			found = append(found, e)
+			return nil
+		}); err != nil {
+			t.Fatalf("Read error: %v", err)
+		}
+		if err := testutil.DeepEqual(test.expected, found); err != nil {
+			t.Errorf("Read(%q): %v", test.kind, err)
+		}
+	}
+}
+
+func TestMemGraphStoreLoad(t *testing.T) {
+	gs := NewMemGraphStore(nodeFact(sig("a"), facts.Text, "old"))
+	gs.Load(nodeFact(sig("a"), facts.Text, "new"), nodeFact(sig("a"), facts.NodeKind, "test"))
+
+	expected := []*spb.Entry{
+		nodeFact(sig("a"), facts.NodeKind, "test"),
+		nodeFact(sig("a"), facts.Text, "new"),
+	}
+	if err := testutil.DeepEqual(expected, gs.Entries()); err != nil {
+		t.Error(err)
+	}
+
+	// A batch is merged among the existing entries, keeping the last of any
+	// equivalent entries within it, without altering an earlier snapshot.
+	snapshot := gs.snapshot()
+	gs.Load(
+		nodeFact(sig("c"), facts.Text, "first"),
+		nodeFact(sig("0"), facts.Text, "text"),
+		nodeFact(sig("c"), facts.Text, "last"),
+		nodeFact(sig("a"), facts.Text, "newer"),
+		nodeFact(sig("b"), facts.Text, "text"),
+	)
+	if err := testutil.DeepEqual(expected, snapshot); err != nil {
+		t.Errorf("Snapshot: %v", err)
+	}
+	expected = []*spb.Entry{
+		nodeFact(sig("0"), facts.Text, "text"),
+		nodeFact(sig("a"), facts.NodeKind, "test"),
+		nodeFact(sig("a"), facts.Text, "newer"),
+		nodeFact(sig("b"), facts.Text, "text"),
+		nodeFact(sig("c"), facts.Text, "last"),
+	}
+	if err := testutil.DeepEqual(expected, gs.Entries()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemGraphStoreEnsureReverseEdges(t *testing.T) {
+	a, b := sig("a"), sig("b")
+	gs := NewMemGraphStore(edgeFact(a, edges.Ref, 0, b))
+
+	// Writing within a Scan must not deadlock.
+	res, err := EnsureReverseEdges(ctx, gs)
+	if err != nil {
+		t.Fatalf("EnsureReverseEdges error: %v", err)
+	} else if err := testutil.DeepEqual(&EnsureReverseEdgesResult{AddedCount: 1, TotalEntries: 1}, res); err != nil {
+		t.Error(err)
+	}
+
+	expected := []*spb.Entry{
+		edgeFact(a, edges.Ref, 0, b),
+		edgeFact(b, edges.Mirror(edges.Ref), 0, a),
+	}
+	if err := testutil.DeepEqual(expected, gs.Entries()); err != nil {
+		t.Error(err)
+	}
+
+	// The reverse edges are now found without writing anything.
+	res, err = EnsureReverseEdges(ctx, gs)
+	if err != nil {
+		t.Fatalf("EnsureReverseEdges error: %v", err)
+	} else if err := testutil.DeepEqual(&EnsureReverseEdgesResult{ReverseEdgesExisted: true}, res); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.DeepEqual(expected, gs.Entries()); err != nil {
+		t.Error(err)
+	}
+
+	res, err = EnsureReverseEdges(ctx, NewMemGraphStore(nodeFact(a, facts.Text, "text")))
+	if err != nil {
+		t.Fatalf("EnsureReverseEdges error: %v", err)
+	} else if err := testutil.DeepEqual(&EnsureReverseEdgesResult{}, res); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddReverseEdgesPartial(t *testing.T) {
+	a, b, c := sig("a"), sig("b"), sig("c")
+	gs := NewMemGraphStore(
+		edgeFact(a, edges.Ref, 0, b),
+		edgeFact(c, edges.Ref, 0, b),
+		edgeFact(b, edges.Mirror(edges.Ref), 0, a),
+	)
+
+	// Only the missing reverse edge is written.  Both forward edges share a
+	// target and kind, so their reverse edges are checked by a single Read.
+	counting := &countingGraphStore{Service: gs}
+	res, err := addReverseEdges(ctx, counting)
+	if err != nil {
+		t.Fatalf("addReverseEdges error: %v", err)
+	} else if err := testutil.DeepEqual(&EnsureReverseEdgesResult{AddedCount: 1, SkippedCount: 1, TotalEntries: 3}, res); err != nil {
+		t.Error(err)
+	} else if counting.reads != 1 {
+		t.Errorf("Expected 1 Read checking reverse edges; found %d", counting.reads)
+	}
+	expected := []*spb.Entry{
+		edgeFact(a, edges.Ref, 0, b),
+		edgeFact(b, edges.Mirror(edges.Ref), 0, a),
+		edgeFact(b, edges.Mirror(edges.Ref), 0, c),
+		edgeFact(c, edges.Ref, 0, b),
+	}
+	if err := testutil.DeepEqual(expected, gs.Entries()); err != nil {
+		t.Error(err)
+	}
+
+	// Re-running writes nothing.
+	res, err = addReverseEdges(ctx, gs)
+	if err != nil {
+		t.Fatalf("addReverseEdges error: %v", err)
+	} else if err := testutil.DeepEqual(&EnsureReverseEdgesResult{SkippedCount: 2, TotalEntries: 4}, res); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A RetryPolicy determines how GraphStore Read and Scan calls that fail with a
+// transient error are retried.  A call is only retried if it failed before
+// passing any entries along, so that no entry is ever seen twice, and errors
+// returned by the caller's EntryFunc are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a single call is made,
+	// including the first.  If <= 1, calls are not retried.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry.  Each later retry waits
+	// twice as long as the one before it, up to MaxBackoff if it is > 0.
+	Backoff, MaxBackoff time.Duration
+
+	// IsTransient reports whether a failed call may succeed if it is retried.
+	// If nil, no error is considered transient.
+	IsTransient func(error) bool
+}
+
+// retryingGraphStore is a graphstore.Service that retries its Read and Scan
+// calls according to a RetryPolicy.
+type retryingGraphStore struct {
+	graphstore.Service
+	policy *RetryPolicy
+}
+
+// Read implements part of the graphstore.Service interface.
+func (r retryingGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return r.retry(ctx, f, func(f graphstore.EntryFunc) error {
+		return r.Service.Read(ctx, req, f)
+	})
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (r retryingGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return r.retry(ctx, f, func(f graphstore.EntryFunc) error {
+		return r.Service.Scan(ctx, req, f)
+	})
+}
+
+// retry calls attempt with a wrapper of f until it succeeds or fails in a way
+// that r.policy does not allow to be retried.
+func (r retryingGraphStore) retry(ctx context.Context, f graphstore.EntryFunc, attempt func(graphstore.EntryFunc) error) error {
+	backoff := r.policy.Backoff
+	for i := 1; ; i++ {
+		var (
+			passed  bool  // whether any entry was passed to f
+			callErr error // the error returned by f, if any
+		)
+		err := attempt(func(e *spb.Entry) error {
+			passed = true
+			callErr = f(e)
+			return callErr
+		})
+		if err == nil || passed || callErr != nil || i >= r.policy.MaxAttempts ||
+			r.policy.IsTransient == nil || !r.policy.IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if r.policy.MaxBackoff > 0 && backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
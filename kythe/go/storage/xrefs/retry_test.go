@@ -0,0 +1,132 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema/edges"
+
+	gpb "kythe.io/kythe/proto/graph_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+var errTransient = errors.New("transient failure")
+
+// flakyGraphStore is a graphstore.Service whose Read calls fail with err until
+// failures reaches zero.  If afterEntry is set, each failure happens after
+// the first entry has been passed along.
+type flakyGraphStore struct {
+	graphstore.Service
+	err        error
+	failures   int
+	afterEntry bool
+	reads      int
+}
+
+func (s *flakyGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	s.reads++
+	if s.failures <= 0 {
+		return s.Service.Read(ctx, req, f)
+	}
+	s.failures--
+	if !s.afterEntry {
+		return s.err
+	}
+	passed := errors.New("passed")
+	if err := s.Service.Read(ctx, req, func(e *spb.Entry) error {
+		if err := f(e); err != nil {
+			return err
+		}
+		return passed
+	}); err != passed {
+		return err
+	}
+	return s.err
+}
+
+func TestRetry(t *testing.T) {
+	isTransient := func(err error) bool { return err == errTransient }
+	source := sig("source")
+	entries := []*spb.Entry{edgeFact(source, edges.Param, 0, sig("param"))}
+	req := &gpb.EdgesRequest{Ticket: []string{kytheuri.ToString(source)}}
+
+	tests := []struct {
+		gs      *flakyGraphStore
+		policy  *RetryPolicy
+		wantErr bool
+		reads   int
+	}{
+		// No policy.
+		{&flakyGraphStore{err: errTransient, failures: 1}, nil, true, 1},
+		// Transient failures within MaxAttempts are retried.
+		{&flakyGraphStore{err: errTransient, failures: 2}, &RetryPolicy{MaxAttempts: 3, IsTransient: isTransient}, false, 3},
+		// Too many transient failures.
+		{&flakyGraphStore{err: errTransient, failures: 3}, &RetryPolicy{MaxAttempts: 3, IsTransient: isTransient}, true, 3},
+		// Non-transient failures are not retried.
+		{&flakyGraphStore{err: errors.New("permanent"), failures: 1}, &RetryPolicy{MaxAttempts: 3, IsTransient: isTransient}, true, 1},
+		// Without a classifier, nothing is transient.
+		{&flakyGraphStore{err: errTransient, failures: 1}, &RetryPolicy{MaxAttempts: 3}, true, 1},
+		// Failures after an entry was passed along are not retried.
+		{&flakyGraphStore{err: errTransient, failures: 1, afterEntry: true}, &RetryPolicy{MaxAttempts: 3, IsTransient: isTransient}, true, 1},
+	}
+	for i, test := range tests {
+		test.gs.Service = NewMemGraphStore(entries...)
+		xs := NewGraphStoreService(test.gs)
+		xs.Retry = test.policy
+		if test.policy != nil {
+			test.policy.Backoff = time.Millisecond
+		}
+
+		reply, err := xs.Edges(ctx, req)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%d: Edges succeeded; expected an error", i)
+			}
+		} else if err != nil {
+			t.Errorf("%d: Edges error: %v", i, err)
+		} else if len(reply.EdgeSets) != 1 {
+			t.Errorf("%d: Unexpected EdgeSets: %v", i, reply.EdgeSets)
+		}
+		if test.gs.reads != test.reads {
+			t.Errorf("%d: found %d reads; expected %d", i, test.gs.reads, test.reads)
+		}
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	gs := &flakyGraphStore{Service: NewMemGraphStore(), err: errTransient, failures: 2}
+	xs := NewGraphStoreService(gs)
+	xs.Retry = &RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Hour,
+		IsTransient: func(err error) bool { return err == errTransient },
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := xs.Edges(ctx, &gpb.EdgesRequest{Ticket: []string{kytheuri.ToString(sig("source"))}}); err == nil {
+		t.Error("Edges succeeded; expected an error")
+	} else if gs.reads != 1 {
+		t.Errorf("Found %d reads; expected 1", gs.reads)
+	}
+}
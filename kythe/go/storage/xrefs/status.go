@@ -0,0 +1,96 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+)
+
+// A causer is an error that annotates the error it was caused by with further
+// detail.
+type causer interface {
+	Cause() error
+}
+
+// A causedError is a causer formatted by errorf.
+type causedError struct {
+	msg   string
+	cause error
+}
+
+func (e *causedError) Error() string { return e.msg }
+func (e *causedError) Cause() error  { return e.cause }
+
+// errorf returns an error formatted as by fmt.Errorf whose Cause is that of
+// cause, which is usually also one of the formatted arguments.
+func errorf(cause error, format string, args ...interface{}) error {
+	return &causedError{fmt.Sprintf(format, args...), cause}
+}
+
+// Cause returns the error underlying err: err itself, unless it is a causer,
+// in which case the Cause of the error it annotates.  An error returned by a
+// GraphStoreService method can be classified by comparing its Cause to the
+// Err* values or by switching on its type.
+func Cause(err error) error {
+	for {
+		c, ok := err.(causer)
+		if !ok {
+			return err
+		}
+		err = c.Cause()
+	}
+}
+
+// Code returns the gRPC status code for an error returned by a
+// GraphStoreService method, so that a gRPC server wrapping the service can
+// report it faithfully:
+//
+//	ErrNoTickets, ErrInvalidTicket,
+//	ErrInvalidPageToken, ErrInvalidArgument -> InvalidArgument
+//	ErrFileNotFound                         -> NotFound
+//	ErrUnimplemented                        -> Unimplemented
+//	*LimitError, *FileTooLargeError         -> ResourceExhausted
+//	context.Canceled                        -> Canceled
+//	context.DeadlineExceeded                -> DeadlineExceeded
+//
+// Errors are classified by their Cause, so they may be annotated.  Code
+// returns OK for a nil error and Unknown for any other error.
+func Code(err error) codes.Code {
+	switch err := Cause(err); err {
+	case nil:
+		return codes.OK
+	case ErrNoTickets, ErrInvalidTicket, ErrInvalidPageToken, ErrInvalidArgument:
+		return codes.InvalidArgument
+	case ErrFileNotFound:
+		return codes.NotFound
+	case ErrUnimplemented:
+		return codes.Unimplemented
+	case context.Canceled:
+		return codes.Canceled
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	default:
+		switch err.(type) {
+		case *LimitError, *FileTooLargeError:
+			return codes.ResourceExhausted
+		}
+		return codes.Unknown
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema/facts"
+	"kythe.io/kythe/go/util/schema/nodes"
+
+	"google.golang.org/grpc/codes"
+
+	gpb "kythe.io/kythe/proto/graph_proto"
+	ipb "kythe.io/kythe/proto/internal_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+	xpb "kythe.io/kythe/proto/xref_proto"
+)
+
+func TestCode(t *testing.T) {
+	limitErr := &LimitError{Limit: "MaxEntries", Max: 1}
+	tooLarge := &FileTooLargeError{Ticket: "kythe:#file", Size: 10, Max: 5}
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{nil, codes.OK},
+		{ErrNoTickets, codes.InvalidArgument},
+		{errorf(ErrInvalidTicket, "%v %q: bad", ErrInvalidTicket, "kythe:"), codes.InvalidArgument},
+		{errorf(ErrInvalidPageToken, "%v: %q", ErrInvalidPageToken, "token"), codes.InvalidArgument},
+		{errorf(ErrFileNotFound, "outer: %v", ErrFileNotFound), codes.NotFound},
+		{errorf(errorf(ErrFileNotFound, "inner: %v", ErrFileNotFound), "outer"), codes.NotFound},
+		{&noTextError{}, codes.NotFound},
+		{errorf(ErrInvalidArgument, "%v: missing location", ErrInvalidArgument), codes.InvalidArgument},
+		{errorf(ErrUnimplemented, "%v: dirty buffers", ErrUnimplemented), codes.Unimplemented},
+		{errorf(limitErr, "read error: %v", limitErr), codes.ResourceExhausted},
+		{errorf(tooLarge, "fetching file: %v", tooLarge), codes.ResourceExhausted},
+		{context.Canceled, codes.Canceled},
+		{errorf(context.DeadlineExceeded, "graphstore probe failed: %v", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{errors.New("some other error"), codes.Unknown},
+	}
+	for _, test := range tests {
+		if code := Code(test.err); code != test.code {
+			t.Errorf("Code(%v): expected %v; found %v", test.err, test.code, code)
+		}
+	}
+}
+
+func TestCodeFromService(t *testing.T) {
+	file := fileVName("file")
+	xs := newService(t, nil)
+	fs := NewFederatedGraphStoreService(NewMemGraphStore())
+
+	tests := []struct {
+		call func() error
+		code codes.Code
+	}{
+		{func() error {
+			_, err := xs.Edges(ctx, &gpb.EdgesRequest{
+				Ticket:    []string{kytheuri.ToString(file)},
+				PageToken: "invalid",
+			})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+				Location: &xpb.Location{Ticket: kytheuri.ToString(file)},
+			})
+			return err
+		}, codes.NotFound},
+		{func() error {
+			_, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+				Location:    &xpb.Location{Ticket: kytheuri.ToString(file)},
+				DirtyBuffer: []byte("text"),
+			})
+			return err
+		}, codes.Unimplemented},
+		{func() error {
+			_, err := xs.Decorations(ctx, &xpb.DecorationsRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := fs.Edges(ctx, &gpb.EdgesRequest{
+				Ticket:    []string{kytheuri.ToString(file)},
+				PageToken: "token",
+			})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := fs.Decorations(ctx, &xpb.DecorationsRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			token, err := encodePageToken(&ipb.PageToken{Index: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = fs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+				Ticket:    []string{kytheuri.ToString(file)},
+				PageToken: token,
+			})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			xs := newService(t, federatedEntries("file"))
+			xs.MaxFileBytes = 5
+			_, err := xs.FileNormalizer(ctx, kytheuri.ToString(file))
+			return err
+		}, codes.ResourceExhausted},
+		{func() error {
+			deadline, cancel := context.WithTimeout(ctx, time.Hour)
+			defer cancel()
+			xs := newService(t, []*spb.Entry{nodeFact(file, facts.NodeKind, nodes.File)})
+			_, err := xs.Nodes(WithLimits(deadline, Limits{DeadlineMargin: 2 * time.Hour}), &gpb.NodesRequest{
+				Ticket: []string{kytheuri.ToString(file)},
+			})
+			return err
+		}, codes.DeadlineExceeded},
+	}
+	for i, test := range tests {
+		if err := test.call(); Code(err) != test.code {
+			t.Errorf("Test %d: expected %v; found %v (%v)", i, test.code, Code(err), err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xrefs
+
+import (
+	"context"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/util/kytheuri"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A Tracer creates spans recording the work done by a GraphStoreService.  It
+// may be implemented as an adapter to any tracing system.
+type Tracer interface {
+	// StartSpan starts a new span with the given name as a child of any span
+	// carried by ctx.  The returned context carries the new span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span is a single traced operation.
+type Span interface {
+	// SetAttribute records a key-value pair describing the operation.
+	SetAttribute(key string, value interface{})
+
+	// End marks the end of the operation.
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End()                             {}
+
+// startSpan starts a span using g.Tracer, if set.
+func (g *GraphStoreService) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if g.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return g.Tracer.StartSpan(ctx, name)
+}
+
+// store returns the GraphStore backing g, retried according to g.Retry if
+// set, limited by the Limits of each call's context, traced by g.Tracer if
+// set, and cached if each call's context carries a read cache (see CacheReads
+// and DecorationsBatch).  Cached reads are neither limited nor traced and each
+// traced call covers all of its retries.
+func (g *GraphStoreService) store() graphstore.Service {
+	gs := g.gs
+	if g.Retry != nil {
+		gs = retryingGraphStore{gs, g.Retry}
+	}
+	gs = limitedGraphStore{gs}
+	if g.Tracer != nil {
+		gs = tracedGraphStore{gs, g.Tracer}
+	}
+	return cachingGraphStore{gs}
+}
+
+// tracedGraphStore is a graphstore.Service that records a span for each Read
+// and Scan call.
+type tracedGraphStore struct {
+	graphstore.Service
+	tracer Tracer
+}
+
+// Read implements part of the graphstore.Service interface.
+func (t tracedGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	ctx, span := t.tracer.StartSpan(ctx, "GraphStore.Read")
+	defer span.End()
+	span.SetAttribute("source", kytheuri.ToString(req.Source))
+	span.SetAttribute("edge_kind", req.EdgeKind)
+
+	var entries int
+	err := t.Service.Read(ctx, req, func(e *spb.Entry) error {
+		entries++
+		return f(e)
+	})
+	span.SetAttribute("entries", entries)
+	return err
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (t tracedGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	ctx, span := t.tracer.StartSpan(ctx, "GraphStore.Scan")
+	defer span.End()
+	span.SetAttribute("edge_kind", req.EdgeKind)
+	span.SetAttribute("fact_prefix", req.FactPrefix)
+
+	var entries int
+	err := t.Service.Scan(ctx, req, func(e *spb.Entry) error {
+		entries++
+		return f(e)
+	})
+	span.SetAttribute("entries", entries)
+	return err
+}
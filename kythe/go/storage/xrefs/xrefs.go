@@ -19,20 +19,31 @@
 package xrefs
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/heap"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"regexp"
+	"math"
+	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
 	"kythe.io/kythe/go/services/xrefs"
 	"kythe.io/kythe/go/util/encoding/text"
 	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/markedsource"
 	"kythe.io/kythe/go/util/schema"
 	"kythe.io/kythe/go/util/schema/edges"
 	"kythe.io/kythe/go/util/schema/facts"
@@ -40,17 +51,65 @@ import (
 	"kythe.io/kythe/go/util/schema/tickets"
 
 	"bitbucket.org/creachadair/stringset"
+	"github.com/golang/protobuf/proto"
 
 	cpb "kythe.io/kythe/proto/common_proto"
 	gpb "kythe.io/kythe/proto/graph_proto"
+	ipb "kythe.io/kythe/proto/internal_proto"
 	spb "kythe.io/kythe/proto/storage_proto"
 	xpb "kythe.io/kythe/proto/xref_proto"
 )
 
+// Errors returned by the GraphStoreService, possibly wrapped with further
+// detail.  Callers can distinguish them by comparing the Cause of an error.
+var (
+	// ErrNoTickets is returned for a request without any tickets.
+	ErrNoTickets = errors.New("no tickets specified")
+
+	// ErrInvalidTicket is returned for a ticket that cannot be parsed (see
+	// parseTicket).
+	ErrInvalidTicket = errors.New("invalid ticket")
+
+	// ErrInvalidArgument is returned for a request that is malformed in some
+	// other way, such as one missing its location.
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrInvalidPageToken is returned for a page token not returned by a
+	// previous call of the same method.
+	ErrInvalidPageToken = errors.New("invalid page_token")
+
+	// ErrFileNotFound is returned for a requested file without any text.
+	ErrFileNotFound = errors.New("file not found")
+
+	// ErrUnimplemented is returned for a request using an unsupported
+	// feature, such as dirty buffers.
+	ErrUnimplemented = errors.New("UNIMPLEMENTED")
+)
+
+// An EnsureReverseEdgesResult reports the outcome of EnsureReverseEdges.
+type EnsureReverseEdgesResult struct {
+	// ReverseEdgesExisted is true if the GraphStore already contained reverse
+	// edges and nothing was written.
+	ReverseEdgesExisted bool
+
+	// AddedCount is the number of reverse edges written to the GraphStore.
+	AddedCount int
+
+	// SkippedCount is the number of forward edges whose reverse edge was
+	// already in the GraphStore and so was not written again.
+	SkippedCount int
+
+	// TotalEntries is the number of entries scanned while adding reverse edges.
+	// It is 0 if no reverse edges needed to be added.
+	TotalEntries int
+}
+
 // EnsureReverseEdges checks if gs contains reverse edges.  If it doesn't, it
 // will scan gs for all forward edges, adding a reverse for each back into the
-// GraphStore.  This is necessary for a GraphStoreService to work properly.
-func EnsureReverseEdges(ctx context.Context, gs graphstore.Service) error {
+// GraphStore.  This is necessary for a GraphStoreService to work properly.  If
+// adding the reverse edges fails part way through, the partial result is
+// returned along with the error.
+func EnsureReverseEdges(ctx context.Context, gs graphstore.Service) (*EnsureReverseEdgesResult, error) {
 	var edge *spb.Entry
 	if err := gs.Scan(ctx, &spb.ScanRequest{}, func(e *spb.Entry) error {
 		if graphstore.IsEdge(e) {
@@ -59,14 +118,14 @@ func EnsureReverseEdges(ctx context.Context, gs graphstore.Service) error {
 		}
 		return nil
 	}); err != nil {
-		return err
+		return nil, err
 	}
 
 	if edge == nil {
 		log.Println("No edges found in GraphStore")
-		return nil
+		return &EnsureReverseEdgesResult{}, nil
 	} else if edges.IsReverse(edge.EdgeKind) {
-		return nil
+		return &EnsureReverseEdgesResult{ReverseEdgesExisted: true}, nil
 	}
 
 	var foundReverse bool
@@ -77,451 +136,3834 @@ func EnsureReverseEdges(ctx context.Context, gs graphstore.Service) error {
 		foundReverse = true
 		return nil
 	}); err != nil {
-		return fmt.Errorf("error checking for reverse edge: %v", err)
+		return nil, errorf(err, "error checking for reverse edge: %v", err)
 	}
 	if foundReverse {
-		return nil
+		return &EnsureReverseEdgesResult{ReverseEdgesExisted: true}, nil
 	}
 	return addReverseEdges(ctx, gs)
 }
 
-func addReverseEdges(ctx context.Context, gs graphstore.Service) error {
-	log.Println("Adding reverse edges")
-	var (
-		totalEntries int
-		addedEdges   int
-	)
-	startTime := time.Now()
-	err := gs.Scan(ctx, new(spb.ScanRequest), func(entry *spb.Entry) error {
-		kind := entry.EdgeKind
-		if kind != "" && edges.IsForward(kind) {
-			if err := gs.Write(ctx, &spb.WriteRequest{
-				Source: entry.Target,
-				Update: []*spb.WriteRequest_Update{{
-					Target:    entry.Source,
-					EdgeKind:  edges.Mirror(kind),
-					FactName:  entry.FactName,
-					FactValue: entry.FactValue,
-				}},
-			}); err != nil {
-				return fmt.Errorf("Failed to write reverse edge: %v", err)
-			}
-			addedEdges++
-		}
-		totalEntries++
-		return nil
-	})
-	log.Printf("Wrote %d reverse edges to GraphStore (%d total entries): %v", addedEdges, totalEntries, time.Since(startTime))
-	return err
-}
-
-// A GraphStoreService partially implements the xrefs.Service interface
-// directly using a graphstore.Service with stored reverse edges.  This is a
-// low-performance, simple alternative to creating the serving Table
-// representation.
-// TODO(schroederc): parallelize GraphStore calls
-type GraphStoreService struct {
-	gs graphstore.Service
-}
+// WriteWithReverse writes req to gs along with the reverse of each forward
+// edge it contains, keeping the reverse edges required by a GraphStoreService
+// consistent without rescanning gs as EnsureReverseEdges does.  Node facts and
+// reverse edges in req are written as given.
+//
+// The writes are not atomic: req is written first, followed by a separate
+// request for the reverse edges sourced at each distinct edge target.  Unless
+// gs provides its own transactions, a failure part way through may leave some
+// forward edges without their reverses; as writes are idempotent, retrying the
+// same req restores consistency.
+func WriteWithReverse(ctx context.Context, gs graphstore.Service, req *spb.WriteRequest) error {
+	if err := gs.Write(ctx, req); err != nil {
+		return err
+	}
 
-// NewGraphStoreService returns a new GraphStoreService given an
-// existing graphstore.Service.
-func NewGraphStoreService(gs graphstore.Service) *GraphStoreService {
-	return &GraphStoreService{gs}
+	// Group the reverse edges by their sources (the forward edges' targets).
+	var order []string
+	reverse := make(map[string]*spb.WriteRequest)
+	for _, u := range req.Update {
+		if u.EdgeKind == "" || !edges.IsForward(u.EdgeKind) {
+			continue
+		}
+		target := kytheuri.ToString(u.Target)
+		r, ok := reverse[target]
+		if !ok {
+			r = &spb.WriteRequest{Source: u.Target}
+			reverse[target] = r
+			order = append(order, target)
+		}
+		r.Update = append(r.Update, &spb.WriteRequest_Update{
+			Target:    req.Source,
+			EdgeKind:  edges.Mirror(u.EdgeKind),
+			FactName:  u.FactName,
+			FactValue: u.FactValue,
+		})
+	}
+	for _, target := range order {
+		if err := gs.Write(ctx, reverse[target]); err != nil {
+			return errorf(err, "failed to write reverse edges of %q: %v", target, err)
+		}
+	}
+	return nil
 }
 
-// Nodes implements part of the Service interface.
-func (g *GraphStoreService) Nodes(ctx context.Context, req *gpb.NodesRequest) (*gpb.NodesReply, error) {
-	patterns := xrefs.ConvertFilters(req.Filter)
+// reverseEdgeBatchSize is the number of forward edges whose reverse edges are
+// checked and written together by addReverseEdges.
+const reverseEdgeBatchSize = 1024
 
-	var names []*spb.VName
-	for _, ticket := range req.Ticket {
-		name, err := kytheuri.ToVName(ticket)
-		if err != nil {
-			return nil, err
+func addReverseEdges(ctx context.Context, gs graphstore.Service) (*EnsureReverseEdgesResult, error) {
+	log.Println("Adding reverse edges")
+	res := &EnsureReverseEdgesResult{}
+	startTime := time.Now()
+	var batch []*spb.Entry
+	err := gs.Scan(ctx, new(spb.ScanRequest), func(entry *spb.Entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		names = append(names, name)
-	}
-	nodes := make(map[string]*cpb.NodeInfo)
-	for i, vname := range names {
-		ticket := req.Ticket[i]
-		info := &cpb.NodeInfo{Facts: make(map[string][]byte)}
-		if err := g.gs.Read(ctx, &spb.ReadRequest{Source: vname}, func(entry *spb.Entry) error {
-			if len(patterns) == 0 || xrefs.MatchesAny(entry.FactName, patterns) {
-				info.Facts[entry.FactName] = entry.FactValue
+		res.TotalEntries++
+		if kind := entry.EdgeKind; kind != "" && edges.IsForward(kind) {
+			batch = append(batch, entry)
+			if len(batch) >= reverseEdgeBatchSize {
+				err := writeMissingReverseEdges(ctx, gs, batch, res)
+				batch = nil
+				return err
 			}
-			return nil
-		}); err != nil {
-			return nil, err
-		}
-		if len(info.Facts) > 0 {
-			nodes[ticket] = info
 		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = writeMissingReverseEdges(ctx, gs, batch, res)
 	}
-	return &gpb.NodesReply{Nodes: nodes}, nil
-}
-
-// Edges implements part of the Service interface.
-func (g *GraphStoreService) Edges(ctx context.Context, req *gpb.EdgesRequest) (*gpb.EdgesReply, error) {
-	if len(req.Ticket) == 0 {
-		return nil, errors.New("no tickets specified")
-	} else if req.PageToken != "" {
-		return nil, errors.New("UNIMPLEMENTED: page_token")
+	log.Printf("Wrote %d reverse edges to GraphStore (%d already present; %d total entries): %v", res.AddedCount, res.SkippedCount, res.TotalEntries, time.Since(startTime))
+	if err != nil {
+		return res, errorf(err, "reverse edges incomplete after writing %d: %v", res.AddedCount, err)
 	}
+	return res, nil
+}
 
-	patterns := xrefs.ConvertFilters(req.Filter)
-	allowedKinds := stringset.New(req.Kind...)
-	var targetSet stringset.Set
-	reply := &gpb.EdgesReply{
-		EdgeSets: make(map[string]*gpb.EdgeSet),
-		Nodes:    make(map[string]*cpb.NodeInfo),
+// writeMissingReverseEdges writes the reverse of each of the given forward
+// edges that is not already in gs, counting each in res as added or skipped.
+// The existing reverse edges are found with a single Read per distinct target
+// and edge kind, and the missing ones are written with a single Write per
+// target.
+func writeMissingReverseEdges(ctx context.Context, gs graphstore.Service, forward []*spb.Entry, res *EnsureReverseEdgesResult) error {
+	type reverseKey struct{ target, kind string }
+	type forwardKey struct{ source, fact string }
+	var keys []reverseKey
+	groups := make(map[reverseKey][]*spb.Entry)
+	for _, e := range forward {
+		k := reverseKey{kytheuri.ToString(e.Target), edges.Mirror(e.EdgeKind)}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], e)
 	}
 
-	for _, ticket := range req.Ticket {
-		vname, err := kytheuri.ToVName(ticket)
-		if err != nil {
-			return nil, fmt.Errorf("invalid ticket %q: %v", ticket, err)
+	var order []string
+	writes := make(map[string]*spb.WriteRequest)
+	for _, k := range keys {
+		group := groups[k]
+		missing := make(map[forwardKey]bool)
+		for _, e := range group {
+			missing[forwardKey{kytheuri.ToString(e.Source), e.FactName}] = true
 		}
-
-		var (
-			// EdgeKind -> TargetTicket -> OrdinalSet
-			filteredEdges = make(map[string]map[string]map[int32]struct{})
-			filteredFacts = make(map[string][]byte)
-		)
-
-		if err := g.gs.Read(ctx, &spb.ReadRequest{
-			Source:   vname,
-			EdgeKind: "*",
-		}, func(entry *spb.Entry) error {
-			edgeKind := entry.EdgeKind
-			if edgeKind == "" {
-				// node fact
-				if len(patterns) > 0 && xrefs.MatchesAny(entry.FactName, patterns) {
-					filteredFacts[entry.FactName] = entry.FactValue
-				}
-			} else {
-				// edge
-				edgeKind, ordinal, _ := edges.ParseOrdinal(edgeKind)
-				if len(req.Kind) == 0 || allowedKinds.Contains(edgeKind) {
-					targets, ok := filteredEdges[edgeKind]
-					if !ok {
-						targets = make(map[string]map[int32]struct{})
-						filteredEdges[edgeKind] = targets
-					}
-					ticket := kytheuri.ToString(entry.Target)
-					ordSet, ok := targets[ticket]
-					if !ok {
-						ordSet = make(map[int32]struct{})
-						targets[ticket] = ordSet
-					}
-					ordSet[int32(ordinal)] = struct{}{}
+		if err := gs.Read(ctx, &spb.ReadRequest{
+			Source:   group[0].Target,
+			EdgeKind: k.kind,
+		}, func(e *spb.Entry) error {
+			if key := (forwardKey{kytheuri.ToString(e.Target), e.FactName}); missing[key] {
+				delete(missing, key)
+				res.SkippedCount++
+				if len(missing) == 0 {
+					return io.EOF
 				}
 			}
 			return nil
 		}); err != nil {
-			return nil, fmt.Errorf("failed to retrieve entries for ticket %q", ticket)
-		}
-
-		// Only add a EdgeSet if there are targets for the requested edge kinds.
-		if len(filteredEdges) > 0 {
-			groups := make(map[string]*gpb.EdgeSet_Group)
-			for edgeKind, targets := range filteredEdges {
-				g := &gpb.EdgeSet_Group{}
-				for target, ordinals := range targets {
-					for ordinal := range ordinals {
-						g.Edge = append(g.Edge, &gpb.EdgeSet_Group_Edge{
-							TargetTicket: target,
-							Ordinal:      ordinal,
-						})
-					}
-					targetSet.Add(target)
-				}
-				groups[edgeKind] = g
-			}
-			reply.EdgeSets[ticket] = &gpb.EdgeSet{
-				Groups: groups,
-			}
+			return errorf(err, "Failed to check for reverse edges: %v", err)
+		}
 
-			// In addition, only add a NodeInfo if the filters have resulting facts.
-			if len(filteredFacts) > 0 {
-				reply.Nodes[ticket] = &cpb.NodeInfo{
-					Facts: filteredFacts,
-				}
+		for _, e := range group {
+			if !missing[forwardKey{kytheuri.ToString(e.Source), e.FactName}] {
+				continue
+			}
+			w, ok := writes[k.target]
+			if !ok {
+				w = &spb.WriteRequest{Source: e.Target}
+				writes[k.target] = w
+				order = append(order, k.target)
 			}
+			w.Update = append(w.Update, &spb.WriteRequest_Update{
+				Target:    e.Source,
+				EdgeKind:  k.kind,
+				FactName:  e.FactName,
+				FactValue: e.FactValue,
+			})
 		}
 	}
-
-	// Only request Nodes when there are fact filters given.
-	if len(req.Filter) > 0 {
-		// Eliminate redundant work by removing already requested nodes from targetSet
-		for ticket := range reply.Nodes {
-			targetSet.Discard(ticket)
-		}
-
-		// Batch request all leftover target nodes
-		nodesReply, err := g.Nodes(ctx, &gpb.NodesRequest{
-			Ticket: targetSet.Elements(),
-			Filter: req.Filter,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("failure getting target nodes: %v", err)
-		}
-		for ticket, node := range nodesReply.Nodes {
-			reply.Nodes[ticket] = node
+	for _, target := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		} else if err := gs.Write(ctx, writes[target]); err != nil {
+			return errorf(err, "Failed to write reverse edges of %q: %v", target, err)
 		}
+		res.AddedCount += len(writes[target].Update)
 	}
+	return nil
+}
 
-	return reply, nil
+// reverseEdgeExists reports whether gs already contains the reverse of the
+// given forward edge.
+func reverseEdgeExists(ctx context.Context, gs graphstore.Service, edge *spb.Entry) (bool, error) {
+	var found bool
+	err := gs.Read(ctx, &spb.ReadRequest{
+		Source:   edge.Target,
+		EdgeKind: edges.Mirror(edge.EdgeKind),
+	}, func(e *spb.Entry) error {
+		if e.FactName == edge.FactName && compare.VNamesEqual(e.Target, edge.Source) {
+			found = true
+			return io.EOF
+		}
+		return nil
+	})
+	return found, err
 }
 
-// Decorations implements part of the Service interface.
-func (g *GraphStoreService) Decorations(ctx context.Context, req *xpb.DecorationsRequest) (*xpb.DecorationsReply, error) {
-	if len(req.DirtyBuffer) > 0 {
-		return nil, errors.New("UNIMPLEMENTED: dirty buffers")
-	} else if req.GetLocation() == nil {
-		// TODO(schroederc): allow empty location when given dirty buffer
-		return nil, errors.New("missing location")
-	}
+// A MissingReverseEdge is a forward edge, reported by CheckReverseEdges, whose
+// reverse edge is not in the GraphStore.
+type MissingReverseEdge struct {
+	Source, Kind, Target string
+}
 
-	fileVName, err := kytheuri.ToVName(req.Location.Ticket)
-	if err != nil {
-		return nil, fmt.Errorf("invalid file ticket %q: %v", req.Location.Ticket, err)
-	}
+// String implements the fmt.Stringer interface.
+func (m *MissingReverseEdge) String() string {
+	return fmt.Sprintf("%s %s %s", m.Source, m.Kind, m.Target)
+}
 
-	text, encoding, err := getSourceText(ctx, g.gs, fileVName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve file text: %v", err)
-	}
-	norm := xrefs.NewNormalizer(text)
+// CheckReverseEdges reports each forward edge of the node with the given ticket
+// whose reverse edge is missing from the GraphStore, in the order the forward
+// edges are read.  Unlike EnsureReverseEdges, only the given node's edges are
+// read and nothing is written, so a partially-materialized GraphStore can be
+// debugged without a full scan.
+func (g *GraphStoreService) CheckReverseEdges(ctx context.Context, ticket string) ([]*MissingReverseEdge, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.CheckReverseEdges")
+	defer span.End()
 
-	loc, err := norm.Location(req.GetLocation())
+	vname, err := parseTicket(ticket)
 	if err != nil {
 		return nil, err
 	}
+	gs := g.store()
 
-	reply := &xpb.DecorationsReply{
-		Location: loc,
-		Nodes:    make(map[string]*cpb.NodeInfo),
+	var forward []*spb.Entry
+	if err := gs.Read(ctx, &spb.ReadRequest{
+		Source:   vname,
+		EdgeKind: "*",
+	}, func(e *spb.Entry) error {
+		if graphstore.IsEdge(e) && edges.IsForward(e.EdgeKind) {
+			forward = append(forward, e)
+		}
+		return nil
+	}); err != nil {
+		return nil, errorf(err, "failed to read edges of %q: %v", ticket, err)
 	}
 
-	// Handle DecorationsRequest.SourceText switch
-	if req.SourceText {
-		if loc.Kind == xpb.Location_FILE {
-			reply.SourceText = text
-		} else {
-			reply.SourceText = text[loc.Start.ByteOffset:loc.End.ByteOffset]
+	var missing []*MissingReverseEdge
+	for _, e := range forward {
+		if ok, err := reverseEdgeExists(ctx, gs, e); err != nil {
+			return nil, errorf(err, "failed to check reverse edge: %v", err)
+		} else if !ok {
+			missing = append(missing, &MissingReverseEdge{
+				Source: ticket,
+				Kind:   e.EdgeKind,
+				Target: kytheuri.ToString(e.Target),
+			})
 		}
-		reply.Encoding = encoding
 	}
+	return missing, nil
+}
 
-	// Handle DecorationsRequest.References switch
-	if req.References {
-		// Traverse the following chain of edges:
-		//   file --%/kythe/edge/childof-> []anchor --forwardEdgeKind-> []target
-		//
-		// Add []anchor and []target nodes to reply.Nodes
-		// Add all {anchor, forwardEdgeKind, target} tuples to reply.Reference
+// A GraphStoreService partially implements the xrefs.Service interface
+// directly using a graphstore.Service with stored reverse edges.  This is a
+// low-performance, simple alternative to creating the serving Table
+// representation.
+// TODO(schroederc): parallelize GraphStore calls
+type GraphStoreService struct {
+	gs graphstore.Service
 
-		patterns := xrefs.ConvertFilters(req.Filter)
+	// MaxSnippetWidth is the maximum width (in bytes) of the line-based snippet
+	// generated for an anchor without indexer-provided snippet offsets.  Wider
+	// lines are truncated to a window centered on the anchor.  If <= 0, the
+	// entire line is used.  Snippets spanning multiple lines are not
+	// truncated in width.
+	MaxSnippetWidth int
 
-		children, err := getEdges(ctx, g.gs, fileVName, func(e *spb.Entry) bool {
-			return e.EdgeKind == revChildOfEdgeKind
-		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to retrieve file children: %v", err)
-		}
+	// MaxSnippetLines is the maximum number of lines in the line-based snippet
+	// generated for an anchor spanning multiple lines.  The snippet begins at
+	// the anchor's first line.  If <= 0, every line of the anchor is used.
+	MaxSnippetLines int
 
-		var targetSet stringset.Set
-		for _, edge := range children {
-			anchor := edge.Target
-			ticket := kytheuri.ToString(anchor)
-			anchorNodeReply, err := g.Nodes(ctx, &gpb.NodesRequest{
-				Ticket: []string{ticket},
-			})
-			if err != nil {
-				return nil, fmt.Errorf("failure getting reference source node: %v", err)
-			} else if len(anchorNodeReply.Nodes) != 1 {
-				return nil, fmt.Errorf("found %d nodes for {%+v}", len(anchorNodeReply.Nodes), anchor)
-			}
+	// TrimSnippetIndentation determines whether the indentation shared by
+	// every line of a UTF-8 line-based snippet is removed, so that deeply
+	// nested code remains visible.  The snippet's SnippetStart is moved past
+	// the first line's removed indentation; the indentation of any later lines
+	// is only removed from the snippet's text.  The anchor's own span is
+	// unaffected.
+	TrimSnippetIndentation bool
 
-			node, ok := xrefs.NodesMap(anchorNodeReply.Nodes)[ticket]
-			if !ok {
-				return nil, fmt.Errorf("failed to find info for node %q", ticket)
-			} else if string(node[facts.NodeKind]) != nodes.Anchor {
-				// Skip child if it isn't an anchor node
-				continue
-			}
+	// MaxFileBytes is the maximum size in bytes of a file's text, after any
+	// decompression, used by Decorations and CrossReferences.  The text of a
+	// larger file is neither decompressed nor retained: Decorations replies
+	// with the file's TooLargeFact and its references, without source text,
+	// located as for a file without text, and CrossReferences skips the
+	// file's anchors unless their locations can be resolved by the file's
+	// facts.LineIndex fact, in which case they are returned without text or
+	// snippets.  The text fact itself is still read, as a graphstore.Service
+	// has no ranged reads.  If <= 0, files of any size are used.
+	MaxFileBytes int
 
-			anchorStart, err := strconv.Atoi(string(node[facts.AnchorStart]))
-			if err != nil {
-				log.Printf("Invalid anchor start offset %q for node %q: %v", node[facts.AnchorStart], ticket, err)
-				continue
-			}
-			anchorEnd, err := strconv.Atoi(string(node[facts.AnchorEnd]))
-			if err != nil {
-				log.Printf("Invalid anchor end offset %q for node %q: %v", node[facts.AnchorEnd], ticket, err)
-				continue
-			}
+	// MaxEntriesPerNode is the maximum number of entries read for any single
+	// node by Nodes, Edges, Decorations, CrossReferences, and EntriesForFile.
+	// Once it is reached, the node's read is stopped early and the node is
+	// marked with TruncatedFact in the reply's Nodes (or, by EntriesForFile,
+	// with a TruncatedFact entry).  If <= 0, every entry is read.
+	MaxEntriesPerNode int
 
-			if loc.Kind == xpb.Location_SPAN {
-				// Check if anchor fits within/around requested source text window
-				if !xrefs.InSpanBounds(req.SpanKind, int32(anchorStart), int32(anchorEnd), loc.Start.ByteOffset, loc.End.ByteOffset) {
-					continue
-				} else if anchorStart > anchorEnd {
-					log.Printf("Invalid anchor offset span %d:%d", anchorStart, anchorEnd)
-					continue
-				}
-			}
+	// MaxAnchorBatchSize is the maximum number of anchor nodes requested in a
+	// single Nodes call by Decorations.  If <= 0, all of a file's anchors are
+	// requested at once.
+	MaxAnchorBatchSize int
 
-			targets, err := getEdges(ctx, g.gs, anchor, func(e *spb.Entry) bool {
-				return edges.IsForward(e.EdgeKind) && e.EdgeKind != edges.ChildOf
-			})
-			if err != nil {
-				return nil, fmt.Errorf("failed to retrieve targets of anchor %v: %v", anchor, err)
-			}
-			if len(targets) == 0 {
-				log.Printf("Anchor missing forward edges: {%+v}", anchor)
-				continue
-			}
+	// MaxEdgesPerKind is the maximum number of edges of any single edge kind,
+	// counted across all requested tickets, in a page returned by Edges.  Once
+	// it is reached, the page is left to be filled with edges of the other
+	// requested kinds, so that a kind with many targets cannot starve the rest.
+	// The page token then records the offset of each kind separately.  If <= 0,
+	// edges are paged without regard to their kinds.
+	MaxEdgesPerKind int
 
-			if node := filterNode(patterns, anchorNodeReply.Nodes[ticket]); node != nil {
-				reply.Nodes[ticket] = node
-			}
-			for _, edge := range targets {
-				targetTicket := kytheuri.ToString(edge.Target)
-				targetSet.Add(targetTicket)
-				reply.Reference = append(reply.Reference, &xpb.DecorationsReply_Reference{
-					SourceTicket: ticket,
-					Kind:         edge.Kind,
-					TargetTicket: targetTicket,
-					AnchorStart:  norm.ByteOffset(int32(anchorStart)),
-					AnchorEnd:    norm.ByteOffset(int32(anchorEnd)),
-				})
-			}
-		}
-		sort.Sort(bySpan(reply.Reference))
+	// AllowScan determines whether Nodes expands wildcard tickets, whose paths
+	// end in "**", into the tickets of every node whose path begins with the
+	// preceding prefix and whose other VName fields match the ticket's
+	// non-empty fields (e.g. "kythe://corpus?path=foo/**").  Wildcards are
+	// expanded by scanning the entire GraphStore.  If false, such tickets are
+	// read as ordinary tickets.
+	AllowScan bool
 
-		// Only request Nodes when there are fact filters given.
-		if len(req.Filter) > 0 {
-			// Ensure returned nodes are not duplicated.
-			for ticket := range reply.Nodes {
-				targetSet.Discard(ticket)
-			}
+	// MaxScanResults is the maximum number of nodes the wildcard tickets of a
+	// single Nodes call may match before it fails, and the maximum page size
+	// of Files.  If <= 0, DefaultMaxScanResults is used.
+	MaxScanResults int
 
-			// Batch request all Reference target nodes
-			nodesReply, err := g.Nodes(ctx, &gpb.NodesRequest{
-				Ticket: targetSet.Elements(),
-				Filter: req.Filter,
-			})
-			if err != nil {
-				return nil, fmt.Errorf("failure getting reference target nodes: %v", err)
-			}
-			for ticket, node := range nodesReply.Nodes {
-				reply.Nodes[ticket] = node
-			}
-		}
-	}
+	// ExportedByDefault maps a language to whether its nodes without a
+	// facts.Visibility fact are considered exported by the ExportedOnly
+	// option of CrossReferencesWithOptions.  Nodes of languages missing from
+	// the map are considered exported.
+	ExportedByDefault map[string]bool
 
-	return reply, nil
+	// FilterCacheSize is the maximum number of distinct lists of filter globs
+	// whose compiled patterns are cached across calls.  If <= 0, each call
+	// compiles its filters anew.
+	FilterCacheSize int
+
+	// CombinedKinds determines whether Nodes adds a CombinedKindFact to each
+	// returned node whose facts.NodeKind fact matches the request's filter.
+	// The node's facts.NodeKind and facts.Subkind facts are returned as usual.
+	CombinedKinds bool
+
+	// CacheReads determines whether the results of each GraphStore read are
+	// cached for the remainder of the top-level Nodes, Edges, Decorations,
+	// CrossReferences, or Definitions call making it.  Nothing is cached across
+	// calls.
+	CacheReads bool
+
+	// TextResolver, if non-nil, fetches the text of each file without a
+	// facts.Text fact from the external store referenced by its facts.TextRef
+	// fact, for use by Decorations and CrossReferences.  If nil, only inline
+	// text is used.
+	TextResolver TextResolver
+
+	// Retry, if non-nil, determines how each underlying GraphStore Read or
+	// Scan that fails with a transient error is retried.  If nil, no call is
+	// retried.
+	Retry *RetryPolicy
+
+	// KeepDeclarationsWithDefinitions determines whether CrossReferences
+	// returns the declarations of an incomplete node that is completed by a
+	// definition elsewhere.  By default they are dropped, so that navigating
+	// to a node never lands on its forward declaration; tools navigating
+	// between headers and their implementations may set it to see both.
+	KeepDeclarationsWithDefinitions bool
+
+	// Tracer, if non-nil, records a span for each Nodes, Edges, Decorations,
+	// CrossReferences, and Definitions call along with a child span for each
+	// underlying GraphStore Read or Scan.
+	Tracer Tracer
+
+	// Logger, if non-nil, receives the messages logged while serving requests,
+	// such as those describing invalid nodes that are skipped.  A *log.Logger
+	// writing to ioutil.Discard silences them.  If nil, the standard log
+	// package is used.
+	Logger Logger
+
+	filters *filterCache
 }
 
-var revChildOfEdgeKind = edges.Mirror(edges.ChildOf)
+// A Logger records informational messages about the data being served.  It is
+// satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
 
-func getSourceText(ctx context.Context, gs graphstore.Service, fileVName *spb.VName) (text []byte, encoding string, err error) {
-	if err := gs.Read(ctx, &spb.ReadRequest{Source: fileVName}, func(entry *spb.Entry) error {
-		switch entry.FactName {
-		case facts.Text:
+// stdLogger is a Logger writing to the standard log package.
+type stdLogger struct{}
+
+// Printf implements the Logger interface.
+func (stdLogger) Printf(format string, v ...interface{}) { log.Printf(format, v...) }
+
+// logger returns g.Logger, if set, or a Logger writing to the standard log
+// package.
+func (g *GraphStoreService) logger() Logger {
+	if g.Logger != nil {
+		return g.Logger
+	}
+	return stdLogger{}
+}
+
+// logf logs the given message to g's Logger.
+func (g *GraphStoreService) logf(format string, v ...interface{}) {
+	g.logger().Printf(format, v...)
+}
+
+// A TextResolver fetches the text of a file stored outside of the GraphStore.
+type TextResolver interface {
+	// ResolveText returns the bytes referenced by ref, the value of the
+	// facts.TextRef fact of the file with the given ticket.  The bytes are
+	// used as if they were the file's facts.Text fact, so the file's
+	// facts.TextCompression and facts.TextEncoding facts still apply.
+	ResolveText(ctx context.Context, ticket string, ref []byte) ([]byte, error)
+}
+
+// resolveText returns text unless it is nil and the file with the given ticket
+// has a text reference that resolver can fetch.
+func resolveText(ctx context.Context, resolver TextResolver, ticket string, text, ref []byte) ([]byte, error) {
+	if text != nil || ref == nil || resolver == nil {
+		return text, nil
+	}
+	resolved, err := resolver.ResolveText(ctx, ticket, ref)
+	if err != nil {
+		return nil, errorf(err, "resolving text reference %q: %v", ref, err)
+	} else if resolved == nil {
+		resolved = []byte{}
+	}
+	return resolved, nil
+}
+
+// TruncatedFact is the name of a fact added to the NodeInfo of each node whose
+// entries were not all read due to MaxEntriesPerNode.  It is not stored in the
+// GraphStore.
+const TruncatedFact = "/kythe/xrefs/truncated"
+
+// CombinedKindFact is the name of a fact added by Nodes, if CombinedKinds is
+// set, to the NodeInfo of each node with a kind.  Its value is the node's kind
+// combined with its subkind (see schema.CombinedKind), e.g. "record/class".
+// It is not stored in the GraphStore.
+const CombinedKindFact = "/kythe/xrefs/kind"
+
+// TooLargeFact is the name of a fact added by Decorations to the reply NodeInfo
+// of a file whose text exceeds MaxFileBytes.  Its value is the size of the
+// file's text in bytes.  It is omitted for a compressed file, whose
+// decompressed size is unknown.  It is not stored in the GraphStore.
+const TooLargeFact = "/kythe/xrefs/too_large"
+
+// A FileTooLargeError is returned for a file whose text exceeds MaxFileBytes.
+type FileTooLargeError struct {
+	// Ticket is the ticket of the file.
+	Ticket string
+
+	// Size is the size of the file's text in bytes, or -1 if only the
+	// compressed size is known to exceed Max.
+	Size int
+
+	// Max is the MaxFileBytes exceeded by the file.
+	Max int
+}
+
+// Error implements the error interface.
+func (e *FileTooLargeError) Error() string {
+	if e.Size < 0 {
+		return fmt.Sprintf("file %q exceeds %d bytes", e.Ticket, e.Max)
+	}
+	return fmt.Sprintf("file %q is %d bytes; exceeds %d bytes", e.Ticket, e.Size, e.Max)
+}
+
+// ZeroWidthFact is the name of a fact added to the reply NodeInfo of each
+// anchor returned by CrossReferences whose span is empty, such as an implicit
+// reference.  Clients may render such anchors as insertion points rather than
+// spans.  It is not stored in the GraphStore.
+const ZeroWidthFact = "/kythe/xrefs/zero_width"
+
+// DuplicateSnippetFact is the name of a fact added by the DedupSnippets
+// option of CrossReferencesWithOptions to the reply NodeInfo of each anchor
+// whose snippet text was omitted.  Its value is the ticket of the anchor in the
+// same reply carrying the identical snippet.  It is not stored in the
+// GraphStore.
+const DuplicateSnippetFact = "/kythe/xrefs/duplicate_snippet"
+
+// DecodeErrorFact is the name of a fact added by CrossReferences to the reply
+// NodeInfo of each anchor whose text or snippet could not be decoded from its
+// file's encoding, and so may be empty or incomplete.  Its value is the
+// decoding error.  It is not stored in the GraphStore.
+const DecodeErrorFact = "/kythe/xrefs/decode_error"
+
+// NoOrdinal is the Ordinal of each edge returned by Edges whose stored edge
+// kind has no ordinal suffix, distinguishing it from an edge with an explicit
+// ordinal of 0.
+const NoOrdinal int32 = -1
+
+// GzipCompression is the facts.TextCompression value of a file whose text
+// fact is gzip-compressed.  The text of such files is decompressed by each
+// GraphStoreService method before use.
+const GzipCompression = "gzip"
+
+// DefaultMaxScanResults is the MaxScanResults used if none is set.
+const DefaultMaxScanResults = 1000
+
+// DefaultFilterCacheSize is the FilterCacheSize of a new GraphStoreService.
+const DefaultFilterCacheSize = 64
+
+// DefaultMaxSnippetWidth is the MaxSnippetWidth used by NewGraphStoreService.
+const DefaultMaxSnippetWidth = 200
+
+// DefaultMaxSnippetLines is the MaxSnippetLines used by NewGraphStoreService.
+const DefaultMaxSnippetLines = 5
+
+// MaxTicketLength is the maximum length in bytes of a ticket accepted by Nodes
+// and Edges.
+const MaxTicketLength = 64 * 1024
+
+// NewGraphStoreService returns a new GraphStoreService given an
+// existing graphstore.Service.
+func NewGraphStoreService(gs graphstore.Service) *GraphStoreService {
+	return &GraphStoreService{
+		gs:              gs,
+		MaxSnippetWidth: DefaultMaxSnippetWidth,
+		MaxSnippetLines: DefaultMaxSnippetLines,
+		FilterCacheSize: DefaultFilterCacheSize,
+		filters:         newFilterCache(),
+	}
+}
+
+// factFilter returns the FactFilter for the given filter globs, reusing the
+// compiled patterns of a previous call if they are cached.
+func (g *GraphStoreService) factFilter(filters []string) *xrefs.FactFilter {
+	return g.filters.get(filters, g.FilterCacheSize)
+}
+
+// NewGraphStoreServiceWithContext returns a new GraphStoreService given an
+// existing graphstore.Service after probing it for at least one node.  An
+// error is returned if the probe fails, finds no nodes, or does not complete
+// before ctx is done.
+func NewGraphStoreServiceWithContext(ctx context.Context, gs graphstore.Service) (*GraphStoreService, error) {
+	if err := probe(ctx, gs); err != nil {
+		return nil, err
+	}
+	return NewGraphStoreService(gs), nil
+}
+
+// probe scans gs for a single node kind fact.
+func probe(ctx context.Context, gs graphstore.Service) error {
+	errc := make(chan error, 1)
+	go func() {
+		var found bool
+		err := gs.Scan(ctx, &spb.ScanRequest{FactPrefix: facts.NodeKind}, func(*spb.Entry) error {
+			found = true
+			return io.EOF
+		})
+		if err == nil && !found {
+			err = errors.New("no nodes found")
+		}
+		errc <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return errorf(ctx.Err(), "graphstore probe failed: %v", ctx.Err())
+	case err := <-errc:
+		if err != nil && err != io.EOF {
+			return errorf(err, "graphstore probe failed: %v", err)
+		}
+		return nil
+	}
+}
+
+// parseTicket returns the VName of the given ticket, rejecting tickets that
+// are too long or whose fields are not valid UTF-8 or contain control
+// characters, as such VNames do not survive a round-trip through
+// kytheuri.ToString.  The returned error wraps ErrInvalidTicket and names the
+// offending ticket.
+func parseTicket(ticket string) (*spb.VName, error) {
+	if len(ticket) > MaxTicketLength {
+		return nil, errorf(ErrInvalidTicket, "%v %.64q...: length %d exceeds %d", ErrInvalidTicket, ticket, len(ticket), MaxTicketLength)
+	}
+	vname, err := kytheuri.ToVName(ticket)
+	if err != nil {
+		return nil, errorf(ErrInvalidTicket, "%v %q: %v", ErrInvalidTicket, ticket, err)
+	}
+	for _, field := range []struct{ name, value string }{
+		{"signature", vname.Signature},
+		{"corpus", vname.Corpus},
+		{"root", vname.Root},
+		{"path", vname.Path},
+		{"language", vname.Language},
+	} {
+		if !utf8.ValidString(field.value) {
+			return nil, errorf(ErrInvalidTicket, "%v %q: %s is not valid UTF-8", ErrInvalidTicket, ticket, field.name)
+		} else if i := strings.IndexFunc(field.value, unicode.IsControl); i >= 0 {
+			r, _ := utf8.DecodeRuneInString(field.value[i:])
+			return nil, errorf(ErrInvalidTicket, "%v %q: %s contains control character %U", ErrInvalidTicket, ticket, field.name, r)
+		}
+	}
+	return vname, nil
+}
+
+// Nodes implements part of the Service interface.
+func (g *GraphStoreService) Nodes(ctx context.Context, req *gpb.NodesRequest) (*gpb.NodesReply, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.Nodes")
+	ctx = g.withReadCache(ctx)
+	defer span.End()
+	span.SetAttribute("tickets", len(req.Ticket))
+
+	if g.AllowScan {
+		tickets, err := g.expandWildcards(ctx, req.Ticket)
+		if err != nil {
+			return nil, err
+		}
+		req = &gpb.NodesRequest{Ticket: tickets, Filter: req.Filter}
+	}
+
+	filter := g.factFilter(req.Filter)
+
+	names := make([]*spb.VName, 0, len(req.Ticket))
+	for _, ticket := range req.Ticket {
+		name, err := parseTicket(ticket)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	nodes := make(map[string]*cpb.NodeInfo, len(names))
+	for i, vname := range names {
+		info, err := g.readNode(ctx, filter, vname)
+		if err != nil {
+			return nil, err
+		} else if info != nil {
+			nodes[req.Ticket[i]] = info
+		}
+	}
+	return &gpb.NodesReply{Nodes: nodes}, nil
+}
+
+// BatchNodes is equivalent to Nodes except that a ticket that cannot be
+// parsed or read does not fail the request.  Instead, its error is returned in
+// the map keyed by ticket and the remaining tickets' nodes are still returned.
+// Wildcard tickets are not expanded.
+func (g *GraphStoreService) BatchNodes(ctx context.Context, req *gpb.NodesRequest) (*gpb.NodesReply, map[string]error, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.BatchNodes")
+	ctx = g.withReadCache(ctx)
+	defer span.End()
+	span.SetAttribute("tickets", len(req.Ticket))
+
+	filter := g.factFilter(req.Filter)
+	nodes := make(map[string]*cpb.NodeInfo)
+	errs := make(map[string]error)
+	for _, ticket := range req.Ticket {
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			errs[ticket] = err
+			continue
+		}
+		info, err := g.readNode(ctx, filter, vname)
+		if err != nil {
+			errs[ticket] = err
+		} else if info != nil {
+			nodes[ticket] = info
+		}
+	}
+	return &gpb.NodesReply{Nodes: nodes}, errs, nil
+}
+
+// wildcardSuffix marks a wildcard ticket's path as a prefix pattern.
+const wildcardSuffix = "**"
+
+// expandWildcards returns tickets with each wildcard ticket replaced by the
+// tickets of the nodes it matches.  An error is returned if more than
+// g.MaxScanResults nodes are matched.
+func (g *GraphStoreService) expandWildcards(ctx context.Context, tickets []string) ([]string, error) {
+	var (
+		expanded []string
+		patterns []*spb.VName
+	)
+	for _, ticket := range tickets {
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			return nil, err
+		} else if strings.HasSuffix(vname.Path, wildcardSuffix) {
+			vname.Path = strings.TrimSuffix(vname.Path, wildcardSuffix)
+			patterns = append(patterns, vname)
+		} else {
+			expanded = append(expanded, ticket)
+		}
+	}
+	if len(patterns) == 0 {
+		return tickets, nil
+	}
+
+	max := g.MaxScanResults
+	if max <= 0 {
+		max = DefaultMaxScanResults
+	}
+	var matches stringset.Set
+	if err := g.store().Scan(ctx, &spb.ScanRequest{}, func(e *spb.Entry) error {
+		if e.EdgeKind != "" {
+			return nil
+		}
+		for _, p := range patterns {
+			if matchesWildcard(p, e.Source) {
+				matches.Add(kytheuri.ToString(e.Source))
+				if matches.Len() > max {
+					return &LimitError{Limit: "MaxScanResults", Max: max}
+				}
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, errorf(err, "error expanding wildcard tickets: %v", err)
+	}
+	return append(expanded, matches.Elements()...), nil
+}
+
+// matchesWildcard reports whether v matches the wildcard pattern p, whose Path
+// is a prefix and whose other fields must match exactly if non-empty.
+func matchesWildcard(p, v *spb.VName) bool {
+	return strings.HasPrefix(v.Path, p.Path) &&
+		(p.Corpus == "" || p.Corpus == v.Corpus) &&
+		(p.Root == "" || p.Root == v.Root) &&
+		(p.Language == "" || p.Language == v.Language) &&
+		(p.Signature == "" || p.Signature == v.Signature)
+}
+
+// defaultFilesPageSize is the number of file tickets returned by Files if no
+// page size is given.
+const defaultFilesPageSize = 1024
+
+// Files returns the tickets of the file nodes, those with a facts.Text fact or
+// a facts.NodeKind of nodes.File, matching prefix: a ticket whose path is a
+// prefix and whose other non-empty fields must match exactly (e.g.
+// "kythe://corpus?path=src/").  The tickets are returned in order, at most
+// pageSize (or 1024 if <= 0) at a time, along with a token for the next page if
+// there are more.  Files are found by scanning the entire GraphStore, keeping
+// only the tickets of the requested page, which is capped at MaxScanResults.
+func (g *GraphStoreService) Files(ctx context.Context, prefix string, pageSize int, pageToken string) ([]string, string, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.Files")
+	defer span.End()
+	span.SetAttribute("prefix", prefix)
+
+	pattern, err := parseTicket(prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	if pageSize <= 0 {
+		pageSize = defaultFilesPageSize
+	}
+	max := g.MaxScanResults
+	if max <= 0 {
+		max = DefaultMaxScanResults
+	}
+	if pageSize > max {
+		pageSize = max
+	}
+	var after string
+	if pageToken != "" {
+		t, err := decodePageToken(pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		after = t.SecondaryToken
+	}
+
+	// Only the smallest pageSize+1 tickets after the token are kept; the extra
+	// ticket signals that there is another page.
+	var (
+		page ticketHeap
+		seen stringset.Set
+	)
+	if err := g.store().Scan(ctx, &spb.ScanRequest{}, func(e *spb.Entry) error {
+		if e.EdgeKind != "" || !matchesWildcard(pattern, e.Source) {
+			return nil
+		} else if e.FactName != facts.Text && (e.FactName != facts.NodeKind || string(e.FactValue) != nodes.File) {
+			return nil
+		}
+		switch ticket := kytheuri.ToString(e.Source); {
+		case ticket <= after || seen.Contains(ticket):
+		case len(page) <= pageSize:
+			seen.Add(ticket)
+			heap.Push(&page, ticket)
+		case ticket < page[0]:
+			seen.Discard(page[0])
+			seen.Add(ticket)
+			page[0] = ticket
+			heap.Fix(&page, 0)
+		}
+		return nil
+	}); err != nil {
+		return nil, "", errorf(err, "error scanning for files: %v", err)
+	}
+
+	tickets := []string(page)
+	sort.Strings(tickets)
+	if len(tickets) <= pageSize {
+		return tickets, "", nil
+	}
+	tickets = tickets[:pageSize]
+	token, err := encodePageToken(&ipb.PageToken{SecondaryToken: tickets[pageSize-1]})
+	if err != nil {
+		return nil, "", err
+	}
+	return tickets, token, nil
+}
+
+// ticketHeap is a max-heap of tickets, whose root is the greatest ticket.
+type ticketHeap []string
+
+// Len implements part of the heap.Interface.
+func (h ticketHeap) Len() int { return len(h) }
+
+// Less implements part of the heap.Interface.
+func (h ticketHeap) Less(i, j int) bool { return h[i] > h[j] }
+
+// Swap implements part of the heap.Interface.
+func (h ticketHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+// Push implements part of the heap.Interface.
+func (h *ticketHeap) Push(v interface{}) { *h = append(*h, v.(string)) }
+
+// Pop implements part of the heap.Interface.
+func (h *ticketHeap) Pop() interface{} {
+	old := *h
+	v := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return v
+}
+
+// readNode returns the facts of the given node matching filter.  If there are
+// no such facts, nil is returned.
+func (g *GraphStoreService) readNode(ctx context.Context, filter *xrefs.FactFilter, vname *spb.VName) (*cpb.NodeInfo, error) {
+	entries, truncated, err := readEntries(ctx, g.read, &spb.ReadRequest{Source: vname})
+	if err != nil {
+		return nil, err
+	}
+	info := &cpb.NodeInfo{Facts: make(map[string][]byte)}
+	var kind, subkind []byte
+	for _, entry := range entries {
+		if filter.Empty() || filter.Matches(entry.FactName) {
+			info.Facts[entry.FactName] = entry.FactValue
+		}
+		switch entry.FactName {
+		case facts.NodeKind:
+			kind = entry.FactValue
+		case facts.Subkind:
+			subkind = entry.FactValue
+		}
+	}
+	if truncated {
+		info.Facts[TruncatedFact] = []byte("true")
+	}
+	if _, ok := info.Facts[facts.NodeKind]; ok && g.CombinedKinds {
+		combined := schema.CombinedKind(map[string][]byte{facts.NodeKind: kind, facts.Subkind: subkind})
+		info.Facts[CombinedKindFact] = []byte(combined)
+	}
+	if len(info.Facts) == 0 {
+		return nil, nil
+	}
+	return info, nil
+}
+
+// CountEdges returns an EdgesReply with only its TotalEdgesByKind populated
+// for the given request, as if by Edges.  The edges are counted as they are
+// read, without building their groups or reading their target nodes.  As with
+// Edges, each distinct kind, target, and ordinal of a source is counted once,
+// the entries read for each source are bounded by MaxEntriesPerNode, and a
+// source whose entries were truncated has a TruncatedFact in the reply's
+// Nodes.
+func (g *GraphStoreService) CountEdges(ctx context.Context, req *gpb.EdgesRequest) (*gpb.EdgesReply, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.CountEdges")
+	defer span.End()
+	span.SetAttribute("tickets", len(req.Ticket))
+	span.SetAttribute("kinds", req.Kind)
+
+	if len(req.Ticket) == 0 {
+		return nil, ErrNoTickets
+	}
+
+	allowedKinds := newKindMatcher(req.Kind)
+	reply := &gpb.EdgesReply{
+		Nodes:            make(map[string]*cpb.NodeInfo),
+		TotalEdgesByKind: make(map[string]int64),
+	}
+	for i, ticket := range req.Ticket {
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			return nil, err
+		}
+
+		counted := make(map[edgeKey]bool)
+		truncated, err := g.read(ctx, &spb.ReadRequest{
+			Source:   vname,
+			EdgeKind: "*",
+		}, func(entry *spb.Entry) error {
+			if entry.EdgeKind == "" {
+				return nil
+			}
+			edgeKind, ordinal, hasOrdinal := edges.ParseOrdinal(entry.EdgeKind)
+			if !hasOrdinal {
+				ordinal = int(NoOrdinal)
+			}
+			if !allowedKinds.matches(edgeKind) {
+				return nil
+			}
+			key := edgeKey{i, edgeKind, int32(ordinal), kytheuri.ToString(entry.Target)}
+			if !counted[key] {
+				counted[key] = true
+				reply.TotalEdgesByKind[edgeKind]++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errorf(err, "failed to count edges for ticket %q: %v", ticket, err)
+		} else if truncated {
+			addFact(reply.Nodes, ticket, TruncatedFact, []byte("true"))
+		}
+	}
+	return reply, nil
+}
+
+// sortedEdges sorts the given edges by ordinal and then by target ticket and
+// removes any exact duplicates.  The resulting slice shares storage with es.
+func sortedEdges(es []*gpb.EdgeSet_Group_Edge) []*gpb.EdgeSet_Group_Edge {
+	sort.Sort(byOrdinalTarget(es))
+	deduped := es[:0]
+	for i, e := range es {
+		if i > 0 && e.TargetTicket == es[i-1].TargetTicket && e.Ordinal == es[i-1].Ordinal {
+			continue
+		}
+		deduped = append(deduped, e)
+	}
+	return deduped
+}
+
+type byOrdinalTarget []*gpb.EdgeSet_Group_Edge
+
+// Len implements part of the sort.Interface.
+func (s byOrdinalTarget) Len() int { return len(s) }
+
+// Swap implements part of the sort.Interface.
+func (s byOrdinalTarget) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less implements part of the sort.Interface.
+func (s byOrdinalTarget) Less(i, j int) bool {
+	if s[i].Ordinal != s[j].Ordinal {
+		return s[i].Ordinal < s[j].Ordinal
+	}
+	return s[i].TargetTicket < s[j].TargetTicket
+}
+
+// NodesOptions are the optional parameters of NodesWithOptions.  The zero
+// NodesOptions is equivalent to calling Nodes.
+type NodesOptions struct {
+	// If MarkedSource is true, the decoded facts.Code MarkedSource of each
+	// requested node is returned, regardless of whether the request's Filter
+	// matches facts.Code.
+	MarkedSource bool
+
+	// If Modifiers is true, the Modifiers of each requested node are returned,
+	// regardless of whether the request's Filter matches the tag facts.
+	Modifiers bool
+
+	// If Definitions is true, the primary binding definition anchor of each
+	// returned node is returned, as resolved by Definitions.  This saves a
+	// separate Definitions call when only a node's facts and definition site
+	// are needed.
+	Definitions bool
+}
+
+// NodesResults are the additional results of NodesWithOptions.  Each field is
+// only populated if requested by the call's NodesOptions.
+type NodesResults struct {
+	// MarkedSource maps the ticket of each requested node to its decoded
+	// MarkedSource.  Nodes without a facts.Code fact, or with one that cannot
+	// be decoded, are absent.
+	MarkedSource map[string]*xpb.MarkedSource
+
+	// Modifiers maps the ticket of each requested node to its Modifiers,
+	// ordered by name.  Nodes without any modifier tag facts are absent.
+	Modifiers map[string][]Modifier
+
+	// Definitions maps the ticket of each returned node to its primary binding
+	// definition anchor.  A node with several binding definitions uses the
+	// first in Definitions' order, i.e. by parent file and then span.  Nodes
+	// without any definition are absent.
+	Definitions map[string]*xpb.Anchor
+}
+
+// NodesWithOptions is equivalent to Nodes except that it is further
+// parameterized by opts and also returns the additional results requested by
+// opts.
+func (g *GraphStoreService) NodesWithOptions(ctx context.Context, req *gpb.NodesRequest, opts *NodesOptions) (*gpb.NodesReply, *NodesResults, error) {
+	ctx = g.withReadCache(ctx)
+	reply, err := g.Nodes(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &NodesResults{}
+	if opts.MarkedSource {
+		if res.MarkedSource, err = g.markedSources(ctx, req, reply); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.Modifiers {
+		if res.Modifiers, err = g.modifiers(ctx, req, reply); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opts.Definitions {
+		if res.Definitions, err = g.primaryDefinitions(ctx, reply); err != nil {
+			return nil, nil, err
+		}
+	}
+	return reply, res, nil
+}
+
+// markedSources returns the decoded facts.Code MarkedSource of each node in
+// reply, keyed by ticket, reading the facts again if req.Filter does not
+// match facts.Code.
+func (g *GraphStoreService) markedSources(ctx context.Context, req *gpb.NodesRequest, reply *gpb.NodesReply) (map[string]*xpb.MarkedSource, error) {
+	codes := reply.Nodes
+	if filter := g.factFilter(req.Filter); !filter.Empty() && !filter.Matches(facts.Code) {
+		codeReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: req.Ticket,
+			Filter: []string{facts.Code},
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving code facts: %v", err)
+		}
+		codes = codeReply.Nodes
+	}
+
+	sources := make(map[string]*xpb.MarkedSource)
+	for ticket, info := range codes {
+		code := info.Facts[facts.Code]
+		if len(code) == 0 {
+			continue
+		}
+		ms := &xpb.MarkedSource{}
+		if err := proto.Unmarshal(code, ms); err != nil {
+			g.logf("Invalid MarkedSource for %q: %v", ticket, err)
+			continue
+		}
+		sources[ticket] = ms
+	}
+	return sources, nil
+}
+
+// A Modifier is a modifier of a node, such as static or const, denoted by the
+// presence of a tag fact.
+type Modifier string
+
+// Modifiers returned by NodesWithOptions.
+const (
+	ModifierAbstract Modifier = "abstract"
+	ModifierConst    Modifier = "const"
+	ModifierStatic   Modifier = "static"
+)
+
+// modifierFacts maps each tag fact to its Modifier, in Modifier order.
+var modifierFacts = []struct {
+	fact     string
+	modifier Modifier
+}{
+	{facts.TagAbstract, ModifierAbstract},
+	{facts.TagConst, ModifierConst},
+	{facts.TagStatic, ModifierStatic},
+}
+
+// nodeModifiers returns the Modifiers whose tag facts are present in the
+// given facts.  A tag fact is present regardless of its value; an absent one
+// denotes an unset modifier.
+func nodeModifiers(nodeFacts map[string][]byte) []Modifier {
+	var mods []Modifier
+	for _, m := range modifierFacts {
+		if _, ok := nodeFacts[m.fact]; ok {
+			mods = append(mods, m.modifier)
+		}
+	}
+	return mods
+}
+
+// modifiers returns the Modifiers of each node in reply, keyed by ticket,
+// reading the tag facts again unless req.Filter matches all of them.
+func (g *GraphStoreService) modifiers(ctx context.Context, req *gpb.NodesRequest, reply *gpb.NodesReply) (map[string][]Modifier, error) {
+	tags := reply.Nodes
+	filter := g.factFilter(req.Filter)
+	var tagFilter []string
+	var unmatched bool
+	for _, m := range modifierFacts {
+		tagFilter = append(tagFilter, m.fact)
+		unmatched = unmatched || (!filter.Empty() && !filter.Matches(m.fact))
+	}
+	if unmatched {
+		tagReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: req.Ticket,
+			Filter: tagFilter,
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving modifier facts: %v", err)
+		}
+		tags = tagReply.Nodes
+	}
+
+	mods := make(map[string][]Modifier)
+	for ticket, info := range tags {
+		if m := nodeModifiers(info.Facts); len(m) > 0 {
+			mods[ticket] = m
+		}
+	}
+	return mods, nil
+}
+
+// primaryDefinitions returns the first binding definition anchor, in
+// Definitions' order, of each node in reply, keyed by ticket.
+func (g *GraphStoreService) primaryDefinitions(ctx context.Context, reply *gpb.NodesReply) (map[string]*xpb.Anchor, error) {
+	locs := make(map[string]*xpb.Anchor)
+	if len(reply.Nodes) == 0 {
+		return locs, nil
+	}
+	tickets := make([]string, 0, len(reply.Nodes))
+	for ticket := range reply.Nodes {
+		tickets = append(tickets, ticket)
+	}
+	defs, err := g.Definitions(ctx, tickets)
+	if err != nil {
+		return nil, errorf(err, "error retrieving definitions: %v", err)
+	}
+	for ticket, anchors := range defs {
+		locs[ticket] = anchors[0]
+	}
+	return locs, nil
+}
+
+// An EnclosingNode is the nearest semantic node enclosing an anchor, as found
+// by EnclosingNode.
+type EnclosingNode struct {
+	// Ticket is the enclosing node's ticket.
+	Ticket string
+
+	// Facts holds the enclosing node's naming facts (see enclosingFacts) that
+	// are present.
+	Facts map[string][]byte
+}
+
+// enclosingFacts are the facts of an EnclosingNode, which suffice for a client
+// to name it in a breadcrumb.
+var enclosingFacts = []string{facts.NodeKind, facts.Subkind, facts.Code}
+
+// EnclosingNode returns the nearest semantic node (one that is neither an
+// anchor nor a file) enclosing the given anchor, found by following childof
+// edges breadth-first from the anchor.  Parents at the same depth are visited
+// in ticket order.  If the anchor has no semantic parent, nil is returned
+// without an error.
+func (g *GraphStoreService) EnclosingNode(ctx context.Context, anchorTicket string) (*EnclosingNode, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.EnclosingNode")
+	ctx = g.withReadCache(ctx)
+	defer span.End()
+	span.SetAttribute("ticket", anchorTicket)
+
+	vname, err := parseTicket(anchorTicket)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := stringset.New(anchorTicket)
+	level := []*spb.VName{vname}
+	for len(level) > 0 {
+		var next []*spb.VName
+		for _, v := range level {
+			targets, _, err := g.getEdges(ctx, v, func(e *spb.Entry) bool {
+				kind, _, _ := edges.ParseOrdinal(e.EdgeKind)
+				return kind == edges.ChildOf
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range targets {
+				if ticket := kytheuri.ToString(t.Target); !seen.Contains(ticket) {
+					seen.Add(ticket)
+					next = append(next, t.Target)
+				}
+			}
+		}
+		sort.Sort(byVName(next))
+
+		for _, v := range next {
+			entries, _, err := g.nodeEntries(ctx, v)
+			if err != nil {
+				return nil, errorf(err, "read error: %v", err)
+			}
+			node := &EnclosingNode{
+				Ticket: kytheuri.ToString(v),
+				Facts:  make(map[string][]byte),
+			}
+			for _, e := range entries {
+				if graphstore.IsNodeFact(e) {
+					node.Facts[e.FactName] = e.FactValue
+				}
+			}
+			switch string(node.Facts[facts.NodeKind]) {
+			case "", nodes.Anchor, nodes.File:
+				continue
+			}
+			for name := range node.Facts {
+				if !isEnclosingFact(name) {
+					delete(node.Facts, name)
+				}
+			}
+			return node, nil
+		}
+		level = next
+	}
+	return nil, nil
+}
+
+func isEnclosingFact(name string) bool {
+	for _, f := range enclosingFacts {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
+
+// A kindMatcher matches edge kinds against the kinds of an EdgesRequest.  The
+// direction of each requested kind is significant: a forward kind only matches
+// outgoing edges and a reverse kind (see edges.Mirror) only matches incoming
+// edges.  An empty kindMatcher matches every edge kind.
+type kindMatcher struct {
+	forward, reverse stringset.Set
+}
+
+func newKindMatcher(kinds []string) *kindMatcher {
+	m := &kindMatcher{}
+	for _, kind := range kinds {
+		if edges.IsReverse(kind) {
+			m.reverse.Add(edges.Canonical(kind))
+		} else {
+			m.forward.Add(kind)
+		}
+	}
+	return m
+}
+
+// matches reports whether the given edge kind, without its ordinal, is
+// allowed by m.
+func (m *kindMatcher) matches(kind string) bool {
+	if m.forward.Empty() && m.reverse.Empty() {
+		return true
+	} else if edges.IsReverse(kind) {
+		return m.reverse.Contains(edges.Canonical(kind))
+	}
+	return m.forward.Contains(kind)
+}
+
+// Edges implements part of the Service interface.  Each requested edge kind
+// only matches edges of the same direction, so requesting edges.Mirror(kind)
+// returns only the incoming edges of that kind.  The edges of each group are
+// ordered by ordinal and then target ticket, so positional edges such as
+// params are returned in order and identical requests over the same
+// GraphStore return identical EdgeSets; the order of the EdgeSets and their
+// groups is left to the reply's map encoding.  Edges stored without an ordinal
+// are returned with NoOrdinal, and so first, rather than being merged with
+// those with an explicit ordinal of 0.
+//
+// Edges are paged in order of the requested tickets, then edge kind, then the
+// order above; if the request has no PageSize, pages hold up to 2048 edges.
+// TotalEdgesByKind always counts every matching edge, not only those in the
+// page.  If MaxEdgesPerKind is set, each edge kind is instead paged separately
+// in the same order and contributes at most MaxEdgesPerKind edges to a page.
+//
+// Without MaxEdgesPerKind, a page token records the last edge returned rather
+// than a count of the edges before it, so the next page resumes just after
+// that edge.  If the GraphStore is written between pages, no edge present
+// throughout is skipped or repeated; an edge added or removed before the
+// token's position is simply not seen.  With MaxEdgesPerKind, the token holds
+// per-kind offsets and gives no such guarantee.
+func (g *GraphStoreService) Edges(ctx context.Context, req *gpb.EdgesRequest) (*gpb.EdgesReply, error) {
+	return g.edges(ctx, req, &edgesOptions{})
+}
+
+// EdgesOptions are the optional parameters of EdgesWithOptions.  The zero
+// EdgesOptions is equivalent to calling Edges.
+type EdgesOptions struct {
+	// If TargetKinds is non-empty, the reply's Nodes only include the target
+	// nodes with one of the given node kinds.  The edge sets still include
+	// every matching edge and the requested nodes themselves are unaffected.
+	TargetKinds []string
+
+	// If ExcludeAnchorEdges is true, anchor edges (see edges.IsAnchorEdge), in
+	// either direction, are excluded from the reply as if they were not
+	// requested.  This leaves only the semantic edges between nodes, as is
+	// useful for exploring the graph.
+	ExcludeAnchorEdges bool
+
+	// If Ordinals is non-empty, only edges with one of the given ordinals are
+	// returned, e.g. only the third parameter of each requested node with
+	// Ordinals []int{2} when the request's Kind is edges.Param.  Edges stored
+	// without an ordinal match NoOrdinal, not 0.
+	Ordinals []int
+
+	// If RawKinds is true, the stored kind of each edge in the page is
+	// returned.
+	RawKinds bool
+}
+
+// EdgesResults are the additional results of EdgesWithOptions.  Each field is
+// only populated if requested by the call's EdgesOptions.
+type EdgesResults struct {
+	// RawKinds holds the stored kind of each edge in the page, in the order of
+	// the reply's edges.  Edges are grouped by their kinds without any ordinal
+	// suffix, so the raw kinds preserve the suffix exactly as written.
+	RawKinds []*RawKind
+}
+
+// EdgesWithOptions is equivalent to Edges except that it is further
+// parameterized by opts and also returns the additional results requested by
+// opts.
+func (g *GraphStoreService) EdgesWithOptions(ctx context.Context, req *gpb.EdgesRequest, opts *EdgesOptions) (*gpb.EdgesReply, *EdgesResults, error) {
+	eopts := &edgesOptions{
+		targetKinds:        stringset.New(opts.TargetKinds...),
+		excludeAnchorEdges: opts.ExcludeAnchorEdges,
+		withRawKinds:       opts.RawKinds,
+	}
+	if len(opts.Ordinals) > 0 {
+		eopts.ordinals = make(map[int]bool)
+		for _, o := range opts.Ordinals {
+			eopts.ordinals[o] = true
+		}
+	}
+	reply, err := g.edges(ctx, req, eopts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply, &EdgesResults{RawKinds: eopts.rawKinds}, nil
+}
+
+// A RawKind is the kind of an edge exactly as it is stored in the GraphStore,
+// alongside the kind reported for it in a reply.
+type RawKind struct {
+	// Source is the ticket of the edge's source node.
+	Source string
+
+	// Target is the ticket of the edge's target node.
+	Target string
+
+	// Kind is the edge's kind as reported in the reply.
+	Kind string
+
+	// Raw is the edge's stored kind, including its direction and any ordinal
+	// suffix (e.g. "%/kythe/edge/ref/call.1").
+	Raw string
+}
+
+// edgesOptions holds the optional parameters of a single Edges call.
+type edgesOptions struct {
+	// If non-empty, only target nodes of these kinds are added to the reply.
+	targetKinds stringset.Set
+
+	// If excludeAnchorEdges is true, anchor edges are skipped.
+	excludeAnchorEdges bool
+
+	// If non-nil, only edges with these ordinals are kept.
+	ordinals map[int]bool
+
+	// If withRawKinds is true, rawKinds is populated with the stored kind of
+	// each edge in the page.
+	withRawKinds bool
+	rawKinds     []*RawKind
+
+	// If byEdgeKey is true, the page is ordered and its token is encoded by
+	// edgeKey regardless of g.MaxEdgesPerKind.
+	byEdgeKey bool
+}
+
+// matches reports whether an edge with the given kind and ordinal is allowed
+// by opts.
+func (opts *edgesOptions) matches(kind string, ordinal int) bool {
+	if opts.excludeAnchorEdges && edges.IsAnchorEdge(kind) {
+		return false
+	}
+	return opts.ordinals == nil || opts.ordinals[ordinal]
+}
+
+func (g *GraphStoreService) edges(ctx context.Context, req *gpb.EdgesRequest, opts *edgesOptions) (*gpb.EdgesReply, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.Edges")
+	ctx = g.withReadCache(ctx)
+	defer span.End()
+	span.SetAttribute("tickets", len(req.Ticket))
+	span.SetAttribute("kinds", req.Kind)
+
+	if len(req.Ticket) == 0 {
+		return nil, ErrNoTickets
+	} else if req.PageSize < 0 {
+		return nil, errorf(ErrInvalidArgument, "%v: invalid page_size %d", ErrInvalidArgument, req.PageSize)
+	}
+
+	pageSize := int(req.PageSize)
+	if pageSize == 0 {
+		pageSize = defaultEdgesPageSize
+	}
+	maxPerKind := g.MaxEdgesPerKind
+	if opts.byEdgeKey {
+		maxPerKind = 0
+	}
+	var (
+		after       *edgeKey
+		kindOffsets map[string]int
+	)
+	if req.PageToken != "" {
+		t, err := decodePageToken(req.PageToken)
+		if err != nil {
+			return nil, err
+		}
+		if maxPerKind > 0 {
+			kindOffsets, err = decodeKindOffsets(t.SecondaryToken)
+		} else {
+			after, err = decodeEdgeKey(t)
+		}
+		if err != nil {
+			return nil, errorf(ErrInvalidPageToken, "%v: %q", ErrInvalidPageToken, req.PageToken)
+		}
+	}
+	// Edges are ordered across all requested tickets; up to pageSize of those
+	// after the token's edgeKey are returned.  With MaxEdgesPerKind, the edges
+	// of each kind are numbered separately and are returned from their kind's
+	// offset until either the kind or the page is full.
+	var (
+		pageEdges     int
+		last          edgeKey
+		more          bool
+		kindEdges     = make(map[string]int)
+		kindPageEdges = make(map[string]int)
+	)
+	inPage := func(key edgeKey) bool {
+		if maxPerKind <= 0 {
+			if after != nil && !after.less(key) {
+				return false
+			} else if pageEdges >= pageSize {
+				more = true
+				return false
+			}
+			pageEdges++
+			last = key
+			return true
+		}
+		kind := key.kind
+		i := kindEdges[kind]
+		kindEdges[kind]++
+		if i < kindOffsets[kind] || pageEdges >= pageSize || kindPageEdges[kind] >= maxPerKind {
+			return false
+		}
+		pageEdges++
+		kindPageEdges[kind]++
+		return true
+	}
+
+	filter := g.factFilter(req.Filter)
+	allowedKinds := newKindMatcher(req.Kind)
+	var targetSet stringset.Set
+	reply := &gpb.EdgesReply{
+		EdgeSets:         make(map[string]*gpb.EdgeSet),
+		Nodes:            make(map[string]*cpb.NodeInfo),
+		TotalEdgesByKind: make(map[string]int64),
+	}
+
+	for ticketIdx, ticket := range req.Ticket {
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			// EdgeKind -> TargetTicket -> Ordinal -> RawKind
+			filteredEdges = make(map[string]map[string]map[int32]string)
+			filteredFacts = make(map[string][]byte)
+		)
+
+		truncated, err := g.read(ctx, &spb.ReadRequest{
+			Source:   vname,
+			EdgeKind: "*",
+		}, func(entry *spb.Entry) error {
+			edgeKind := entry.EdgeKind
+			if edgeKind == "" {
+				// node fact
+				if filter.Matches(entry.FactName) {
+					filteredFacts[entry.FactName] = entry.FactValue
+				}
+			} else {
+				// edge
+				edgeKind, ordinal, hasOrdinal := edges.ParseOrdinal(edgeKind)
+				if !hasOrdinal {
+					ordinal = int(NoOrdinal)
+				}
+				if allowedKinds.matches(edgeKind) && opts.matches(edgeKind, ordinal) {
+					targets, ok := filteredEdges[edgeKind]
+					if !ok {
+						targets = make(map[string]map[int32]string)
+						filteredEdges[edgeKind] = targets
+					}
+					ticket := kytheuri.ToString(entry.Target)
+					ordSet, ok := targets[ticket]
+					if !ok {
+						ordSet = make(map[int32]string)
+						targets[ticket] = ordSet
+					}
+					if _, ok := ordSet[int32(ordinal)]; !ok {
+						ordSet[int32(ordinal)] = entry.EdgeKind
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errorf(err, "failed to retrieve entries for ticket %q: %v", ticket, err)
+		}
+
+		var kinds []string
+		for edgeKind := range filteredEdges {
+			kinds = append(kinds, edgeKind)
+		}
+		sort.Strings(kinds)
+
+		groups := make(map[string]*gpb.EdgeSet_Group)
+		for _, edgeKind := range kinds {
+			var es []*gpb.EdgeSet_Group_Edge
+			for target, ordinals := range filteredEdges[edgeKind] {
+				for ordinal := range ordinals {
+					es = append(es, &gpb.EdgeSet_Group_Edge{
+						TargetTicket: target,
+						Ordinal:      ordinal,
+					})
+				}
+			}
+			reply.TotalEdgesByKind[edgeKind] += int64(len(es))
+
+			g := &gpb.EdgeSet_Group{}
+			for _, e := range sortedEdges(es) {
+				if inPage(edgeKey{ticketIdx, edgeKind, e.Ordinal, e.TargetTicket}) {
+					g.Edge = append(g.Edge, e)
+					targetSet.Add(e.TargetTicket)
+					if opts.withRawKinds {
+						opts.rawKinds = append(opts.rawKinds, &RawKind{
+							Source: ticket,
+							Target: e.TargetTicket,
+							Kind:   edgeKind,
+							Raw:    filteredEdges[edgeKind][e.TargetTicket][e.Ordinal],
+						})
+					}
+				}
+			}
+			if len(g.Edge) > 0 {
+				groups[edgeKind] = g
+			}
+		}
+
+		// Only add a EdgeSet if there are targets for the requested edge kinds
+		// within the page.
+		if len(groups) > 0 {
+			reply.EdgeSets[ticket] = &gpb.EdgeSet{
+				Groups: groups,
+			}
+
+			// In addition, only add a NodeInfo if the filters have resulting facts.
+			if len(filteredFacts) > 0 {
+				reply.Nodes[ticket] = &cpb.NodeInfo{
+					Facts: filteredFacts,
+				}
+			}
+		}
+		if truncated {
+			addFact(reply.Nodes, ticket, TruncatedFact, []byte("true"))
+		}
+	}
+
+	// Only request Nodes when there are fact filters given.
+	if len(req.Filter) > 0 {
+		// Eliminate redundant work by removing already requested nodes from targetSet
+		for ticket := range reply.Nodes {
+			targetSet.Discard(ticket)
+		}
+
+		// The node kind of each target is needed to filter targets by kind.
+		nodesFilter := req.Filter
+		if !opts.targetKinds.Empty() {
+			nodesFilter = append([]string{facts.NodeKind}, req.Filter...)
+		}
+
+		// Batch request all leftover target nodes
+		nodesReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: targetSet.Elements(),
+			Filter: nodesFilter,
+		})
+		if err != nil {
+			return nil, errorf(err, "failure getting target nodes: %v", err)
+		}
+		for ticket, node := range nodesReply.Nodes {
+			if !opts.targetKinds.Empty() {
+				if !opts.targetKinds.Contains(string(node.Facts[facts.NodeKind])) {
+					continue
+				} else if !filter.Matches(facts.NodeKind) {
+					delete(node.Facts, facts.NodeKind)
+					if len(node.Facts) == 0 {
+						continue
+					}
+				}
+			}
+			reply.Nodes[ticket] = node
+		}
+	}
+
+	if more {
+		token, err := encodePageToken(last.pageToken())
+		if err != nil {
+			return nil, err
+		}
+		reply.NextPageToken = token
+	} else if maxPerKind > 0 {
+		var more bool
+		next := make(map[string]int)
+		for kind, n := range kindEdges {
+			next[kind] = kindOffsets[kind] + kindPageEdges[kind]
+			if next[kind] < n {
+				more = true
+			}
+		}
+		if more {
+			token, err := encodePageToken(&ipb.PageToken{SecondaryToken: encodeKindOffsets(next)})
+			if err != nil {
+				return nil, err
+			}
+			reply.NextPageToken = token
+		}
+	}
+
+	return reply, nil
+}
+
+// An edgeKey is the position of an edge in the paging order of Edges: the
+// index of its source among the requested tickets, then its kind, ordinal,
+// and target ticket.
+type edgeKey struct {
+	ticket  int
+	kind    string
+	ordinal int32
+	target  string
+}
+
+// less reports whether k is ordered before o.
+func (k edgeKey) less(o edgeKey) bool {
+	switch {
+	case k.ticket != o.ticket:
+		return k.ticket < o.ticket
+	case k.kind != o.kind:
+		return k.kind < o.kind
+	case k.ordinal != o.ordinal:
+		return k.ordinal < o.ordinal
+	default:
+		return k.target < o.target
+	}
+}
+
+type byEdgeKey []edgeKey
+
+// Len implements part of the sort.Interface.
+func (s byEdgeKey) Len() int { return len(s) }
+
+// Swap implements part of the sort.Interface.
+func (s byEdgeKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less implements part of the sort.Interface.
+func (s byEdgeKey) Less(i, j int) bool { return s[i].less(s[j]) }
+
+// pageToken returns the Edges page token resuming after k.  The ticket index
+// is held in the token's Index and the rest of k in its secondary token.
+func (k edgeKey) pageToken() *ipb.PageToken {
+	v := make(url.Values)
+	v.Set("kind", k.kind)
+	v.Set("ordinal", strconv.Itoa(int(k.ordinal)))
+	v.Set("target", k.target)
+	return &ipb.PageToken{Index: int32(k.ticket), SecondaryToken: v.Encode()}
+}
+
+// decodeEdgeKey decodes the edgeKey of an Edges page token.
+func decodeEdgeKey(t *ipb.PageToken) (*edgeKey, error) {
+	v, err := url.ParseQuery(t.SecondaryToken)
+	if err != nil {
+		return nil, err
+	}
+	kind, target := v.Get("kind"), v.Get("target")
+	if kind == "" || target == "" {
+		return nil, errors.New("missing edge key")
+	}
+	ordinal, err := strconv.Atoi(v.Get("ordinal"))
+	if err != nil {
+		return nil, err
+	}
+	return &edgeKey{int(t.Index), kind, int32(ordinal), target}, nil
+}
+
+// encodeKindOffsets encodes the offset of each edge kind for the secondary
+// token of an Edges page token.  Kinds with a zero offset are omitted.
+func encodeKindOffsets(offsets map[string]int) string {
+	v := make(url.Values)
+	for kind, offset := range offsets {
+		if offset > 0 {
+			v.Set(kind, strconv.Itoa(offset))
+		}
+	}
+	return v.Encode()
+}
+
+// decodeKindOffsets decodes the per-kind offsets encoded by encodeKindOffsets.
+func decodeKindOffsets(token string) (map[string]int, error) {
+	v, err := url.ParseQuery(token)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]int, len(v))
+	for kind := range v {
+		offset, err := strconv.Atoi(v.Get(kind))
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset for edge kind %q", kind)
+		}
+		offsets[kind] = offset
+	}
+	return offsets, nil
+}
+
+// Decorations implements part of the Service interface.  The references of a
+// file without text are still returned unless req.SourceText is set, as are
+// those of a file exceeding MaxFileBytes, whose text is never returned.  Their
+// points are fully populated if the file has a facts.LineIndex fact and
+// otherwise only have byte offsets.
+func (g *GraphStoreService) Decorations(ctx context.Context, req *xpb.DecorationsRequest) (*xpb.DecorationsReply, error) {
+	return g.decorations(ctx, req, &decorOptions{})
+}
+
+// DecorationsOptions are the optional parameters of DecorationsWithOptions.
+// The zero DecorationsOptions is equivalent to calling Decorations.
+type DecorationsOptions struct {
+	// If LineSpan is true, the request's SPAN location is given by the line
+	// numbers of its start and end points alone (see
+	// xrefs.Normalizer.LineSpan).  The span covers the whole of each line from
+	// the start line through the end line.  Lines past the end of the file are
+	// clamped to its bounds.
+	LineSpan bool
+
+	// If OverlapSpan is true, a SPAN location selects every anchor and file
+	// diagnostic overlapping the span, rather than those within or around it
+	// as given by the request's SpanKind.  The overlap is inclusive (see
+	// xrefs.SpansOverlap), so anchors partially within the span, or merely
+	// touching either of its boundaries, are returned.
+	OverlapSpan bool
+
+	// If Kinds is non-empty, only anchor edges of the given kinds, matched as
+	// by EdgesRequest.Kind, are returned as references.  Anchors without any
+	// such edge are omitted from the reply altogether.
+	Kinds []string
+
+	// If Columns is true, the column offsets of each reference's anchor are
+	// returned measured in ColumnEncoding.  The anchor points of each
+	// reference are still populated with byte offsets.  Columns cannot be
+	// measured for a file exceeding MaxFileBytes, so its references are then
+	// omitted.
+	Columns        bool
+	ColumnEncoding ColumnEncoding
+
+	// If Labels is true, the edges.Label of each reference kind in the reply
+	// is returned.
+	Labels bool
+
+	// If Diagnostics is true, each anchor skipped due to an error (e.g. a
+	// failed node lookup or invalid offsets) is reported as a Diagnostic
+	// rather than only being logged.  Only a failure to read the file itself
+	// fails the request.
+	Diagnostics bool
+
+	// If FileDiagnostics is true, each diagnostic node that is a child of the
+	// requested file is returned.  If the request's location is a SPAN, only
+	// diagnostics within the span (according to the request's SpanKind) or
+	// without a span of their own are returned.  Diagnostic nodes missing a
+	// message or with invalid span facts are skipped.
+	FileDiagnostics bool
+
+	// If Scopes is true, the Scopes of each reference's anchor are returned.
+	Scopes bool
+
+	// If Language is true, the source language of the requested file is
+	// returned.
+	Language bool
+}
+
+// DecorationsResults are the additional results of DecorationsWithOptions.
+// Each field is only populated if requested by the call's DecorationsOptions.
+type DecorationsResults struct {
+	// Columns holds the column offsets of each reference's anchor.  The i-th
+	// Columns corresponds to reply.Reference[i].
+	Columns []*Columns
+
+	// Labels maps each reference kind in the reply to its edges.Label.
+	Labels map[string]string
+
+	// Diagnostics holds a Diagnostic for each skipped anchor.
+	Diagnostics []*Diagnostic
+
+	// FileDiagnostics holds the diagnostic nodes of the requested file.
+	FileDiagnostics []*FileDiagnostic
+
+	// Scopes maps the ticket of each reference's anchor to its Scopes, ordered
+	// by byScopeOrder.  An indexer nesting an anchor in several scopes numbers
+	// its childof edges, so the ordinals allow clients to reconstruct the
+	// nesting, e.g. to render scope boundaries.  Anchors with only their file
+	// as a parent are absent.
+	Scopes map[string][]*Scope
+
+	// Language is the value of the requested file's facts.Language fact or,
+	// failing that, the Language of its ticket.  If neither is set, it is
+	// empty.
+	Language string
+}
+
+// DecorationsWithOptions is equivalent to Decorations except that it is
+// further parameterized by opts and also returns the additional results
+// requested by opts.
+func (g *GraphStoreService) DecorationsWithOptions(ctx context.Context, req *xpb.DecorationsRequest, opts *DecorationsOptions) (*xpb.DecorationsReply, *DecorationsResults, error) {
+	ctx = g.withReadCache(ctx)
+	dopts := &decorOptions{
+		lineSpan:      opts.LineSpan,
+		overlapSpan:   opts.OverlapSpan,
+		withColumns:   opts.Columns,
+		columns:       opts.ColumnEncoding,
+		withFileDiags: opts.FileDiagnostics,
+	}
+	if len(opts.Kinds) > 0 {
+		dopts.kinds = newKindMatcher(opts.Kinds)
+	}
+	if opts.Diagnostics {
+		dopts.diags = &diagnostics{}
+	}
+	if opts.Scopes {
+		dopts.withScopes = true
+		dopts.scopes = make(map[string][]*Scope)
+	}
+	reply, err := g.decorations(ctx, req, dopts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &DecorationsResults{
+		Columns:         dopts.refColumns,
+		FileDiagnostics: dopts.fileDiags,
+		Scopes:          dopts.scopes,
+	}
+	if opts.Diagnostics {
+		res.Diagnostics = dopts.diags.list
+	}
+	if opts.Labels {
+		res.Labels = make(map[string]string)
+		for _, ref := range reply.Reference {
+			res.Labels[ref.Kind] = edges.Label(ref.Kind)
+		}
+	}
+	if opts.Language {
+		if res.Language, err = g.fileLanguage(ctx, req.Location.Ticket); err != nil {
+			return nil, nil, err
+		}
+	}
+	return reply, res, nil
+}
+
+// targetDefinitions returns the binding definition anchor of each of the given
+// tickets that has exactly one, keyed by ticket.  Tickets with no definition,
+// or with several, are omitted.
+func (g *GraphStoreService) targetDefinitions(ctx context.Context, tickets []string) (map[string]*xpb.Anchor, error) {
+	req := &xpb.CrossReferencesRequest{
+		Ticket:         tickets,
+		DefinitionKind: xpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+	}
+	anchors := make(map[string][]*xpb.Anchor)
+	for {
+		reply, err := g.CrossReferences(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		for ticket, xr := range reply.CrossReferences {
+			for _, def := range xr.Definition {
+				anchors[ticket] = append(anchors[ticket], def.Anchor)
+			}
+		}
+		if reply.NextPageToken == "" {
+			break
+		}
+		req.PageToken = reply.NextPageToken
+	}
+
+	defs := make(map[string]*xpb.Anchor)
+	for ticket, as := range anchors {
+		if len(as) == 1 {
+			defs[ticket] = as[0]
+		}
+	}
+	return defs, nil
+}
+
+// A ColumnEncoding is the unit in which column offsets are measured.
+type ColumnEncoding int
+
+// Supported ColumnEncodings.
+const (
+	// ByteColumns measures columns in bytes, as in Location_Point.ColumnOffset.
+	ByteColumns ColumnEncoding = iota
+
+	// UTF16Columns measures columns in UTF-16 code units, as is common for
+	// editors.
+	UTF16Columns
+)
+
+// Columns are the start and end column offsets of an anchor.
+type Columns struct{ Start, End int32 }
+
+// A DecorationsResult is the outcome of a single request of DecorationsBatch.
+// Exactly one of Reply and Err is set.
+type DecorationsResult struct {
+	Reply *xpb.DecorationsReply
+	Err   error
+}
+
+// DecorationsBatch calls Decorations for each of the given requests, returning
+// their results in order.  A failed request is reported by its result's Err
+// and does not affect the others.  Whether or not g.CacheReads is set, reads
+// are cached across the entire batch, so files and nodes shared by several
+// requests are only read once, and the reference target nodes of all requests
+// with the same Filter are fetched in a single Nodes call.  An error is
+// returned only if ctx is done before every request is processed.
+func (g *GraphStoreService) DecorationsBatch(ctx context.Context, reqs []*xpb.DecorationsRequest) ([]*DecorationsResult, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.DecorationsBatch")
+	ctx = newReadCache(ctx)
+	defer span.End()
+	span.SetAttribute("requests", len(reqs))
+
+	results := make([]*DecorationsResult, len(reqs))
+	opts := make([]*decorOptions, len(reqs))
+	byFilter := make(map[string][]int) // filter key -> indices of reqs
+	for i, req := range reqs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		opts[i] = &decorOptions{deferTargets: true}
+		reply, err := g.decorations(ctx, req, opts[i])
+		if err != nil {
+			results[i] = &DecorationsResult{Err: err}
+			continue
+		}
+		results[i] = &DecorationsResult{Reply: reply}
+		if !opts[i].targets.Empty() {
+			key := fmt.Sprintf("%q", req.Filter)
+			byFilter[key] = append(byFilter[key], i)
+		}
+	}
+
+	for _, idxs := range byFilter {
+		var tickets stringset.Set
+		for _, i := range idxs {
+			tickets.Add(opts[i].targets.Elements()...)
+		}
+		nodesReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: tickets.Elements(),
+			Filter: reqs[idxs[0]].Filter,
+		})
+		for _, i := range idxs {
+			if err != nil {
+				results[i] = &DecorationsResult{Err: errorf(err, "failure getting reference target nodes: %v", err)}
+				continue
+			}
+			for _, ticket := range opts[i].targets.Elements() {
+				if node, ok := nodesReply.Nodes[ticket]; ok {
+					results[i].Reply.Nodes[ticket] = node
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+// A FileDiagnostic is a diagnostic node stored (e.g. by an indexer) as a child
+// of a file.
+type FileDiagnostic struct {
+	// Ticket is the ticket of the diagnostic node.
+	Ticket string
+
+	// Message is the value of the node's facts.Message fact.
+	Message string
+
+	// Severity is the value of the node's facts.Severity fact, if any.
+	Severity string
+
+	// Start and End are the bounds of the diagnostic's span within the file.
+	// They are nil if the diagnostic applies to the entire file.
+	Start, End *xpb.Location_Point
+}
+
+// A Scope is an enclosing scope of a reference's anchor: a target of one of
+// the anchor's childof edges other than its file.
+type Scope struct {
+	// Ticket is the ticket of the scope node.
+	Ticket string
+
+	// Ordinal is the ordinal of the childof edge.  It is only meaningful if
+	// HasOrdinal is true.
+	Ordinal int
+
+	// HasOrdinal reports whether the childof edge had an ordinal.
+	HasOrdinal bool
+}
+
+// byScopeOrder orders Scopes by ordinal, with Scopes missing an ordinal last,
+// and then by ticket.
+type byScopeOrder []*Scope
+
+// Len implements part of the sort.Interface.
+func (s byScopeOrder) Len() int { return len(s) }
+
+// Swap implements part of the sort.Interface.
+func (s byScopeOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less implements part of the sort.Interface.
+func (s byScopeOrder) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	switch {
+	case a.HasOrdinal != b.HasOrdinal:
+		return a.HasOrdinal
+	case a.Ordinal != b.Ordinal:
+		return a.Ordinal < b.Ordinal
+	}
+	return a.Ticket < b.Ticket
+}
+
+// fileLanguage returns the language of the given file as described by
+// DecorationsResults.Language.
+func (g *GraphStoreService) fileLanguage(ctx context.Context, fileTicket string) (string, error) {
+	vname, err := parseTicket(fileTicket)
+	if err != nil {
+		return "", err
+	}
+	reply, err := g.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: []string{fileTicket},
+		Filter: []string{facts.Language},
+	})
+	if err != nil {
+		return "", errorf(err, "fetching language of %q: %v", fileTicket, err)
+	}
+	if lang := reply.Nodes[fileTicket].GetFacts()[facts.Language]; len(lang) > 0 {
+		return string(lang), nil
+	}
+	return vname.Language, nil
+}
+
+// DecorationsCountOnly estimates the number of anchors that Decorations would
+// resolve for the request's file without resolving any of them.  Only the
+// file's incoming childof edges are read: neither its text nor its anchors are
+// fetched, so the estimate also counts any children that are not anchors (e.g.
+// diagnostic nodes) and a SPAN location is treated as the entire file.  This
+// allows a client to decide whether a large file is worth decorating in full.
+func (g *GraphStoreService) DecorationsCountOnly(ctx context.Context, req *xpb.DecorationsRequest) (int, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.DecorationsCountOnly")
+	defer span.End()
+
+	if len(req.DirtyBuffer) > 0 {
+		return 0, errorf(ErrUnimplemented, "%v: dirty buffers", ErrUnimplemented)
+	} else if req.GetLocation() == nil {
+		return 0, errorf(ErrInvalidArgument, "%v: missing location", ErrInvalidArgument)
+	}
+	span.SetAttribute("location", req.Location.Ticket)
+
+	fileVName, err := parseTicket(req.Location.Ticket)
+	if err != nil {
+		return 0, err
+	}
+	// Unlike the reads of the other methods, this one is not subject to
+	// MaxEntriesPerNode: the edges are only counted, never held in memory, and
+	// a truncated count would understate the size of exactly the files the
+	// estimate is meant to flag.
+	var count int
+	if err := g.store().Read(ctx, &spb.ReadRequest{
+		Source:   fileVName,
+		EdgeKind: revChildOfEdgeKind,
+	}, func(entry *spb.Entry) error {
+		if entry.EdgeKind == revChildOfEdgeKind {
+			count++
+		}
+		return nil
+	}); err != nil {
+		return 0, errorf(err, "failed to count file children: %v", err)
+	}
+	return count, nil
+}
+
+// EntriesForFile passes to f, in order, the fact entries of the file with the
+// given ticket followed by, for each of the file's anchors, the anchor's fact
+// entries and its forward edge entries (including its childof edge).  The
+// anchors are ordered by ticket and each anchor's entries are ordered as by
+// NodeEntries.  The file's and each anchor's entries are subject to
+// MaxEntriesPerNode; the entries of a node whose read was truncated are
+// followed by a TruncatedFact entry for the node, and a truncated file may be
+// missing some of its anchors.  Children of the file that are not anchors are
+// skipped.  Only a single
+// anchor's entries are held in memory at once, so whole files may be exported
+// without assembling their Decorations.  If f returns io.EOF, no further
+// entries are passed and nil is returned.
+func (g *GraphStoreService) EntriesForFile(ctx context.Context, fileTicket string, f graphstore.EntryFunc) error {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.EntriesForFile")
+	defer span.End()
+	span.SetAttribute("location", fileTicket)
+
+	fileVName, err := parseTicket(fileTicket)
+	if err != nil {
+		return err
+	}
+
+	var (
+		children []*spb.VName
+		stopped  bool
+	)
+	truncated, err := g.read(ctx, &spb.ReadRequest{
+		Source:   fileVName,
+		EdgeKind: "*",
+	}, func(entry *spb.Entry) error {
+		if entry.EdgeKind == revChildOfEdgeKind {
+			children = append(children, entry.Target)
+		} else if !graphstore.IsEdge(entry) {
+			err := f(entry)
+			stopped = err == io.EOF
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return errorf(err, "failed to read file %q: %v", fileTicket, err)
+	} else if stopped {
+		return nil
+	} else if truncated {
+		if err := f(truncatedEntry(fileVName)); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	sort.Sort(byVName(children))
+
+	for _, child := range children {
+		entries, truncated, err := g.nodeEntries(ctx, child)
+		if err != nil {
+			return errorf(err, "failed to read anchor %q: %v", kytheuri.ToString(child), err)
+		}
+		if !isAnchor(entries) {
+			continue
+		}
+		if truncated {
+			entries = append(entries, truncatedEntry(child))
+		}
+		for _, entry := range entries {
+			if graphstore.IsEdge(entry) && !edges.IsForward(entry.EdgeKind) {
+				continue
+			}
+			if err := f(entry); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// truncatedEntry returns a TruncatedFact entry for the given node.
+func truncatedEntry(node *spb.VName) *spb.Entry {
+	return &spb.Entry{Source: node, FactName: TruncatedFact, FactValue: []byte("true")}
+}
+
+// isAnchor reports whether the given entries of a node include a
+// facts.NodeKind fact of nodes.Anchor.
+func isAnchor(entries []*spb.Entry) bool {
+	for _, entry := range entries {
+		if entry.FactName == facts.NodeKind && !graphstore.IsEdge(entry) {
+			return string(entry.FactValue) == nodes.Anchor
+		}
+	}
+	return false
+}
+
+// byVName orders VNames by their tickets.
+type byVName []*spb.VName
+
+func (s byVName) Len() int           { return len(s) }
+func (s byVName) Less(i, j int) bool { return kytheuri.ToString(s[i]) < kytheuri.ToString(s[j]) }
+func (s byVName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// decorOptions holds the optional parameters and results of a single
+// Decorations call.
+type decorOptions struct {
+	// If lineSpan is true, the request's location is a line span.
+	lineSpan bool
+
+	// If overlapSpan is true, a SPAN location matches the anchors overlapping
+	// it regardless of the request's SpanKind.
+	overlapSpan bool
+
+	// If withColumns is true, refColumns is populated using the given
+	// ColumnEncoding.
+	withColumns bool
+	columns     ColumnEncoding
+
+	// refColumns is populated with the Columns of each reply Reference.
+	refColumns []*Columns
+
+	// diags collects each anchor skipped due to a failure.  If nil, they are
+	// only logged to g's Logger.
+	diags *diagnostics
+
+	// If withFileDiags is true, fileDiags is populated with the file's
+	// diagnostic nodes.
+	withFileDiags bool
+	fileDiags     []*FileDiagnostic
+
+	// If non-nil, only anchor edges of these kinds become references.
+	kinds *kindMatcher
+
+	// If withScopes is true, scopes is populated with the Scopes of each
+	// reference's anchor.
+	withScopes bool
+	scopes     map[string][]*Scope
+
+	// If deferTargets is true, the reference target nodes not already in the
+	// reply are left in targets rather than fetched.
+	deferTargets bool
+	targets      stringset.Set
+}
+
+// inSpan reports whether [start,end) is selected by the given SPAN location,
+// according to spanKind or, if opts.overlapSpan, xrefs.SpansOverlap.
+func (opts *decorOptions) inSpan(spanKind xpb.DecorationsRequest_SpanKind, start, end int32, loc *xpb.Location) bool {
+	if opts.overlapSpan {
+		return xrefs.SpansOverlap(start, end, loc.Start.ByteOffset, loc.End.ByteOffset)
+	}
+	return xrefs.InSpanBounds(spanKind, start, end, loc.Start.ByteOffset, loc.End.ByteOffset)
+}
+
+func (g *GraphStoreService) decorations(ctx context.Context, req *xpb.DecorationsRequest, opts *decorOptions) (*xpb.DecorationsReply, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.Decorations")
+	ctx = g.withReadCache(ctx)
+	defer span.End()
+
+	if len(req.DirtyBuffer) > 0 {
+		return nil, errorf(ErrUnimplemented, "%v: dirty buffers", ErrUnimplemented)
+	} else if req.GetLocation() == nil {
+		// TODO(schroederc): allow empty location when given dirty buffer
+		return nil, errorf(ErrInvalidArgument, "%v: missing location", ErrInvalidArgument)
+	}
+	span.SetAttribute("location", req.Location.Ticket)
+	if opts.diags == nil {
+		opts.diags = g.logDiagnostics()
+	}
+
+	fileVName, src, encoding, err := g.fileText(ctx, req.Location.Ticket)
+
+	// A file too large to load still has its references returned, though
+	// never its text, as does an existing file without text, such as a
+	// generated file whose text was not indexed, unless its text was
+	// requested.  They are located by the file's facts.LineIndex fact, if
+	// any, or else only by byte offset.
+	var (
+		norm        *xrefs.Normalizer
+		offsetsOnly bool
+	)
+	tooLarge, _ := Cause(err).(*FileTooLargeError)
+	noText, _ := err.(*noTextError)
+	if tooLarge != nil && opts.withColumns {
+		// Columns cannot be measured without the file's text, so only the
+		// requested location and the file's size are returned.
+		reply := &xpb.DecorationsReply{
+			Location: req.Location,
+			Nodes:    make(map[string]*cpb.NodeInfo),
+		}
+		addTooLargeFact(reply.Nodes, req.Location.Ticket, tooLarge)
+		return reply, nil
+	} else if tooLarge != nil || (noText != nil && noText.exists && !req.SourceText && !opts.withColumns) {
+		if norm, err = g.lineIndexNormalizer(ctx, req.Location.Ticket); err != nil {
+			return nil, err
+		} else if norm == nil && opts.lineSpan {
+			return nil, errorf(ErrInvalidArgument, "%v: file %q has neither text nor a line index", ErrInvalidArgument, req.Location.Ticket)
+		} else if norm == nil {
+			norm, offsetsOnly = offsetNormalizer, true
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		norm = xrefs.NewNormalizer(src)
+	}
+
+	var loc *xpb.Location
+	if opts.lineSpan {
+		loc, err = norm.LineSpan(req.GetLocation())
+	} else {
+		loc, err = norm.Location(req.GetLocation())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if offsetsOnly && loc.Kind == xpb.Location_SPAN {
+		loc.Start, loc.End = offsetPoint(loc.Start), offsetPoint(loc.End)
+	}
+
+	reply := &xpb.DecorationsReply{
+		Location: loc,
+		Nodes:    make(map[string]*cpb.NodeInfo),
+	}
+	if tooLarge != nil {
+		addTooLargeFact(reply.Nodes, req.Location.Ticket, tooLarge)
+	}
+
+	// Handle DecorationsRequest.SourceText switch
+	if req.SourceText && tooLarge == nil {
+		if loc.Kind == xpb.Location_FILE {
+			reply.SourceText = src
+			reply.Encoding = encoding
+		} else if isUTF8(encoding) {
+			reply.SourceText = src[loc.Start.ByteOffset:loc.End.ByteOffset]
+			reply.Encoding = encoding
+		} else {
+			// A span of a file in another encoding may split a multi-byte
+			// character, so it is decoded and returned as UTF-8 instead.
+			decoded, err := text.ToUTF8(encoding, src[loc.Start.ByteOffset:loc.End.ByteOffset])
+			if err != nil {
+				return nil, errorf(err, "failed to decode source text: %v", err)
+			}
+			reply.SourceText = []byte(decoded)
+			reply.Encoding = facts.DefaultTextEncoding
+		}
+	}
+
+	// Handle DecorationsRequest.References switch (also needed to find the
+	// file's diagnostic nodes)
+	if req.References || opts.withFileDiags {
+		// Traverse the following chain of edges:
+		//   file --%/kythe/edge/childof-> []anchor --forwardEdgeKind-> []target
+		//
+		// Add []anchor and []target nodes to reply.Nodes
+		// Add all {anchor, forwardEdgeKind, target} tuples to reply.Reference
+
+		filter := g.factFilter(req.Filter)
+
+		children, truncated, err := g.getEdges(ctx, fileVName, func(e *spb.Entry) bool {
+			kind, _, _ := edges.ParseOrdinal(e.EdgeKind)
+			return kind == revChildOfEdgeKind
+		})
+		if err != nil {
+			return nil, errorf(err, "failed to retrieve file children: %v", err)
+		} else if truncated {
+			addFact(reply.Nodes, req.Location.Ticket, TruncatedFact, []byte("true"))
+		}
+
+		anchorNodes, failed := g.anchorNodes(ctx, children, opts.diags)
+
+		var targetSet stringset.Set
+		for _, edge := range children {
+			anchor := edge.Target
+			ticket := kytheuri.ToString(anchor)
+			if failed.Contains(ticket) {
+				continue
+			}
+			info, ok := anchorNodes[ticket]
+			if !ok {
+				opts.diags.addf(ticket, "Failed to find info for node %q", ticket)
+				continue
+			}
+
+			node := info.Facts
+			if kind := string(node[facts.NodeKind]); kind == nodes.Diagnostic {
+				if opts.withFileDiags {
+					if d := fileDiagnostic(opts, norm, loc, req.SpanKind, ticket, node); d != nil {
+						opts.fileDiags = append(opts.fileDiags, d)
+					}
+				}
+				continue
+			} else if kind != nodes.Anchor || !req.References {
+				// Skip child if it isn't an anchor node (or references weren't
+				// requested)
+				continue
+			}
+
+			anchorStart, anchorEnd, err := facts.ValidateAnchor(node)
+			if err != nil {
+				opts.diags.addf(ticket, "Invalid anchor span for %q: %v", ticket, err)
+				continue
+			}
+
+			// Check if anchor fits within/around requested source text window
+			if loc.Kind == xpb.Location_SPAN && !opts.inSpan(req.SpanKind, int32(anchorStart), int32(anchorEnd), loc) {
+				continue
+			}
+
+			// Childof edges, which may carry an ordinal for nested scopes, are
+			// separated from the anchor's targets.
+			var scopes []*Scope
+			forward, truncated, err := g.getEdges(ctx, anchor, func(e *spb.Entry) bool {
+				return edges.IsForward(e.EdgeKind)
+			})
+			if err != nil {
+				opts.diags.addf(ticket, "Failed to retrieve targets of anchor %q: %v", ticket, err)
+				continue
+			}
+			var targets []*edgeTarget
+			for _, e := range forward {
+				if e.Kind != edges.ChildOf {
+					targets = append(targets, e)
+				} else if opts.withScopes && !proto.Equal(e.Target, fileVName) {
+					scopes = append(scopes, &Scope{
+						Ticket:     kytheuri.ToString(e.Target),
+						Ordinal:    int(e.Ordinal),
+						HasOrdinal: e.HasOrdinal,
+					})
+				}
+			}
+			if len(targets) == 0 {
+				opts.diags.addf(ticket, "Anchor %q missing forward edges", ticket)
+				continue
+			}
+			if opts.kinds != nil {
+				var kept []*edgeTarget
+				for _, e := range targets {
+					if opts.kinds.matches(e.Kind) {
+						kept = append(kept, e)
+					}
+				}
+				if targets = kept; len(targets) == 0 {
+					continue
+				}
+			}
+
+			if node := filterNode(filter, info); node != nil {
+				reply.Nodes[ticket] = node
+			}
+			if truncated {
+				addFact(reply.Nodes, ticket, TruncatedFact, []byte("true"))
+			}
+			if len(scopes) > 0 {
+				sort.Sort(byScopeOrder(scopes))
+				opts.scopes[ticket] = scopes
+			}
+			for _, edge := range targets {
+				targetTicket := kytheuri.ToString(edge.Target)
+				targetSet.Add(targetTicket)
+				reply.Reference = append(reply.Reference, &xpb.DecorationsReply_Reference{
+					SourceTicket: ticket,
+					Kind:         edges.Canonical(edge.Kind),
+					TargetTicket: targetTicket,
+					AnchorStart:  norm.ByteOffset(int32(anchorStart)),
+					AnchorEnd:    norm.ByteOffset(int32(anchorEnd)),
+				})
+			}
+		}
+		sort.Sort(bySpan(reply.Reference))
+
+		if req.TargetDefinitions && !targetSet.Empty() {
+			defs, err := g.targetDefinitions(ctx, targetSet.Elements())
+			if err != nil {
+				return nil, errorf(err, "failed to retrieve target definitions: %v", err)
+			}
+			for _, ref := range reply.Reference {
+				def, ok := defs[ref.TargetTicket]
+				if !ok {
+					continue
+				} else if reply.DefinitionLocations == nil {
+					reply.DefinitionLocations = make(map[string]*xpb.Anchor)
+				}
+				ref.TargetDefinition = def.Ticket
+				reply.DefinitionLocations[def.Ticket] = def
+			}
+		}
+
+		if opts.withColumns {
+			for _, ref := range reply.Reference {
+				start, err := column(src, encoding, ref.AnchorStart, opts.columns)
+				if err != nil {
+					return nil, errorf(err, "invalid anchor start for %q: %v", ref.SourceTicket, err)
+				}
+				end, err := column(src, encoding, ref.AnchorEnd, opts.columns)
+				if err != nil {
+					return nil, errorf(err, "invalid anchor end for %q: %v", ref.SourceTicket, err)
+				}
+				opts.refColumns = append(opts.refColumns, &Columns{start, end})
+			}
+		}
+
+		if offsetsOnly {
+			for _, ref := range reply.Reference {
+				ref.AnchorStart = offsetPoint(ref.AnchorStart)
+				ref.AnchorEnd = offsetPoint(ref.AnchorEnd)
+			}
+			for _, d := range opts.fileDiags {
+				if d.Start != nil {
+					d.Start, d.End = offsetPoint(d.Start), offsetPoint(d.End)
+				}
+			}
+		}
+
+		// Only request Nodes when there are fact filters given.
+		if len(req.Filter) > 0 {
+			// Ensure returned nodes are not duplicated.
+			for ticket := range reply.Nodes {
+				targetSet.Discard(ticket)
+			}
+			if opts.deferTargets {
+				opts.targets = targetSet
+				return reply, nil
+			}
+
+			// Batch request all Reference target nodes
+			nodesReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+				Ticket: targetSet.Elements(),
+				Filter: req.Filter,
+			})
+			if err != nil {
+				return nil, errorf(err, "failure getting reference target nodes: %v", err)
+			}
+			for ticket, node := range nodesReply.Nodes {
+				reply.Nodes[ticket] = node
+			}
+		}
+	}
+
+	return reply, nil
+}
+
+// addTooLargeFact adds the TooLargeFact of the given file to nodes, if its size
+// is known.
+func addTooLargeFact(nodes map[string]*cpb.NodeInfo, ticket string, tooLarge *FileTooLargeError) {
+	if tooLarge.Size >= 0 {
+		addFact(nodes, ticket, TooLargeFact, []byte(strconv.Itoa(tooLarge.Size)))
+	}
+}
+
+var (
+	revChildOfEdgeKind        = edges.Mirror(edges.ChildOf)
+	revDefinesBindingEdgeKind = edges.Mirror(edges.DefinesBinding)
+)
+
+// lineIndexNormalizer returns a Normalizer for the file with the given ticket
+// built from its facts.LineIndex fact, or nil if it has none.
+func (g *GraphStoreService) lineIndexNormalizer(ctx context.Context, fileTicket string) (*xrefs.Normalizer, error) {
+	reply, err := g.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: []string{fileTicket},
+		Filter: []string{facts.LineIndex},
+	})
+	if err != nil {
+		return nil, errorf(err, "fetching line index for %q: %v", fileTicket, err)
+	}
+	idx := reply.Nodes[fileTicket].GetFacts()[facts.LineIndex]
+	if idx == nil {
+		return nil, nil
+	}
+	lines, err := facts.ParseLineIndex(idx)
+	if err != nil {
+		g.logf("Invalid line index for %q: %v", fileTicket, err)
+		return nil, nil
+	}
+	return xrefs.NewLineIndexNormalizer(lines), nil
+}
+
+// offsetNormalizer normalizes the byte offsets of a file without text or a
+// line index as if the file were a single, unbounded line.  The line and
+// column of each point it returns are meaningless; see offsetPoint.
+var offsetNormalizer = xrefs.NewLineIndexNormalizer([]int{math.MaxInt32 / 2})
+
+// offsetPoint returns p with only its ByteOffset.
+func offsetPoint(p *xpb.Location_Point) *xpb.Location_Point {
+	if p == nil {
+		return &xpb.Location_Point{}
+	}
+	return &xpb.Location_Point{ByteOffset: p.ByteOffset}
+}
+
+// fileDiagnostic returns the FileDiagnostic for the given diagnostic node facts
+// if it is valid and within loc.  Invalid nodes are reported to opts.diags.
+func fileDiagnostic(opts *decorOptions, norm *xrefs.Normalizer, loc *xpb.Location, spanKind xpb.DecorationsRequest_SpanKind, ticket string, node map[string][]byte) *FileDiagnostic {
+	d := &FileDiagnostic{
+		Ticket:   ticket,
+		Message:  string(node[facts.Message]),
+		Severity: string(node[facts.Severity]),
+	}
+	if d.Message == "" {
+		opts.diags.addf(ticket, "Diagnostic node %q missing %s fact", ticket, facts.Message)
+		return nil
+	}
+
+	if node[facts.AnchorStart] == nil && node[facts.AnchorEnd] == nil {
+		return d
+	}
+	start, end, err := facts.ValidateAnchor(node)
+	if err != nil {
+		opts.diags.addf(ticket, "Invalid diagnostic span for %q: %v", ticket, err)
+		return nil
+	}
+	d.Start, d.End, err = normalizeSpan(norm, int32(start), int32(end))
+	if err != nil {
+		opts.diags.addf(ticket, "Invalid diagnostic span for %q: %v", ticket, err)
+		return nil
+	} else if loc.Kind == xpb.Location_SPAN && !opts.inSpan(spanKind, d.Start.ByteOffset, d.End.ByteOffset, loc) {
+		return nil
+	}
+	return d
+}
+
+// anchorNodes returns the NodeInfo of each of the given file children,
+// requested in batches of at most g.MaxAnchorBatchSize nodes.  The children of
+// each batch that failed are reported to diags and returned in failed.
+func (g *GraphStoreService) anchorNodes(ctx context.Context, children []*edgeTarget, diags *diagnostics) (map[string]*cpb.NodeInfo, stringset.Set) {
+	var tickets []string
+	for _, edge := range children {
+		tickets = append(tickets, kytheuri.ToString(edge.Target))
+	}
+
+	batchSize := g.MaxAnchorBatchSize
+	if batchSize <= 0 {
+		batchSize = len(tickets)
+	}
+
+	infos := make(map[string]*cpb.NodeInfo, len(tickets))
+	var failed stringset.Set
+	for len(tickets) > 0 {
+		n := batchSize
+		if n > len(tickets) {
+			n = len(tickets)
+		}
+		batch := tickets[:n]
+		tickets = tickets[n:]
+
+		reply, err := g.Nodes(ctx, &gpb.NodesRequest{Ticket: batch})
+		if err != nil {
+			for _, ticket := range batch {
+				diags.addf(ticket, "Failure getting reference source node %q: %v", ticket, err)
+				failed.Add(ticket)
+			}
+			continue
+		}
+		for ticket, info := range reply.Nodes {
+			infos[ticket] = info
+		}
+	}
+	return infos, failed
+}
+
+// column returns the column offset of the normalized point p within src
+// (encoded as encoding) measured in the given ColumnEncoding.
+func column(src []byte, encoding string, p *xpb.Location_Point, enc ColumnEncoding) (int32, error) {
+	switch enc {
+	case ByteColumns:
+		return p.ColumnOffset, nil
+	case UTF16Columns:
+		line := src[p.ByteOffset-p.ColumnOffset : p.ByteOffset]
+		if !isUTF8(encoding) {
+			decoded, err := text.ToUTF8(encoding, line)
+			if err != nil {
+				return 0, err
+			}
+			line = []byte(decoded)
+		}
+		var units int32
+		for len(line) > 0 {
+			r, size := utf8.DecodeRune(line)
+			if r >= 0x10000 {
+				units += 2 // surrogate pair
+			} else {
+				units++
+			}
+			line = line[size:]
+		}
+		return units, nil
+	default:
+		return 0, errorf(ErrInvalidArgument, "%v: unknown ColumnEncoding %v", ErrInvalidArgument, enc)
+	}
+}
+
+// FileNormalizer returns a Normalizer for the text of the given file, for use
+// in converting between byte offsets and line/column points as done by
+// Decorations.  As with anchor offsets, the Normalizer's byte offsets are
+// relative to the file's text in its stored encoding.  An error is returned if
+// the file has no text or its encoding is unsupported.
+func (g *GraphStoreService) FileNormalizer(ctx context.Context, fileTicket string) (*xrefs.Normalizer, error) {
+	_, src, _, err := g.fileText(ctx, fileTicket)
+	if err != nil {
+		return nil, err
+	}
+	return xrefs.NewNormalizer(src), nil
+}
+
+// fileText returns the VName, text, and text encoding of the given file.  A
+// *FileTooLargeError is returned, along with the file's VName, if the text
+// exceeds g.MaxFileBytes.
+func (g *GraphStoreService) fileText(ctx context.Context, fileTicket string) (*spb.VName, []byte, string, error) {
+	fileVName, err := parseTicket(fileTicket)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err := limitsFrom(ctx).addFile(); err != nil {
+		return nil, nil, "", err
+	}
+	src, encoding, err := getSourceText(ctx, g.store(), fileVName, g.MaxFileBytes, g.TextResolver)
+	switch e := err.(type) {
+	case nil:
+	case *FileTooLargeError:
+		e.Ticket = fileTicket
+		return fileVName, nil, "", e
+	case *noTextError:
+		return fileVName, nil, "", e
+	default:
+		return nil, nil, "", errorf(err, "failed to retrieve file text: %v", err)
+	}
+	return fileVName, src, encoding, nil
+}
+
+// noTextError is returned by getSourceText for a file without any text.
+// exists reports whether the file has any other facts.
+type noTextError struct {
+	file   *spb.VName
+	exists bool
+}
+
+func (e *noTextError) Error() string { return fmt.Sprintf("%v: %+v", ErrFileNotFound, e.file) }
+
+// Cause returns ErrFileNotFound.
+func (e *noTextError) Cause() error { return ErrFileNotFound }
+
+// getSourceText returns the text and text encoding of the given file.  If the
+// file has no inline text, its text reference is fetched by resolver, if
+// non-nil.  If maxBytes > 0 and the text exceeds it, a *FileTooLargeError
+// without a Ticket is returned.  If the file has no text, a *noTextError is
+// returned.
+func getSourceText(ctx context.Context, gs graphstore.Service, fileVName *spb.VName, maxBytes int, resolver TextResolver) (text []byte, encoding string, err error) {
+	var compression string
+	var ref []byte
+	var exists bool
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: fileVName}, func(entry *spb.Entry) error {
+		exists = true
+		switch entry.FactName {
+		case facts.Text:
 			text = entry.FactValue
 		case facts.TextEncoding:
 			encoding = string(entry.FactValue)
+		case facts.TextCompression:
+			compression = string(entry.FactValue)
+		case facts.TextRef:
+			ref = entry.FactValue
 		default:
 			// skip other file facts
 		}
-		return nil
-	}); err != nil {
-		return nil, "", fmt.Errorf("read error: %v", err)
+		return nil
+	}); err != nil {
+		return nil, "", errorf(err, "read error: %v", err)
+	}
+	if text, err = resolveText(ctx, resolver, kytheuri.ToString(fileVName), text, ref); err != nil {
+		return nil, "", errorf(err, "file %+v: %v", fileVName, err)
+	} else if text == nil {
+		return nil, "", &noTextError{fileVName, exists}
+	}
+
+	if encoding, err = textEncoding(encoding); err != nil {
+		return nil, "", errorf(err, "file %+v: %v", fileVName, err)
+	}
+	text, err = decompressText(text, compression, maxBytes)
+	return
+}
+
+// textEncoding returns the given facts.TextEncoding value, defaulting to
+// facts.DefaultTextEncoding, or an error if the encoding is not supported.
+func textEncoding(encoding string) (string, error) {
+	if encoding == "" {
+		return facts.DefaultTextEncoding, nil
+	} else if err := validateEncoding(encoding); err != nil {
+		return "", err
+	}
+	return encoding, nil
+}
+
+// validateEncoding returns an error if the given text encoding name is not
+// supported.
+func validateEncoding(encoding string) error {
+	if isUTF8(encoding) {
+		return nil
+	} else if _, err := text.ToUTF8(encoding, nil); err == text.ErrUnsupportedEncoding {
+		return errorf(ErrInvalidArgument, "%v: unsupported text encoding %q", ErrInvalidArgument, encoding)
+	}
+	return nil
+}
+
+// decompressText returns the given file text decompressed according to its
+// facts.TextCompression value.  Text without a compression is returned as-is.
+// If maxBytes > 0 and the (decompressed) text exceeds it, a *FileTooLargeError
+// without a Ticket is returned; compressed text is only decompressed up to the
+// limit.
+func decompressText(text []byte, compression string, maxBytes int) ([]byte, error) {
+	if maxBytes > 0 && len(text) > maxBytes {
+		size := len(text)
+		if compression != "" {
+			size = -1
+		}
+		return nil, &FileTooLargeError{Size: size, Max: maxBytes}
+	}
+	switch compression {
+	case "":
+		return text, nil
+	case GzipCompression:
+		r, err := gzip.NewReader(bytes.NewReader(text))
+		if err != nil {
+			return nil, errorf(err, "invalid gzip text: %v", err)
+		}
+		defer r.Close()
+		var rd io.Reader = r
+		if maxBytes > 0 {
+			rd = io.LimitReader(r, int64(maxBytes)+1)
+		}
+		decompressed, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return nil, errorf(err, "invalid gzip text: %v", err)
+		} else if maxBytes > 0 && len(decompressed) > maxBytes {
+			return nil, &FileTooLargeError{Size: -1, Max: maxBytes}
+		}
+		return decompressed, nil
+	default:
+		return nil, errorf(ErrInvalidArgument, "%v: unsupported text compression %q", ErrInvalidArgument, compression)
+	}
+}
+
+type edgeTarget struct {
+	Kind       string
+	Target     *spb.VName
+	Ordinal    int32
+	HasOrdinal bool
+}
+
+// getEdges returns edgeTargets with the given node as their source.  Only edge
+// entries that return true when applied to pred are returned.  The returned
+// bool reports whether the node's entries were truncated by MaxEntriesPerNode.
+func (g *GraphStoreService) getEdges(ctx context.Context, node *spb.VName, pred func(*spb.Entry) bool) ([]*edgeTarget, bool, error) {
+	entries, truncated, err := g.nodeEntries(ctx, node)
+	if err != nil {
+		return nil, false, errorf(err, "read error: %v", err)
+	}
+
+	var targets []*edgeTarget
+	for _, entry := range entries {
+		if graphstore.IsEdge(entry) && pred(entry) {
+			edgeKind, ordinal, hasOrdinal := edges.ParseOrdinal(entry.EdgeKind)
+			targets = append(targets, &edgeTarget{edgeKind, entry.Target, int32(ordinal), hasOrdinal})
+		}
+	}
+	return targets, truncated, nil
+}
+
+// NodeEntries returns all of the entries, facts and edges, with the given
+// source in gs.  The entries are ordered by edge kind, fact name, and then
+// target (see compare.Entries) regardless of the order in which gs returns
+// them.
+func NodeEntries(ctx context.Context, gs graphstore.Service, vname *spb.VName) ([]*spb.Entry, error) {
+	entries, _, err := readEntries(ctx, func(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) (bool, error) {
+		return false, gs.Read(ctx, req, f)
+	}, &spb.ReadRequest{Source: vname, EdgeKind: "*"})
+	return entries, err
+}
+
+// nodeEntries returns the entries with the given source as by NodeEntries,
+// subject to g.MaxEntriesPerNode.  The returned bool reports whether any
+// entries were skipped.
+func (g *GraphStoreService) nodeEntries(ctx context.Context, vname *spb.VName) ([]*spb.Entry, bool, error) {
+	return readEntries(ctx, g.read, &spb.ReadRequest{Source: vname, EdgeKind: "*"})
+}
+
+// readEntries collects the entries passed by read for req, ordered as by
+// NodeEntries.  The returned bool is the one reported by read.
+func readEntries(ctx context.Context, read func(context.Context, *spb.ReadRequest, graphstore.EntryFunc) (bool, error), req *spb.ReadRequest) ([]*spb.Entry, bool, error) {
+	var entries []*spb.Entry
+	truncated, err := read(ctx, req, func(entry *spb.Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Sort(compare.ByEntries(entries))
+	return entries, truncated, nil
+}
+
+// read calls Read on the underlying GraphStore, stopping once
+// MaxEntriesPerNode entries have been passed to f.  The returned bool reports
+// whether any further entries were skipped.
+func (g *GraphStoreService) read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) (bool, error) {
+	var (
+		entries   int
+		truncated bool
+	)
+	err := g.store().Read(ctx, req, func(entry *spb.Entry) error {
+		if g.MaxEntriesPerNode > 0 && entries >= g.MaxEntriesPerNode {
+			truncated = true
+			return io.EOF
+		}
+		entries++
+		return f(entry)
+	})
+	return truncated, err
+}
+
+func filterNode(filter *xrefs.FactFilter, node *cpb.NodeInfo) *cpb.NodeInfo {
+	if filter.Empty() {
+		return nil
+	}
+
+	filteredFacts := make(map[string][]byte)
+	for name, value := range node.Facts {
+		if filter.Matches(name) {
+			filteredFacts[name] = value
+		}
+	}
+
+	if len(filteredFacts) == 0 {
+		return nil
+	}
+	return &cpb.NodeInfo{
+		Facts: filteredFacts,
+	}
+}
+
+// bySpan implements the sort.Interface, ordering by each reference's anchor
+// span and then by its source ticket, target ticket, and kind so that the
+// ordering is total.
+type bySpan []*xpb.DecorationsReply_Reference
+
+// Len implements part of the sort.Interface.
+func (s bySpan) Len() int { return len(s) }
+
+// Swap implements part of the sort.Interface.
+func (s bySpan) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less implements part of the sort.Interface.
+func (s bySpan) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	switch {
+	case a.AnchorStart.ByteOffset != b.AnchorStart.ByteOffset:
+		return a.AnchorStart.ByteOffset < b.AnchorStart.ByteOffset
+	case a.AnchorEnd.ByteOffset != b.AnchorEnd.ByteOffset:
+		return a.AnchorEnd.ByteOffset < b.AnchorEnd.ByteOffset
+	case a.SourceTicket != b.SourceTicket:
+		return a.SourceTicket < b.SourceTicket
+	case a.TargetTicket != b.TargetTicket:
+		return a.TargetTicket < b.TargetTicket
+	}
+	return a.Kind < b.Kind
+}
+
+// byAnchorLocation orders anchors by their parent file, then by their span,
+// and then by their ticket so that the ordering is total.
+type byAnchorLocation []*xpb.CrossReferencesReply_RelatedAnchor
+
+// Len implements part of the sort.Interface.
+func (s byAnchorLocation) Len() int { return len(s) }
+
+// Swap implements part of the sort.Interface.
+func (s byAnchorLocation) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less implements part of the sort.Interface.
+func (s byAnchorLocation) Less(i, j int) bool {
+	a, b := s[i].Anchor, s[j].Anchor
+	switch {
+	case a.Parent != b.Parent:
+		return a.Parent < b.Parent
+	case byteOffset(a.Start) != byteOffset(b.Start):
+		return byteOffset(a.Start) < byteOffset(b.Start)
+	case byteOffset(a.End) != byteOffset(b.End):
+		return byteOffset(a.End) < byteOffset(b.End)
+	}
+	return a.Ticket < b.Ticket
+}
+
+// byteOffset returns the ByteOffset of p, or 0 if p is nil.
+func byteOffset(p *xpb.Location_Point) int32 {
+	if p == nil {
+		return 0
+	}
+	return p.ByteOffset
+}
+
+const defaultXRefPageSize = 1024
+
+// defaultEdgesPageSize is the number of edges returned by Edges when the
+// request does not specify a page size.
+const defaultEdgesPageSize = 2048
+
+// CrossReferences implements part of the xrefs Service interface.  The
+// anchors of each edge kind are ordered by parent file, then by span, and then
+// by ticket, so identical requests return identical anchor lists.
+//
+// Anchors are paged by the underlying Edges page token, so, as for Edges, a
+// GraphStore written between pages neither skips nor repeats the anchors of
+// edges present throughout, unless MaxEdgesPerKind is set.  Related nodes are
+// paged by offset and carry no such guarantee.
+func (g *GraphStoreService) CrossReferences(ctx context.Context, req *xpb.CrossReferencesRequest) (*xpb.CrossReferencesReply, error) {
+	return g.crossReferences(ctx, req, &xrefOptions{})
+}
+
+// CrossReferencesOptions are the optional parameters of
+// CrossReferencesWithOptions.  The zero CrossReferencesOptions is equivalent
+// to calling CrossReferences.
+type CrossReferencesOptions struct {
+	// If Span is non-nil, only anchors within the given location are returned.
+	// If Span is a FILE location, every anchor in the file is kept.
+	// Otherwise, each anchor is checked against the location's span according
+	// to SpanKind, as in Decorations.  Related nodes are unaffected by the
+	// restriction.
+	Span     *xpb.Location
+	SpanKind xpb.DecorationsRequest_SpanKind
+
+	// If LocationsOnly is true, anchors are returned with only their
+	// locations: their text and snippets are never populated, regardless of
+	// the request's AnchorText.  The text of an anchor's file is not read if
+	// the file has a facts.LineIndex fact, making this suitable for e.g.
+	// jumping to a definition within a large file.
+	LocationsOnly bool
+
+	// If DedupSnippets is true, each anchor's snippet is only returned once
+	// per file.  The Snippet of each anchor repeating the snippet text of an
+	// earlier anchor in the same file is left empty and the anchor is given a
+	// DuplicateSnippetFact in the reply's Nodes referencing the earlier
+	// anchor.  SnippetStart and SnippetEnd are always populated.  Anchors are
+	// considered in order of their CrossReferenceSet's ticket and then their
+	// position in the set.
+	DedupSnippets bool
+
+	// If ExcludeDefinitionSites is true, a requested node's references exclude
+	// the anchors at its own definition sites: each anchor with a defines or
+	// defines/binding edge to the node, along with any other anchor spanning
+	// the same location.  Such anchors are still returned as definitions, so
+	// reference counts reflect only the node's uses.
+	ExcludeDefinitionSites bool
+
+	// If FilterComplete is true, only the definitions of requested nodes at
+	// least as complete as MinCompleteness, according to their facts.Complete
+	// facts, are returned.  For example, a MinCompleteness of
+	// facts.CompletenessComplete excludes the definitions of incomplete nodes
+	// such as forward declarations.  Nodes without a facts.Complete fact are
+	// not filtered, nor are their other cross-references.
+	FilterComplete  bool
+	MinCompleteness facts.Completeness
+
+	// If ExportedOnly is true, only the cross-references of exported requested
+	// nodes are returned, along with only their exported related nodes.  A
+	// node is exported according to its facts.Visibility fact or, if it has
+	// none, g.ExportedByDefault.
+	ExportedOnly bool
+
+	// If Labels is true, the edges.Label of each anchor kind and related node
+	// relation kind in the reply is returned.
+	Labels bool
+
+	// If Diagnostics is true, each anchor skipped due to an invalid span is
+	// reported as a Diagnostic rather than only being logged.
+	Diagnostics bool
+
+	// If Overrides is true, the overrides edges of each requested node are
+	// returned as Overrides rather than as part of each CrossReferenceSet's
+	// RelatedNode list.
+	Overrides bool
+
+	// If RawKinds is true, the stored kind of the edge to each returned
+	// definition, reference, and documentation anchor is returned.
+	RawKinds bool
+
+	// If GroupByFile is true, the references of each CrossReferenceSet are
+	// also returned grouped by their parent files.  The reply itself,
+	// including its flat Reference lists, is unchanged, and only the
+	// references within the reply's page are grouped.
+	GroupByFile bool
+
+	// If Imports is true, reference anchors whose edge is a ref/imports edge
+	// (see edges.IsImport) are returned separately rather than as part of
+	// their CrossReferenceSet's Reference list.  This allows the places a node
+	// is imported to be shown apart from its other uses.  Imports are paged
+	// along with the other anchors and are only returned if the request's
+	// ReferenceKind includes ref/imports edges.
+	Imports bool
+
+	// If Hierarchy is true, related types connected to a requested node by an
+	// extends edge (see edges.IsExtends), in either direction, are returned
+	// as HierarchyNodes rather than as part of its CrossReferenceSet's
+	// RelatedNode list.
+	Hierarchy bool
+
+	// If Aliases is true, related nodes connected to a requested node by an
+	// alias edge (see edges.IsAlias), in either direction, are returned
+	// separately rather than as part of its CrossReferenceSet's RelatedNode
+	// list.
+	Aliases bool
+
+	// If Params is true, the parameters of each requested node are returned.
+	Params bool
+
+	// If Deprecation is true, the deprecation message of each deprecated
+	// CrossReferenceSet node is returned.
+	Deprecation bool
+
+	// If Docs is true, the documentation of each requested node is returned.
+	Docs bool
+}
+
+// CrossReferencesResults are the additional results of
+// CrossReferencesWithOptions.  Each field is only populated if requested by
+// the call's CrossReferencesOptions.
+type CrossReferencesResults struct {
+	// Labels maps each anchor kind and related node relation kind in the reply
+	// to its edges.Label.
+	Labels map[string]string
+
+	// Diagnostics holds a Diagnostic for each skipped anchor.
+	Diagnostics []*Diagnostic
+
+	// Overrides holds the overrides edges of each requested node.  They are
+	// only returned with the first page of cross-references.  As with related
+	// nodes, the overriding/overridden nodes are added to the reply's Nodes
+	// when the request has a fact filter.
+	Overrides []*Override
+
+	// RawKinds holds the stored edge kind of each returned anchor.  Each
+	// RawKind's Source is the anchor's cross-referenced node, its Target is
+	// the anchor's ticket, and its Kind is the anchor's canonical Kind.  An
+	// anchor related to its node by edges of several ordinals has a RawKind
+	// for each of them.
+	RawKinds []*RawKind
+
+	// Files maps the ticket of each cross-referenced node with references to
+	// its references grouped by file, ordered by file ticket.
+	Files map[string][]*FileReferences
+
+	// Imports maps the ticket of each referenced node to its ref/imports
+	// anchors.
+	Imports map[string][]*xpb.CrossReferencesReply_RelatedAnchor
+
+	// Hierarchy maps the ticket of each requested node to its related types.
+	// As with other related nodes, they are paged and their facts are added to
+	// the reply's Nodes, so they are only returned when the request has a fact
+	// filter.
+	Hierarchy map[string][]*HierarchyNode
+
+	// Aliases maps the ticket of each requested node to its aliases.  Aliases
+	// are paged along with the other related nodes, so they are only returned
+	// when the request has a fact filter.
+	Aliases map[string][]*xpb.CrossReferencesReply_RelatedNode
+
+	// Params maps the ticket of each requested node having any parameters to
+	// its parameters, ordered by ordinal.  Parameters whose param edge lacks
+	// an ordinal are ordered last.  The parameters are only returned with the
+	// first page of cross-references.  As with related nodes, the parameter
+	// nodes are added to the reply's Nodes when the request has a fact filter.
+	Params map[string][]*Param
+
+	// Deprecated maps the ticket of each deprecated CrossReferenceSet node to
+	// its facts.Deprecated value, which may be empty.  Nodes without the fact
+	// are not included.
+	Deprecated map[string]string
+
+	// Docs maps the ticket of each requested node to its documentation, as
+	// assembled from the doc nodes documenting it.  The raw text of the doc
+	// nodes is only included if the request's AnchorText is set; their links
+	// are always included.  Nodes without doc nodes are omitted.  As with
+	// overrides, the documentation is only returned with the first page of
+	// cross-references.
+	Docs map[string]*xpb.Printable
+}
+
+// CrossReferencesWithOptions is equivalent to CrossReferences except that it
+// is further parameterized by opts and also returns the additional results
+// requested by opts.
+func (g *GraphStoreService) CrossReferencesWithOptions(ctx context.Context, req *xpb.CrossReferencesRequest, opts *CrossReferencesOptions) (*xpb.CrossReferencesReply, *CrossReferencesResults, error) {
+	xopts := &xrefOptions{
+		locationsOnly:   opts.LocationsOnly,
+		dedupSnippets:   opts.DedupSnippets,
+		excludeDefSites: opts.ExcludeDefinitionSites,
+		filterComplete:  opts.FilterComplete,
+		minComplete:     opts.MinCompleteness,
+		exportedOnly:    opts.ExportedOnly,
+		withOverrides:   opts.Overrides,
+		withRawKinds:    opts.RawKinds,
+		withHierarchy:   opts.Hierarchy,
+		withAliases:     opts.Aliases,
+		withParams:      opts.Params,
+		withDeprecation: opts.Deprecation,
+		withDocs:        opts.Docs,
+	}
+	if loc := opts.Span; loc != nil {
+		if loc.Ticket == "" {
+			return nil, nil, errorf(ErrInvalidArgument, "%v: missing location ticket", ErrInvalidArgument)
+		}
+		ticket, err := kytheuri.Fix(loc.Ticket)
+		if err != nil {
+			return nil, nil, errorf(ErrInvalidTicket, "%v %q: %v", ErrInvalidTicket, loc.Ticket, err)
+		}
+		xopts.span = &spanRestriction{
+			ticket: ticket,
+			loc:    loc,
+			kind:   opts.SpanKind,
+		}
+	}
+	if opts.Diagnostics {
+		xopts.diags = &diagnostics{}
+	}
+	if opts.Imports {
+		xopts.withImports = true
+		xopts.imports = make(map[string][]*xpb.CrossReferencesReply_RelatedAnchor)
+	}
+	reply, err := g.crossReferences(ctx, req, xopts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &CrossReferencesResults{
+		Overrides:  xopts.overrides,
+		RawKinds:   xopts.rawKinds,
+		Imports:    xopts.imports,
+		Hierarchy:  xopts.hierarchy,
+		Aliases:    xopts.aliases,
+		Params:     xopts.params,
+		Deprecated: xopts.deprecated,
+		Docs:       xopts.docs,
+	}
+	if opts.Diagnostics {
+		res.Diagnostics = xopts.diags.list
+	}
+	if opts.Labels {
+		res.Labels = xrefLabels(reply)
+	}
+	if opts.GroupByFile {
+		res.Files = groupByFile(reply)
+	}
+	return reply, res, nil
+}
+
+// xrefLabels returns the edges.Label of each anchor kind and related node
+// relation kind in reply, keyed by kind.
+func xrefLabels(reply *xpb.CrossReferencesReply) map[string]string {
+	labels := make(map[string]string)
+	for _, set := range reply.CrossReferences {
+		for _, anchors := range [][]*xpb.CrossReferencesReply_RelatedAnchor{
+			set.Definition, set.Declaration, set.Reference, set.Documentation, set.Caller,
+		} {
+			for _, a := range anchors {
+				labels[a.Anchor.Kind] = edges.Label(a.Anchor.Kind)
+			}
+		}
+		for _, n := range set.RelatedNode {
+			labels[n.RelationKind] = edges.Label(n.RelationKind)
+		}
+	}
+	return labels
+}
+
+// Definitions returns the binding definition anchors of each of the given
+// tickets, keyed by ticket.  Only each node's incoming defines/binding edges
+// are read, making this a much cheaper alternative to CrossReferences with
+// BINDING_DEFINITIONS when no references, documentation, or related nodes are
+// needed.  Anchors are returned with their snippets but without their text,
+// ordered by parent file and then span.  Tickets without any definition are
+// omitted.  If a node's edges are truncated by MaxEntriesPerNode, a diagnostic
+// is logged for it.
+func (g *GraphStoreService) Definitions(ctx context.Context, tickets []string) (map[string][]*xpb.Anchor, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.Definitions")
+	ctx = g.withReadCache(ctx)
+	defer span.End()
+	span.SetAttribute("tickets", len(tickets))
+
+	if len(tickets) == 0 {
+		return nil, ErrNoTickets
+	}
+
+	completer := &anchorCompleter{g: g, files: newFileCache(), diags: g.logDiagnostics()}
+	defs := make(map[string][]*xpb.Anchor)
+	for _, ticket := range tickets {
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			return nil, err
+		}
+		var anchors stringset.Set
+		truncated, err := g.read(ctx, &spb.ReadRequest{
+			Source:   vname,
+			EdgeKind: revDefinesBindingEdgeKind,
+		}, func(e *spb.Entry) error {
+			anchors.Add(kytheuri.ToString(e.Target))
+			return nil
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving definitions of %q: %v", ticket, err)
+		} else if truncated {
+			completer.diags.addf(ticket, "Definitions of %q truncated after %d edges", ticket, g.MaxEntriesPerNode)
+		}
+		if anchors.Empty() {
+			continue
+		}
+
+		related, err := completer.completeAnchors(ctx, edges.DefinesBinding, anchors.Elements())
+		if err != nil {
+			return nil, errorf(err, "error resolving definition anchors: %v", err)
+		}
+		for _, r := range related {
+			defs[ticket] = append(defs[ticket], r.Anchor)
+		}
+	}
+	return defs, nil
+}
+
+// An Override is a node related to a cross-referenced node by an overrides
+// edge.
+type Override struct {
+	// Source is the ticket of the cross-referenced node.
+	Source string
+
+	// Ticket is the ticket of the related node.
+	Ticket string
+
+	// Kind is the overrides edge kind from Source to Ticket.  A reverse kind
+	// (see edges.Mirror) means that Ticket overrides Source.
+	Kind string
+}
+
+// OverriddenBy reports whether o.Ticket overrides o.Source, rather than being
+// overridden by it.
+func (o *Override) OverriddenBy() bool { return edges.IsReverse(o.Kind) }
+
+// Transitive reports whether o is a transitive override.
+func (o *Override) Transitive() bool { return edges.Canonical(o.Kind) == edges.OverridesTransitive }
+
+// FileReferences are the reference anchors of a cross-referenced node within a
+// single file.
+type FileReferences struct {
+	// File is the ticket of the file, the Parent of each of its anchors.
+	File string
+
+	// Reference holds the file's reference anchors in reply order.
+	Reference []*xpb.CrossReferencesReply_RelatedAnchor
+}
+
+// Count returns the number of references within the file.
+func (f *FileReferences) Count() int { return len(f.Reference) }
+
+// groupByFile groups the references of each of reply's CrossReferenceSets by
+// their parent files.  Sets without references are omitted.
+func groupByFile(reply *xpb.CrossReferencesReply) map[string][]*FileReferences {
+	groups := make(map[string][]*FileReferences)
+	for ticket, xr := range reply.CrossReferences {
+		files := make(map[string]*FileReferences)
+		for _, ref := range xr.Reference {
+			parent := ref.Anchor.Parent
+			f, ok := files[parent]
+			if !ok {
+				f = &FileReferences{File: parent}
+				files[parent] = f
+				groups[ticket] = append(groups[ticket], f)
+			}
+			f.Reference = append(f.Reference, ref)
+		}
+		sort.Sort(byFile(groups[ticket]))
+	}
+	return groups
+}
+
+// byFile orders FileReferences by their file tickets.
+type byFile []*FileReferences
+
+// Len implements part of the sort.Interface.
+func (s byFile) Len() int { return len(s) }
+
+// Swap implements part of the sort.Interface.
+func (s byFile) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less implements part of the sort.Interface.
+func (s byFile) Less(i, j int) bool { return s[i].File < s[j].File }
+
+// A HierarchyNode is a type related to a cross-referenced node by an extends
+// edge (see edges.IsExtends).
+type HierarchyNode struct {
+	// Ticket is the ticket of the related type.
+	Ticket string
+
+	// Kind is the extends edge kind from the cross-referenced node to Ticket.
+	// A reverse kind (see edges.Mirror) means that Ticket extends the
+	// cross-referenced node.
+	Kind string
+
+	// Name is the rendered facts.Code MarkedSource of the related type.  It is
+	// empty if the type has no valid facts.Code fact.
+	Name string
+}
+
+// Subtype reports whether h.Ticket extends the cross-referenced node, rather
+// than being extended by it.
+func (h *HierarchyNode) Subtype() bool { return edges.IsReverse(h.Kind) }
+
+// A Param is a parameter of a cross-referenced node, related to it by a param
+// edge.
+type Param struct {
+	// Ticket is the ticket of the parameter node.
+	Ticket string
+
+	// Ordinal is the position of the parameter.  It is only meaningful if
+	// HasOrdinal is true.
+	Ordinal int
+
+	// HasOrdinal reports whether the param edge had an ordinal.
+	HasOrdinal bool
+}
+
+// byParamOrder orders Params by ordinal, with Params missing an ordinal last,
+// and then by ticket.
+type byParamOrder []*Param
+
+// Len implements part of the sort.Interface.
+func (s byParamOrder) Len() int { return len(s) }
+
+// Swap implements part of the sort.Interface.
+func (s byParamOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less implements part of the sort.Interface.
+func (s byParamOrder) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	switch {
+	case a.HasOrdinal != b.HasOrdinal:
+		return a.HasOrdinal
+	case a.Ordinal != b.Ordinal:
+		return a.Ordinal < b.Ordinal
+	}
+	return a.Ticket < b.Ticket
+}
+
+// nodeParams returns the parameters of the given node ordered as described by
+// CrossReferencesResults.Params.
+func (g *GraphStoreService) nodeParams(ctx context.Context, vname *spb.VName) ([]*Param, error) {
+	var params []*Param
+	if _, err := g.read(ctx, &spb.ReadRequest{
+		Source:   vname,
+		EdgeKind: "*",
+	}, func(e *spb.Entry) error {
+		if kind, ordinal, hasOrdinal := edges.ParseOrdinal(e.EdgeKind); kind == edges.Param {
+			params = append(params, &Param{
+				Ticket:     kytheuri.ToString(e.Target),
+				Ordinal:    ordinal,
+				HasOrdinal: hasOrdinal,
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, errorf(err, "read error: %v", err)
+	}
+	sort.Sort(byParamOrder(params))
+	return params, nil
+}
+
+// nodeDocs returns the documentation of each of the given tickets as described
+// by CrossReferencesResults.Docs.  The text and links of several doc nodes
+// documenting the same node are concatenated in order of their tickets.
+func (g *GraphStoreService) nodeDocs(ctx context.Context, tickets []string, withText bool) (map[string]*xpb.Printable, error) {
+	docs := make(map[string]*xpb.Printable)
+	for _, ticket := range tickets {
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			return nil, err
+		}
+		documenters, _, err := g.getEdges(ctx, vname, func(e *spb.Entry) bool {
+			kind, _, _ := edges.ParseOrdinal(e.EdgeKind)
+			return kind == edges.Mirror(edges.Documents)
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving doc nodes: %v", err)
+		} else if len(documenters) == 0 {
+			continue
+		}
+
+		var docTickets stringset.Set
+		for _, d := range documenters {
+			docTickets.Add(kytheuri.ToString(d.Target))
+		}
+		doc, err := g.docPrintable(ctx, docTickets, withText)
+		if err != nil {
+			return nil, err
+		} else if doc != nil {
+			docs[ticket] = doc
+		}
+	}
+	return docs, nil
+}
+
+// docPrintable returns the concatenated text and links of the given doc nodes
+// in order of their tickets, or nil if none of them is a nodes.Doc.  The text
+// of the doc nodes is only read if withText is set.
+func (g *GraphStoreService) docPrintable(ctx context.Context, docTickets stringset.Set, withText bool) (*xpb.Printable, error) {
+	filter := []string{facts.NodeKind}
+	if withText {
+		filter = append(filter, facts.Text)
+	}
+	nReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: docTickets.Elements(),
+		Filter: filter,
+	})
+	if err != nil {
+		return nil, errorf(err, "error retrieving doc nodes: %v", err)
+	}
+
+	var doc *xpb.Printable
+	for _, docTicket := range docTickets.Elements() {
+		info := nReply.Nodes[docTicket]
+		if string(info.GetFacts()[facts.NodeKind]) != nodes.Doc {
+			continue
+		}
+		if doc == nil {
+			doc = &xpb.Printable{}
+		}
+		doc.RawText += string(info.Facts[facts.Text])
+
+		// The i-th link of a doc node is its i-th param.
+		docVName, err := kytheuri.ToVName(docTicket)
+		if err != nil {
+			return nil, errorf(ErrInvalidTicket, "%v %q: %v", ErrInvalidTicket, docTicket, err)
+		}
+		params, _, err := g.getEdges(ctx, docVName, func(e *spb.Entry) bool {
+			kind, _, _ := edges.ParseOrdinal(e.EdgeKind)
+			return kind == edges.Param
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving doc links: %v", err)
+		}
+		var links []*gpb.EdgeSet_Group_Edge
+		for _, p := range params {
+			links = append(links, &gpb.EdgeSet_Group_Edge{
+				TargetTicket: kytheuri.ToString(p.Target),
+				Ordinal:      p.Ordinal,
+			})
+		}
+		sort.Sort(xrefs.ByOrdinal(links))
+		for _, l := range links {
+			doc.Link = append(doc.Link, &xpb.Link{Definition: []string{l.TargetTicket}})
+		}
 	}
-	if text == nil {
-		err = fmt.Errorf("file not found: %+v", fileVName)
+	return doc, nil
+}
+
+// dedupSnippets clears each repeated snippet in reply as described by
+// CrossReferencesOptions.DedupSnippets.
+func dedupSnippets(reply *xpb.CrossReferencesReply) {
+	type snippetKey struct{ parent, snippet string }
+	first := make(map[snippetKey]string)
+
+	var subjects []string
+	for ticket := range reply.CrossReferences {
+		subjects = append(subjects, ticket)
+	}
+	sort.Strings(subjects)
+	for _, ticket := range subjects {
+		xr := reply.CrossReferences[ticket]
+		for _, anchors := range [][]*xpb.CrossReferencesReply_RelatedAnchor{
+			xr.Definition, xr.Declaration, xr.Reference, xr.Documentation,
+		} {
+			for _, ra := range anchors {
+				a := ra.Anchor
+				if a.Snippet == "" {
+					continue
+				}
+				key := snippetKey{a.Parent, a.Snippet}
+				if orig, ok := first[key]; !ok {
+					first[key] = a.Ticket
+				} else if orig != a.Ticket {
+					a.Snippet = ""
+					if reply.Nodes == nil {
+						reply.Nodes = make(map[string]*cpb.NodeInfo)
+					}
+					addFact(reply.Nodes, a.Ticket, DuplicateSnippetFact, []byte(orig))
+				}
+			}
+		}
 	}
-	return
 }
 
-type edgeTarget struct {
-	Kind    string
-	Target  *spb.VName
-	Ordinal int32
+// defSites identifies the definition anchors of a single node by ticket and
+// by span.
+type defSites struct {
+	anchors stringset.Set
+	spans   map[defSpan]bool
 }
 
-// getEdges returns edgeTargets with the given node as their source.  Only edge
-// entries that return true when applied to pred are returned.
-func getEdges(ctx context.Context, gs graphstore.Service, node *spb.VName, pred func(*spb.Entry) bool) ([]*edgeTarget, error) {
-	var targets []*edgeTarget
+type defSpan struct {
+	parent     string
+	start, end int32
+}
 
-	if err := gs.Read(ctx, &spb.ReadRequest{
-		Source:   node,
-		EdgeKind: "*",
-	}, func(entry *spb.Entry) error {
-		if graphstore.IsEdge(entry) && pred(entry) {
-			edgeKind, ordinal, _ := edges.ParseOrdinal(entry.EdgeKind)
-			targets = append(targets, &edgeTarget{edgeKind, entry.Target, int32(ordinal)})
+// contains reports whether the given anchor is at one of the definition sites.
+func (d *defSites) contains(a *xpb.Anchor) bool {
+	if d == nil {
+		return false
+	}
+	return d.anchors.Contains(a.Ticket) ||
+		d.spans[defSpan{a.Parent, a.Start.ByteOffset, a.End.ByteOffset}]
+}
+
+// definitionSites returns the defSites of each of the given nodes with any
+// definitions, keyed by ticket.
+func (g *GraphStoreService) definitionSites(ctx context.Context, nodeTickets []string) (map[string]*defSites, error) {
+	sites := make(map[string]*defSites)
+	for _, ticket := range nodeTickets {
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			return nil, err
 		}
-		return nil
-	}); err != nil {
-		return nil, fmt.Errorf("read error: %v", err)
+		defs, _, err := g.getEdges(ctx, vname, func(e *spb.Entry) bool {
+			kind, _, _ := edges.ParseOrdinal(e.EdgeKind)
+			return kind == edges.Mirror(edges.Defines) || kind == edges.Mirror(edges.DefinesBinding)
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving definitions of %q: %v", ticket, err)
+		} else if len(defs) == 0 {
+			continue
+		}
+
+		d := &defSites{spans: make(map[defSpan]bool)}
+		for _, def := range defs {
+			d.anchors.Add(kytheuri.ToString(def.Target))
+		}
+		reply, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: d.anchors.Elements(),
+			Filter: []string{schema.AnchorLocFilter},
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving definition anchors: %v", err)
+		}
+		for anchor, info := range reply.Nodes {
+			start, end, err := facts.ValidateAnchor(info.Facts)
+			if err != nil {
+				continue
+			}
+			parent, err := tickets.AnchorFile(anchor)
+			if err != nil {
+				return nil, errorf(err, "invalid anchor %q: %v", anchor, err)
+			}
+			d.spans[defSpan{parent, int32(start), int32(end)}] = true
+		}
+		sites[ticket] = d
 	}
-	return targets, nil
+	return sites, nil
 }
 
-func filterNode(patterns []*regexp.Regexp, node *cpb.NodeInfo) *cpb.NodeInfo {
-	if len(patterns) == 0 {
-		return nil
+// completeness returns the parsed facts.Complete fact of each of the given
+// nodes, keyed by ticket.  Nodes without a valid facts.Complete fact are
+// absent.
+func (g *GraphStoreService) completeness(ctx context.Context, nodeTickets []string) (map[string]facts.Completeness, error) {
+	reply, err := g.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: nodeTickets,
+		Filter: []string{facts.Complete},
+	})
+	if err != nil {
+		return nil, errorf(err, "error retrieving completeness: %v", err)
+	}
+	complete := make(map[string]facts.Completeness)
+	for ticket, info := range reply.Nodes {
+		if c, err := facts.ParseComplete(info.Facts[facts.Complete]); err == nil {
+			complete[ticket] = c
+		}
 	}
+	return complete, nil
+}
 
-	filteredFacts := make(map[string][]byte)
-	for name, value := range node.Facts {
-		if xrefs.MatchesAny(name, patterns) {
-			filteredFacts[name] = value
+// declaredNodes returns the given nodes whose facts.Complete fact marks them
+// as incomplete, and so whose defines anchors are declarations, along with
+// those of them that are completed by a definition elsewhere.
+func (g *GraphStoreService) declaredNodes(ctx context.Context, nodeTickets []string) (incomplete, defined stringset.Set, err error) {
+	complete, err := g.completeness(ctx, nodeTickets)
+	if err != nil {
+		return incomplete, defined, err
+	}
+	for ticket, c := range complete {
+		if c != facts.CompletenessIncomplete {
+			continue
+		}
+		incomplete.Add(ticket)
+
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			return incomplete, defined, err
+		}
+		completions, _, err := g.getEdges(ctx, vname, func(e *spb.Entry) bool {
+			kind, _, _ := edges.ParseOrdinal(e.EdgeKind)
+			return kind == edges.Mirror(edges.Completes) || kind == edges.Mirror(edges.CompletesUniquely)
+		})
+		if err != nil {
+			return incomplete, defined, errorf(err, "error retrieving completions of %q: %v", ticket, err)
+		} else if len(completions) > 0 {
+			defined.Add(ticket)
 		}
 	}
+	return incomplete, defined, nil
+}
 
-	if len(filteredFacts) == 0 {
-		return nil
+// exported returns the subset of the given tickets whose nodes are exported.
+func (g *GraphStoreService) exported(ctx context.Context, tickets []string) (stringset.Set, error) {
+	reply, err := g.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: tickets,
+		Filter: []string{facts.Visibility},
+	})
+	if err != nil {
+		return nil, errorf(err, "error retrieving visibility facts: %v", err)
 	}
-	return &cpb.NodeInfo{
-		Facts: filteredFacts,
+
+	var exported stringset.Set
+	for _, ticket := range tickets {
+		isExported, ok := facts.IsExported(reply.Nodes[ticket].GetFacts()[facts.Visibility])
+		if !ok {
+			vname, err := parseTicket(ticket)
+			if err != nil {
+				return nil, err
+			}
+			isExported, ok = g.ExportedByDefault[vname.Language]
+			isExported = isExported || !ok
+		}
+		if isExported {
+			exported.Add(ticket)
+		}
 	}
+	return exported, nil
 }
 
-// bySpan implements the sort.Interface, ordering by each reference's anchor
-// span.
-type bySpan []*xpb.DecorationsReply_Reference
+// xrefOptions holds the optional parameters and results of a single
+// CrossReferences call.
+type xrefOptions struct {
+	// If non-nil, diags receives a Diagnostic for each skipped anchor.
+	// Otherwise, they are logged to g's Logger.
+	diags *diagnostics
 
-// Len implements part of the sort.Interface.
-func (s bySpan) Len() int { return len(s) }
+	// If non-nil, span restricts the returned anchors to a file region.
+	span *spanRestriction
 
-// Swap implements part of the sort.Interface.
-func (s bySpan) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+	// If withOverrides is true, overrides edges are collected into overrides
+	// instead of being returned as related nodes.
+	withOverrides bool
+	overrides     []*Override
 
-// Less implements part of the sort.Interface.
-func (s bySpan) Less(i, j int) bool {
-	if s[i].AnchorStart.ByteOffset < s[j].AnchorStart.ByteOffset {
-		return true
-	} else if s[i].AnchorStart.ByteOffset > s[j].AnchorStart.ByteOffset {
-		return false
-	} else if s[i].AnchorEnd.ByteOffset < s[j].AnchorEnd.ByteOffset {
-		return true
+	// If withAliases is true, related nodes connected by alias edges are
+	// collected into aliases instead of each CrossReferenceSet.
+	withAliases bool
+	aliases     map[string][]*xpb.CrossReferencesReply_RelatedNode
+
+	// If withHierarchy is true, related nodes connected by extends edges are
+	// collected into hierarchy instead of each CrossReferenceSet.
+	withHierarchy bool
+	hierarchy     map[string][]*HierarchyNode
+
+	// If withImports is true, reference anchors of ref/imports edges are
+	// collected into imports instead of each CrossReferenceSet.
+	withImports bool
+	imports     map[string][]*xpb.CrossReferencesReply_RelatedAnchor
+
+	// If withParams is true, params is populated with the parameters of each
+	// requested node.
+	withParams bool
+	params     map[string][]*Param
+
+	// If withDocs is true, docs is populated with the documentation of each
+	// requested node.
+	withDocs bool
+	docs     map[string]*xpb.Printable
+
+	// If locationsOnly is true, anchors are returned without text or
+	// snippets.
+	locationsOnly bool
+
+	// If dedupSnippets is true, repeated snippets are omitted.
+	dedupSnippets bool
+
+	// If exportedOnly is true, only exported subjects and related nodes are
+	// returned.
+	exportedOnly bool
+
+	// If filterComplete is true, the definitions of subjects whose
+	// facts.Complete fact is less complete than minComplete are dropped.
+	filterComplete bool
+	minComplete    facts.Completeness
+
+	// If withDeprecation is true, deprecated is populated with the
+	// facts.Deprecated value of each deprecated CrossReferenceSet subject.
+	withDeprecation bool
+	deprecated      map[string]string
+
+	// If excludeDefSites is true, reference anchors at one of the definition
+	// sites of their requested node are skipped.
+	excludeDefSites bool
+
+	// If withRawKinds is true, rawKinds is populated with the stored edge kind
+	// of each returned anchor.
+	withRawKinds bool
+	rawKinds     []*RawKind
+}
+
+// A spanRestriction restricts anchors to a location within a single file.
+type spanRestriction struct {
+	ticket string // canonical ticket of the location's file
+	loc    *xpb.Location
+	kind   xpb.DecorationsRequest_SpanKind
+}
+
+// contains reports whether the anchor [start,end) within the given parent file
+// falls within the restriction.
+func (r *spanRestriction) contains(parent string, file *fileNode, start, end int32) (bool, error) {
+	if parent != r.ticket {
+		return false, nil
+	} else if r.loc.Kind == xpb.Location_FILE {
+		return true, nil
 	}
-	return false
+	loc, err := file.norm.Location(r.loc)
+	if err != nil {
+		return false, err
+	}
+	return xrefs.InSpanBounds(r.kind, start, end, loc.Start.ByteOffset, loc.End.ByteOffset), nil
 }
 
-const defaultXRefPageSize = 1024
+func (g *GraphStoreService) crossReferences(ctx context.Context, req *xpb.CrossReferencesRequest, opts *xrefOptions) (*xpb.CrossReferencesReply, error) {
+	ctx, span := g.startSpan(ctx, "GraphStoreService.CrossReferences")
+	ctx = g.withReadCache(ctx)
+	defer span.End()
+	span.SetAttribute("tickets", len(req.Ticket))
 
-// CrossReferences implements part of the xrefs Service interface.
-func (g *GraphStoreService) CrossReferences(ctx context.Context, req *xpb.CrossReferencesRequest) (*xpb.CrossReferencesReply, error) {
 	// TODO(zarko): Callgraph integration.
 	if len(req.Ticket) == 0 {
-		return nil, errors.New("no cross-references requested")
+		return nil, ErrNoTickets
+	}
+	if opts.diags == nil {
+		opts.diags = g.logDiagnostics()
+	}
+
+	if opts.exportedOnly {
+		exported, err := g.exported(ctx, req.Ticket)
+		if err != nil {
+			return nil, err
+		} else if exported.Empty() {
+			return &xpb.CrossReferencesReply{
+				CrossReferences: make(map[string]*xpb.CrossReferencesReply_CrossReferenceSet),
+			}, nil
+		}
+		exportedReq := *req
+		exportedReq.Ticket = exported.Elements()
+		req = &exportedReq
 	}
 
 	requestedPageSize := int(req.PageSize)
@@ -529,117 +3971,560 @@ func (g *GraphStoreService) CrossReferences(ctx context.Context, req *xpb.CrossR
 		requestedPageSize = defaultXRefPageSize
 	}
 
-	eReply, err := g.Edges(ctx, &gpb.EdgesRequest{
-		Ticket:    req.Ticket,
-		PageSize:  int32(requestedPageSize),
-		PageToken: req.PageToken,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error getting edges for cross-references: %v", err)
+	// The page token tracks the anchor-based cross-references (through the
+	// Edges page token) separately from the offset into the related nodes.  An
+	// empty Edges page token in a non-empty page token signals that all
+	// anchors have already been returned.
+	var (
+		edgesToken    string
+		anchorsDone   bool
+		relatedOffset int
+	)
+	if req.PageToken != "" {
+		t, err := decodePageToken(req.PageToken)
+		if err != nil {
+			return nil, err
+		}
+		edgesToken, anchorsDone, relatedOffset = t.SecondaryToken, t.SecondaryToken == "", int(t.Index)
 	}
 
 	reply := &xpb.CrossReferencesReply{
 		CrossReferences: make(map[string]*xpb.CrossReferencesReply_CrossReferenceSet),
-
-		NextPageToken: eReply.NextPageToken,
 	}
 	var allRelatedNodes stringset.Set
 	if len(req.Filter) > 0 {
 		reply.Nodes = make(map[string]*cpb.NodeInfo)
 	}
 
-	// Cache parent files across all anchors
-	files := make(map[string]*fileNode)
+	xrefSet := func(ticket string) *xpb.CrossReferencesReply_CrossReferenceSet {
+		xr, ok := reply.CrossReferences[ticket]
+		if !ok {
+			xr = &xpb.CrossReferencesReply_CrossReferenceSet{Ticket: ticket}
+			reply.CrossReferences[ticket] = xr
+		}
+		return xr
+	}
+
+	completer := &anchorCompleter{
+		g:             g,
+		diags:         opts.diags,
+		span:          opts.span,
+		retrieveText:  req.AnchorText,
+		locationsOnly: opts.locationsOnly,
+		files:         newFileCache(),
+	}
+	if reply.Nodes != nil && g.factFilter(req.Filter).Matches(facts.BuildConfig) {
+		completer.nodes = reply.Nodes
+	}
+
+	var sites map[string]*defSites
+	if opts.excludeDefSites && !anchorsDone && req.ReferenceKind != xpb.CrossReferencesRequest_NO_REFERENCES {
+		var err error
+		if sites, err = g.definitionSites(ctx, req.Ticket); err != nil {
+			return nil, err
+		}
+	}
+
+	// raws maps each anchor edge of the current Edges page to its stored kinds.
+	type rawKey struct{ source, kind, anchor string }
+	var raws map[rawKey][]string
+	addRawKinds := func(source, kind string, anchors []*xpb.CrossReferencesReply_RelatedAnchor) {
+		for _, a := range anchors {
+			for _, raw := range raws[rawKey{source, kind, a.Anchor.Ticket}] {
+				opts.rawKinds = append(opts.rawKinds, &RawKind{
+					Source: source,
+					Target: a.Anchor.Ticket,
+					Kind:   a.Anchor.Kind,
+					Raw:    raw,
+				})
+			}
+		}
+	}
+
+	var complete map[string]facts.Completeness
+	if opts.filterComplete && !anchorsDone && req.DefinitionKind != xpb.CrossReferencesRequest_NO_DEFINITIONS {
+		var err error
+		if complete, err = g.completeness(ctx, req.Ticket); err != nil {
+			return nil, err
+		}
+	}
+
+	// Declarations are the defines anchors of incomplete nodes.  Unless
+	// g.KeepDeclarationsWithDefinitions is set, they are dropped for nodes
+	// with a definition elsewhere.
+	var incomplete, defined stringset.Set
+	if req.DeclarationKind != xpb.CrossReferencesRequest_NO_DECLARATIONS && !anchorsDone {
+		var err error
+		if incomplete, defined, err = g.declaredNodes(ctx, req.Ticket); err != nil {
+			return nil, err
+		}
+		if g.KeepDeclarationsWithDefinitions {
+			defined = stringset.Set{}
+		}
+	}
 
 	var totalXRefs int
-	for {
-		for source, es := range eReply.EdgeSets {
-			xr, ok := reply.CrossReferences[source]
-			if !ok {
-				xr = &xpb.CrossReferencesReply_CrossReferenceSet{Ticket: source}
+	for !anchorsDone {
+		eOpts := &edgesOptions{withRawKinds: opts.withRawKinds}
+		eReply, err := g.edges(ctx, &gpb.EdgesRequest{
+			Ticket:    req.Ticket,
+			PageSize:  int32(requestedPageSize),
+			PageToken: edgesToken,
+		}, eOpts)
+		if err != nil {
+			return nil, errorf(err, "error getting edges for cross-references: %v", err)
+		}
+		edgesToken = eReply.NextPageToken
+		if opts.withRawKinds {
+			raws = make(map[rawKey][]string)
+			for _, r := range eOpts.rawKinds {
+				k := rawKey{r.Source, r.Kind, r.Target}
+				raws[k] = append(raws[k], r.Raw)
 			}
+		}
 
-			var count int
+		for source, es := range eReply.EdgeSets {
 			for kind, grp := range es.Groups {
 				switch {
-				// TODO(schroeder): handle declarations
-				case xrefs.IsDefKind(req.DefinitionKind, kind, false):
-					anchors, err := completeAnchors(ctx, g, req.AnchorText, files, kind, edgeTickets(grp.Edge))
+				case xrefs.IsDeclKind(req.DeclarationKind, kind, incomplete.Contains(source)):
+					if defined.Contains(source) {
+						continue
+					}
+					anchors, err := completer.completeAnchors(ctx, kind, edgeTickets(grp.Edge))
+					if err != nil {
+						return nil, errorf(err, "error resolving declaration anchors: %v", err)
+					} else if len(anchors) > 0 {
+						addRawKinds(source, kind, anchors)
+						xr := xrefSet(source)
+						xr.Declaration = append(xr.Declaration, anchors...)
+						totalXRefs += len(anchors)
+					}
+				case xrefs.IsDefKind(req.DefinitionKind, kind, incomplete.Contains(source)):
+					if c, ok := complete[source]; ok && c < opts.minComplete {
+						continue
+					}
+					anchors, err := completer.completeAnchors(ctx, kind, edgeTickets(grp.Edge))
 					if err != nil {
-						return nil, fmt.Errorf("error resolving definition anchors: %v", err)
+						return nil, errorf(err, "error resolving definition anchors: %v", err)
+					} else if len(anchors) > 0 {
+						addRawKinds(source, kind, anchors)
+						xr := xrefSet(source)
+						xr.Definition = append(xr.Definition, anchors...)
+						totalXRefs += len(anchors)
 					}
-					count += len(anchors)
-					xr.Definition = append(xr.Definition, anchors...)
 				case xrefs.IsRefKind(req.ReferenceKind, kind):
-					anchors, err := completeAnchors(ctx, g, req.AnchorText, files, kind, edgeTickets(grp.Edge))
+					anchors, err := completer.completeAnchors(ctx, kind, edgeTickets(grp.Edge))
 					if err != nil {
-						return nil, fmt.Errorf("error resolving reference anchors: %v", err)
+						return nil, errorf(err, "error resolving reference anchors: %v", err)
+					}
+					if d := sites[source]; d != nil {
+						var uses []*xpb.CrossReferencesReply_RelatedAnchor
+						for _, a := range anchors {
+							if !d.contains(a.Anchor) {
+								uses = append(uses, a)
+							}
+						}
+						anchors = uses
+					}
+					if len(anchors) > 0 && opts.withImports && edges.IsImport(kind) {
+						addRawKinds(source, kind, anchors)
+						opts.imports[source] = append(opts.imports[source], anchors...)
+						totalXRefs += len(anchors)
+					} else if len(anchors) > 0 {
+						addRawKinds(source, kind, anchors)
+						xr := xrefSet(source)
+						xr.Reference = append(xr.Reference, anchors...)
+						totalXRefs += len(anchors)
 					}
-					count += len(anchors)
-					xr.Reference = append(xr.Reference, anchors...)
 				case xrefs.IsDocKind(req.DocumentationKind, kind):
-					anchors, err := completeAnchors(ctx, g, req.AnchorText, files, kind, edgeTickets(grp.Edge))
+					anchors, err := completer.completeAnchors(ctx, kind, edgeTickets(grp.Edge))
 					if err != nil {
-						return nil, fmt.Errorf("error resolving documentation anchors: %v", err)
-					}
-					count += len(anchors)
-					xr.Documentation = append(xr.Documentation, anchors...)
-				case !allRelatedNodes.Empty() && !edges.IsAnchorEdge(kind):
-					count += len(grp.Edge)
-					for _, edge := range grp.Edge {
-						xr.RelatedNode = append(xr.RelatedNode, &xpb.CrossReferencesReply_RelatedNode{
-							Ticket:       edge.TargetTicket,
-							RelationKind: kind,
-							Ordinal:      edge.Ordinal,
-						})
-						allRelatedNodes.Add(edge.TargetTicket)
+						return nil, errorf(err, "error resolving documentation anchors: %v", err)
+					} else if len(anchors) > 0 {
+						addRawKinds(source, kind, anchors)
+						xr := xrefSet(source)
+						xr.Documentation = append(xr.Documentation, anchors...)
+						totalXRefs += len(anchors)
 					}
 				}
 			}
+		}
+
+		if edgesToken == "" {
+			anchorsDone = true
+		} else if totalXRefs > 0 {
+			break
+		} else {
+			// We need to return at least 1 xref, if there are any
+			g.logf("Extra CrossReferences Edges call: %s", edgesToken)
+		}
+	}
+
+	// Related nodes are paged independently of the anchors above.
+	var moreRelated bool
+	if len(req.Filter) > 0 {
+		related, more, truncated, err := g.relatedNodes(ctx, req.Ticket, relatedOffset, requestedPageSize, opts.withOverrides)
+		if err != nil {
+			return nil, errorf(err, "error retrieving related nodes: %v", err)
+		}
+		for _, ticket := range truncated.Elements() {
+			addFact(reply.Nodes, ticket, TruncatedFact, []byte("true"))
+		}
+		var exported stringset.Set
+		if opts.exportedOnly && len(related) > 0 {
+			var tickets []string
+			for _, r := range related {
+				tickets = append(tickets, r.node.Ticket)
+			}
+			if exported, err = g.exported(ctx, tickets); err != nil {
+				return nil, err
+			}
+		}
+		if opts.withAliases {
+			opts.aliases = make(map[string][]*xpb.CrossReferencesReply_RelatedNode)
+		}
+		if opts.withHierarchy {
+			opts.hierarchy = make(map[string][]*HierarchyNode)
+		}
+		for _, r := range related {
+			if opts.exportedOnly && !exported.Contains(r.node.Ticket) {
+				continue
+			}
+			if opts.withAliases && edges.IsAlias(r.node.RelationKind) {
+				opts.aliases[r.source] = append(opts.aliases[r.source], r.node)
+				allRelatedNodes.Add(r.node.Ticket)
+				continue
+			} else if opts.withHierarchy && edges.IsExtends(r.node.RelationKind) {
+				opts.hierarchy[r.source] = append(opts.hierarchy[r.source], &HierarchyNode{
+					Ticket: r.node.Ticket,
+					Kind:   r.node.RelationKind,
+				})
+				allRelatedNodes.Add(r.node.Ticket)
+				continue
+			}
+			xr := xrefSet(r.source)
+			xr.RelatedNode = append(xr.RelatedNode, r.node)
+			allRelatedNodes.Add(r.node.Ticket)
+		}
+		relatedOffset += len(related)
+		moreRelated = more
+	}
+
+	if opts.withOverrides && req.PageToken == "" {
+		for _, ticket := range req.Ticket {
+			vname, err := parseTicket(ticket)
+			if err != nil {
+				return nil, err
+			}
+			overrides, _, err := g.getEdges(ctx, vname, func(e *spb.Entry) bool {
+				kind, _, _ := edges.ParseOrdinal(e.EdgeKind)
+				return edges.IsOverride(kind)
+			})
+			if err != nil {
+				return nil, errorf(err, "error retrieving overrides: %v", err)
+			}
+			for _, o := range overrides {
+				target := kytheuri.ToString(o.Target)
+				opts.overrides = append(opts.overrides, &Override{
+					Source: ticket,
+					Ticket: target,
+					Kind:   o.Kind,
+				})
+				if len(req.Filter) > 0 {
+					allRelatedNodes.Add(target)
+				}
+			}
+		}
+	}
+
+	if opts.withParams && req.PageToken == "" {
+		opts.params = make(map[string][]*Param)
+		for _, ticket := range req.Ticket {
+			vname, err := parseTicket(ticket)
+			if err != nil {
+				return nil, err
+			}
+			params, err := g.nodeParams(ctx, vname)
+			if err != nil {
+				return nil, errorf(err, "error retrieving params: %v", err)
+			} else if len(params) == 0 {
+				continue
+			}
+			opts.params[ticket] = params
+			if len(req.Filter) > 0 {
+				for _, p := range params {
+					allRelatedNodes.Add(p.Ticket)
+				}
+			}
+		}
+	}
+
+	if !anchorsDone || moreRelated {
+		token, err := encodePageToken(&ipb.PageToken{
+			Index:          int32(relatedOffset),
+			SecondaryToken: edgesToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		reply.NextPageToken = token
+	}
+
+	if !allRelatedNodes.Empty() {
+		nReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: allRelatedNodes.Elements(),
+			Filter: req.Filter,
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving related nodes: %v", err)
+		}
+		for ticket, n := range nReply.Nodes {
+			reply.Nodes[ticket] = n
+		}
+	}
+
+	if len(opts.hierarchy) > 0 {
+		var types stringset.Set
+		for _, hs := range opts.hierarchy {
+			for _, h := range hs {
+				types.Add(h.Ticket)
+			}
+		}
+		_, nres, err := g.NodesWithOptions(ctx, &gpb.NodesRequest{
+			Ticket: types.Elements(),
+			Filter: []string{facts.Code},
+		}, &NodesOptions{MarkedSource: true})
+		if err != nil {
+			return nil, errorf(err, "error retrieving hierarchy names: %v", err)
+		}
+		for _, hs := range opts.hierarchy {
+			for _, h := range hs {
+				if ms, ok := nres.MarkedSource[h.Ticket]; ok {
+					h.Name = markedsource.Render(ms)
+				}
+			}
+		}
+	}
 
-			if count > 0 {
-				reply.CrossReferences[xr.Ticket] = xr
-				totalXRefs += count
+	if opts.withDeprecation && len(reply.CrossReferences) > 0 {
+		var subjects []string
+		for ticket := range reply.CrossReferences {
+			subjects = append(subjects, ticket)
+		}
+		nReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: subjects,
+			Filter: []string{facts.Deprecated},
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving deprecation facts: %v", err)
+		}
+		opts.deprecated = make(map[string]string)
+		for ticket, n := range nReply.Nodes {
+			if msg, ok := n.Facts[facts.Deprecated]; ok {
+				opts.deprecated[ticket] = string(msg)
 			}
 		}
+	}
 
-		if reply.NextPageToken == "" || totalXRefs > 0 {
-			break
+	for _, ticket := range completer.zeroWidth.Elements() {
+		if reply.Nodes == nil {
+			reply.Nodes = make(map[string]*cpb.NodeInfo)
+		}
+		addFact(reply.Nodes, ticket, ZeroWidthFact, []byte("true"))
+	}
+	for ticket, msg := range completer.decodeErrors {
+		if reply.Nodes == nil {
+			reply.Nodes = make(map[string]*cpb.NodeInfo)
 		}
+		addFact(reply.Nodes, ticket, DecodeErrorFact, []byte(msg))
+	}
 
-		// We need to return at least 1 xref, if there are any
-		log.Println("Extra CrossReferences Edges call: ", reply.NextPageToken)
-		eReply, err = g.Edges(ctx, &gpb.EdgesRequest{
-			Ticket:    req.Ticket,
-			PageSize:  int32(requestedPageSize),
-			PageToken: reply.NextPageToken,
-		})
+	if opts.dedupSnippets {
+		dedupSnippets(reply)
+	}
+
+	if opts.withDocs && req.PageToken == "" {
+		docs, err := g.nodeDocs(ctx, req.Ticket, req.AnchorText)
 		if err != nil {
-			return nil, fmt.Errorf("error getting edges for cross-references: %v", err)
+			return nil, err
 		}
-		reply.NextPageToken = eReply.NextPageToken
+		opts.docs = docs
 	}
 
-	if !allRelatedNodes.Empty() {
-		nReply, err := g.Nodes(ctx, &gpb.NodesRequest{
-			Ticket: allRelatedNodes.Elements(),
-			Filter: req.Filter,
+	return reply, nil
+}
+
+type relatedNode struct {
+	source string
+	node   *xpb.CrossReferencesReply_RelatedNode
+}
+
+// relatedNodes returns up to pageSize of the non-anchor edges of the given
+// tickets as related nodes, skipping the first offset.  If skipOverrides is
+// true, overrides edges are also excluded.  The edges are ordered as they are
+// read from the GraphStore, subject to MaxEntriesPerNode.  The returned bool
+// reports whether there are further related nodes past the returned page and
+// the returned set holds the tickets whose reads were truncated.
+func (g *GraphStoreService) relatedNodes(ctx context.Context, tickets []string, offset, pageSize int, skipOverrides bool) ([]*relatedNode, bool, stringset.Set, error) {
+	var (
+		related   []*relatedNode
+		more      bool
+		idx       int
+		truncated stringset.Set
+	)
+	for _, ticket := range tickets {
+		vname, err := parseTicket(ticket)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		trunc, err := g.read(ctx, &spb.ReadRequest{
+			Source:   vname,
+			EdgeKind: "*",
+		}, func(entry *spb.Entry) error {
+			if !graphstore.IsEdge(entry) {
+				return nil
+			}
+			kind, ordinal, _ := edges.ParseOrdinal(entry.EdgeKind)
+			if edges.IsAnchorEdge(kind) || (skipOverrides && edges.IsOverride(kind)) {
+				return nil
+			}
+
+			idx++
+			if idx <= offset {
+				return nil
+			} else if len(related) == pageSize {
+				more = true
+				return io.EOF
+			}
+			related = append(related, &relatedNode{
+				source: ticket,
+				node: &xpb.CrossReferencesReply_RelatedNode{
+					Ticket:       kytheuri.ToString(entry.Target),
+					RelationKind: kind,
+					Ordinal:      int32(ordinal),
+				},
+			})
+			return nil
 		})
 		if err != nil {
-			return nil, fmt.Errorf("error retrieving related nodes: %v", err)
+			return nil, false, nil, errorf(err, "read error: %v", err)
+		} else if trunc {
+			truncated.Add(ticket)
 		}
-		for ticket, n := range nReply.Nodes {
-			reply.Nodes[ticket] = n
+		if more {
+			break
 		}
 	}
+	return related, more, truncated, nil
+}
+
+func decodePageToken(token string) (*ipb.PageToken, error) {
+	rec, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errorf(ErrInvalidPageToken, "%v: %q", ErrInvalidPageToken, token)
+	}
+	var t ipb.PageToken
+	if err := proto.Unmarshal(rec, &t); err != nil || t.Index < 0 {
+		return nil, errorf(ErrInvalidPageToken, "%v: %q", ErrInvalidPageToken, token)
+	}
+	return &t, nil
+}
 
-	return reply, nil
+func encodePageToken(t *ipb.PageToken) (string, error) {
+	rec, err := proto.Marshal(t)
+	if err != nil {
+		return "", errorf(err, "internal error: error marshalling page token: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(rec), nil
+}
+
+// A Diagnostic describes a problem with a particular node that caused it to be
+// skipped, or only partially resolved, while serving a request.
+type Diagnostic struct {
+	Ticket  string
+	Message string
+}
+
+// String implements the fmt.Stringer interface.
+func (d *Diagnostic) String() string { return d.Message }
+
+// diagnostics collects the Diagnostics for a single request.  A nil
+// *diagnostics logs each problem to the standard log package instead.
+type diagnostics struct {
+	list []*Diagnostic
+
+	// log, if non-nil, receives each problem instead of list.
+	log Logger
+}
+
+// logDiagnostics returns a *diagnostics logging each problem to g's Logger.
+func (g *GraphStoreService) logDiagnostics() *diagnostics {
+	return &diagnostics{log: g.logger()}
+}
+
+func (d *diagnostics) addf(ticket, format string, args ...interface{}) {
+	if d == nil {
+		log.Printf(format, args...)
+		return
+	} else if d.log != nil {
+		d.log.Printf(format, args...)
+		return
+	}
+	d.list = append(d.list, &Diagnostic{Ticket: ticket, Message: fmt.Sprintf(format, args...)})
 }
 
 type fileNode struct {
-	text     []byte
-	encoding string
-	norm     *xrefs.Normalizer
+	text        []byte
+	encoding    string
+	buildConfig []byte
+	norm        *xrefs.Normalizer
+
+	// tooLarge is set for a file whose text exceeds MaxFileBytes.  Its text is
+	// nil and its norm is only set if the file has a line index.
+	tooLarge *FileTooLargeError
+
+	// encodingErr is set for a file whose encoding is not supported.  None of
+	// its text can be decoded.
+	encodingErr error
+}
+
+// decode returns the given text of f decoded from f's encoding into UTF-8.
+func (f *fileNode) decode(b []byte) (string, error) {
+	if f.encodingErr != nil {
+		return "", f.encodingErr
+	}
+	return text.ToUTF8(f.encoding, b)
+}
+
+// An anchorCompleter resolves anchor tickets into RelatedAnchors on behalf of
+// a single request.
+type anchorCompleter struct {
+	g     *GraphStoreService
+	diags *diagnostics
+
+	// retrieveText determines whether each anchor's text is populated.
+	retrieveText bool
+
+	// If locationsOnly is true, anchors are completed without their text or
+	// snippets, and a file's text is only fetched if it has no line index.
+	locationsOnly bool
+
+	// files caches parent files across all anchors.
+	files *fileCache
+
+	// If non-nil, only anchors within span are completed.
+	span *spanRestriction
+
+	// If non-nil, nodes is given a facts.BuildConfig fact for each completed
+	// anchor whose node (or parent file) has a build configuration.
+	nodes map[string]*cpb.NodeInfo
+
+	// zeroWidth collects the tickets of each completed zero-width anchor.
+	zeroWidth stringset.Set
+
+	// decodeErrors maps the ticket of each completed anchor whose text or
+	// snippet failed to decode to the first such error.
+	decodeErrors map[string]string
 }
 
 func edgeTickets(edges []*gpb.EdgeSet_Group_Edge) (tickets []string) {
@@ -649,22 +4534,32 @@ func edgeTickets(edges []*gpb.EdgeSet_Group_Edge) (tickets []string) {
 	return
 }
 
-func completeAnchors(ctx context.Context, xs xrefs.GraphService, retrieveText bool, files map[string]*fileNode, edgeKind string, anchors []string) ([]*xpb.CrossReferencesReply_RelatedAnchor, error) {
+func (c *anchorCompleter) completeAnchors(ctx context.Context, edgeKind string, anchors []string) ([]*xpb.CrossReferencesReply_RelatedAnchor, error) {
 	edgeKind = edges.Canonical(edgeKind)
 
-	parents := make(map[string]string)
+	// Most anchors share a handful of files, so each file's ticket is only
+	// encoded once (see tickets.AnchorFile).
+	fileTickets := make(map[kytheuri.URI]string)
+	parents := make(map[string]string, len(anchors))
 	for _, anchor := range anchors {
-		file, err := tickets.AnchorFile(anchor)
+		u, err := kytheuri.Parse(anchor)
 		if err != nil {
-			return nil, fmt.Errorf("invalid anchor %q: %v", anchor, err)
+			return nil, errorf(err, "invalid anchor %q: %v", anchor, err)
+		}
+		key := kytheuri.URI{Corpus: u.Corpus, Root: u.Root, Path: u.Path}
+		file, ok := fileTickets[key]
+		if !ok {
+			file = key.String()
+			fileTickets[key] = file
 		}
 		parents[anchor] = file
 	}
-	reply, err := xs.Nodes(ctx, &gpb.NodesRequest{
+	reply, err := c.g.Nodes(ctx, &gpb.NodesRequest{
 		Ticket: anchors,
 		Filter: []string{
 			schema.AnchorLocFilter,
 			schema.SnippetLocFilter,
+			facts.BuildConfig,
 		},
 	})
 	if err != nil {
@@ -673,9 +4568,9 @@ func completeAnchors(ctx context.Context, xs xrefs.GraphService, retrieveText bo
 
 	var result []*xpb.CrossReferencesReply_RelatedAnchor
 	for ticket, info := range reply.Nodes {
-		start, end, err := getSpan(info.Facts, facts.AnchorStart, facts.AnchorEnd)
+		start, end, err := facts.ValidateAnchor(info.Facts)
 		if err != nil {
-			log.Printf("Invalid anchor span for %q: %v", ticket, err)
+			c.diags.addf(ticket, "Invalid anchor span for %q: %v", ticket, err)
 			continue
 		}
 
@@ -685,50 +4580,68 @@ func completeAnchors(ctx context.Context, xs xrefs.GraphService, retrieveText bo
 			Kind:   edgeKind,
 			Parent: parents[ticket],
 		}
+		if c.span != nil && anchor.Parent != c.span.ticket {
+			// Skip anchors outside of the restricted file before fetching its text.
+			continue
+		}
 
-		// If we haven't already fetched the contents of this file, do so now.
-		file, ok := files[anchor.Parent]
-		if !ok {
-			rsp, err := xs.Nodes(ctx, &gpb.NodesRequest{
-				Ticket: []string{anchor.Parent},
-			})
-			if err != nil {
-				return nil, fmt.Errorf("fetching file contents for %q: %v", anchor.Parent, err)
-			}
-			info := rsp.Nodes[anchor.Parent]
-			text := info.Facts[facts.Text]
-			file = &fileNode{
-				text:     text,
-				encoding: string(info.Facts[facts.TextEncoding]),
-				norm:     xrefs.NewNormalizer(text),
-			}
-			files[anchor.Parent] = file
+		file, err := c.file(ctx, anchor.Parent)
+		if err != nil {
+			return nil, err
+		} else if file.norm == nil {
+			c.diags.addf(ticket, "Skipping anchor %q: %v", ticket, file.tooLarge)
+			continue
 		}
 
 		// Normalize the anchor's bounds relative to the file.
 		anchor.Start, anchor.End, err = normalizeSpan(file.norm, int32(start), int32(end))
 		if err != nil {
-			log.Printf("Invalid anchor span %q in file %q: %v", ticket, anchor.Parent, err)
+			c.diags.addf(ticket, "Invalid anchor span %q in file %q: %v", ticket, anchor.Parent, err)
+			continue
+		}
+
+		if c.span != nil {
+			if ok, err := c.span.contains(anchor.Parent, file, anchor.Start.ByteOffset, anchor.End.ByteOffset); err != nil {
+				return nil, errorf(err, "invalid location: %v", err)
+			} else if !ok {
+				continue
+			}
+		}
+
+		if c.locationsOnly || file.tooLarge != nil {
+			if anchor.Start.ByteOffset == anchor.End.ByteOffset {
+				c.zeroWidth.Add(ticket)
+			}
+			c.addBuildConfig(ticket, info, file)
+			result = append(result, &xpb.CrossReferencesReply_RelatedAnchor{Anchor: anchor})
 			continue
 		}
 
 		// Decode the content of the file spanned by the anchor.
-		if retrieveText && anchor.Start.ByteOffset < anchor.End.ByteOffset {
-			anchor.Text, err = text.ToUTF8(file.encoding, file.text[anchor.Start.ByteOffset:anchor.End.ByteOffset])
+		if anchor.Start.ByteOffset == anchor.End.ByteOffset {
+			// A zero-width anchor (e.g. an implicit reference) has no text; its
+			// snippet is the line containing its point.
+			c.zeroWidth.Add(ticket)
+		} else if c.retrieveText && anchor.Start.ByteOffset < anchor.End.ByteOffset {
+			anchor.Text, err = file.decode(file.text[anchor.Start.ByteOffset:anchor.End.ByteOffset])
 			if err != nil {
-				log.Printf("Error decoding anchor text: %v", err)
+				c.decodeError(ticket, "anchor text", err)
 			}
 		}
 
-		// If the anchor provided snippet bounds, extract the snippet.
-		if snipStart, snipEnd, err := getSpan(reply.Nodes[ticket].Facts, facts.SnippetStart, facts.SnippetEnd); err == nil {
-			start, end, err := normalizeSpan(file.norm, int32(snipStart), int32(snipEnd))
+		// If the anchor provided snippet bounds, extract the snippet.  The
+		// bounds are within the file named by its facts.SnippetFile fact, if
+		// any, rather than its parent.
+		if snipStart, snipEnd, err := facts.ValidateSnippet(reply.Nodes[ticket].Facts); err == nil {
+			snipFile, snipParent, err := c.snippetFile(ctx, info, file, anchor.Parent)
 			if err != nil {
-				log.Printf("Invalid snippet span %q in file %q: %v", ticket, anchor.Parent, err)
+				c.diags.addf(ticket, "Invalid snippet file for %q: %v", ticket, err)
+			} else if start, end, err := normalizeSpan(snipFile.norm, int32(snipStart), int32(snipEnd)); err != nil {
+				c.diags.addf(ticket, "Invalid snippet span %q in file %q: %v", ticket, snipParent, err)
 			} else {
-				anchor.Snippet, err = text.ToUTF8(file.encoding, file.text[start.ByteOffset:end.ByteOffset])
+				anchor.Snippet, err = snipFile.decode(snipFile.text[start.ByteOffset:end.ByteOffset])
 				if err != nil {
-					log.Printf("Error decoding snippet text: %v", err)
+					c.decodeError(ticket, "snippet text", err)
 				}
 				anchor.SnippetStart = start
 				anchor.SnippetEnd = end
@@ -738,48 +4651,267 @@ func completeAnchors(ctx context.Context, xs xrefs.GraphService, retrieveText bo
 		// Fall back to a line-based snippet if the indexer did not provide its
 		// own snippet offsets.
 		if anchor.Snippet == "" {
-			anchor.SnippetStart = &xpb.Location_Point{
-				ByteOffset: anchor.Start.ByteOffset - anchor.Start.ColumnOffset,
-				LineNumber: anchor.Start.LineNumber,
-			}
-			nextLine := file.norm.Point(&xpb.Location_Point{LineNumber: anchor.Start.LineNumber + 1})
-			anchor.SnippetEnd = &xpb.Location_Point{
-				ByteOffset:   nextLine.ByteOffset - 1,
-				LineNumber:   anchor.Start.LineNumber,
-				ColumnOffset: anchor.Start.ColumnOffset + (nextLine.ByteOffset - anchor.Start.ByteOffset - 1),
-			}
-			anchor.Snippet, err = text.ToUTF8(file.encoding,
-				file.text[anchor.SnippetStart.ByteOffset:anchor.SnippetEnd.ByteOffset])
+			lastLine := snippetLastLine(anchor.Start, anchor.End, c.g.MaxSnippetLines)
+			lineStart := file.norm.Point(&xpb.Location_Point{LineNumber: anchor.Start.LineNumber}).ByteOffset
+			nextLine := file.norm.Point(&xpb.Location_Point{LineNumber: lastLine + 1})
+			lineEnd := nextLine.ByteOffset - 1
+			var indent int32
+			if c.g.TrimSnippetIndentation && isUTF8(file.encoding) {
+				// The indentation may not cover any of the anchor itself.
+				indent = commonIndent(file.text[lineStart:lineEnd])
+				if max := anchor.Start.ByteOffset - lineStart; indent > max {
+					indent = max
+				}
+				lineStart += indent
+			}
+			if lastLine == anchor.Start.LineNumber && isUTF8(file.encoding) {
+				// Only UTF-8 text can be safely trimmed without splitting a character.
+				lineStart, lineEnd = trimSnippet(file.text, lineStart, lineEnd, anchor.Start.ByteOffset, anchor.End.ByteOffset, c.g.MaxSnippetWidth)
+			}
+			anchor.SnippetStart = file.norm.ByteOffset(lineStart)
+			anchor.SnippetEnd = file.norm.ByteOffset(lineEnd)
+			anchor.Snippet, err = file.decode(file.text[anchor.SnippetStart.ByteOffset:anchor.SnippetEnd.ByteOffset])
 			if err != nil {
-				log.Printf("Error decoding snippet text: %v", err)
+				c.decodeError(ticket, "snippet text", err)
+			} else if indent > 0 && lastLine > anchor.Start.LineNumber {
+				anchor.Snippet = dedentLines(anchor.Snippet, int(indent))
 			}
 		}
 
+		c.addBuildConfig(ticket, info, file)
 		result = append(result, &xpb.CrossReferencesReply_RelatedAnchor{Anchor: anchor})
 	}
+	sort.Sort(byAnchorLocation(result))
 	return result, nil
 }
 
-func getSpan(facts map[string][]byte, startFact, endFact string) (startOffset, endOffset int, err error) {
-	start := string(facts[startFact])
-	end := string(facts[endFact])
-	if start == "" || end == "" {
-		return 0, 0, fmt.Errorf("missing location facts; found: %s=%q and %s=%q",
-			startFact, start, endFact, end)
+// snippetFile returns the file, and its ticket, containing the indexer-provided
+// snippet of the anchor with the given facts: the file named by its
+// facts.SnippetFile fact, fetched into c.files, or else its parent.
+func (c *anchorCompleter) snippetFile(ctx context.Context, info *cpb.NodeInfo, parent *fileNode, parentTicket string) (*fileNode, string, error) {
+	ref := info.Facts[facts.SnippetFile]
+	if len(ref) == 0 {
+		return parent, parentTicket, nil
 	}
-	so, err := strconv.Atoi(start)
+	u, err := kytheuri.Parse(string(ref))
 	if err != nil {
-		return 0, 0, fmt.Errorf("error parsing %s value %q: %v", startFact, start, err)
+		return nil, "", errorf(ErrInvalidTicket, "%v %q (%s): %v", ErrInvalidTicket, ref, facts.SnippetFile, err)
 	}
-	eo, err := strconv.Atoi(end)
+	ticket := u.String()
+	if ticket == parentTicket {
+		return parent, parentTicket, nil
+	}
+	file, err := c.file(ctx, ticket)
+	if err != nil {
+		return nil, "", err
+	} else if file.tooLarge != nil {
+		return nil, "", file.tooLarge
+	}
+	return file, ticket, nil
+}
+
+// decodeError records that the given part of an anchor's content failed to
+// decode.  The failure is also reported to c.diags.
+func (c *anchorCompleter) decodeError(ticket, what string, err error) {
+	c.diags.addf(ticket, "Error decoding %s of %q: %v", what, ticket, err)
+	if c.decodeErrors == nil {
+		c.decodeErrors = make(map[string]string)
+	}
+	if _, ok := c.decodeErrors[ticket]; !ok {
+		c.decodeErrors[ticket] = err.Error()
+	}
+}
+
+// file returns the parent file with the given ticket, fetching it if it has
+// not already been.  If c.locationsOnly is set and the file has a
+// facts.LineIndex fact, its text is not fetched.
+func (c *anchorCompleter) file(ctx context.Context, ticket string) (*fileNode, error) {
+	return c.files.get(ticket, func() (*fileNode, error) {
+		return c.fetchFile(ctx, ticket)
+	})
+}
+
+func (c *anchorCompleter) fetchFile(ctx context.Context, ticket string) (*fileNode, error) {
+	if c.locationsOnly {
+		rsp, err := c.g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: []string{ticket},
+			Filter: []string{facts.LineIndex, facts.BuildConfig},
+		})
+		if err != nil {
+			return nil, errorf(err, "fetching line index for %q: %v", ticket, err)
+		}
+		if idx := rsp.Nodes[ticket].GetFacts()[facts.LineIndex]; idx != nil {
+			lines, err := facts.ParseLineIndex(idx)
+			if err != nil {
+				c.g.logf("Invalid line index for %q: %v", ticket, err)
+			} else {
+				return &fileNode{
+					buildConfig: rsp.Nodes[ticket].Facts[facts.BuildConfig],
+					norm:        xrefs.NewLineIndexNormalizer(lines),
+				}, nil
+			}
+		}
+	}
+
+	if err := limitsFrom(ctx).addFile(); err != nil {
+		return nil, err
+	}
+	rsp, err := c.g.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: []string{ticket},
+	})
 	if err != nil {
-		return 0, 0, fmt.Errorf("error parsing %s value %q: %v", endFact, end, err)
+		return nil, errorf(err, "fetching file contents for %q: %v", ticket, err)
+	}
+	info := rsp.Nodes[ticket]
+	if info == nil {
+		return nil, errorf(ErrFileNotFound, "%v: %q", ErrFileNotFound, ticket)
+	}
+	text, err := resolveText(ctx, c.g.TextResolver, ticket, info.Facts[facts.Text], info.Facts[facts.TextRef])
+	if err != nil {
+		return nil, errorf(err, "fetching file contents for %q: %v", ticket, err)
+	}
+	text, err = decompressText(text, string(info.Facts[facts.TextCompression]), c.g.MaxFileBytes)
+	if tooLarge, ok := Cause(err).(*FileTooLargeError); ok {
+		tooLarge.Ticket = ticket
+		file := &fileNode{buildConfig: info.Facts[facts.BuildConfig], tooLarge: tooLarge}
+		if idx := info.Facts[facts.LineIndex]; idx != nil {
+			if lines, err := facts.ParseLineIndex(idx); err == nil {
+				file.norm = xrefs.NewLineIndexNormalizer(lines)
+			}
+		}
+		return file, nil
+	} else if err != nil {
+		return nil, errorf(err, "decompressing file contents for %q: %v", ticket, err)
+	}
+	file := &fileNode{
+		text:        text,
+		buildConfig: info.Facts[facts.BuildConfig],
+		norm:        xrefs.NewNormalizer(text),
+	}
+	// The anchors of a file with an unsupported encoding are still located,
+	// but none of their text is decoded.
+	file.encoding, file.encodingErr = textEncoding(string(info.Facts[facts.TextEncoding]))
+	if file.encodingErr != nil {
+		file.encodingErr = errorf(file.encodingErr, "file %q: %v", ticket, file.encodingErr)
 	}
-	if so > eo {
-		return 0, 0, fmt.Errorf("invalid %s/%s span: %d-%d", startFact, endFact, so, eo)
+	return file, nil
+}
+
+// addBuildConfig adds the build configuration of the given anchor (or its
+// parent file) to c.nodes, if requested.
+func (c *anchorCompleter) addBuildConfig(ticket string, info *cpb.NodeInfo, file *fileNode) {
+	if c.nodes == nil {
+		return
+	}
+	buildConfig := info.Facts[facts.BuildConfig]
+	if buildConfig == nil {
+		buildConfig = file.buildConfig
+	}
+	if buildConfig != nil {
+		addFact(c.nodes, ticket, facts.BuildConfig, buildConfig)
+	}
+}
+
+// addFact adds the given fact to the NodeInfo for ticket in nodes, creating
+// the NodeInfo if necessary.
+func addFact(nodes map[string]*cpb.NodeInfo, ticket, name string, value []byte) {
+	info, ok := nodes[ticket]
+	if !ok {
+		info = &cpb.NodeInfo{Facts: make(map[string][]byte)}
+		nodes[ticket] = info
+	}
+	info.Facts[name] = value
+}
+
+// snippetLastLine returns the last line of the line-based snippet for the
+// anchor span [start,end), covering at most maxLines lines.  An anchor ending
+// at the start of a line does not include that line.
+func snippetLastLine(start, end *xpb.Location_Point, maxLines int) int32 {
+	last := end.LineNumber
+	if last > start.LineNumber && end.ColumnOffset == 0 {
+		last--
+	}
+	if maxLines > 0 && last-start.LineNumber >= int32(maxLines) {
+		last = start.LineNumber + int32(maxLines) - 1
+	}
+	if last < start.LineNumber {
+		last = start.LineNumber
+	}
+	return last
+}
+
+// trimSnippet narrows the snippet span [start,end) within text to at most
+// maxWidth bytes centered on the anchor span [anchorStart,anchorEnd).  The
+// returned bounds are adjusted so that they do not split a UTF-8 encoded rune.
+// If maxWidth <= 0, the snippet span is returned unchanged.
+func trimSnippet(text []byte, start, end, anchorStart, anchorEnd int32, maxWidth int) (int32, int32) {
+	width := int32(maxWidth)
+	if width <= 0 || end-start <= width {
+		return start, end
+	}
+
+	s := anchorStart + (anchorEnd-anchorStart)/2 - width/2
+	if s < start {
+		s = start
+	}
+	e := s + width
+	if e > end {
+		e = end
+		s = e - width
+	}
+
+	for s < e && !utf8.RuneStart(text[s]) {
+		s++
+	}
+	for e > s && e < int32(len(text)) && !utf8.RuneStart(text[e]) {
+		e--
+	}
+	return s, e
+}
+
+// commonIndent returns the length in bytes of the leading spaces and tabs
+// shared by every line of text that is not entirely whitespace.
+func commonIndent(text []byte) int32 {
+	var (
+		indent []byte
+		found  bool
+	)
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		rest := bytes.TrimLeft(line, " \t")
+		if len(rest) == 0 {
+			continue
+		}
+		ws := line[:len(line)-len(rest)]
+		if !found {
+			indent, found = ws, true
+			continue
+		}
+		n := 0
+		for n < len(indent) && n < len(ws) && indent[n] == ws[n] {
+			n++
+		}
+		indent = indent[:n]
+	}
+	return int32(len(indent))
+}
+
+// dedentLines removes up to indent leading bytes of whitespace from each line
+// of s after the first.
+func dedentLines(s string, indent int) string {
+	lines := strings.Split(s, "\n")
+	for i := 1; i < len(lines); i++ {
+		n := 0
+		for n < indent && n < len(lines[i]) && (lines[i][n] == ' ' || lines[i][n] == '\t') {
+			n++
+		}
+		lines[i] = lines[i][n:]
 	}
+	return strings.Join(lines, "\n")
+}
 
-	return so, eo, nil
+// isUTF8 reports whether the given text encoding name denotes UTF-8.
+func isUTF8(encoding string) bool {
+	return encoding == "" || strings.EqualFold(encoding, facts.DefaultTextEncoding) || strings.EqualFold(encoding, "utf8")
 }
 
 func normalizeSpan(norm *xrefs.Normalizer, startOffset, endOffset int32) (start, end *xpb.Location_Point, err error) {
@@ -796,7 +4928,251 @@ func normalizeSpan(norm *xrefs.Normalizer, startOffset, endOffset int32) (start,
 	return
 }
 
-// Documentation implements part of the Service interface.
+// documentedKinds are the node kinds whose documentation is read directly by
+// Documentation.  The documentation of nodes of any other kind is left to
+// xrefs.SlowDocumentation.
+var documentedKinds = stringset.New(
+	nodes.Constant,
+	nodes.EnumK,
+	nodes.Function,
+	nodes.Interface,
+	nodes.Package,
+	nodes.Record,
+	nodes.TAlias,
+	nodes.Variable,
+)
+
+// Documentation implements part of the Service interface.  The document of
+// each requested node of one of the documentedKinds is assembled directly from
+// the node's entries and those of its doc nodes.  Nodes of other kinds, and
+// nodes whose documentation may be shared with other nodes through completes
+// edges, are documented by xrefs.SlowDocumentation instead.
 func (g *GraphStoreService) Documentation(ctx context.Context, req *xpb.DocumentationRequest) (*xpb.DocumentationReply, error) {
-	return xrefs.SlowDocumentation(ctx, g, req)
+	ctx, span := g.startSpan(ctx, "GraphStoreService.Documentation")
+	ctx = g.withReadCache(ctx)
+	defer span.End()
+	span.SetAttribute("tickets", len(req.Ticket))
+
+	tickets, err := xrefs.FixTickets(req.Ticket)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make(map[string]*xpb.DocumentationReply_Document)
+	var slow []string
+	var definitionSet stringset.Set
+	for _, ticket := range tickets {
+		document, err := g.document(ctx, ticket)
+		if err != nil {
+			return nil, errorf(err, "error documenting %q: %v", ticket, err)
+		} else if document == nil {
+			slow = append(slow, ticket)
+			continue
+		}
+		documents[ticket] = document
+		definitionSet.Add(ticket)
+		for _, l := range document.Text.GetLink() {
+			definitionSet.Add(l.Definition...)
+		}
+	}
+
+	reply := &xpb.DocumentationReply{}
+	if len(definitionSet) != 0 {
+		defs, err := g.targetDefinitions(ctx, definitionSet.Elements())
+		if err != nil {
+			return nil, errorf(err, "error retrieving definition locations: %v", err)
+		}
+		if len(defs) != 0 {
+			reply.DefinitionLocations = make(map[string]*xpb.Anchor, len(defs))
+			for _, def := range defs {
+				def.Kind = ""
+				reply.DefinitionLocations[def.Ticket] = def
+			}
+		}
+		nReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+			Ticket: definitionSet.Elements(),
+			Filter: req.Filter,
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving linked nodes: %v", err)
+		}
+		if len(nReply.Nodes) != 0 {
+			reply.Nodes = make(map[string]*cpb.NodeInfo, len(nReply.Nodes))
+			for ticket, info := range nReply.Nodes {
+				if def, ok := defs[ticket]; ok {
+					info.Definition = def.Ticket
+				}
+				reply.Nodes[ticket] = info
+			}
+		}
+	}
+
+	if len(slow) != 0 {
+		sReply, err := xrefs.SlowDocumentation(ctx, g, &xpb.DocumentationRequest{
+			Ticket: slow,
+			Filter: req.Filter,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, document := range sReply.Document {
+			documents[document.Ticket] = document
+		}
+		for ticket, info := range sReply.Nodes {
+			if reply.Nodes == nil {
+				reply.Nodes = make(map[string]*cpb.NodeInfo)
+			}
+			reply.Nodes[ticket] = info
+		}
+		for ticket, def := range sReply.DefinitionLocations {
+			if reply.DefinitionLocations == nil {
+				reply.DefinitionLocations = make(map[string]*xpb.Anchor)
+			}
+			reply.DefinitionLocations[ticket] = def
+		}
+	}
+
+	// Documents are returned in the order of their requested tickets.
+	for _, ticket := range tickets {
+		if document, ok := documents[ticket]; ok {
+			reply.Document = append(reply.Document, document)
+		}
+	}
+	return reply, nil
+}
+
+// DocumentationWithURIs is equivalent to Documentation except that it also
+// returns the external documentation URI (the facts.DocURI value) of each
+// returned Document's node, keyed by the Document's ticket, e.g. to link to
+// generated documentation.  Nodes without the fact are absent from the
+// returned map.
+func (g *GraphStoreService) DocumentationWithURIs(ctx context.Context, req *xpb.DocumentationRequest) (*xpb.DocumentationReply, map[string]string, error) {
+	ctx = g.withReadCache(ctx)
+	reply, err := g.Documentation(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uris := make(map[string]string)
+	if len(reply.Document) == 0 {
+		return reply, uris, nil
+	}
+	tickets := make([]string, len(reply.Document))
+	for i, document := range reply.Document {
+		tickets[i] = document.Ticket
+	}
+	nReply, err := g.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: tickets,
+		Filter: []string{facts.DocURI},
+	})
+	if err != nil {
+		return nil, nil, errorf(err, "error retrieving documentation URIs: %v", err)
+	}
+	for ticket, info := range nReply.Nodes {
+		if uri := info.Facts[facts.DocURI]; len(uri) > 0 {
+			uris[ticket] = string(uri)
+		}
+	}
+	return reply, uris, nil
+}
+
+// document returns the Document of the given ticket as read directly by
+// Documentation.  nil is returned if the node must instead be documented by
+// xrefs.SlowDocumentation.
+func (g *GraphStoreService) document(ctx context.Context, ticket string) (*xpb.DocumentationReply_Document, error) {
+	vname, err := parseTicket(ticket)
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := g.nodeEntries(ctx, vname)
+	if err != nil {
+		return nil, errorf(err, "read error: %v", err)
+	}
+
+	var (
+		kind       string
+		code       []byte
+		docTickets stringset.Set
+		bindings   []*spb.VName
+	)
+	for _, entry := range entries {
+		if graphstore.IsNodeFact(entry) {
+			switch entry.FactName {
+			case facts.NodeKind:
+				kind = string(entry.FactValue)
+			case facts.Code:
+				code = entry.FactValue
+			}
+			continue
+		}
+		edgeKind, _, _ := edges.ParseOrdinal(entry.EdgeKind)
+		switch edgeKind {
+		case edges.Mirror(edges.Documents):
+			docTickets.Add(kytheuri.ToString(entry.Target))
+		case edges.Mirror(edges.DefinesBinding):
+			bindings = append(bindings, entry.Target)
+		case edges.Mirror(edges.Completes), edges.Mirror(edges.CompletesUniquely):
+			// The node is completed by another node.
+			return nil, nil
+		}
+	}
+	if !documentedKinds.Contains(kind) {
+		return nil, nil
+	}
+	for _, anchor := range bindings {
+		completes, _, err := g.getEdges(ctx, anchor, func(e *spb.Entry) bool {
+			kind, _, _ := edges.ParseOrdinal(e.EdgeKind)
+			return kind == edges.Completes || kind == edges.CompletesUniquely
+		})
+		if err != nil {
+			return nil, errorf(err, "error retrieving completions: %v", err)
+		} else if len(completes) != 0 {
+			// The node completes another node.
+			return nil, nil
+		}
+	}
+
+	document := &xpb.DocumentationReply_Document{Ticket: ticket, Text: &xpb.Printable{}}
+	if len(docTickets) != 0 {
+		text, err := g.docPrintable(ctx, docTickets, true)
+		if err != nil {
+			return nil, err
+		} else if text != nil {
+			document.Text = text
+		}
+	}
+
+	var ms xpb.MarkedSource
+	if code != nil {
+		if err := proto.Unmarshal(code, &ms); err != nil {
+			return nil, errorf(err, "could not unmarshal signature: %v", err)
+		}
+	}
+	if code != nil && !hasLookups(&ms) {
+		document.MarkedSource = &ms
+	} else {
+		// Signatures requiring lookups in other nodes are resolved generically.
+		document.MarkedSource, err = xrefs.SlowSignature(ctx, g, ticket)
+		if err != nil {
+			return nil, errorf(err, "error retrieving signature: %v", err)
+		}
+	}
+	return document, nil
+}
+
+// hasLookups reports whether ms, or any of its children, must be substituted
+// with marked source derived from the param edges of its context node.
+func hasLookups(ms *xpb.MarkedSource) bool {
+	switch ms.Kind {
+	case xpb.MarkedSource_PARAMETER_LOOKUP_BY_PARAM,
+		xpb.MarkedSource_LOOKUP_BY_PARAM,
+		xpb.MarkedSource_PARAMETER_LOOKUP_BY_PARAM_WITH_DEFAULTS:
+		return true
+	}
+	for _, c := range ms.Child {
+		if hasLookups(c) {
+			return true
+		}
+	}
+	return false
 }
@@ -17,153 +17,4860 @@
 package xrefs
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"kythe.io/kythe/go/services/graphstore"
 	"kythe.io/kythe/go/services/xrefs"
-	"kythe.io/kythe/go/storage/inmemory"
 	"kythe.io/kythe/go/test/testutil"
 	"kythe.io/kythe/go/util/kytheuri"
 	"kythe.io/kythe/go/util/schema/edges"
 	"kythe.io/kythe/go/util/schema/facts"
 	"kythe.io/kythe/go/util/schema/nodes"
 
+	"bitbucket.org/creachadair/stringset"
+	"github.com/golang/protobuf/proto"
+
 	cpb "kythe.io/kythe/proto/common_proto"
 	gpb "kythe.io/kythe/proto/graph_proto"
 	spb "kythe.io/kythe/proto/storage_proto"
 	xpb "kythe.io/kythe/proto/xref_proto"
 )
 
-var (
-	ctx = context.Background()
+var (
+	ctx = context.Background()
+
+	testFileVName    = sig("testFileNode")
+	testFileContent  = "file_content"
+	testFileEncoding = "UTF-8"
+
+	testAnchorVName       = sig("testAnchor")
+	testAnchorTargetVName = sig("someSemanticNode")
+
+	testNodes = []*node{
+		{sig("orphanedNode"), newFacts(facts.NodeKind, "orphan"), nil},
+		{testFileVName, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, testFileContent,
+			facts.TextEncoding, testFileEncoding), map[string][]*spb.VName{
+			revChildOfEdgeKind: {testAnchorVName},
+		}},
+		{sig("sig2"), newFacts(facts.NodeKind, "test"), map[string][]*spb.VName{
+			"someEdgeKind": {sig("signature")},
+		}},
+		{sig("signature"), newFacts(facts.NodeKind, "test"), map[string][]*spb.VName{
+			edges.Mirror("someEdgeKind"): {sig("sig2")},
+			edges.Param:                  {sig("sig2"), sig("someParameter")},
+		}},
+		{testAnchorVName, newFacts(
+			facts.AnchorEnd, "4",
+			facts.AnchorStart, "1",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.ChildOf: {testFileVName},
+			edges.Ref:     {testAnchorTargetVName},
+		}},
+		{testAnchorTargetVName, newFacts(facts.NodeKind, "record"), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {testAnchorVName},
+		}},
+	}
+	testEntries = nodesToEntries(testNodes)
+)
+
+func TestNewGraphStoreServiceWithContext(t *testing.T) {
+	if _, err := NewGraphStoreServiceWithContext(ctx, newService(t, testEntries).gs); err != nil {
+		t.Errorf("Unexpected probe error: %v", err)
+	}
+	if xs, err := NewGraphStoreServiceWithContext(ctx, new(MemGraphStore)); err == nil {
+		t.Errorf("Expected probe error for empty GraphStore; found %v", xs)
+	}
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if xs, err := NewGraphStoreServiceWithContext(timeoutCtx, blockingGraphStore(unblock)); err == nil {
+		t.Errorf("Expected probe error for unresponsive GraphStore; found %v", xs)
+	}
+}
+
+// errorGraphStore is a graphstore.Service that always fails with the given
+// error.
+type errorGraphStore struct{ err error }
+
+func (e errorGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return e.err
+}
+
+func (e errorGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return e.err
+}
+
+func (e errorGraphStore) Write(ctx context.Context, req *spb.WriteRequest) error { return e.err }
+func (e errorGraphStore) Close(ctx context.Context) error                        { return nil }
+
+// blockingGraphStore is a graphstore.Service whose Scan ignores its context
+// and blocks until the given channel is closed.
+type blockingGraphStore chan struct{}
+
+func (b blockingGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return errors.New("unimplemented")
+}
+
+func (b blockingGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	<-b
+	return nil
+}
+
+func (b blockingGraphStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return errors.New("unimplemented")
+}
+
+func (b blockingGraphStore) Close(ctx context.Context) error { return nil }
+
+func TestCheckReverseEdges(t *testing.T) {
+	a, b, c := sig("a"), sig("b"), sig("c")
+	xs := newService(t, []*spb.Entry{
+		nodeFact(a, facts.NodeKind, nodes.Function),
+		edgeFact(a, edges.Ref, 0, b),
+		edgeFact(a, edges.Param, 1, c),
+		edgeFact(a, edges.Mirror(edges.Ref), 0, c),
+		edgeFact(b, edges.Mirror(edges.Ref), 0, a),
+	})
+
+	missing, err := xs.CheckReverseEdges(ctx, kytheuri.ToString(a))
+	if err != nil {
+		t.Fatalf("CheckReverseEdges error: %v", err)
+	}
+	expected := []*MissingReverseEdge{{
+		Source: kytheuri.ToString(a),
+		Kind:   edges.Param + ".1",
+		Target: kytheuri.ToString(c),
+	}}
+	if err := testutil.DeepEqual(expected, missing); err != nil {
+		t.Error(err)
+	}
+
+	// Reverse edges are not themselves checked.
+	if missing, err := xs.CheckReverseEdges(ctx, kytheuri.ToString(b)); err != nil {
+		t.Fatalf("CheckReverseEdges error: %v", err)
+	} else if len(missing) != 0 {
+		t.Errorf("Unexpected missing reverse edges: %v", missing)
+	}
+
+	if _, err := xs.CheckReverseEdges(ctx, "kythe://corpus?bad=param"); err == nil {
+		t.Error("CheckReverseEdges with an invalid ticket succeeded")
+	}
+}
+
+func TestAddReverseEdgesCancelled(t *testing.T) {
+	var entries []*spb.Entry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, edgeFact(sig(fmt.Sprintf("source%d", i)), edges.Ref, 0, sig(fmt.Sprintf("target%d", i))))
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	gs := &cancellingGraphStore{entries: entries, cancelAfter: 3, cancel: cancel}
+	res, err := addReverseEdges(cancelCtx, gs)
+	if err == nil {
+		t.Fatal("Expected error from cancelled addReverseEdges")
+	} else if !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("Expected cancellation error; found %v", err)
+	}
+	if gs.written != gs.cancelAfter {
+		t.Errorf("Wrote %d reverse edges; expected %d", gs.written, gs.cancelAfter)
+	} else if res.AddedCount != gs.written {
+		t.Errorf("Reported %d reverse edges added; expected %d", res.AddedCount, gs.written)
+	}
+}
+
+func TestWriteWithReverse(t *testing.T) {
+	source, x, y := sig("source"), sig("x"), sig("y")
+	gs := NewMemGraphStore()
+	if err := WriteWithReverse(ctx, gs, &spb.WriteRequest{
+		Source: source,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: facts.NodeKind, FactValue: []byte(nodes.Function)},
+			{Target: x, EdgeKind: edges.Param, FactName: "/"},
+			{Target: y, EdgeKind: edges.Param + ".1", FactName: "/"},
+			{Target: x, EdgeKind: edges.ChildOf, FactName: "/"},
+			{Target: y, EdgeKind: edges.Mirror(edges.Ref), FactName: "/"},
+		},
+	}); err != nil {
+		t.Fatalf("WriteWithReverse error: %v", err)
+	}
+
+	tests := []struct {
+		source   *spb.VName
+		expected []*spb.Entry
+	}{
+		{x, []*spb.Entry{
+			edgeFact(x, edges.Mirror(edges.ChildOf), 0, source),
+			edgeFact(x, edges.Mirror(edges.Param), 0, source),
+		}},
+		// The reverse edge in the request is written as given.
+		{y, []*spb.Entry{
+			edgeFact(y, edges.Mirror(edges.Param), 1, source),
+		}},
+	}
+	for _, test := range tests {
+		found, err := NodeEntries(ctx, gs, test.source)
+		if err != nil {
+			t.Fatalf("NodeEntries error: %v", err)
+		}
+		if err := testutil.DeepEqual(test.expected, found); err != nil {
+			t.Errorf("Entries of %v: %v", test.source, err)
+		}
+	}
+
+	entries, err := NodeEntries(ctx, gs, source)
+	if err != nil {
+		t.Fatalf("NodeEntries error: %v", err)
+	} else if len(entries) != 5 {
+		t.Errorf("Expected 5 entries for %v; found %v", source, entries)
+	}
+}
+
+// cancellingGraphStore is a graphstore.Service that scans a fixed set of
+// entries and calls cancel once cancelAfter entries have been written.
+type cancellingGraphStore struct {
+	entries     []*spb.Entry
+	written     int
+	cancelAfter int
+	cancel      func()
+}
+
+func (c *cancellingGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return nil // no reverse edges are stored
+}
+
+func (c *cancellingGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	for _, e := range c.entries {
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cancellingGraphStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	c.written += len(req.Update)
+	if c.written >= c.cancelAfter {
+		c.cancel()
+	}
+	return nil
+}
+
+func (c *cancellingGraphStore) Close(ctx context.Context) error { return nil }
+
+func TestNodeEntries(t *testing.T) {
+	source, x, y := sig("source"), sig("x"), sig("y")
+	expected := []*spb.Entry{
+		nodeFact(source, facts.NodeKind, nodes.Function),
+		nodeFact(source, facts.Text, "text"),
+		edgeFact(source, edges.Param, 0, x),
+		edgeFact(source, edges.Param, 1, y),
+		edgeFact(source, edges.Ref, 0, x),
+	}
+	gs := reversedGraphStore{NewMemGraphStore(append(expected,
+		nodeFact(x, facts.NodeKind, nodes.Variable),
+		edgeFact(y, edges.Param, 0, source),
+	)...)}
+
+	found, err := NodeEntries(ctx, gs, source)
+	if err != nil {
+		t.Fatalf("NodeEntries error: %v", err)
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Error(err)
+	}
+}
+
+// reversedGraphStore is a graphstore.Service whose Read returns entries in the
+// reverse of the underlying GraphStore's order.
+type reversedGraphStore struct{ graphstore.Service }
+
+func (r reversedGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	var entries []*spb.Entry
+	if err := r.Service.Read(ctx, req, func(e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := f(entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestNodes(t *testing.T) {
+	xs := newService(t, testEntries)
+
+	reply, err := xs.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: nodesToTickets(testNodes),
+	})
+	if err != nil {
+		t.Fatalf("Error fetching nodes for %+v: %v", nodesToTickets(testNodes), err)
+	}
+	expected := nodesToInfos(testNodes)
+	if err := testutil.DeepEqual(expected, reply.Nodes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodesExcludeFilter(t *testing.T) {
+	xs := newService(t, testEntries)
+
+	ticket := kytheuri.ToString(testFileVName)
+	reply, err := xs.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: []string{ticket},
+		Filter: []string{"/kythe/**", "-" + facts.Text},
+	})
+	if err != nil {
+		t.Fatalf("Error fetching nodes for %q: %v", ticket, err)
+	}
+	expected := map[string]*cpb.NodeInfo{
+		ticket: {
+			Facts: map[string][]byte{
+				facts.NodeKind:     []byte(nodes.File),
+				facts.TextEncoding: []byte(testFileEncoding),
+			},
+		},
+	}
+	if err := testutil.DeepEqual(expected, reply.Nodes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodesCombinedKinds(t *testing.T) {
+	class, fn := sig("class"), sig("fn")
+	xs := newService(t, nodesToEntries([]*node{
+		{class, newFacts(facts.NodeKind, nodes.Record, facts.Subkind, nodes.Class), nil},
+		{fn, newFacts(facts.NodeKind, nodes.Function), nil},
+	}))
+	xs.CombinedKinds = true
+
+	classTicket, fnTicket := kytheuri.ToString(class), kytheuri.ToString(fn)
+	reply, err := xs.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: []string{classTicket, fnTicket},
+		Filter: []string{facts.NodeKind},
+	})
+	if err != nil {
+		t.Fatalf("Nodes error: %v", err)
+	}
+	expected := map[string]*cpb.NodeInfo{
+		classTicket: {Facts: map[string][]byte{
+			facts.NodeKind:   []byte(nodes.Record),
+			CombinedKindFact: []byte("record/class"),
+		}},
+		fnTicket: {Facts: map[string][]byte{
+			facts.NodeKind:   []byte(nodes.Function),
+			CombinedKindFact: []byte(nodes.Function),
+		}},
+	}
+	if err := testutil.DeepEqual(expected, reply.Nodes); err != nil {
+		t.Error(err)
+	}
+
+	reply, err = xs.Nodes(ctx, &gpb.NodesRequest{
+		Ticket: []string{classTicket},
+		Filter: []string{facts.Subkind},
+	})
+	if err != nil {
+		t.Fatalf("Nodes error: %v", err)
+	} else if _, ok := reply.Nodes[classTicket].GetFacts()[CombinedKindFact]; ok {
+		t.Errorf("Unexpected %s fact without %s: %v", CombinedKindFact, facts.NodeKind, reply.Nodes)
+	}
+}
+
+func TestNodesWithModifiers(t *testing.T) {
+	method, plain := sig("method"), sig("plain")
+	xs := newService(t, []*spb.Entry{
+		nodeFact(method, facts.NodeKind, nodes.Function),
+		nodeFact(method, facts.TagStatic, ""),
+		nodeFact(method, facts.TagConst, ""),
+		nodeFact(method, facts.TagAbstract, ""),
+		nodeFact(plain, facts.NodeKind, nodes.Function),
+	})
+
+	methodTicket, plainTicket := kytheuri.ToString(method), kytheuri.ToString(plain)
+	expected := map[string][]Modifier{
+		methodTicket: {ModifierAbstract, ModifierConst, ModifierStatic},
+	}
+	for _, filter := range [][]string{nil, {facts.NodeKind}} {
+		reply, res, err := xs.NodesWithOptions(ctx, &gpb.NodesRequest{
+			Ticket: []string{methodTicket, plainTicket},
+			Filter: filter,
+		}, &NodesOptions{Modifiers: true})
+		if err != nil {
+			t.Fatalf("NodesWithOptions error: %v", err)
+		} else if len(reply.Nodes) != 2 {
+			t.Errorf("Filter %q: expected 2 nodes; found %v", filter, reply.Nodes)
+		}
+		if err := testutil.DeepEqual(expected, res.Modifiers); err != nil {
+			t.Errorf("Filter %q: %v", filter, err)
+		}
+	}
+}
+
+func TestNodesWithMarkedSource(t *testing.T) {
+	ms := &xpb.MarkedSource{
+		Kind:     xpb.MarkedSource_IDENTIFIER,
+		PreText:  "someFunction",
+		PostText: "()",
+	}
+	code, err := proto.Marshal(ms)
+	if err != nil {
+		t.Fatalf("Error marshaling MarkedSource: %v", err)
+	}
+
+	withCode := sig("withCode")
+	badCode := sig("badCode")
+	noCode := sig("noCode")
+	xs := newService(t, nodesToEntries([]*node{
+		{withCode, newFacts(facts.NodeKind, nodes.Function, facts.Code, string(code)), nil},
+		{badCode, newFacts(facts.NodeKind, nodes.Function, facts.Code, "\xff\xff"), nil},
+		{noCode, newFacts(facts.NodeKind, nodes.Function), nil},
+	}))
+
+	tickets := []string{kytheuri.ToString(withCode), kytheuri.ToString(badCode), kytheuri.ToString(noCode)}
+	expected := map[string]*xpb.MarkedSource{kytheuri.ToString(withCode): ms}
+	for _, filter := range [][]string{nil, {facts.NodeKind}} {
+		reply, res, err := xs.NodesWithOptions(ctx, &gpb.NodesRequest{
+			Ticket: tickets,
+			Filter: filter,
+		}, &NodesOptions{MarkedSource: true})
+		if err != nil {
+			t.Fatalf("NodesWithOptions error: %v", err)
+		}
+		if len(reply.Nodes) != len(tickets) {
+			t.Errorf("Expected %d nodes; found %v", len(tickets), reply.Nodes)
+		}
+		if err := testutil.DeepEqual(expected, res.MarkedSource); err != nil {
+			t.Errorf("Filter %v: %v", filter, err)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	xs := newService(t, testEntries)
+	tracer := &recordingTracer{}
+	xs.Tracer = tracer
+
+	tickets := nodesToTickets(testNodes)
+	if _, err := xs.Nodes(ctx, &gpb.NodesRequest{Ticket: tickets}); err != nil {
+		t.Fatalf("Error fetching nodes for %+v: %v", tickets, err)
+	}
+
+	if len(tracer.spans) != len(tickets)+1 {
+		t.Fatalf("Expected %d spans; found %v", len(tickets)+1, tracer.spans)
+	}
+	root := tracer.spans[0]
+	if root.name != "GraphStoreService.Nodes" || root.parent != nil || !root.ended {
+		t.Errorf("Unexpected root span: %+v", root)
+	} else if n := root.attrs["tickets"]; n != len(tickets) {
+		t.Errorf("Found %v tickets in root span; expected %d", n, len(tickets))
+	}
+	var entries int
+	for _, span := range tracer.spans[1:] {
+		if span.name != "GraphStore.Read" || span.parent != root || !span.ended {
+			t.Errorf("Unexpected child span: %+v", span)
+		}
+		entries += span.attrs["entries"].(int)
+	}
+	var expected int
+	for _, n := range testNodes {
+		expected += len(n.Facts)
+	}
+	if entries != expected {
+		t.Errorf("Found %d entries read; expected %d", entries, expected)
+	}
+}
+
+type recordingSpan struct {
+	name   string
+	parent *recordingSpan
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *recordingSpan) End()                                       { s.ended = true }
+
+type spanKey struct{}
+
+// recordingTracer is a Tracer that records each span started.
+type recordingTracer struct{ spans []*recordingSpan }
+
+func (r *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordingSpan)
+	span := &recordingSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	r.spans = append(r.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestMaxEntriesPerNode(t *testing.T) {
+	xs := newService(t, testEntries)
+	xs.MaxEntriesPerNode = 2
+
+	fileTicket := kytheuri.ToString(testFileVName)
+	nodesReply, err := xs.Nodes(ctx, &gpb.NodesRequest{Ticket: []string{fileTicket}})
+	if err != nil {
+		t.Fatalf("Error fetching nodes for %q: %v", fileTicket, err)
+	}
+	if info := nodesReply.Nodes[fileTicket]; info == nil {
+		t.Errorf("Missing node for %q", fileTicket)
+	} else if len(info.Facts) != 3 || string(info.Facts[TruncatedFact]) != "true" {
+		t.Errorf("Expected 2 facts and a truncation marker; found %v", info.Facts)
+	}
+
+	ticket := kytheuri.ToString(sig("signature"))
+	edgesReply, err := xs.Edges(ctx, &gpb.EdgesRequest{Ticket: []string{ticket}})
+	if err != nil {
+		t.Fatalf("Error fetching edges for %q: %v", ticket, err)
+	}
+	var found int
+	for _, grp := range edgesReply.EdgeSets[ticket].GetGroups() {
+		found += len(grp.Edge)
+	}
+	if found != 1 {
+		t.Errorf("Expected 1 edge; found %v", edgesReply.EdgeSets)
+	}
+	if info := edgesReply.Nodes[ticket]; info == nil || string(info.Facts[TruncatedFact]) != "true" {
+		t.Errorf("Expected truncation marker for %q; found %v", ticket, edgesReply.Nodes)
+	}
+
+	xs.MaxEntriesPerNode = 0
+	edgesReply, err = xs.Edges(ctx, &gpb.EdgesRequest{Ticket: []string{ticket}})
+	if err != nil {
+		t.Fatalf("Error fetching edges for %q: %v", ticket, err)
+	}
+	if info := edgesReply.Nodes[ticket]; info != nil {
+		t.Errorf("Unexpected node for %q: %v", ticket, info)
+	}
+}
+
+func TestMaxEntriesPerNodeRelatedNodes(t *testing.T) {
+	source, a, b, c := sig("source"), sig("a"), sig("b"), sig("c")
+	xs := newService(t, nodesToEntries([]*node{
+		{source, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Param: {a, b, c},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(source)
+	req := &xpb.CrossReferencesRequest{
+		Ticket: []string{ticket},
+		Filter: []string{facts.NodeKind},
+	}
+	for _, test := range []struct {
+		maxEntries int
+		related    int
+		truncated  bool
+	}{
+		{0, 3, false},
+		{2, 1, true}, // the node's kind fact and its first param
+	} {
+		xs.MaxEntriesPerNode = test.maxEntries
+		reply, err := xs.CrossReferences(ctx, req)
+		if err != nil {
+			t.Fatalf("CrossReferences error: %v", err)
+		}
+		if related := reply.CrossReferences[ticket].GetRelatedNode(); len(related) != test.related {
+			t.Errorf("MaxEntriesPerNode %d: expected %d related nodes; found %v", test.maxEntries, test.related, related)
+		}
+		if truncated := string(reply.Nodes[ticket].GetFacts()[TruncatedFact]) == "true"; truncated != test.truncated {
+			t.Errorf("MaxEntriesPerNode %d: expected truncated %v; found %v", test.maxEntries, test.truncated, reply.Nodes)
+		}
+	}
+}
+
+func TestParseTicket(t *testing.T) {
+	valid := "kythe://corpus?lang=go?path=some/file#sig"
+	if vname, err := parseTicket(valid); err != nil {
+		t.Errorf("parseTicket(%q) error: %v", valid, err)
+	} else if err := testutil.DeepEqual(&spb.VName{
+		Corpus:    "corpus",
+		Language:  "go",
+		Path:      "some/file",
+		Signature: "sig",
+	}, vname); err != nil {
+		t.Error(err)
+	}
+
+	for _, ticket := range []string{
+		"kythe://corpus?lang=%zz",
+		"kythe://corpus?path=some/%01file",
+		"kythe://corpus#sig%7f",
+		"kythe://corpus?root=%ff",
+		"kythe://corpus?path=" + strings.Repeat("a", MaxTicketLength),
+	} {
+		if vname, err := parseTicket(ticket); err == nil {
+			t.Errorf("parseTicket(%.64q) succeeded: %v", ticket, vname)
+		} else if !strings.Contains(err.Error(), fmt.Sprintf("%.64q", ticket)[:16]) {
+			t.Errorf("parseTicket(%.64q) error does not name the ticket: %v", ticket, err)
+		}
+	}
+
+	xs := newService(t, testEntries)
+	bad := "kythe://corpus?path=%00"
+	if reply, err := xs.Nodes(ctx, &gpb.NodesRequest{Ticket: []string{bad}}); err == nil {
+		t.Errorf("Expected Nodes error; found %v", reply)
+	}
+	if reply, err := xs.Edges(ctx, &gpb.EdgesRequest{Ticket: []string{bad}}); err == nil {
+		t.Errorf("Expected Edges error; found %v", reply)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	file := fileVName("file")
+	xs := newService(t, []*spb.Entry{
+		nodeFact(file, facts.NodeKind, nodes.File),
+	})
+
+	tests := []struct {
+		name     string
+		call     func() error
+		expected error
+	}{
+		{"Edges no tickets", func() error {
+			_, err := xs.Edges(ctx, &gpb.EdgesRequest{})
+			return err
+		}, ErrNoTickets},
+		{"Nodes invalid ticket", func() error {
+			_, err := xs.Nodes(ctx, &gpb.NodesRequest{Ticket: []string{"kythe://corpus?bad=param"}})
+			return err
+		}, ErrInvalidTicket},
+		{"CrossReferences invalid ticket", func() error {
+			_, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{Ticket: []string{"kythe://corpus?bad=param"}})
+			return err
+		}, ErrInvalidTicket},
+		{"Definitions invalid ticket", func() error {
+			_, err := xs.Definitions(ctx, []string{"kythe://corpus?path=some/%01file"})
+			return err
+		}, ErrInvalidTicket},
+		{"CheckReverseEdges invalid ticket", func() error {
+			_, err := xs.CheckReverseEdges(ctx, "kythe://corpus?path=some/%01file")
+			return err
+		}, ErrInvalidTicket},
+		{"Files invalid prefix", func() error {
+			_, _, err := xs.Files(ctx, "kythe://corpus?bad=param", 0, "")
+			return err
+		}, ErrInvalidTicket},
+		{"Decorations missing file", func() error {
+			_, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+				Location: &xpb.Location{Ticket: kytheuri.ToString(fileVName("missing"))},
+			})
+			return err
+		}, ErrFileNotFound},
+		{"Decorations without text", func() error {
+			_, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+				Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+				SourceText: true,
+			})
+			return err
+		}, ErrFileNotFound},
+		{"Decorations dirty buffer", func() error {
+			_, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+				Location:    &xpb.Location{Ticket: kytheuri.ToString(file)},
+				DirtyBuffer: []byte("text"),
+			})
+			return err
+		}, ErrUnimplemented},
+	}
+	for _, test := range tests {
+		if err := test.call(); Cause(err) != test.expected {
+			t.Errorf("%s: expected %v; found %v", test.name, test.expected, err)
+		}
+	}
+}
+
+// TestParseTicketRoundTrip checks random VNames, including ones with control
+// characters and invalid UTF-8, through kytheuri.ToString and parseTicket.
+func TestParseTicketRoundTrip(t *testing.T) {
+	alphabet := []string{"a", "Z", "0", "/", ".", "?", "#", "%", "=", ":", "@", " ", "\x00", "\n", "\x7f", "\u0085", "\xff", "\u00e9", "\u4e16"}
+	rng := rand.New(rand.NewSource(0))
+	field := func() string {
+		var buf bytes.Buffer
+		for n := rng.Intn(8); n > 0; n-- {
+			buf.WriteString(alphabet[rng.Intn(len(alphabet))])
+		}
+		return buf.String()
+	}
+	valid := func(v *spb.VName) bool {
+		for _, s := range []string{v.Signature, v.Corpus, v.Root, v.Path, v.Language} {
+			if !utf8.ValidString(s) || strings.IndexFunc(s, unicode.IsControl) >= 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < 10000; i++ {
+		v := &spb.VName{
+			Signature: field(),
+			Corpus:    field(),
+			Root:      field(),
+			Path:      field(),
+			Language:  field(),
+		}
+		ticket := kytheuri.ToString(v)
+		parsed, err := parseTicket(ticket)
+		if err != nil {
+			if valid(v) {
+				t.Errorf("parseTicket(%q) error: %v", ticket, err)
+			}
+			continue
+		} else if !valid(parsed) {
+			t.Errorf("parseTicket(%q) accepted invalid VName: %v", ticket, parsed)
+			continue
+		}
+
+		// The parsed VName must survive another round-trip unchanged.
+		again, err := parseTicket(kytheuri.ToString(parsed))
+		if err != nil {
+			t.Errorf("parseTicket(ToString(%v)) error: %v", parsed, err)
+		} else if err := testutil.DeepEqual(parsed, again); err != nil {
+			t.Errorf("Round-trip of %q: %v", ticket, err)
+		}
+	}
+}
+
+func TestBatchNodes(t *testing.T) {
+	const invalid = "kythe://corpus?lang=%zz"
+	tickets := append(nodesToTickets(testNodes), invalid)
+
+	xs := newService(t, testEntries)
+	if reply, err := xs.Nodes(ctx, &gpb.NodesRequest{Ticket: tickets}); err == nil {
+		t.Errorf("Expected Nodes error; found %v", reply)
+	}
+
+	reply, errs, err := xs.BatchNodes(ctx, &gpb.NodesRequest{Ticket: tickets})
+	if err != nil {
+		t.Fatalf("BatchNodes error: %v", err)
+	}
+	if err := testutil.DeepEqual(nodesToInfos(testNodes), reply.Nodes); err != nil {
+		t.Error(err)
+	}
+	if len(errs) != 1 || errs[invalid] == nil {
+		t.Errorf("Expected an error only for %q; found %v", invalid, errs)
+	}
+
+	readErr := errors.New("sentinel read error")
+	xs = NewGraphStoreService(errorGraphStore{readErr})
+	reply, errs, err = xs.BatchNodes(ctx, &gpb.NodesRequest{Ticket: tickets})
+	if err != nil {
+		t.Fatalf("BatchNodes error: %v", err)
+	} else if len(reply.Nodes) != 0 {
+		t.Errorf("Unexpected nodes: %v", reply.Nodes)
+	}
+	for _, ticket := range tickets {
+		if errs[ticket] == nil {
+			t.Errorf("Missing error for %q", ticket)
+		}
+	}
+}
+
+func TestNodesWildcard(t *testing.T) {
+	fooA, fooB, bar := fileVName("foo/a"), fileVName("foo/b"), fileVName("bar/c")
+	anchor := anchorVName(fooA, "anchor")
+	entries := []*spb.Entry{
+		nodeFact(fooA, facts.NodeKind, nodes.File),
+		nodeFact(fooB, facts.NodeKind, nodes.File),
+		nodeFact(bar, facts.NodeKind, nodes.File),
+		nodeFact(anchor, facts.NodeKind, nodes.Anchor),
+		edgeFact(anchor, edges.ChildOf, 0, fooA),
+	}
+
+	tests := []struct {
+		ticket   string
+		expected []*spb.VName
+	}{
+		{"kythe://corpus?path=foo/**", []*spb.VName{fooA, fooB, anchor}},
+		{"kythe://corpus?lang=lang?path=foo/**", []*spb.VName{anchor}},
+		{"kythe://corpus?path=**", []*spb.VName{fooA, fooB, bar, anchor}},
+		{"kythe://other?path=foo/**", nil},
+		{kytheuri.ToString(bar), []*spb.VName{bar}},
+	}
+
+	xs := newService(t, entries)
+	for _, test := range tests {
+		req := &gpb.NodesRequest{Ticket: []string{test.ticket}, Filter: []string{facts.NodeKind}}
+
+		xs.AllowScan = false
+		if reply, err := xs.Nodes(ctx, req); err != nil {
+			t.Fatalf("Nodes error: %v", err)
+		} else if strings.HasSuffix(test.ticket, "**") && len(reply.Nodes) != 0 {
+			t.Errorf("Unexpected nodes for %q without AllowScan: %v", test.ticket, reply.Nodes)
+		}
+
+		xs.AllowScan = true
+		reply, err := xs.Nodes(ctx, req)
+		if err != nil {
+			t.Fatalf("Nodes error: %v", err)
+		}
+		var found stringset.Set
+		for ticket := range reply.Nodes {
+			found.Add(ticket)
+		}
+		var expected stringset.Set
+		for _, v := range test.expected {
+			expected.Add(kytheuri.ToString(v))
+		}
+		if err := testutil.DeepEqual(expected.Elements(), found.Elements()); err != nil {
+			t.Errorf("Nodes for %q: %v", test.ticket, err)
+		}
+	}
+
+	xs.MaxScanResults = 2
+	reply, err := xs.Nodes(ctx, &gpb.NodesRequest{Ticket: []string{"kythe://corpus?path=foo/**"}})
+	if _, ok := Cause(err).(*LimitError); !ok {
+		t.Errorf("Expected LimitError exceeding MaxScanResults; found %v, %v", reply, err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	fooA, fooB, fooC, bar := fileVName("foo/a"), fileVName("foo/b"), fileVName("foo/c"), fileVName("bar/d")
+	anchor := anchorVName(fooA, "anchor")
+	xs := newService(t, []*spb.Entry{
+		nodeFact(fooA, facts.NodeKind, nodes.File),
+		nodeFact(fooA, facts.Text, "a\n"),
+		nodeFact(fooB, facts.Text, "b\n"),
+		nodeFact(fooC, facts.NodeKind, nodes.File),
+		nodeFact(bar, facts.NodeKind, nodes.File),
+		nodeFact(anchor, facts.NodeKind, nodes.Anchor),
+		edgeFact(anchor, edges.ChildOf, 0, fooA),
+	})
+
+	tests := []struct {
+		prefix   string
+		expected []*spb.VName
+	}{
+		{"kythe://corpus?path=foo/", []*spb.VName{fooA, fooB, fooC}},
+		{"kythe://corpus", []*spb.VName{bar, fooA, fooB, fooC}},
+		{"kythe://corpus?path=bar", []*spb.VName{bar}},
+		{"kythe://other?path=foo/", nil},
+	}
+	for _, test := range tests {
+		files, next, err := xs.Files(ctx, test.prefix, 0, "")
+		if err != nil {
+			t.Fatalf("Files(%q) error: %v", test.prefix, err)
+		} else if next != "" {
+			t.Errorf("Files(%q): unexpected page token %q", test.prefix, next)
+		}
+		var expected []string
+		for _, v := range test.expected {
+			expected = append(expected, kytheuri.ToString(v))
+		}
+		if err := testutil.DeepEqual(expected, files); err != nil {
+			t.Errorf("Files(%q): %v", test.prefix, err)
+		}
+	}
+
+	// Page through the files one at a time.
+	var (
+		found []string
+		token string
+	)
+	for {
+		files, next, err := xs.Files(ctx, "kythe://corpus?path=foo/", 1, token)
+		if err != nil {
+			t.Fatalf("Files error: %v", err)
+		} else if len(files) != 1 {
+			t.Fatalf("Expected 1 file per page; found %v", files)
+		}
+		found = append(found, files...)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	expected := []string{kytheuri.ToString(fooA), kytheuri.ToString(fooB), kytheuri.ToString(fooC)}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Errorf("Paged files: %v", err)
+	}
+
+	// Pages are capped at MaxScanResults, however many files match.
+	xs.MaxScanResults = 2
+	files, next, err := xs.Files(ctx, "kythe://corpus?path=foo/", 0, "")
+	if err != nil {
+		t.Fatalf("Files error: %v", err)
+	} else if err := testutil.DeepEqual(expected[:2], files); err != nil {
+		t.Errorf("Capped files: %v", err)
+	} else if next == "" {
+		t.Error("Missing next page token for capped files")
+	}
+	files, next, err = xs.Files(ctx, "kythe://corpus?path=foo/", 0, next)
+	if err != nil {
+		t.Fatalf("Files error: %v", err)
+	} else if err := testutil.DeepEqual(expected[2:], files); err != nil {
+		t.Errorf("Capped files after page token: %v", err)
+	} else if next != "" {
+		t.Errorf("Unexpected page token %q", next)
+	}
+}
+
+func TestNodesSingleTicket(t *testing.T) {
+	xs := newService(t, testEntries)
+
+	for _, n := range testNodes {
+		ticket := kytheuri.ToString(n.Source)
+		for _, filter := range [][]string{nil, {facts.NodeKind}, {"/kythe/text/**"}} {
+			req := &gpb.NodesRequest{Ticket: []string{ticket}, Filter: filter}
+			single, err := xs.Nodes(ctx, req)
+			if err != nil {
+				t.Fatalf("Error fetching node %q: %v", ticket, err)
+			}
+
+			// Compare against the multi-ticket path with a duplicated ticket.
+			req.Ticket = []string{ticket, ticket}
+			multi, err := xs.Nodes(ctx, req)
+			if err != nil {
+				t.Fatalf("Error fetching node %q: %v", ticket, err)
+			}
+			if err := testutil.DeepEqual(multi, single); err != nil {
+				t.Errorf("Node %q with filter %v: %v", ticket, filter, err)
+			}
+		}
+	}
+
+	if reply, err := xs.Nodes(ctx, &gpb.NodesRequest{Ticket: []string{"kythe://corpus?bad=param"}}); err == nil {
+		t.Errorf("Expected error for invalid ticket; found %v", reply)
+	}
+}
+
+func BenchmarkNodesSingle(b *testing.B) {
+	benchmarkNodes(b, nodesToTickets(testNodes)[:1])
+}
+
+func BenchmarkNodesMultiple(b *testing.B) {
+	benchmarkNodes(b, nodesToTickets(testNodes))
+}
+
+func benchmarkNodes(b *testing.B, tickets []string) {
+	xs := NewGraphStoreService(NewMemGraphStore(testEntries...))
+	req := &gpb.NodesRequest{Ticket: tickets}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := xs.Nodes(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEdges(t *testing.T) {
+	xs := newService(t, testEntries)
+
+	reply, err := xs.Edges(ctx, &gpb.EdgesRequest{
+		Ticket: nodesToTickets(testNodes),
+		Filter: []string{"**"}, // every fact
+	})
+	if err != nil {
+		t.Fatalf("Error fetching edges for %+v: %v", nodesToTickets(testNodes), err)
+	}
+
+	expectedEdges := nodesToEdgeSets(testNodes)
+	if err := testutil.DeepEqual(expectedEdges, sortEdgeSets(reply.EdgeSets)); err != nil {
+		t.Error(err)
+	}
+
+	nodesWithEdges := testNodes[1:]
+	expectedInfos := nodesToInfos(nodesWithEdges)
+	if err := testutil.DeepEqual(expectedInfos, reply.Nodes); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEdgesReadError(t *testing.T) {
+	readErr := errors.New("sentinel read error")
+	xs := NewGraphStoreService(errorGraphStore{readErr})
+
+	ticket := kytheuri.ToString(sig("source"))
+	reply, err := xs.Edges(ctx, &gpb.EdgesRequest{Ticket: []string{ticket}})
+	if err == nil {
+		t.Fatalf("Expected error; found %v", reply)
+	} else if msg := err.Error(); !strings.Contains(msg, readErr.Error()) || !strings.Contains(msg, ticket) {
+		t.Errorf("Error %q does not contain %q and %q", msg, readErr, ticket)
+	}
+}
+
+func TestEdgesDeduplicated(t *testing.T) {
+	source := sig("source")
+	targetA, targetB := sig("a"), sig("b")
+	entries := []*spb.Entry{
+		edgeFact(source, edges.Param, 1, targetB),
+		edgeFact(source, edges.Param, 0, targetB),
+		edgeFact(source, edges.Param, 1, targetA),
+		edgeFact(source, edges.Param, 1, targetA),
+		edgeFact(source, edges.Param, 0, targetA),
+		{Source: source, Target: targetA, EdgeKind: edges.Param + ".0", FactName: "/"},
+	}
+	xs := newService(t, entries)
+
+	ticket := kytheuri.ToString(source)
+	reply, err := xs.Edges(ctx, &gpb.EdgesRequest{Ticket: []string{ticket}})
+	if err != nil {
+		t.Fatalf("Error fetching edges for %q: %v", ticket, err)
+	}
+
+	expected := map[string]*gpb.EdgeSet{
+		ticket: {
+			Groups: map[string]*gpb.EdgeSet_Group{
+				edges.Param: {
+					Edge: []*gpb.EdgeSet_Group_Edge{
+						{TargetTicket: kytheuri.ToString(targetA), Ordinal: NoOrdinal},
+						{TargetTicket: kytheuri.ToString(targetB), Ordinal: NoOrdinal},
+						{TargetTicket: kytheuri.ToString(targetA), Ordinal: 0},
+						{TargetTicket: kytheuri.ToString(targetA), Ordinal: 1},
+						{TargetTicket: kytheuri.ToString(targetB), Ordinal: 1},
+					},
+				},
+			},
+		},
+	}
+	// The edges are compared without sorting to check their order.
+	if err := testutil.DeepEqual(expected, reply.EdgeSets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEdgesOrdinalOrder(t *testing.T) {
+	fn := sig("fn")
+	// The parameters' tickets sort in the reverse of their positions.
+	params := []*spb.VName{sig("z"), sig("y"), sig("x"), sig("w")}
+	xs := newService(t, []*spb.Entry{
+		edgeFact(fn, edges.Param, 2, params[2]),
+		edgeFact(fn, edges.Param, 0, params[0]),
+		edgeFact(fn, edges.Param, 3, params[3]),
+		edgeFact(fn, edges.Param, 1, params[1]),
+	})
+
+	ticket := kytheuri.ToString(fn)
+	reply, err := xs.Edges(ctx, &gpb.EdgesRequest{Ticket: []string{ticket}})
+	if err != nil {
+		t.Fatalf("Edges error: %v", err)
+	}
+	expected := []*gpb.EdgeSet_Group_Edge{
+		{TargetTicket: kytheuri.ToString(params[0]), Ordinal: NoOrdinal},
+		{TargetTicket: kytheuri.ToString(params[1]), Ordinal: 1},
+		{TargetTicket: kytheuri.ToString(params[2]), Ordinal: 2},
+		{TargetTicket: kytheuri.ToString(params[3]), Ordinal: 3},
+	}
+	if err := testutil.DeepEqual(expected, reply.EdgeSets[ticket].GetGroups()[edges.Param].GetEdge()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEdgesStableOrder(t *testing.T) {
+	source := sig("source")
+	var entries []*spb.Entry
+	for i := 0; i < 20; i++ {
+		target := sig(fmt.Sprintf("target%d", (i*7)%20))
+		entries = append(entries,
+			edgeFact(source, edges.Param, i%3, target),
+			edgeFact(source, fmt.Sprintf("/kythe/edge/kind%d", i%4), 0, target))
+	}
+	xs := newService(t, entries)
+	req := &gpb.EdgesRequest{Ticket: []string{kytheuri.ToString(source)}}
+
+	var encoded [][]byte
+	for i := 0; i < 2; i++ {
+		reply, err := xs.Edges(ctx, req)
+		if err != nil {
+			t.Fatalf("Edges error: %v", err)
+		}
+		rec, err := encodeEdgeSets(reply.EdgeSets)
+		if err != nil {
+			t.Fatalf("Error encoding EdgeSets: %v", err)
+		}
+		encoded = append(encoded, rec)
+	}
+	if !bytes.Equal(encoded[0], encoded[1]) {
+		t.Error("Identical Edges requests returned different EdgeSets")
+	}
+}
+
+// encodeEdgeSets returns an encoding of the given EdgeSets that does not
+// depend on map iteration order.
+func encodeEdgeSets(sets map[string]*gpb.EdgeSet) ([]byte, error) {
+	var tickets []string
+	for ticket := range sets {
+		tickets = append(tickets, ticket)
+	}
+	sort.Strings(tickets)
+
+	var buf bytes.Buffer
+	for _, ticket := range tickets {
+		buf.WriteString(ticket)
+		groups := sets[ticket].Groups
+		var kinds []string
+		for kind := range groups {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			rec, err := proto.Marshal(groups[kind])
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteString(kind)
+			buf.Write(rec)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func TestEdgesPaging(t *testing.T) {
+	a, b := sig("a"), sig("b")
+	var entries []*spb.Entry
+	for i := 0; i < 3; i++ {
+		entries = append(entries, edgeFact(a, edges.Param, i, sig(fmt.Sprintf("param%d", i))))
+	}
+	entries = append(entries,
+		edgeFact(a, edges.ChildOf, 0, b),
+		edgeFact(b, edges.Param, 0, a))
+	xs := newService(t, entries)
+
+	ticketA, ticketB := kytheuri.ToString(a), kytheuri.ToString(b)
+	req := &gpb.EdgesRequest{
+		Ticket:   []string{ticketA, ticketB},
+		PageSize: 2,
+	}
+	var pages []map[string]*gpb.EdgeSet
+	for {
+		reply, err := xs.Edges(ctx, req)
+		if err != nil {
+			t.Fatalf("Edges error: %v", err)
+		}
+		pages = append(pages, reply.EdgeSets)
+		if err := testutil.DeepEqual(map[string]int64{edges.ChildOf: 1, edges.Param: 4}, reply.TotalEdgesByKind); err != nil {
+			t.Errorf("TotalEdgesByKind: %v", err)
+		}
+
+		if reply.NextPageToken == "" {
+			break
+		} else if len(pages) > 3 {
+			t.Fatalf("Too many pages: %v", pages)
+		}
+		req.PageToken = reply.NextPageToken
+	}
+
+	group := func(kind string, es ...*gpb.EdgeSet_Group_Edge) *gpb.EdgeSet {
+		return &gpb.EdgeSet{Groups: map[string]*gpb.EdgeSet_Group{kind: {Edge: es}}}
+	}
+	expected := []map[string]*gpb.EdgeSet{{
+		ticketA: {Groups: map[string]*gpb.EdgeSet_Group{
+			edges.ChildOf: {Edge: []*gpb.EdgeSet_Group_Edge{{TargetTicket: ticketB, Ordinal: NoOrdinal}}},
+			edges.Param:   {Edge: []*gpb.EdgeSet_Group_Edge{{TargetTicket: kytheuri.ToString(sig("param0")), Ordinal: NoOrdinal}}},
+		}},
+	}, {
+		ticketA: group(edges.Param,
+			&gpb.EdgeSet_Group_Edge{TargetTicket: kytheuri.ToString(sig("param1")), Ordinal: 1},
+			&gpb.EdgeSet_Group_Edge{TargetTicket: kytheuri.ToString(sig("param2")), Ordinal: 2}),
+	}, {
+		ticketB: group(edges.Param, &gpb.EdgeSet_Group_Edge{TargetTicket: ticketA, Ordinal: NoOrdinal}),
+	}}
+	if err := testutil.DeepEqual(expected, pages); err != nil {
+		t.Error(err)
+	}
+
+	for _, req := range []*gpb.EdgesRequest{
+		{Ticket: []string{ticketA}, PageSize: -1},
+		{Ticket: []string{ticketA}, PageToken: "invalid"},
+	} {
+		if reply, err := xs.Edges(ctx, req); err == nil {
+			t.Errorf("Expected error for %v; found %v", req, reply)
+		}
+	}
+}
+
+func TestEdgesPagingConcurrentWrites(t *testing.T) {
+	a, b := sig("a"), sig("b")
+	param := func(i int) *spb.VName { return sig(fmt.Sprintf("param%d", i)) }
+	var entries []*spb.Entry
+	for i := 0; i < 4; i++ {
+		entries = append(entries, edgeFact(a, edges.Param, i, param(i)))
+	}
+	gs := NewMemGraphStore(entries...)
+	xs := NewGraphStoreService(gs)
+
+	req := &gpb.EdgesRequest{
+		Ticket:   []string{kytheuri.ToString(a)},
+		PageSize: 2,
+	}
+	var targets []string
+	for page := 0; ; page++ {
+		reply, err := xs.Edges(ctx, req)
+		if err != nil {
+			t.Fatalf("Edges error: %v", err)
+		}
+		for _, set := range reply.EdgeSets {
+			for _, grp := range set.Groups {
+				for _, e := range grp.Edge {
+					targets = append(targets, e.TargetTicket)
+				}
+			}
+		}
+
+		if page == 0 {
+			// Add an edge before the page token's position and one after it.
+			if err := gs.Write(ctx, &spb.WriteRequest{
+				Source: a,
+				Update: []*spb.WriteRequest_Update{
+					{Target: b, EdgeKind: edges.ChildOf, FactName: "/"},
+					{Target: param(4), EdgeKind: edges.Param + ".4", FactName: "/"},
+				},
+			}); err != nil {
+				t.Fatalf("Write error: %v", err)
+			}
+		}
+
+		if reply.NextPageToken == "" {
+			break
+		} else if page > 3 {
+			t.Fatalf("Too many pages: %v", targets)
+		}
+		req.PageToken = reply.NextPageToken
+	}
+
+	var expected []string
+	for i := 0; i < 5; i++ {
+		expected = append(expected, kytheuri.ToString(param(i)))
+	}
+	if err := testutil.DeepEqual(expected, targets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEdgesMaxEdgesPerKind(t *testing.T) {
+	a, b := sig("a"), sig("b")
+	var entries []*spb.Entry
+	for i := 0; i < 3; i++ {
+		entries = append(entries, edgeFact(a, edges.Param, i, sig(fmt.Sprintf("param%d", i))))
+	}
+	entries = append(entries,
+		edgeFact(a, edges.ChildOf, 0, b),
+		edgeFact(b, edges.Param, 0, a))
+	xs := newService(t, entries)
+	xs.MaxEdgesPerKind = 2
+
+	ticketA, ticketB := kytheuri.ToString(a), kytheuri.ToString(b)
+	req := &gpb.EdgesRequest{
+		Ticket:   []string{ticketA, ticketB},
+		PageSize: 4,
+	}
+	var pages []map[string]*gpb.EdgeSet
+	for {
+		reply, err := xs.Edges(ctx, req)
+		if err != nil {
+			t.Fatalf("Edges error: %v", err)
+		}
+		pages = append(pages, reply.EdgeSets)
+		if err := testutil.DeepEqual(map[string]int64{edges.ChildOf: 1, edges.Param: 4}, reply.TotalEdgesByKind); err != nil {
+			t.Errorf("TotalEdgesByKind: %v", err)
+		}
+
+		if reply.NextPageToken == "" {
+			break
+		} else if len(pages) > 2 {
+			t.Fatalf("Too many pages: %v", pages)
+		}
+		req.PageToken = reply.NextPageToken
+	}
+
+	param := func(i int) *gpb.EdgeSet_Group_Edge {
+		e := &gpb.EdgeSet_Group_Edge{TargetTicket: kytheuri.ToString(sig(fmt.Sprintf("param%d", i))), Ordinal: int32(i)}
+		if i == 0 {
+			e.Ordinal = NoOrdinal
+		}
+		return e
+	}
+	expected := []map[string]*gpb.EdgeSet{{
+		ticketA: {Groups: map[string]*gpb.EdgeSet_Group{
+			edges.ChildOf: {Edge: []*gpb.EdgeSet_Group_Edge{{TargetTicket: ticketB, Ordinal: NoOrdinal}}},
+			edges.Param:   {Edge: []*gpb.EdgeSet_Group_Edge{param(0), param(1)}},
+		}},
+	}, {
+		ticketA: {Groups: map[string]*gpb.EdgeSet_Group{
+			edges.Param: {Edge: []*gpb.EdgeSet_Group_Edge{param(2)}},
+		}},
+		ticketB: {Groups: map[string]*gpb.EdgeSet_Group{
+			edges.Param: {Edge: []*gpb.EdgeSet_Group_Edge{{TargetTicket: ticketA, Ordinal: NoOrdinal}}},
+		}},
+	}}
+	if err := testutil.DeepEqual(expected, pages); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEdgesTotals(t *testing.T) {
+	xs := newService(t, testEntries)
+
+	ticket := kytheuri.ToString(sig("signature"))
+	expected := map[string]int64{
+		edges.Mirror("someEdgeKind"): 1,
+		edges.Param:                  2,
+	}
+	req := &gpb.EdgesRequest{Ticket: []string{ticket}}
+
+	reply, err := xs.Edges(ctx, req)
+	if err != nil {
+		t.Fatalf("Error fetching edges for %q: %v", ticket, err)
+	}
+	if err := testutil.DeepEqual(expected, reply.TotalEdgesByKind); err != nil {
+		t.Errorf("Edges totals: %v", err)
+	}
+
+	reply, err = xs.CountEdges(ctx, req)
+	if err != nil {
+		t.Fatalf("Error counting edges for %q: %v", ticket, err)
+	}
+	if err := testutil.DeepEqual(expected, reply.TotalEdgesByKind); err != nil {
+		t.Errorf("CountEdges totals: %v", err)
+	} else if len(reply.EdgeSets) != 0 || len(reply.Nodes) != 0 {
+		t.Errorf("Unexpected edges in CountEdges reply: %v", reply)
+	}
+}
+
+func TestCountEdgesDeduplicated(t *testing.T) {
+	source, target := sig("source"), sig("target")
+	xs := newService(t, []*spb.Entry{
+		edgeFact(source, edges.Param, 0, target),
+		{Source: source, Target: target, EdgeKind: edges.Param + ".0", FactName: "/"},
+		edgeFact(source, edges.Param, 1, target),
+		{Source: source, Target: target, EdgeKind: edges.Param + ".01", FactName: "/"},
+		edgeFact(source, edges.ChildOf, 0, target),
+	})
+
+	ticket := kytheuri.ToString(source)
+	req := &gpb.EdgesRequest{Ticket: []string{ticket}}
+	reply, err := xs.CountEdges(ctx, req)
+	if err != nil {
+		t.Fatalf("CountEdges error: %v", err)
+	}
+	// The unnumbered param is distinct from the param with ordinal 0.
+	expected := map[string]int64{edges.ChildOf: 1, edges.Param: 3}
+	if err := testutil.DeepEqual(expected, reply.TotalEdgesByKind); err != nil {
+		t.Errorf("CountEdges totals: %v", err)
+	}
+
+	xs.MaxEntriesPerNode = 2
+	reply, err = xs.CountEdges(ctx, req)
+	if err != nil {
+		t.Fatalf("CountEdges error: %v", err)
+	} else if string(reply.Nodes[ticket].GetFacts()[TruncatedFact]) != "true" {
+		t.Errorf("Missing %s fact: %v", TruncatedFact, reply.Nodes)
+	}
+}
+
+func TestEdgesKindDirection(t *testing.T) {
+	source, outgoing, incoming := sig("source"), sig("outgoing"), sig("incoming")
+	xs := newService(t, nodesToEntries([]*node{
+		{source, nil, map[string][]*spb.VName{
+			edges.Ref:               {outgoing},
+			edges.Mirror(edges.Ref): {incoming},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(source)
+	forward := &gpb.EdgeSet_Group{Edge: []*gpb.EdgeSet_Group_Edge{{TargetTicket: kytheuri.ToString(outgoing), Ordinal: NoOrdinal}}}
+	reverse := &gpb.EdgeSet_Group{Edge: []*gpb.EdgeSet_Group_Edge{{TargetTicket: kytheuri.ToString(incoming), Ordinal: NoOrdinal}}}
+	tests := []struct {
+		kinds    []string
+		expected map[string]*gpb.EdgeSet_Group
+	}{
+		{[]string{edges.Ref}, map[string]*gpb.EdgeSet_Group{edges.Ref: forward}},
+		{[]string{edges.Mirror(edges.Ref)}, map[string]*gpb.EdgeSet_Group{edges.Mirror(edges.Ref): reverse}},
+		{[]string{edges.Ref, edges.Mirror(edges.Ref)}, map[string]*gpb.EdgeSet_Group{
+			edges.Ref:               forward,
+			edges.Mirror(edges.Ref): reverse,
+		}},
+		{nil, map[string]*gpb.EdgeSet_Group{
+			edges.Ref:               forward,
+			edges.Mirror(edges.Ref): reverse,
+		}},
+	}
+
+	for _, test := range tests {
+		reply, err := xs.Edges(ctx, &gpb.EdgesRequest{
+			Ticket: []string{ticket},
+			Kind:   test.kinds,
+		})
+		if err != nil {
+			t.Fatalf("Error fetching edges for %q: %v", ticket, err)
+		}
+		if err := testutil.DeepEqual(map[string]*gpb.EdgeSet{ticket: {Groups: test.expected}}, reply.EdgeSets); err != nil {
+			t.Errorf("Kinds %v: %v", test.kinds, err)
+		}
+	}
+}
+
+func TestEdgesWithoutAnchors(t *testing.T) {
+	caller := sig("caller")
+	xs := newService(t, append(federatedEntries("file"),
+		edgeFact(federatedTarget, edges.Mirror(edges.Param), 0, caller)))
+
+	ticket := kytheuri.ToString(federatedTarget)
+	req := &gpb.EdgesRequest{Ticket: []string{ticket}}
+	reply, err := xs.Edges(ctx, req)
+	if err != nil {
+		t.Fatalf("Edges error: %v", err)
+	} else if _, ok := reply.EdgeSets[ticket].GetGroups()[edges.Mirror(edges.Ref)]; !ok {
+		t.Errorf("Missing anchor edges: %v", reply.EdgeSets)
+	}
+
+	reply, _, err = xs.EdgesWithOptions(ctx, req, &EdgesOptions{ExcludeAnchorEdges: true})
+	if err != nil {
+		t.Fatalf("EdgesWithOptions error: %v", err)
+	}
+	expected := map[string]*gpb.EdgeSet{
+		ticket: {Groups: map[string]*gpb.EdgeSet_Group{
+			edges.Mirror(edges.Param): {Edge: []*gpb.EdgeSet_Group_Edge{{TargetTicket: kytheuri.ToString(caller), Ordinal: NoOrdinal}}},
+		}},
+	}
+	if err := testutil.DeepEqual(expected, reply.EdgeSets); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.DeepEqual(map[string]int64{edges.Mirror(edges.Param): 1}, reply.TotalEdgesByKind); err != nil {
+		t.Errorf("TotalEdgesByKind: %v", err)
+	}
+}
+
+func TestEdgesWithOrdinals(t *testing.T) {
+	source := sig("source")
+	var entries []*spb.Entry
+	for i := 0; i < 4; i++ {
+		entries = append(entries, edgeFact(source, edges.Param, i, sig(fmt.Sprintf("param%d", i))))
+	}
+	entries = append(entries, edgeFact(source, edges.ChildOf, 0, sig("parent")))
+	xs := newService(t, entries)
+
+	ticket := kytheuri.ToString(source)
+	req := &gpb.EdgesRequest{Ticket: []string{ticket}, Kind: []string{edges.Param}}
+	tests := []struct {
+		ordinals []int
+		expected []*gpb.EdgeSet_Group_Edge
+	}{
+		{[]int{2}, []*gpb.EdgeSet_Group_Edge{
+			{TargetTicket: kytheuri.ToString(sig("param2")), Ordinal: 2},
+		}},
+		{[]int{int(NoOrdinal), 3, 7}, []*gpb.EdgeSet_Group_Edge{
+			{TargetTicket: kytheuri.ToString(sig("param0")), Ordinal: NoOrdinal},
+			{TargetTicket: kytheuri.ToString(sig("param3")), Ordinal: 3},
+		}},
+		{nil, []*gpb.EdgeSet_Group_Edge{
+			{TargetTicket: kytheuri.ToString(sig("param0")), Ordinal: NoOrdinal},
+			{TargetTicket: kytheuri.ToString(sig("param1")), Ordinal: 1},
+			{TargetTicket: kytheuri.ToString(sig("param2")), Ordinal: 2},
+			{TargetTicket: kytheuri.ToString(sig("param3")), Ordinal: 3},
+		}},
+	}
+	for _, test := range tests {
+		reply, _, err := xs.EdgesWithOptions(ctx, req, &EdgesOptions{Ordinals: test.ordinals})
+		if err != nil {
+			t.Fatalf("EdgesWithOptions(%v) error: %v", test.ordinals, err)
+		}
+		expected := map[string]*gpb.EdgeSet{
+			ticket: {Groups: map[string]*gpb.EdgeSet_Group{edges.Param: {Edge: test.expected}}},
+		}
+		if err := testutil.DeepEqual(expected, reply.EdgeSets); err != nil {
+			t.Errorf("EdgesWithOptions(%v): %v", test.ordinals, err)
+		}
+	}
+
+	reply, _, err := xs.EdgesWithOptions(ctx, req, &EdgesOptions{Ordinals: []int{9}})
+	if err != nil {
+		t.Fatalf("EdgesWithOptions error: %v", err)
+	} else if len(reply.EdgeSets) != 0 {
+		t.Errorf("Unexpected edges: %v", reply.EdgeSets)
+	}
+}
+
+func TestEdgesWithOrdinalsZero(t *testing.T) {
+	source, unordered, zero := sig("source"), sig("unordered"), sig("zero")
+	xs := newService(t, []*spb.Entry{
+		edgeFact(source, edges.Param, 0, unordered),
+		{Source: source, EdgeKind: edges.Param + ".0", Target: zero, FactName: "/"},
+	})
+
+	ticket := kytheuri.ToString(source)
+	req := &gpb.EdgesRequest{Ticket: []string{ticket}, Kind: []string{edges.Param}}
+	tests := []struct {
+		ordinal  int
+		expected *gpb.EdgeSet_Group_Edge
+	}{
+		{0, &gpb.EdgeSet_Group_Edge{TargetTicket: kytheuri.ToString(zero), Ordinal: 0}},
+		{int(NoOrdinal), &gpb.EdgeSet_Group_Edge{TargetTicket: kytheuri.ToString(unordered), Ordinal: NoOrdinal}},
+	}
+	for _, test := range tests {
+		reply, _, err := xs.EdgesWithOptions(ctx, req, &EdgesOptions{Ordinals: []int{test.ordinal}})
+		if err != nil {
+			t.Fatalf("EdgesWithOptions(%d) error: %v", test.ordinal, err)
+		}
+		expected := map[string]*gpb.EdgeSet{
+			ticket: {Groups: map[string]*gpb.EdgeSet_Group{edges.Param: {Edge: []*gpb.EdgeSet_Group_Edge{test.expected}}}},
+		}
+		if err := testutil.DeepEqual(expected, reply.EdgeSets); err != nil {
+			t.Errorf("EdgesWithOptions(%d): %v", test.ordinal, err)
+		}
+	}
+}
+
+func TestEdgesWithRawKinds(t *testing.T) {
+	source, param0, param1, parent := sig("source"), sig("param0"), sig("param1"), sig("parent")
+	xs := newService(t, []*spb.Entry{
+		edgeFact(source, edges.Param, 0, param0),
+		edgeFact(source, edges.Param, 1, param1),
+		edgeFact(source, edges.Mirror(edges.ChildOf), 0, parent),
+	})
+
+	ticket := kytheuri.ToString(source)
+	reply, res, err := xs.EdgesWithOptions(ctx, &gpb.EdgesRequest{Ticket: []string{ticket}}, &EdgesOptions{RawKinds: true})
+	if err != nil {
+		t.Fatalf("EdgesWithOptions error: %v", err)
+	}
+	if n := len(reply.EdgeSets[ticket].GetGroups()[edges.Param].GetEdge()); n != 2 {
+		t.Errorf("Expected 2 %s edges; found %d", edges.Param, n)
+	}
+
+	expected := []*RawKind{
+		{Source: ticket, Target: kytheuri.ToString(parent), Kind: edges.Mirror(edges.ChildOf), Raw: edges.Mirror(edges.ChildOf)},
+		{Source: ticket, Target: kytheuri.ToString(param0), Kind: edges.Param, Raw: edges.Param},
+		{Source: ticket, Target: kytheuri.ToString(param1), Kind: edges.Param, Raw: edges.Param + ".1"},
+	}
+	if err := testutil.DeepEqual(expected, res.RawKinds); err != nil {
+		t.Error(err)
+	}
+
+	// Raw kinds are only returned for the edges in the page.
+	_, res, err = xs.EdgesWithOptions(ctx, &gpb.EdgesRequest{Ticket: []string{ticket}, PageSize: 1}, &EdgesOptions{RawKinds: true})
+	if err != nil {
+		t.Fatalf("EdgesWithOptions error: %v", err)
+	} else if err := testutil.DeepEqual(expected[:1], res.RawKinds); err != nil {
+		t.Errorf("Paged: %v", err)
+	}
+}
+
+func TestEdgesWithTargetKinds(t *testing.T) {
+	source := sig("source")
+	fn, v, rec := sig("fn"), sig("v"), sig("rec")
+	xs := newService(t, nodesToEntries([]*node{
+		{source, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Param: {fn, v, rec},
+		}},
+		{fn, newFacts(facts.NodeKind, nodes.Function, facts.Subkind, "method"), nil},
+		{v, newFacts(facts.NodeKind, nodes.Variable, facts.Subkind, "local"), nil},
+		{rec, newFacts(facts.NodeKind, nodes.Function), nil},
+	}))
+
+	ticket := kytheuri.ToString(source)
+	tests := []struct {
+		filter   []string
+		expected map[string]*cpb.NodeInfo
+	}{
+		{[]string{facts.Subkind}, map[string]*cpb.NodeInfo{
+			kytheuri.ToString(fn): {Facts: map[string][]byte{facts.Subkind: []byte("method")}},
+		}},
+		{[]string{facts.NodeKind}, map[string]*cpb.NodeInfo{
+			ticket:                 {Facts: map[string][]byte{facts.NodeKind: []byte(nodes.Function)}},
+			kytheuri.ToString(fn):  {Facts: map[string][]byte{facts.NodeKind: []byte(nodes.Function)}},
+			kytheuri.ToString(rec): {Facts: map[string][]byte{facts.NodeKind: []byte(nodes.Function)}},
+		}},
+	}
+
+	for _, test := range tests {
+		reply, _, err := xs.EdgesWithOptions(ctx, &gpb.EdgesRequest{
+			Ticket: []string{ticket},
+			Filter: test.filter,
+		}, &EdgesOptions{TargetKinds: []string{nodes.Function}})
+		if err != nil {
+			t.Fatalf("EdgesWithOptions error: %v", err)
+		}
+		if n := len(reply.EdgeSets[ticket].GetGroups()[edges.Param].GetEdge()); n != 3 {
+			t.Errorf("Filter %v: expected 3 edges; found %v", test.filter, reply.EdgeSets)
+		}
+		if err := testutil.DeepEqual(test.expected, reply.Nodes); err != nil {
+			t.Errorf("Filter %v: %v", test.filter, err)
+		}
+	}
+}
+
+func TestDecorations(t *testing.T) {
+	xs := newService(t, testEntries)
+
+	reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+		Location: &xpb.Location{
+			Ticket: kytheuri.ToString(testFileVName),
+		},
+		SourceText: true,
+		References: true,
+		Filter:     []string{"**"},
+	})
+	if err != nil {
+		t.Fatalf("Error fetching decorations for %+v: %v", testFileVName, err)
+	}
+
+	if string(reply.SourceText) != testFileContent {
+		t.Errorf("Incorrect file content: %q; Expected: %q", string(reply.SourceText), testFileContent)
+	}
+	if reply.Encoding != testFileEncoding {
+		t.Errorf("Incorrect file encoding: %q; Expected: %q", reply.Encoding, testFileEncoding)
+	}
+
+	expectedRefs := []*xpb.DecorationsReply_Reference{
+		{
+			SourceTicket: kytheuri.ToString(testAnchorVName),
+			TargetTicket: kytheuri.ToString(testAnchorTargetVName),
+			Kind:         edges.Ref,
+			AnchorStart: &xpb.Location_Point{
+				ByteOffset:   1,
+				LineNumber:   1,
+				ColumnOffset: 1,
+			},
+			AnchorEnd: &xpb.Location_Point{
+				ByteOffset:   4,
+				LineNumber:   1,
+				ColumnOffset: 4,
+			},
+		},
+	}
+	if err := testutil.DeepEqual(sortRefs(expectedRefs), sortRefs(reply.Reference)); err != nil {
+		t.Error(err)
+	}
+
+	expectedNodes := nodesToInfos(testNodes[4:6])
+	if err := testutil.DeepEqual(expectedNodes, reply.Nodes); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecorationsCountOnly(t *testing.T) {
+	file := fileVName("file")
+	var entries []*spb.Entry
+	entries = append(entries, nodeFact(file, facts.Text, "some text\n"))
+	for i := 0; i < 3; i++ {
+		entries = append(entries, edgeFact(file, edges.Mirror(edges.ChildOf), 0, anchorVName(file, fmt.Sprintf("a%d", i))))
+	}
+	entries = append(entries, edgeFact(file, edges.Mirror(edges.Ref), 0, anchorVName(file, "ref")))
+	xs := newService(t, entries)
+	// The file's text is never read.
+	xs.MaxFileBytes = 1
+
+	req := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}
+	if count, err := xs.DecorationsCountOnly(ctx, req); err != nil {
+		t.Fatalf("DecorationsCountOnly error: %v", err)
+	} else if count != 3 {
+		t.Errorf("DecorationsCountOnly: found %d; expected 3", count)
+	}
+
+	if count, err := xs.DecorationsCountOnly(ctx, &xpb.DecorationsRequest{
+		Location: &xpb.Location{Ticket: kytheuri.ToString(fileVName("missing"))},
+	}); err != nil {
+		t.Fatalf("DecorationsCountOnly error: %v", err)
+	} else if count != 0 {
+		t.Errorf("DecorationsCountOnly(missing): found %d; expected 0", count)
+	}
+
+	if _, err := xs.DecorationsCountOnly(ctx, &xpb.DecorationsRequest{}); err == nil {
+		t.Error("DecorationsCountOnly without a location succeeded")
+	}
+}
+
+func TestEntriesForFile(t *testing.T) {
+	file := fileVName("file")
+	anchor := anchorVName(file, "anchor")
+	diag := anchorVName(file, "diagnostic")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, []*spb.Entry{
+		nodeFact(file, facts.NodeKind, nodes.File),
+		nodeFact(file, facts.Text, "some text\n"),
+		edgeFact(file, revChildOfEdgeKind, 0, anchor),
+		edgeFact(file, revChildOfEdgeKind, 0, diag),
+		nodeFact(anchor, facts.NodeKind, nodes.Anchor),
+		nodeFact(anchor, facts.AnchorStart, "0"),
+		nodeFact(anchor, facts.AnchorEnd, "4"),
+		edgeFact(anchor, edges.ChildOf, 0, file),
+		edgeFact(anchor, edges.Ref, 0, target),
+		edgeFact(anchor, edges.Mirror(edges.Ref), 0, target),
+		nodeFact(diag, facts.NodeKind, nodes.Diagnostic),
+		edgeFact(diag, edges.ChildOf, 0, file),
+	})
+
+	var found []string
+	if err := xs.EntriesForFile(ctx, kytheuri.ToString(file), func(e *spb.Entry) error {
+		found = append(found, fmt.Sprintf("%s %s%s", e.Source.Signature, e.EdgeKind, e.FactName))
+		return nil
+	}); err != nil {
+		t.Fatalf("EntriesForFile error: %v", err)
+	}
+	sort.Strings(found[:2])
+	expected := []string{
+		" " + facts.NodeKind,
+		" " + facts.Text,
+		"anchor " + facts.AnchorEnd,
+		"anchor " + facts.AnchorStart,
+		"anchor " + facts.NodeKind,
+		"anchor " + edges.ChildOf + "/",
+		"anchor " + edges.Ref + "/",
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Error(err)
+	}
+
+	var count int
+	if err := xs.EntriesForFile(ctx, kytheuri.ToString(file), func(*spb.Entry) error {
+		count++
+		return io.EOF
+	}); err != nil {
+		t.Fatalf("EntriesForFile error: %v", err)
+	} else if count != 1 {
+		t.Errorf("Found %d entries after io.EOF; expected 1", count)
+	}
+
+	// Both the file's and its anchor's reads are truncated.
+	xs.MaxEntriesPerNode = 3
+	found = nil
+	if err := xs.EntriesForFile(ctx, kytheuri.ToString(file), func(e *spb.Entry) error {
+		found = append(found, fmt.Sprintf("%s %s%s", e.Source.Signature, e.EdgeKind, e.FactName))
+		return nil
+	}); err != nil {
+		t.Fatalf("EntriesForFile error: %v", err)
+	}
+	sort.Strings(found[:2])
+	expected = []string{
+		" " + facts.NodeKind,
+		" " + facts.Text,
+		" " + TruncatedFact,
+		"anchor " + facts.AnchorEnd,
+		"anchor " + facts.AnchorStart,
+		"anchor " + facts.NodeKind,
+		"anchor " + TruncatedFact,
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Errorf("Truncated: %v", err)
+	}
+	xs.MaxEntriesPerNode = 0
+
+	if err := xs.EntriesForFile(ctx, "kythe://corpus?bad=param", func(*spb.Entry) error { return nil }); err == nil {
+		t.Error("EntriesForFile with an invalid ticket succeeded")
+	}
+}
+
+func TestFileNormalizer(t *testing.T) {
+	file, unsupported := fileVName("file"), fileVName("unsupported")
+	xs := newService(t, []*spb.Entry{
+		nodeFact(file, facts.Text, "ab\ncd\n"),
+		nodeFact(unsupported, facts.Text, "text\n"),
+		nodeFact(unsupported, facts.TextEncoding, "not-an-encoding"),
+	})
+
+	norm, err := xs.FileNormalizer(ctx, kytheuri.ToString(file))
+	if err != nil {
+		t.Fatalf("FileNormalizer error: %v", err)
+	}
+	expected := &xpb.Location_Point{ByteOffset: 4, LineNumber: 2, ColumnOffset: 1}
+	if err := testutil.DeepEqual(expected, norm.ByteOffset(4)); err != nil {
+		t.Error(err)
+	}
+
+	for _, f := range []*spb.VName{unsupported, fileVName("missing")} {
+		if norm, err := xs.FileNormalizer(ctx, kytheuri.ToString(f)); err == nil {
+			t.Errorf("Expected error for %v; found %v", f, norm)
+		}
+	}
+}
+
+func TestGzipText(t *testing.T) {
+	const content = "some text\n"
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	} else if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := fileVName("file")
+	xs := newService(t, append(federatedEntries("file"),
+		nodeFact(file, facts.Text, buf.String()),
+		nodeFact(file, facts.TextCompression, GzipCompression)))
+
+	reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		SourceText: true,
+		References: true,
+	})
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	} else if string(reply.SourceText) != content {
+		t.Errorf("Found source text %q; expected %q", reply.SourceText, content)
+	} else if len(reply.Reference) != 1 {
+		t.Errorf("Expected 1 reference; found %v", reply.Reference)
+	}
+
+	ticket := kytheuri.ToString(federatedTarget)
+	xrefs, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		AnchorText:    true,
+	})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+	if refs := xrefs.CrossReferences[ticket].GetReference(); len(refs) != 1 {
+		t.Errorf("Expected 1 reference; found %v", refs)
+	} else if a := refs[0].Anchor; a.Text != "some" || a.Snippet != "some text" {
+		t.Errorf("Found anchor text %q and snippet %q; expected %q and %q", a.Text, a.Snippet, "some", "some text")
+	}
+
+	xs = newService(t, append(federatedEntries("file"),
+		nodeFact(file, facts.TextCompression, "unknown")))
+	if reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		SourceText: true,
+	}); err == nil {
+		t.Errorf("Expected error for unknown compression; found %v", reply)
+	}
+}
+
+// mapTextResolver is a TextResolver backed by a map from reference to text.
+type mapTextResolver map[string]string
+
+func (m mapTextResolver) ResolveText(_ context.Context, _ string, ref []byte) ([]byte, error) {
+	text, ok := m[string(ref)]
+	if !ok {
+		return nil, fmt.Errorf("unknown reference %q", ref)
+	}
+	return []byte(text), nil
+}
+
+func TestTextResolver(t *testing.T) {
+	file := fileVName("file")
+	fileTicket := kytheuri.ToString(file)
+	var entries []*spb.Entry
+	for _, e := range federatedEntries("file") {
+		if e.FactName == facts.Text {
+			e = nodeFact(file, facts.TextRef, "blob:1")
+		}
+		entries = append(entries, e)
+	}
+	decorReq := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: fileTicket},
+		SourceText: true,
+		References: true,
+	}
+
+	// Without a resolver, the file has no text.
+	xs := newService(t, entries)
+	if reply, err := xs.Decorations(ctx, decorReq); err == nil {
+		t.Errorf("Expected Decorations error; found %v", reply)
+	}
+
+	xs.TextResolver = mapTextResolver{"blob:1": "some text\n"}
+	reply, err := xs.Decorations(ctx, decorReq)
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	} else if string(reply.SourceText) != "some text\n" {
+		t.Errorf("Found source text %q; expected %q", reply.SourceText, "some text\n")
+	} else if len(reply.Reference) != 1 {
+		t.Errorf("Expected 1 reference; found %v", reply.Reference)
+	}
+
+	ticket := kytheuri.ToString(federatedTarget)
+	xr, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		AnchorText:    true,
+	})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+	if refs := xr.CrossReferences[ticket].GetReference(); len(refs) != 1 {
+		t.Errorf("Expected 1 reference; found %v", refs)
+	} else if a := refs[0].Anchor; a.Text != "some" || a.Snippet != "some text" {
+		t.Errorf("Unexpected anchor text %q and snippet %q", a.Text, a.Snippet)
+	}
+
+	// Resolver failures are reported.
+	xs.TextResolver = mapTextResolver{}
+	if reply, err := xs.Decorations(ctx, decorReq); err == nil {
+		t.Errorf("Expected Decorations error; found %v", reply)
+	}
+}
+
+func TestMaxFileBytes(t *testing.T) {
+	file := fileVName("file")
+	fileTicket := kytheuri.ToString(file)
+	ticket := kytheuri.ToString(federatedTarget)
+	xrefsReq := &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		AnchorText:    true,
+	}
+
+	xs := newService(t, federatedEntries("file"))
+	xs.MaxFileBytes = 5
+	reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: fileTicket},
+		SourceText: true,
+		References: true,
+	})
+	// The file's references are still located by their byte offsets.
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	} else if len(reply.SourceText) != 0 {
+		t.Errorf("Unexpected source text: %q", reply.SourceText)
+	} else if size := string(reply.Nodes[fileTicket].GetFacts()[TooLargeFact]); size != "10" {
+		t.Errorf("Found %s fact %q; expected %q", TooLargeFact, size, "10")
+	}
+	expectedRef := &xpb.DecorationsReply_Reference{
+		SourceTicket: kytheuri.ToString(anchorVName(file, "anchor")),
+		TargetTicket: ticket,
+		Kind:         edges.Ref,
+		AnchorStart:  &xpb.Location_Point{ByteOffset: 0},
+		AnchorEnd:    &xpb.Location_Point{ByteOffset: 4},
+	}
+	if err := testutil.DeepEqual([]*xpb.DecorationsReply_Reference{expectedRef}, reply.Reference); err != nil {
+		t.Errorf("Decorations references: %v", err)
+	}
+
+	if _, err := xs.FileNormalizer(ctx, fileTicket); err == nil {
+		t.Error("Expected FileNormalizer error")
+	} else if tooLarge, ok := Cause(err).(*FileTooLargeError); !ok || tooLarge.Ticket != fileTicket || tooLarge.Size != 10 || tooLarge.Max != 5 {
+		t.Errorf("Unexpected FileNormalizer error: %#v", err)
+	}
+
+	// Without a line index, the file's anchors are skipped.
+	xr, res, err := xs.CrossReferencesWithOptions(ctx, xrefsReq, &CrossReferencesOptions{Diagnostics: true})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	} else if refs := xr.CrossReferences[ticket].GetReference(); len(refs) != 0 {
+		t.Errorf("Unexpected references: %v", refs)
+	} else if len(res.Diagnostics) != 1 {
+		t.Errorf("Expected 1 diagnostic; found %v", res.Diagnostics)
+	}
+
+	// With a line index, the file's anchors are returned without text.
+	xs = newService(t, append(federatedEntries("file"), nodeFact(file, facts.LineIndex, "10,0")))
+	xs.MaxFileBytes = 5
+	xr, err = xs.CrossReferences(ctx, xrefsReq)
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+	if refs := xr.CrossReferences[ticket].GetReference(); len(refs) != 1 {
+		t.Errorf("Expected 1 reference; found %v", refs)
+	} else if a := refs[0].Anchor; a.Start.ByteOffset != 0 || a.End.ByteOffset != 4 || a.Text != "" || a.Snippet != "" {
+		t.Errorf("Unexpected anchor: %v", a)
+	}
+
+	// Compressed text is limited by its decompressed size.
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(bytes.Repeat([]byte("x"), 100)); err != nil {
+		t.Fatal(err)
+	} else if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompressText(buf.Bytes(), GzipCompression, 99); err == nil {
+		t.Error("Expected error for decompressed text exceeding its limit")
+	} else if _, ok := Cause(err).(*FileTooLargeError); !ok {
+		t.Errorf("Unexpected decompressText error: %v", err)
+	}
+	if text, err := decompressText(buf.Bytes(), GzipCompression, 100); err != nil || len(text) != 100 {
+		t.Errorf("decompressText: found %d bytes, %v; expected 100 bytes", len(text), err)
+	}
+
+	// The TooLargeFact of a compressed file is omitted as its size is unknown.
+	xs = newService(t, append(federatedEntries("file"),
+		nodeFact(file, facts.Text, buf.String()),
+		nodeFact(file, facts.TextCompression, GzipCompression)))
+	xs.MaxFileBytes = 50
+	reply, err = xs.Decorations(ctx, &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: fileTicket},
+		SourceText: true,
+		References: true,
+	})
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	} else if len(reply.SourceText) != 0 {
+		t.Errorf("Unexpected source text: %q", reply.SourceText)
+	} else if size, ok := reply.Nodes[fileTicket].GetFacts()[TooLargeFact]; ok {
+		t.Errorf("Unexpected %s fact %q", TooLargeFact, size)
+	} else if len(reply.Reference) != 1 {
+		t.Errorf("Expected 1 reference; found %v", reply.Reference)
+	}
+}
+
+func TestDecorationsWithColumns(t *testing.T) {
+	file := fileVName("file")
+	emoji := anchorVName(file, "emoji")
+	ident := anchorVName(file, "ident")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+	xs := newService(t, append(nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "a \u00e9 \U0001F600 x\n",
+		), map[string][]*spb.VName{
+			revChildOfEdgeKind: {emoji},
+		}},
+		{emoji, newFacts(
+			facts.AnchorStart, "5",
+			facts.AnchorEnd, "9",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.ChildOf: {file},
+			edges.Ref:     {target},
+		}},
+		{ident, newFacts(
+			facts.AnchorStart, "10",
+			facts.AnchorEnd, "11",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.ChildOf: {file},
+			edges.Ref:     {target},
+		}},
+	}), edgeFact(file, revChildOfEdgeKind, 0, ident)))
+
+	req := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}
+	tests := []struct {
+		enc      ColumnEncoding
+		expected []*Columns
+	}{
+		{ByteColumns, []*Columns{{5, 9}, {10, 11}}},
+		{UTF16Columns, []*Columns{{4, 6}, {7, 8}}},
+	}
+	for _, test := range tests {
+		reply, res, err := xs.DecorationsWithOptions(ctx, req, &DecorationsOptions{Columns: true, ColumnEncoding: test.enc})
+		if err != nil {
+			t.Fatalf("DecorationsWithOptions(%v) error: %v", test.enc, err)
+		}
+		if err := testutil.DeepEqual(test.expected, res.Columns); err != nil {
+			t.Errorf("DecorationsWithOptions(%v): %v", test.enc, err)
+		}
+		if len(reply.Reference) != 2 || reply.Reference[1].AnchorStart.ByteOffset != 10 {
+			t.Errorf("DecorationsWithOptions(%v): unexpected references %v", test.enc, reply.Reference)
+		}
+	}
+}
+
+func TestGetSourceTextEncoding(t *testing.T) {
+	tests := []struct {
+		encoding, expected string
+	}{
+		{"", facts.DefaultTextEncoding},
+		{"UTF-8", "UTF-8"},
+		{"utf8", "utf8"},
+		{"Shift_JIS", "Shift_JIS"},
+	}
+	for _, test := range tests {
+		file := fileVName("file")
+		entries := []*spb.Entry{nodeFact(file, facts.Text, "text")}
+		if test.encoding != "" {
+			entries = append(entries, nodeFact(file, facts.TextEncoding, test.encoding))
+		}
+		_, encoding, err := getSourceText(ctx, NewMemGraphStore(entries...), file, 0, nil)
+		if err != nil {
+			t.Errorf("getSourceText(%q) error: %v", test.encoding, err)
+		} else if encoding != test.expected {
+			t.Errorf("getSourceText(%q): found encoding %q; expected %q", test.encoding, encoding, test.expected)
+		}
+	}
+
+	file := fileVName("file")
+	gs := NewMemGraphStore(
+		nodeFact(file, facts.Text, "text"),
+		nodeFact(file, facts.TextEncoding, "not-an-encoding"),
+	)
+	if _, encoding, err := getSourceText(ctx, gs, file, 0, nil); err == nil {
+		t.Errorf("Expected error for invalid encoding; found %q", encoding)
+	} else if !strings.Contains(err.Error(), "not-an-encoding") {
+		t.Errorf("Error does not mention the invalid encoding: %v", err)
+	}
+}
+
+func TestDecorationsSourceTextSpan(t *testing.T) {
+	utf8File, sjisFile := fileVName("utf8"), fileVName("sjis")
+	xs := newService(t, nodesToEntries([]*node{
+		{utf8File, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "a\u65e5\u672cb\n",
+		), nil},
+		{sjisFile, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "a\x93\xfa\x96\x7bb\n",
+			facts.TextEncoding, "Shift_JIS",
+		), nil},
+	}))
+
+	tests := []struct {
+		file       *spb.VName
+		span       bool
+		start, end int32
+		text       string
+		encoding   string
+	}{
+		{utf8File, true, 1, 7, "\u65e5\u672c", facts.DefaultTextEncoding},
+		{sjisFile, false, 0, 0, "a\x93\xfa\x96\x7bb\n", "Shift_JIS"},
+		{sjisFile, true, 1, 5, "\u65e5\u672c", facts.DefaultTextEncoding},
+	}
+	for _, test := range tests {
+		loc := &xpb.Location{Ticket: kytheuri.ToString(test.file)}
+		if test.span {
+			loc.Kind = xpb.Location_SPAN
+			loc.Start = &xpb.Location_Point{ByteOffset: test.start}
+			loc.End = &xpb.Location_Point{ByteOffset: test.end}
+		}
+		reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+			Location:   loc,
+			SourceText: true,
+		})
+		if err != nil {
+			t.Errorf("Decorations(%v) error: %v", loc, err)
+			continue
+		}
+		if string(reply.SourceText) != test.text {
+			t.Errorf("Decorations(%v): found text %q; expected %q", loc, reply.SourceText, test.text)
+		}
+		if reply.Encoding != test.encoding {
+			t.Errorf("Decorations(%v): found encoding %q; expected %q", loc, reply.Encoding, test.encoding)
+		}
+	}
+}
+
+func TestDecorationsAnchorBatches(t *testing.T) {
+	file := fileVName("file")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	entries := nodesToEntries([]*node{{file, newFacts(
+		facts.NodeKind, nodes.File,
+		facts.Text, "0123456789\n",
+	), nil}})
+	for i := 0; i < 5; i++ {
+		anchor := anchorVName(file, fmt.Sprintf("anchor%d", i))
+		entries = append(entries,
+			nodeFact(anchor, facts.NodeKind, nodes.Anchor),
+			nodeFact(anchor, facts.AnchorStart, strconv.Itoa(2*i)),
+			nodeFact(anchor, facts.AnchorEnd, strconv.Itoa(2*i+1)),
+			edgeFact(anchor, edges.Ref, 0, target),
+			edgeFact(file, revChildOfEdgeKind, 0, anchor))
+	}
+
+	tests := []struct{ batchSize, calls int }{{0, 1}, {2, 3}, {5, 1}, {10, 1}}
+	for _, test := range tests {
+		xs := newService(t, entries)
+		xs.MaxAnchorBatchSize = test.batchSize
+		tracer := &recordingTracer{}
+		xs.Tracer = tracer
+
+		reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+			Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+			References: true,
+		})
+		if err != nil {
+			t.Fatalf("Decorations error: %v", err)
+		} else if len(reply.Reference) != 5 {
+			t.Fatalf("Expected 5 references; found %v", reply.Reference)
+		}
+		for i, ref := range reply.Reference {
+			if ref.AnchorStart.ByteOffset != int32(2*i) {
+				t.Errorf("Reference %d out of order: %v", i, ref)
+			}
+		}
+
+		var calls int
+		for _, span := range tracer.spans {
+			if span.name == "GraphStoreService.Nodes" {
+				calls++
+			}
+		}
+		if calls != test.calls {
+			t.Errorf("MaxAnchorBatchSize %d: found %d Nodes calls; expected %d", test.batchSize, calls, test.calls)
+		}
+	}
+}
+
+func TestDecorationsWithFileDiagnostics(t *testing.T) {
+	file := fileVName("file")
+	fileDiag := anchorVName(file, "file-diag")
+	spanDiag := anchorVName(file, "span-diag")
+	outsideDiag := anchorVName(file, "outside-diag")
+	noMessage := anchorVName(file, "no-message")
+	entries := nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "some text\n",
+		), nil},
+		{fileDiag, newFacts(
+			facts.NodeKind, nodes.Diagnostic,
+			facts.Message, "file problem",
+		), nil},
+		{spanDiag, newFacts(
+			facts.NodeKind, nodes.Diagnostic,
+			facts.Message, "span problem",
+			facts.Severity, "warning",
+			facts.AnchorStart, "5",
+			facts.AnchorEnd, "9",
+		), nil},
+		{outsideDiag, newFacts(
+			facts.NodeKind, nodes.Diagnostic,
+			facts.Message, "outside problem",
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "4",
+		), nil},
+		{noMessage, newFacts(facts.NodeKind, nodes.Diagnostic), nil},
+	})
+	for _, d := range []*spb.VName{fileDiag, spanDiag, outsideDiag, noMessage} {
+		entries = append(entries, edgeFact(file, revChildOfEdgeKind, 0, d))
+	}
+	xs := newService(t, entries)
+
+	reply, res, err := xs.DecorationsWithOptions(ctx, &xpb.DecorationsRequest{
+		Location: &xpb.Location{
+			Ticket: kytheuri.ToString(file),
+			Kind:   xpb.Location_SPAN,
+			Start:  &xpb.Location_Point{ByteOffset: 5},
+			End:    &xpb.Location_Point{ByteOffset: 10},
+		},
+	}, &DecorationsOptions{FileDiagnostics: true})
+	if err != nil {
+		t.Fatalf("DecorationsWithOptions error: %v", err)
+	} else if len(reply.Reference) != 0 {
+		t.Errorf("Unexpected references: %v", reply.Reference)
+	}
+
+	expected := []*FileDiagnostic{{
+		Ticket:  kytheuri.ToString(fileDiag),
+		Message: "file problem",
+	}, {
+		Ticket:   kytheuri.ToString(spanDiag),
+		Message:  "span problem",
+		Severity: "warning",
+		Start:    &xpb.Location_Point{ByteOffset: 5, LineNumber: 1, ColumnOffset: 5},
+		End:      &xpb.Location_Point{ByteOffset: 9, LineNumber: 1, ColumnOffset: 9},
+	}}
+	if err := testutil.DeepEqual(expected, res.FileDiagnostics); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBySpanTotalOrder(t *testing.T) {
+	ref := func(start, end int32, source, target, kind string) *xpb.DecorationsReply_Reference {
+		return &xpb.DecorationsReply_Reference{
+			SourceTicket: source,
+			TargetTicket: target,
+			Kind:         kind,
+			AnchorStart:  &xpb.Location_Point{ByteOffset: start},
+			AnchorEnd:    &xpb.Location_Point{ByteOffset: end},
+		}
+	}
+	expected := []*xpb.DecorationsReply_Reference{
+		ref(0, 4, "a", "x", edges.Ref),
+		ref(0, 5, "a", "x", edges.Ref),
+		ref(1, 3, "a", "x", edges.Defines),
+		ref(1, 3, "a", "x", edges.Ref),
+		ref(1, 3, "a", "y", edges.Ref),
+		ref(1, 3, "b", "x", edges.Ref),
+		ref(2, 3, "a", "x", edges.Ref),
+	}
+
+	// Each reversed rotation of the references sorts to the same order.
+	for i := range expected {
+		refs := append(append([]*xpb.DecorationsReply_Reference{}, expected[i:]...), expected[:i]...)
+		for j, k := 0, len(refs)-1; j < k; j, k = j+1, k-1 {
+			refs[j], refs[k] = refs[k], refs[j]
+		}
+		sort.Sort(bySpan(refs))
+		if err := testutil.DeepEqual(expected, refs); err != nil {
+			t.Errorf("Rotation %d: %v", i, err)
+		}
+	}
+}
+
+func TestDecorationsTargetDefinitions(t *testing.T) {
+	file, other := fileVName("file"), fileVName("other")
+	def, ref := anchorVName(file, "def"), anchorVName(file, "ref")
+	ambiguousRef, undefinedRef := anchorVName(file, "ambiguous"), anchorVName(file, "undefined")
+	def1, def2 := anchorVName(other, "def1"), anchorVName(other, "def2")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+	ambiguous := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "ambiguous"}
+	undefined := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "undefined"}
+
+	anchor := func(vname *spb.VName, start, end int, kind string, target *spb.VName) *node {
+		return &node{vname, newFacts(
+			facts.AnchorStart, strconv.Itoa(start),
+			facts.AnchorEnd, strconv.Itoa(end),
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{kind: {target}}}
+	}
+	entries := append(nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "f = 1\nf\n"), nil},
+		{other, newFacts(facts.NodeKind, nodes.File, facts.Text, "a a\n"), nil},
+		anchor(def, 0, 1, edges.DefinesBinding, target),
+		anchor(ambiguousRef, 2, 3, edges.Ref, ambiguous),
+		anchor(undefinedRef, 4, 5, edges.Ref, undefined),
+		anchor(ref, 6, 7, edges.Ref, target),
+		anchor(def1, 0, 1, edges.DefinesBinding, ambiguous),
+		anchor(def2, 2, 3, edges.DefinesBinding, ambiguous),
+		{target, nil, map[string][]*spb.VName{edges.Mirror(edges.DefinesBinding): {def}}},
+		{ambiguous, nil, map[string][]*spb.VName{edges.Mirror(edges.DefinesBinding): {def1, def2}}},
+	}),
+		edgeFact(file, revChildOfEdgeKind, 0, def),
+		edgeFact(file, revChildOfEdgeKind, 0, ref),
+		edgeFact(file, revChildOfEdgeKind, 0, ambiguousRef),
+		edgeFact(file, revChildOfEdgeKind, 0, undefinedRef))
+	xs := newService(t, entries)
+
+	req := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}
+	reply, err := xs.Decorations(ctx, req)
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	} else if len(reply.DefinitionLocations) != 0 {
+		t.Errorf("Unexpected definition locations: %v", reply.DefinitionLocations)
+	}
+
+	req.TargetDefinitions = true
+	reply, err = xs.Decorations(ctx, req)
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	}
+
+	defTicket := kytheuri.ToString(def)
+	expected := map[string]string{
+		defTicket:                       defTicket,
+		kytheuri.ToString(ref):          defTicket,
+		kytheuri.ToString(ambiguousRef): "",
+		kytheuri.ToString(undefinedRef): "",
+	}
+	found := make(map[string]string)
+	for _, r := range reply.Reference {
+		found[r.SourceTicket] = r.TargetDefinition
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Errorf("TargetDefinitions: %v", err)
+	}
+
+	if len(reply.DefinitionLocations) != 1 {
+		t.Errorf("Expected 1 definition location; found %v", reply.DefinitionLocations)
+	} else if loc := reply.DefinitionLocations[defTicket]; loc == nil {
+		t.Errorf("Missing definition location for %q: %v", defTicket, reply.DefinitionLocations)
+	} else if loc.Parent != kytheuri.ToString(file) || loc.Start.ByteOffset != 0 || loc.End.ByteOffset != 1 {
+		t.Errorf("Unexpected definition location: %v", loc)
+	}
+}
+
+func TestDecorationsForLines(t *testing.T) {
+	file := fileVName("file")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	ns := []*node{{file, newFacts(
+		facts.NodeKind, nodes.File,
+		facts.Text, "a b\nc d\ne f\n",
+	), nil}}
+	var anchors []*spb.VName
+	var childOf []*spb.Entry
+	for i, start := range []int{0, 4, 8} {
+		anchor := anchorVName(file, strconv.Itoa(i))
+		anchors = append(anchors, anchor)
+		childOf = append(childOf, edgeFact(file, revChildOfEdgeKind, 0, anchor))
+		ns = append(ns, &node{anchor, newFacts(
+			facts.AnchorStart, strconv.Itoa(start),
+			facts.AnchorEnd, strconv.Itoa(start+1),
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}})
+	}
+	xs := newService(t, append(nodesToEntries(ns), childOf...))
+
+	tests := []struct {
+		start, end int32
+		expected   []*spb.VName
+	}{
+		{1, 1, anchors[:1]},
+		{2, 2, anchors[1:2]},
+		{2, 10, anchors[1:]},
+		{1, 3, anchors},
+	}
+
+	for _, test := range tests {
+		reply, _, err := xs.DecorationsWithOptions(ctx, &xpb.DecorationsRequest{
+			Location: &xpb.Location{
+				Ticket: kytheuri.ToString(file),
+				Kind:   xpb.Location_SPAN,
+				Start:  &xpb.Location_Point{LineNumber: test.start},
+				End:    &xpb.Location_Point{LineNumber: test.end},
+			},
+			References: true,
+		}, &DecorationsOptions{LineSpan: true})
+		if err != nil {
+			t.Fatalf("DecorationsWithOptions(%d, %d) error: %v", test.start, test.end, err)
+		}
+		var found []string
+		for _, ref := range reply.Reference {
+			found = append(found, ref.SourceTicket)
+		}
+		var expected []string
+		for _, anchor := range test.expected {
+			expected = append(expected, kytheuri.ToString(anchor))
+		}
+		if err := testutil.DeepEqual(expected, found); err != nil {
+			t.Errorf("DecorationsWithOptions(%d, %d): %v", test.start, test.end, err)
+		}
+	}
+}
+
+func TestDecorationsOverlapSpan(t *testing.T) {
+	file := fileVName("file")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	ns := []*node{{file, newFacts(
+		facts.NodeKind, nodes.File,
+		facts.Text, "abc def ghi\n",
+	), nil}}
+	var anchors []*spb.VName
+	var childOf []*spb.Entry
+	for i, start := range []int{0, 4, 8} {
+		anchor := anchorVName(file, strconv.Itoa(i))
+		anchors = append(anchors, anchor)
+		childOf = append(childOf, edgeFact(file, revChildOfEdgeKind, 0, anchor))
+		ns = append(ns, &node{anchor, newFacts(
+			facts.AnchorStart, strconv.Itoa(start),
+			facts.AnchorEnd, strconv.Itoa(start+3),
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}})
+	}
+	xs := newService(t, append(nodesToEntries(ns), childOf...))
+
+	tests := []struct {
+		overlap    bool
+		start, end int32
+		expected   []*spb.VName
+	}{
+		{true, 5, 6, anchors[1:2]},
+		{true, 2, 5, anchors[:2]},  // cuts through both anchors
+		{true, 3, 4, anchors[:2]},  // touches both anchors
+		{true, 7, 7, anchors[1:2]}, // touches the end of an anchor
+		{true, 11, 12, anchors[2:]},
+		{true, 0, 12, anchors},
+		{false, 2, 5, nil},
+	}
+
+	for _, test := range tests {
+		reply, _, err := xs.DecorationsWithOptions(ctx, &xpb.DecorationsRequest{
+			Location: &xpb.Location{
+				Ticket: kytheuri.ToString(file),
+				Kind:   xpb.Location_SPAN,
+				Start:  &xpb.Location_Point{ByteOffset: test.start},
+				End:    &xpb.Location_Point{ByteOffset: test.end},
+			},
+			SpanKind:   xpb.DecorationsRequest_WITHIN_SPAN,
+			References: true,
+		}, &DecorationsOptions{OverlapSpan: test.overlap})
+		if err != nil {
+			t.Fatalf("DecorationsWithOptions(%v, %d, %d) error: %v", test.overlap, test.start, test.end, err)
+		}
+		var found []string
+		for _, ref := range reply.Reference {
+			found = append(found, ref.SourceTicket)
+		}
+		var expected []string
+		for _, anchor := range test.expected {
+			expected = append(expected, kytheuri.ToString(anchor))
+		}
+		if err := testutil.DeepEqual(expected, found); err != nil {
+			t.Errorf("DecorationsWithOptions(%v, %d, %d): %v", test.overlap, test.start, test.end, err)
+		}
+	}
+}
+
+func TestDecorationsBatch(t *testing.T) {
+	xs := newService(t, append(federatedEntries("a"), federatedEntries("b")...))
+	xs.CacheReads = true
+
+	reqs := []*xpb.DecorationsRequest{
+		{Location: &xpb.Location{Ticket: kytheuri.ToString(fileVName("a"))}, References: true},
+		{},
+		{Location: &xpb.Location{Ticket: kytheuri.ToString(fileVName("b"))}, References: true},
+	}
+	results, err := xs.DecorationsBatch(ctx, reqs)
+	if err != nil {
+		t.Fatalf("DecorationsBatch error: %v", err)
+	} else if len(results) != len(reqs) {
+		t.Fatalf("Expected %d results; found %v", len(reqs), results)
+	}
+
+	for _, i := range []int{0, 2} {
+		expected, err := xs.Decorations(ctx, reqs[i])
+		if err != nil {
+			t.Fatalf("Decorations error: %v", err)
+		}
+		if results[i].Err != nil {
+			t.Errorf("Request %d error: %v", i, results[i].Err)
+		} else if err := testutil.DeepEqual(expected, results[i].Reply); err != nil {
+			t.Errorf("Request %d: %v", i, err)
+		}
+	}
+	if results[1].Err == nil || results[1].Reply != nil {
+		t.Errorf("Expected an error for the request without a location; found %+v", results[1])
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if results, err := xs.DecorationsBatch(cancelled, reqs); err == nil {
+		t.Errorf("Expected error for cancelled context; found %v", results)
+	}
+}
+
+func TestDecorationsWithScopes(t *testing.T) {
+	file := fileVName("file")
+	a, b := anchorVName(file, "a"), anchorVName(file, "b")
+	fn, outer, inner, target := sig("fn"), sig("outer"), sig("inner"), sig("target")
+	entries := []*spb.Entry{
+		nodeFact(file, facts.NodeKind, nodes.File),
+		nodeFact(file, facts.Text, "{ { x } }\n"),
+		edgeFact(file, revChildOfEdgeKind, 0, a),
+		edgeFact(file, revChildOfEdgeKind, 1, b),
+	}
+	for _, anchor := range []*spb.VName{a, b} {
+		entries = append(entries,
+			nodeFact(anchor, facts.NodeKind, nodes.Anchor),
+			nodeFact(anchor, facts.AnchorStart, "4"),
+			nodeFact(anchor, facts.AnchorEnd, "5"),
+			edgeFact(anchor, edges.Ref, 0, target))
+	}
+	entries = append(entries,
+		edgeFact(a, edges.ChildOf, 0, file),
+		edgeFact(a, edges.ChildOf, 0, fn),
+		edgeFact(a, edges.ChildOf, 2, inner),
+		edgeFact(a, edges.ChildOf, 1, outer),
+		edgeFact(b, edges.ChildOf, 1, file))
+	xs := newService(t, entries)
+
+	reply, res, err := xs.DecorationsWithOptions(ctx, &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}, &DecorationsOptions{Scopes: true})
+	if err != nil {
+		t.Fatalf("DecorationsWithOptions error: %v", err)
+	}
+
+	var refs []string
+	for _, ref := range reply.Reference {
+		refs = append(refs, ref.SourceTicket+" "+ref.Kind)
+	}
+	sort.Strings(refs)
+	expectedRefs := []string{
+		kytheuri.ToString(a) + " " + edges.Ref,
+		kytheuri.ToString(b) + " " + edges.Ref,
+	}
+	if err := testutil.DeepEqual(expectedRefs, refs); err != nil {
+		t.Errorf("References: %v", err)
+	}
+
+	expected := map[string][]*Scope{
+		kytheuri.ToString(a): {
+			{Ticket: kytheuri.ToString(outer), Ordinal: 1, HasOrdinal: true},
+			{Ticket: kytheuri.ToString(inner), Ordinal: 2, HasOrdinal: true},
+			{Ticket: kytheuri.ToString(fn)},
+		},
+	}
+	if err := testutil.DeepEqual(expected, res.Scopes); err != nil {
+		t.Errorf("Scopes: %v", err)
+	}
+}
+
+func TestDecorationsWithKinds(t *testing.T) {
+	file := fileVName("file")
+	a, b, c := anchorVName(file, "a"), anchorVName(file, "b"), anchorVName(file, "c")
+	t1, t2, t3 := sig("t1"), sig("t2"), sig("t3")
+	anchorFacts := newFacts(facts.NodeKind, nodes.Anchor, facts.AnchorStart, "0", facts.AnchorEnd, "1")
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "text\n"), map[string][]*spb.VName{
+			revChildOfEdgeKind: {a, b, c},
+		}},
+		{a, anchorFacts, map[string][]*spb.VName{edges.ChildOf: {file}, edges.Ref: {t1}}},
+		{b, anchorFacts, map[string][]*spb.VName{edges.ChildOf: {file}, edges.DefinesBinding: {t2}}},
+		{c, anchorFacts, map[string][]*spb.VName{edges.ChildOf: {file}, edges.Ref: {t1}, edges.RefCall: {t3}}},
+	}))
+	req := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}
+
+	ref := func(anchor *spb.VName, kind string, target *spb.VName) string {
+		return fmt.Sprintf("%s %s %s", kytheuri.ToString(anchor), kind, kytheuri.ToString(target))
+	}
+	tests := []struct {
+		kinds    []string
+		expected []string
+	}{
+		{nil, []string{ref(a, edges.Ref, t1), ref(b, edges.DefinesBinding, t2), ref(c, edges.Ref, t1), ref(c, edges.RefCall, t3)}},
+		{[]string{edges.Ref}, []string{ref(a, edges.Ref, t1), ref(c, edges.Ref, t1)}},
+		{[]string{edges.DefinesBinding, edges.RefCall}, []string{ref(b, edges.DefinesBinding, t2), ref(c, edges.RefCall, t3)}},
+		{[]string{edges.Mirror(edges.Ref)}, nil},
+	}
+	for _, test := range tests {
+		reply, _, err := xs.DecorationsWithOptions(ctx, req, &DecorationsOptions{Kinds: test.kinds})
+		if err != nil {
+			t.Fatalf("DecorationsWithOptions(%v) error: %v", test.kinds, err)
+		}
+		var found []string
+		for _, r := range reply.Reference {
+			found = append(found, fmt.Sprintf("%s %s %s", r.SourceTicket, r.Kind, r.TargetTicket))
+		}
+		sort.Strings(found)
+		sort.Strings(test.expected)
+		if err := testutil.DeepEqual(test.expected, found); err != nil {
+			t.Errorf("DecorationsWithOptions(%v): %v", test.kinds, err)
+		}
+	}
+}
+
+func TestDecorationsWithLanguage(t *testing.T) {
+	withFact, withVName, neither := fileVName("fact"), fileVName("vname"), fileVName("neither")
+	withVName.Language = "java"
+	var entries []*spb.Entry
+	for _, file := range []*spb.VName{withFact, withVName, neither} {
+		entries = append(entries,
+			nodeFact(file, facts.NodeKind, nodes.File),
+			nodeFact(file, facts.Text, "text\n"))
+	}
+	entries = append(entries, nodeFact(withFact, facts.Language, "go"))
+	xs := newService(t, entries)
+
+	tests := []struct {
+		file *spb.VName
+		lang string
+	}{
+		{withFact, "go"},
+		{withVName, "java"},
+		{neither, ""},
+	}
+	for _, test := range tests {
+		ticket := kytheuri.ToString(test.file)
+		reply, res, err := xs.DecorationsWithOptions(ctx, &xpb.DecorationsRequest{
+			Location: &xpb.Location{Ticket: ticket},
+		}, &DecorationsOptions{Language: true})
+		if err != nil {
+			t.Fatalf("DecorationsWithOptions(%q) error: %v", ticket, err)
+		} else if reply.Location.Ticket != ticket {
+			t.Errorf("DecorationsWithOptions(%q): unexpected location %v", ticket, reply.Location)
+		}
+		if res.Language != test.lang {
+			t.Errorf("DecorationsWithOptions(%q): expected language %q; found %q", ticket, test.lang, res.Language)
+		}
+	}
+}
+
+func TestDecorationsWithoutText(t *testing.T) {
+	file := fileVName("generated")
+	anchor := anchorVName(file, "anchor")
+	target := sig("target")
+	entries := nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File), map[string][]*spb.VName{
+			revChildOfEdgeKind: {anchor},
+		}},
+		{anchor, newFacts(
+			facts.AnchorStart, "4",
+			facts.AnchorEnd, "7",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.ChildOf: {file},
+			edges.Ref:     {target},
+		}},
+	})
+	req := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}
+
+	tests := []struct {
+		lineIndex  string
+		start, end *xpb.Location_Point
+	}{
+		{"", &xpb.Location_Point{ByteOffset: 4}, &xpb.Location_Point{ByteOffset: 7}},
+		{"3,6,0",
+			&xpb.Location_Point{ByteOffset: 4, LineNumber: 2, ColumnOffset: 1},
+			&xpb.Location_Point{ByteOffset: 7, LineNumber: 2, ColumnOffset: 4}},
+	}
+	for _, test := range tests {
+		es := entries
+		if test.lineIndex != "" {
+			es = append(es, nodeFact(file, facts.LineIndex, test.lineIndex))
+		}
+		xs := newService(t, es)
+
+		reply, err := xs.Decorations(ctx, req)
+		if err != nil {
+			t.Fatalf("Decorations error: %v", err)
+		}
+		expected := []*xpb.DecorationsReply_Reference{{
+			SourceTicket: kytheuri.ToString(anchor),
+			Kind:         edges.Ref,
+			TargetTicket: kytheuri.ToString(target),
+			AnchorStart:  test.start,
+			AnchorEnd:    test.end,
+		}}
+		if err := testutil.DeepEqual(expected, reply.Reference); err != nil {
+			t.Errorf("Line index %q: %v", test.lineIndex, err)
+		}
+
+		// The file's text cannot be returned.
+		if reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+			Location:   req.Location,
+			References: true,
+			SourceText: true,
+		}); err == nil {
+			t.Errorf("Line index %q: expected error for SourceText; found %v", test.lineIndex, reply)
+		}
+	}
+}
+
+func TestDecorationsWithDiagnostics(t *testing.T) {
+	file := fileVName("file")
+	goodAnchor := anchorVName(file, "good")
+	badOffsets := anchorVName(file, "offsets")
+	missing := anchorVName(file, "missing")
+	untargeted := anchorVName(file, "untargeted")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, append(nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "some text\n",
+		), map[string][]*spb.VName{
+			revChildOfEdgeKind: {goodAnchor},
+		}},
+		{goodAnchor, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{badOffsets, newFacts(
+			facts.AnchorStart, "zero",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{untargeted, newFacts(
+			facts.AnchorStart, "5",
+			facts.AnchorEnd, "9",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.ChildOf: {file},
+		}},
+	}),
+		edgeFact(file, revChildOfEdgeKind, 0, badOffsets),
+		edgeFact(file, revChildOfEdgeKind, 0, missing),
+		edgeFact(file, revChildOfEdgeKind, 0, untargeted)))
+
+	req := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}
+	reply, res, err := xs.DecorationsWithOptions(ctx, req, &DecorationsOptions{Diagnostics: true})
+	if err != nil {
+		t.Fatalf("DecorationsWithOptions error: %v", err)
+	}
+
+	if len(reply.Reference) != 1 {
+		t.Errorf("Expected 1 reference; found %v", reply.Reference)
+	} else if found := reply.Reference[0].SourceTicket; found != kytheuri.ToString(goodAnchor) {
+		t.Errorf("Found reference %q; expected %q", found, kytheuri.ToString(goodAnchor))
+	}
+
+	var found []string
+	for _, d := range res.Diagnostics {
+		found = append(found, d.Ticket)
+	}
+	expected := []string{kytheuri.ToString(missing), kytheuri.ToString(badOffsets), kytheuri.ToString(untargeted)}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Errorf("Diagnostics: %v", err)
+	}
+
+	if reply, err := xs.Decorations(ctx, req); err != nil {
+		t.Errorf("Decorations error: %v", err)
+	} else if len(reply.Reference) != 1 {
+		t.Errorf("Expected 1 reference; found %v", reply.Reference)
+	}
+
+	if _, _, err := xs.DecorationsWithOptions(ctx, &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(fileVName("nonexistent"))},
+		References: true,
+	}, &DecorationsOptions{Diagnostics: true}); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+// recordingLogger is a Logger recording each message.
+type recordingLogger struct{ msgs []string }
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	file := fileVName("file")
+	badOffsets := anchorVName(file, "offsets")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "some text\n",
+		), map[string][]*spb.VName{
+			revChildOfEdgeKind: {badOffsets},
+		}},
+		{badOffsets, newFacts(
+			facts.AnchorStart, "zero",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+	}))
+	logger := &recordingLogger{}
+	xs.Logger = logger
+
+	req := &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}
+	if reply, err := xs.Decorations(ctx, req); err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	} else if len(reply.Reference) != 0 {
+		t.Errorf("Expected no references; found %v", reply.Reference)
+	}
+	if len(logger.msgs) != 1 || !strings.Contains(logger.msgs[0], kytheuri.ToString(badOffsets)) {
+		t.Errorf("Expected 1 message for %q; found %q", kytheuri.ToString(badOffsets), logger.msgs)
+	}
+
+	// Problems reported as Diagnostics are not also logged.
+	logger.msgs = nil
+	if _, res, err := xs.DecorationsWithOptions(ctx, req, &DecorationsOptions{Diagnostics: true}); err != nil {
+		t.Fatalf("DecorationsWithOptions error: %v", err)
+	} else if len(res.Diagnostics) != 1 {
+		t.Errorf("Expected 1 diagnostic; found %v", res.Diagnostics)
+	}
+	if len(logger.msgs) != 0 {
+		t.Errorf("Unexpected messages: %q", logger.msgs)
+	}
+}
+
+func TestCrossReferencesCrossFileSnippet(t *testing.T) {
+	gen, src := fileVName("gen"), fileVName("src")
+	mapped, dangling := anchorVName(gen, "mapped"), anchorVName(gen, "dangling")
+	target := sig("target")
+	snippetAnchor := func(vname *spb.VName, snippetFile *spb.VName) *node {
+		return &node{vname, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "2",
+			facts.NodeKind, nodes.Anchor,
+			facts.SnippetStart, "4",
+			facts.SnippetEnd, "11",
+			facts.SnippetFile, kytheuri.ToString(snippetFile),
+		), map[string][]*spb.VName{edges.Ref: {target}}}
+	}
+	xs := newService(t, nodesToEntries([]*node{
+		{gen, newFacts(facts.NodeKind, nodes.File, facts.Text, "xx\n"), nil},
+		{src, newFacts(facts.NodeKind, nodes.File, facts.Text, "abc\ndef ghi\n"), nil},
+		snippetAnchor(mapped, src),
+		snippetAnchor(dangling, fileVName("missing")),
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {mapped, dangling},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+	}, &CrossReferencesOptions{Diagnostics: true})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+	anchors := make(map[string]*xpb.Anchor)
+	for _, ref := range reply.CrossReferences[ticket].GetReference() {
+		anchors[ref.Anchor.Ticket] = ref.Anchor
+	}
+
+	// The snippet is read from the file named by its facts.SnippetFile fact.
+	if a := anchors[kytheuri.ToString(mapped)]; a == nil {
+		t.Errorf("Missing reference %q: %v", kytheuri.ToString(mapped), anchors)
+	} else if a.Parent != kytheuri.ToString(gen) || a.Snippet != "def ghi" {
+		t.Errorf("Unexpected cross-file snippet anchor: %v", a)
+	} else if err := testutil.DeepEqual(&xpb.Location_Point{ByteOffset: 4, LineNumber: 2}, a.SnippetStart); err != nil {
+		t.Errorf("SnippetStart: %v", err)
+	}
+
+	// A snippet file that cannot be read falls back to a line-based snippet.
+	if a := anchors[kytheuri.ToString(dangling)]; a == nil {
+		t.Errorf("Missing reference %q: %v", kytheuri.ToString(dangling), anchors)
+	} else if a.Snippet != "xx" {
+		t.Errorf("Found snippet %q; expected %q", a.Snippet, "xx")
+	}
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Ticket != kytheuri.ToString(dangling) {
+		t.Errorf("Expected 1 diagnostic for %q; found %v", kytheuri.ToString(dangling), res.Diagnostics)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	file := fileVName("file")
+	call := anchorVName(file, "call")
+	target, typ := sig("function"), sig("type")
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "call();\n",
+		), map[string][]*spb.VName{
+			revChildOfEdgeKind: {call},
+		}},
+		{call, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.ChildOf: {file},
+			edges.RefCall: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.RefCall): {call},
+			edges.Typed:                 {typ},
+		}},
+		{typ, newFacts(facts.NodeKind, nodes.TApp), nil},
+	}))
+
+	_, res, err := xs.DecorationsWithOptions(ctx, &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	}, &DecorationsOptions{Labels: true})
+	if err != nil {
+		t.Fatalf("DecorationsWithOptions error: %v", err)
+	} else if err := testutil.DeepEqual(map[string]string{edges.RefCall: "call"}, res.Labels); err != nil {
+		t.Errorf("Decorations labels: %v", err)
+	}
+
+	_, xres, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{kytheuri.ToString(target)},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		Filter:        []string{facts.NodeKind},
+	}, &CrossReferencesOptions{Labels: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+	expected := map[string]string{
+		edges.RefCall: "call",
+		edges.Typed:   "type",
+	}
+	if err := testutil.DeepEqual(expected, xres.Labels); err != nil {
+		t.Errorf("CrossReferences labels: %v", err)
+	}
+}
+
+func TestReferenceKindConsistency(t *testing.T) {
+	file := fileVName("file")
+	anchor := anchorVName(file, "anchor")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "call();\n",
+		), map[string][]*spb.VName{
+			revChildOfEdgeKind: {anchor},
+		}},
+		{anchor, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.ChildOf:        {file},
+			edges.RefCall + ".0": {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.RefCall) + ".0": {anchor},
+		}},
+	}))
+
+	decor, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
+		Location:   &xpb.Location{Ticket: kytheuri.ToString(file)},
+		References: true,
+	})
+	if err != nil {
+		t.Fatalf("Decorations error: %v", err)
+	} else if len(decor.Reference) != 1 {
+		t.Fatalf("Expected 1 reference; found %v", decor.Reference)
+	}
+
+	targetTicket := kytheuri.ToString(target)
+	xrefs, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{targetTicket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+	})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	} else if xr := xrefs.CrossReferences[targetTicket]; xr == nil || len(xr.Reference) != 1 {
+		t.Fatalf("Expected 1 reference; found %v", xrefs.CrossReferences)
+	}
+
+	decorKind := decor.Reference[0].Kind
+	xrefKind := xrefs.CrossReferences[targetTicket].Reference[0].Anchor.Kind
+	if decorKind != edges.RefCall || xrefKind != edges.RefCall {
+		t.Errorf("Inconsistent reference kinds: Decorations %q; CrossReferences %q; expected %q", decorKind, xrefKind, edges.RefCall)
+	}
+}
+
+func TestCrossReferencesDiagnostics(t *testing.T) {
+	file := fileVName("file")
+	goodAnchor := anchorVName(file, "good")
+	badAnchor := anchorVName(file, "bad")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "some text\n",
+		), nil},
+		{goodAnchor, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{badAnchor, newFacts(
+			facts.AnchorStart, "5",
+			facts.AnchorEnd, "2",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {goodAnchor, badAnchor},
+		}},
+	}))
+
+	targetTicket := kytheuri.ToString(target)
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{targetTicket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+	}, &CrossReferencesOptions{Diagnostics: true})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+
+	if xr := reply.CrossReferences[targetTicket]; xr == nil || len(xr.Reference) != 1 {
+		t.Errorf("Expected 1 reference; found %v", reply.CrossReferences)
+	} else if found := xr.Reference[0].Anchor.Ticket; found != kytheuri.ToString(goodAnchor) {
+		t.Errorf("Found reference %q; expected %q", found, kytheuri.ToString(goodAnchor))
+	}
+
+	if len(res.Diagnostics) != 1 {
+		t.Fatalf("Expected 1 diagnostic; found %v", res.Diagnostics)
+	} else if found := res.Diagnostics[0].Ticket; found != kytheuri.ToString(badAnchor) {
+		t.Errorf("Found diagnostic for %q; expected %q", found, kytheuri.ToString(badAnchor))
+	}
+}
+
+func TestCrossReferencesBuildConfig(t *testing.T) {
+	file := fileVName("file")
+	ownConfig := anchorVName(file, "own")
+	fileConfig := anchorVName(file, "file")
+	otherFile := fileVName("other")
+	noConfig := anchorVName(otherFile, "none")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "some text\n",
+			facts.BuildConfig, "file-config",
+		), nil},
+		{otherFile, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "other text\n",
+		), nil},
+		{ownConfig, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "4",
+			facts.BuildConfig, "anchor-config",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{fileConfig, newFacts(
+			facts.AnchorStart, "5",
+			facts.AnchorEnd, "9",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{noConfig, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "5",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {ownConfig, fileConfig, noConfig},
+		}},
+	}))
+
+	targetTicket := kytheuri.ToString(target)
+	reply, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{targetTicket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		Filter:        []string{facts.BuildConfig},
+	})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+
+	if xr := reply.CrossReferences[targetTicket]; xr == nil || len(xr.Reference) != 3 {
+		t.Fatalf("Expected 3 references; found %v", reply.CrossReferences)
+	}
+
+	expected := map[string]string{
+		kytheuri.ToString(ownConfig):  "anchor-config",
+		kytheuri.ToString(fileConfig): "file-config",
+		kytheuri.ToString(noConfig):   "",
+	}
+	for ticket, config := range expected {
+		var found string
+		if info := reply.Nodes[ticket]; info != nil {
+			found = string(info.Facts[facts.BuildConfig])
+		}
+		if found != config {
+			t.Errorf("Build config for %q: found %q; expected %q", ticket, found, config)
+		}
+	}
+	if info := reply.Nodes[kytheuri.ToString(noConfig)]; info != nil {
+		t.Errorf("Unexpected node for anchor without a build config: %v", info)
+	}
+
+	reply, err = xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{targetTicket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		Filter:        []string{facts.NodeKind},
+	})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+	for ticket := range expected {
+		if info := reply.Nodes[ticket]; info != nil {
+			t.Errorf("Unexpected anchor node %q without a build config filter: %v", ticket, info)
+		}
+	}
+}
+
+func TestCrossReferencesInSpan(t *testing.T) {
+	file := fileVName("file")
+	first := anchorVName(file, "first")
+	second := anchorVName(file, "second")
+	otherFile := fileVName("other")
+	other := anchorVName(otherFile, "other")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "some text\n",
+		), nil},
+		{otherFile, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "other text\n",
+		), nil},
+		{first, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{second, newFacts(
+			facts.AnchorStart, "5",
+			facts.AnchorEnd, "9",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{other, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "5",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {first, second, other},
+		}},
+	}))
+
+	targetTicket := kytheuri.ToString(target)
+	fileTicket := kytheuri.ToString(file)
+	tests := []struct {
+		loc      *xpb.Location
+		kind     xpb.DecorationsRequest_SpanKind
+		expected []*spb.VName
+	}{
+		{nil, xpb.DecorationsRequest_WITHIN_SPAN, []*spb.VName{first, second, other}},
+		{&xpb.Location{Ticket: fileTicket}, xpb.DecorationsRequest_WITHIN_SPAN, []*spb.VName{first, second}},
+		{&xpb.Location{
+			Ticket: fileTicket,
+			Kind:   xpb.Location_SPAN,
+			Start:  &xpb.Location_Point{ByteOffset: 3},
+			End:    &xpb.Location_Point{ByteOffset: 10},
+		}, xpb.DecorationsRequest_WITHIN_SPAN, []*spb.VName{second}},
+		{&xpb.Location{
+			Ticket: fileTicket,
+			Kind:   xpb.Location_SPAN,
+			Start:  &xpb.Location_Point{ByteOffset: 1},
+			End:    &xpb.Location_Point{ByteOffset: 2},
+		}, xpb.DecorationsRequest_AROUND_SPAN, []*spb.VName{first}},
+	}
+
+	for _, test := range tests {
+		reply, _, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+			Ticket:        []string{targetTicket},
+			ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		}, &CrossReferencesOptions{Span: test.loc, SpanKind: test.kind})
+		if err != nil {
+			t.Errorf("CrossReferencesWithOptions(%v) error: %v", test.loc, err)
+			continue
+		}
+
+		var found []string
+		if xr := reply.CrossReferences[targetTicket]; xr != nil {
+			for _, ref := range xr.Reference {
+				found = append(found, ref.Anchor.Ticket)
+			}
+		}
+		sort.Strings(found)
+		var expected []string
+		for _, v := range test.expected {
+			expected = append(expected, kytheuri.ToString(v))
+		}
+		sort.Strings(expected)
+		if err := testutil.DeepEqual(expected, found); err != nil {
+			t.Errorf("CrossReferencesWithOptions(%v): %v", test.loc, err)
+		}
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	file := fileVName("file")
+	def, ref := anchorVName(file, "def"), anchorVName(file, "ref")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+	undefined := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "undefined"}
+	anchor := func(vname *spb.VName, start, end string, kind string, target *spb.VName) *node {
+		return &node{vname, newFacts(
+			facts.AnchorStart, start,
+			facts.AnchorEnd, end,
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{kind: {target}}}
+	}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "f = 1\nf\n"), nil},
+		anchor(def, "0", "1", edges.DefinesBinding, target),
+		anchor(ref, "6", "7", edges.Ref, target),
+		{target, newFacts(facts.NodeKind, nodes.Variable), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {def},
+			edges.Mirror(edges.Ref):            {ref},
+		}},
+		{undefined, newFacts(facts.NodeKind, nodes.Variable), nil},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	defs, err := xs.Definitions(ctx, []string{ticket, kytheuri.ToString(undefined)})
+	if err != nil {
+		t.Fatalf("Definitions error: %v", err)
+	} else if len(defs) != 1 || len(defs[ticket]) != 1 {
+		t.Fatalf("Expected a single definition of %q; found %v", ticket, defs)
+	}
+	found := defs[ticket][0]
+	if found.Ticket != kytheuri.ToString(def) || found.Kind != edges.DefinesBinding {
+		t.Errorf("Unexpected definition anchor: %v", found)
+	} else if found.Parent != kytheuri.ToString(file) || found.Start.ByteOffset != 0 || found.End.ByteOffset != 1 {
+		t.Errorf("Unexpected definition location: %v", found)
+	} else if found.Text != "" || found.Snippet != "f = 1" {
+		t.Errorf("Unexpected definition text %q and snippet %q", found.Text, found.Snippet)
+	}
+
+	if defs, err := xs.Definitions(ctx, nil); err == nil {
+		t.Errorf("Expected error for no tickets; found %v", defs)
+	}
+}
+
+func TestDefinitionsTruncated(t *testing.T) {
+	file := fileVName("file")
+	def := anchorVName(file, "def")
+	target := sig("target")
+	entries := append(nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "f = 1\n"), nil},
+		{def, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "1",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{edges.DefinesBinding: {target}}},
+		{target, newFacts(facts.NodeKind, nodes.Variable), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {def},
+		}},
+	}), edgeFact(target, edges.Mirror(edges.DefinesBinding), 0, anchorVName(file, "other")))
+	// References of the node do not count against MaxEntriesPerNode.
+	for i := 0; i < 10; i++ {
+		entries = append(entries, edgeFact(target, edges.Mirror(edges.Ref), 0, anchorVName(file, fmt.Sprintf("ref%d", i))))
+	}
+
+	ticket := kytheuri.ToString(target)
+	truncated := func(msgs []string) bool {
+		for _, msg := range msgs {
+			if strings.Contains(msg, "Definitions of "+strconv.Quote(ticket)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, test := range []struct {
+		maxEntries int
+		truncated  bool
+	}{{2, false}, {1, true}} {
+		logger := &recordingLogger{}
+		xs := newService(t, entries)
+		xs.Logger = logger
+		xs.MaxEntriesPerNode = test.maxEntries
+
+		if _, err := xs.Definitions(ctx, []string{ticket}); err != nil {
+			t.Fatalf("Definitions error: %v", err)
+		} else if found := truncated(logger.msgs); found != test.truncated {
+			t.Errorf("MaxEntriesPerNode %d: expected truncated %v; found %v", test.maxEntries, test.truncated, logger.msgs)
+		}
+	}
+}
+
+func TestNodesWithDefinitions(t *testing.T) {
+	file := fileVName("file")
+	first, second := anchorVName(file, "first"), anchorVName(file, "second")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+	undefined := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "undefined"}
+	anchor := func(vname *spb.VName, start, end string) *node {
+		return &node{vname, newFacts(
+			facts.AnchorStart, start,
+			facts.AnchorEnd, end,
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{edges.DefinesBinding: {target}}}
+	}
+	xs := newService(t, append(nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "f = 1\nf = 2\n"), nil},
+		anchor(second, "6", "7"),
+		anchor(first, "0", "1"),
+		{target, newFacts(facts.NodeKind, nodes.Variable), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {second},
+		}},
+		{undefined, newFacts(facts.NodeKind, nodes.Variable), nil},
+	}), edgeFact(target, edges.Mirror(edges.DefinesBinding), 0, first)))
+
+	ticket := kytheuri.ToString(target)
+	req := &gpb.NodesRequest{
+		Ticket: []string{ticket, kytheuri.ToString(undefined)},
+		Filter: []string{facts.NodeKind},
+	}
+	reply, res, err := xs.NodesWithOptions(ctx, req, &NodesOptions{Definitions: true})
+	if err != nil {
+		t.Fatalf("NodesWithOptions error: %v", err)
+	}
+	expected, err := xs.Nodes(ctx, req)
+	if err != nil {
+		t.Fatalf("Nodes error: %v", err)
+	} else if err := testutil.DeepEqual(expected, reply); err != nil {
+		t.Error(err)
+	}
+
+	if len(res.Definitions) != 1 {
+		t.Fatalf("Expected a single definition location; found %v", res.Definitions)
+	}
+	loc := res.Definitions[ticket]
+	if loc == nil || loc.Ticket != kytheuri.ToString(first) {
+		t.Errorf("Expected primary definition %q; found %v", kytheuri.ToString(first), loc)
+	} else if loc.Parent != kytheuri.ToString(file) || loc.Start.ByteOffset != 0 || loc.End.ByteOffset != 1 {
+		t.Errorf("Unexpected definition location: %v", loc)
+	}
+}
+
+func TestEnclosingNode(t *testing.T) {
+	file := fileVName("file")
+	fn := sig("fn")
+	inner, outer, orphan := anchorVName(file, "inner"), anchorVName(file, "outer"), anchorVName(file, "orphan")
+	anchorFacts := func() map[string]string {
+		return newFacts(facts.NodeKind, nodes.Anchor, facts.AnchorStart, "0", facts.AnchorEnd, "1")
+	}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "f\n"), nil},
+		{fn, newFacts(facts.NodeKind, nodes.Function, facts.Code, "fn", facts.Complete, "definition"), nil},
+		{outer, anchorFacts(), map[string][]*spb.VName{edges.ChildOf: {file, fn}}},
+		{inner, anchorFacts(), map[string][]*spb.VName{edges.ChildOf: {outer}}},
+		{orphan, anchorFacts(), map[string][]*spb.VName{edges.ChildOf: {file}}},
+	}))
+
+	expected := &EnclosingNode{
+		Ticket: kytheuri.ToString(fn),
+		Facts: map[string][]byte{
+			facts.NodeKind: []byte(nodes.Function),
+			facts.Code:     []byte("fn"),
+		},
+	}
+	for _, a := range []*spb.VName{outer, inner} {
+		found, err := xs.EnclosingNode(ctx, kytheuri.ToString(a))
+		if err != nil {
+			t.Fatalf("EnclosingNode(%v) error: %v", a, err)
+		}
+		if err := testutil.DeepEqual(expected, found); err != nil {
+			t.Errorf("EnclosingNode(%v): %v", a, err)
+		}
+	}
+
+	if found, err := xs.EnclosingNode(ctx, kytheuri.ToString(orphan)); err != nil {
+		t.Errorf("EnclosingNode(orphan) error: %v", err)
+	} else if found != nil {
+		t.Errorf("EnclosingNode(orphan): expected nil; found %+v", found)
+	}
+
+	if _, err := xs.EnclosingNode(ctx, "kythe://corpus?bad=param"); err == nil {
+		t.Error("EnclosingNode(invalid ticket): expected error")
+	}
+
+	// The walk is traced, and its nodes, each read both for its facts and its
+	// childof edges, are only read once with CacheReads.
+	tracer := &recordingTracer{}
+	xs.Tracer, xs.CacheReads = tracer, true
+	if _, err := xs.EnclosingNode(ctx, kytheuri.ToString(inner)); err != nil {
+		t.Fatalf("EnclosingNode(inner) error: %v", err)
+	}
+	reads := make(map[string]int)
+	for _, span := range tracer.spans {
+		if span.name == "GraphStore.Read" {
+			reads[span.attrs["source"].(string)]++
+		}
+	}
+	if root := tracer.spans[0]; root.name != "GraphStoreService.EnclosingNode" || !root.ended || root.attrs["ticket"] != kytheuri.ToString(inner) {
+		t.Errorf("Unexpected root span: %+v", root)
+	}
+	for ticket, n := range reads {
+		if n != 1 {
+			t.Errorf("Found %d reads of %q; expected 1", n, ticket)
+		}
+	}
+}
+
+func TestCrossReferencesExcludingDefinitionSites(t *testing.T) {
+	file := fileVName("file")
+	def, defRef, ref := anchorVName(file, "def"), anchorVName(file, "defRef"), anchorVName(file, "ref")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+	anchor := func(vname *spb.VName, start, end string, kinds ...string) *node {
+		es := make(map[string][]*spb.VName)
+		for _, kind := range kinds {
+			es[kind] = []*spb.VName{target}
+		}
+		return &node{vname, newFacts(
+			facts.AnchorStart, start,
+			facts.AnchorEnd, end,
+			facts.NodeKind, nodes.Anchor,
+		), es}
+	}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "f = 1\nf\n"), nil},
+		// The definition anchor also references its node and another anchor
+		// references the node from the same span.
+		anchor(def, "0", "1", edges.DefinesBinding, edges.Ref),
+		anchor(defRef, "0", "1", edges.Ref),
+		anchor(ref, "6", "7", edges.Ref),
+		{target, newFacts(facts.NodeKind, nodes.Variable), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {def},
+			edges.Mirror(edges.Ref):            {def, defRef, ref},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	req := &xpb.CrossReferencesRequest{
+		Ticket:         []string{ticket},
+		DefinitionKind: xpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+		ReferenceKind:  xpb.CrossReferencesRequest_ALL_REFERENCES,
+	}
+	reply, err := xs.CrossReferences(ctx, req)
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	} else if n := len(reply.CrossReferences[ticket].GetReference()); n != 3 {
+		t.Errorf("Expected 3 references; found %v", reply.CrossReferences[ticket])
+	}
+
+	reply, _, err = xs.CrossReferencesWithOptions(ctx, req, &CrossReferencesOptions{ExcludeDefinitionSites: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+	xr := reply.CrossReferences[ticket]
+	if refs := xr.GetReference(); len(refs) != 1 || refs[0].Anchor.Ticket != kytheuri.ToString(ref) {
+		t.Errorf("Expected only reference %q; found %v", kytheuri.ToString(ref), refs)
+	}
+	if defs := xr.GetDefinition(); len(defs) != 1 || defs[0].Anchor.Ticket != kytheuri.ToString(def) {
+		t.Errorf("Expected definition %q; found %v", kytheuri.ToString(def), defs)
+	}
+}
+
+func TestCrossReferencesAnchorOrder(t *testing.T) {
+	fileA, fileB := fileVName("a"), fileVName("b")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+	ns := []*node{
+		{fileA, newFacts(facts.NodeKind, nodes.File, facts.Text, "f f f\n"), nil},
+		{fileB, newFacts(facts.NodeKind, nodes.File, facts.Text, "ff\n"), nil},
+	}
+	// Anchors are written out of order, including two with the same span.
+	var refs []*spb.VName
+	for _, a := range []struct {
+		file       *spb.VName
+		sig        string
+		start, end string
+	}{
+		{fileB, "b0", "0", "2"},
+		{fileA, "a4", "4", "5"},
+		{fileA, "a0-wide", "0", "3"},
+		{fileB, "b0-narrow", "0", "1"},
+		{fileA, "a2", "2", "3"},
+		{fileA, "a0", "0", "1"},
+		{fileA, "a0-dup", "0", "1"},
+	} {
+		anchor := anchorVName(a.file, a.sig)
+		refs = append(refs, anchor)
+		ns = append(ns, &node{anchor, newFacts(
+			facts.AnchorStart, a.start,
+			facts.AnchorEnd, a.end,
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{edges.Ref: {target}}})
+	}
+	ns = append(ns, &node{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+		edges.Mirror(edges.Ref): refs,
+	}})
+	xs := newService(t, nodesToEntries(ns))
+
+	var expected []string
+	for _, a := range []struct {
+		file *spb.VName
+		sig  string
+	}{
+		{fileA, "a0"}, {fileA, "a0-dup"}, {fileA, "a0-wide"}, {fileA, "a2"}, {fileA, "a4"},
+		{fileB, "b0-narrow"}, {fileB, "b0"},
+	} {
+		expected = append(expected, kytheuri.ToString(anchorVName(a.file, a.sig)))
+	}
+
+	ticket := kytheuri.ToString(target)
+	for i := 0; i < 5; i++ {
+		reply, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+			Ticket:        []string{ticket},
+			ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		})
+		if err != nil {
+			t.Fatalf("CrossReferences error: %v", err)
+		}
+		var found []string
+		for _, ref := range reply.CrossReferences[ticket].GetReference() {
+			found = append(found, ref.Anchor.Ticket)
+		}
+		if err := testutil.DeepEqual(expected, found); err != nil {
+			t.Fatalf("Call %d: %v", i, err)
+		}
+	}
+}
+
+func TestCrossReferencesGroupedByFile(t *testing.T) {
+	fileA, fileB := fileVName("a"), fileVName("b")
+	a1, a2, b1 := anchorVName(fileA, "a1"), anchorVName(fileA, "a2"), anchorVName(fileB, "b1")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+	anchor := func(vname *spb.VName, start, end, kind string) *node {
+		return &node{vname, newFacts(
+			facts.AnchorStart, start,
+			facts.AnchorEnd, end,
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{kind: {target}}}
+	}
+	xs := newService(t, nodesToEntries([]*node{
+		{fileA, newFacts(facts.NodeKind, nodes.File, facts.Text, "f()\nf\n"), nil},
+		{fileB, newFacts(facts.NodeKind, nodes.File, facts.Text, "f\n"), nil},
+		anchor(a1, "0", "1", edges.RefCall),
+		anchor(a2, "4", "5", edges.Ref),
+		anchor(b1, "0", "1", edges.Ref),
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.RefCall): {a1},
+			edges.Mirror(edges.Ref):     {b1, a2},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	req := &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+	}
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, req, &CrossReferencesOptions{GroupByFile: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	} else if n := len(reply.CrossReferences[ticket].GetReference()); n != 3 {
+		t.Errorf("Expected 3 flat references; found %v", reply.CrossReferences[ticket])
+	}
+
+	files := res.Files[ticket]
+	if len(res.Files) != 1 || len(files) != 2 {
+		t.Fatalf("Unexpected file groups: %v", res.Files)
+	}
+	type fileRefs struct {
+		file    string
+		count   int
+		anchors stringset.Set
+	}
+	var found []fileRefs
+	for _, f := range files {
+		r := fileRefs{file: f.File, count: f.Count()}
+		for _, ref := range f.Reference {
+			r.anchors.Add(ref.Anchor.Ticket)
+		}
+		found = append(found, r)
+	}
+	expected := []fileRefs{
+		{kytheuri.ToString(fileA), 2, stringset.New(kytheuri.ToString(a1), kytheuri.ToString(a2))},
+		{kytheuri.ToString(fileB), 1, stringset.New(kytheuri.ToString(b1))},
+	}
+	for i, e := range expected {
+		if f := found[i]; f.file != e.file || f.count != e.count || !f.anchors.Equals(e.anchors) {
+			t.Errorf("File %d: found %+v; expected %+v", i, f, e)
+		}
+	}
+}
+
+func TestCrossReferencesWithRawKinds(t *testing.T) {
+	file := fileVName("file")
+	def, call := anchorVName(file, "def"), anchorVName(file, "call")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "target"}
+	anchor := func(vname *spb.VName, start, end, kind string) *node {
+		return &node{vname, newFacts(
+			facts.AnchorStart, start,
+			facts.AnchorEnd, end,
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{kind: {target}}}
+	}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "f()\nf()\n"), nil},
+		anchor(def, "0", "1", edges.DefinesBinding),
+		anchor(call, "4", "7", edges.RefCall),
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {def},
+			// The second target is written with an ordinal suffix.
+			edges.Mirror(edges.RefCall): {def, call},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	req := &xpb.CrossReferencesRequest{
+		Ticket:         []string{ticket},
+		DefinitionKind: xpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+		ReferenceKind:  xpb.CrossReferencesRequest_CALL_REFERENCES,
+	}
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, req, &CrossReferencesOptions{RawKinds: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+	xr := reply.CrossReferences[ticket]
+	if len(xr.GetDefinition()) != 1 || len(xr.GetReference()) != 2 {
+		t.Fatalf("Unexpected cross-references: %v", xr)
+	}
+
+	expected := map[RawKind]bool{
+		{Source: ticket, Target: kytheuri.ToString(def), Kind: edges.DefinesBinding, Raw: edges.Mirror(edges.DefinesBinding)}: true,
+		{Source: ticket, Target: kytheuri.ToString(def), Kind: edges.RefCall, Raw: edges.Mirror(edges.RefCall)}:               true,
+		{Source: ticket, Target: kytheuri.ToString(call), Kind: edges.RefCall, Raw: edges.Mirror(edges.RefCall) + ".1"}:       true,
+	}
+	found := make(map[RawKind]bool)
+	for _, r := range res.RawKinds {
+		found[*r] = true
+	}
+	if err := testutil.DeepEqual(expected, found); err != nil {
+		t.Error(err)
+	}
+
+	// The reply itself is unchanged.
+	plain, err := xs.CrossReferences(ctx, req)
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	} else if len(plain.CrossReferences[ticket].GetReference()) != len(xr.GetReference()) {
+		t.Errorf("Expected %d references; found %v", len(xr.GetReference()), plain.CrossReferences[ticket])
+	}
+}
+
+func TestCrossReferencesWithImports(t *testing.T) {
+	file := fileVName("file")
+	imp, ref := anchorVName(file, "import"), anchorVName(file, "ref")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "pkg"}
+	anchor := func(vname *spb.VName, start, end, kind string) *node {
+		return &node{vname, newFacts(
+			facts.AnchorStart, start,
+			facts.AnchorEnd, end,
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{kind: {target}}}
+	}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "import pkg\npkg.f()\n"), nil},
+		anchor(imp, "7", "10", edges.RefImports),
+		anchor(ref, "11", "14", edges.Ref),
+		{target, newFacts(facts.NodeKind, nodes.Package), map[string][]*spb.VName{
+			edges.Mirror(edges.RefImports): {imp},
+			edges.Mirror(edges.Ref):        {ref},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	req := &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		AnchorText:    true,
+	}
+	reply, err := xs.CrossReferences(ctx, req)
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	} else if n := len(reply.CrossReferences[ticket].GetReference()); n != 2 {
+		t.Errorf("Expected 2 references; found %v", reply.CrossReferences[ticket])
+	}
+
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, req, &CrossReferencesOptions{Imports: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+	if refs := reply.CrossReferences[ticket].GetReference(); len(refs) != 1 || refs[0].Anchor.Ticket != kytheuri.ToString(ref) {
+		t.Errorf("Expected only reference %q; found %v", kytheuri.ToString(ref), refs)
+	}
+	if is := res.Imports[ticket]; len(is) != 1 || is[0].Anchor.Ticket != kytheuri.ToString(imp) {
+		t.Errorf("Expected only import %q; found %v", kytheuri.ToString(imp), res.Imports)
+	} else if is[0].Anchor.Kind != edges.RefImports || is[0].Anchor.Text != "pkg" {
+		t.Errorf("Unexpected import anchor: %v", is[0].Anchor)
+	}
+}
+
+func TestCrossReferencesDeclarations(t *testing.T) {
+	header, impl := fileVName("header"), fileVName("impl")
+	decl, def := anchorVName(header, "decl"), anchorVName(impl, "def")
+	fwdDecl := anchorVName(header, "fwd")
+	fn, fwd := sig("fn"), sig("fwd")
+	anchor := func(vname *spb.VName, kind string, target *spb.VName) *node {
+		return &node{vname, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "2",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{kind: {target}}}
+	}
+	xs := newService(t, nodesToEntries([]*node{
+		{header, newFacts(facts.NodeKind, nodes.File, facts.Text, "fn();\n"), nil},
+		{impl, newFacts(facts.NodeKind, nodes.File, facts.Text, "fn() {}\n"), nil},
+		anchor(decl, edges.DefinesBinding, fn),
+		anchor(def, edges.Completes, fn),
+		anchor(fwdDecl, edges.DefinesBinding, fwd),
+		{fn, newFacts(facts.NodeKind, nodes.Function, facts.Complete, "incomplete"), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {decl},
+			edges.Mirror(edges.Completes):      {def},
+		}},
+		{fwd, newFacts(facts.NodeKind, nodes.Function, facts.Complete, "incomplete"), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {fwdDecl},
+		}},
+	}))
+
+	fnTicket, fwdTicket := kytheuri.ToString(fn), kytheuri.ToString(fwd)
+	req := &xpb.CrossReferencesRequest{
+		Ticket:          []string{fnTicket, fwdTicket},
+		DefinitionKind:  xpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+		DeclarationKind: xpb.CrossReferencesRequest_ALL_DECLARATIONS,
+	}
+	tickets := func(anchors []*xpb.CrossReferencesReply_RelatedAnchor) []string {
+		var ts []string
+		for _, a := range anchors {
+			ts = append(ts, a.Anchor.Ticket)
+		}
+		return ts
+	}
+
+	for _, keep := range []bool{false, true} {
+		xs.KeepDeclarationsWithDefinitions = keep
+		reply, err := xs.CrossReferences(ctx, req)
+		if err != nil {
+			t.Fatalf("CrossReferences error: %v", err)
+		}
+		fnSet, fwdSet := reply.CrossReferences[fnTicket], reply.CrossReferences[fwdTicket]
+
+		if err := testutil.DeepEqual([]string{kytheuri.ToString(def)}, tickets(fnSet.GetDefinition())); err != nil {
+			t.Errorf("Keep %v: definitions of fn: %v", keep, err)
+		}
+		var expected []string
+		if keep {
+			expected = []string{kytheuri.ToString(decl)}
+		}
+		if err := testutil.DeepEqual(expected, tickets(fnSet.GetDeclaration())); err != nil {
+			t.Errorf("Keep %v: declarations of fn: %v", keep, err)
+		}
+
+		// A declaration without any definition is always returned.
+		if err := testutil.DeepEqual([]string{kytheuri.ToString(fwdDecl)}, tickets(fwdSet.GetDeclaration())); err != nil {
+			t.Errorf("Keep %v: declarations of fwd: %v", keep, err)
+		} else if len(fwdSet.GetDefinition()) != 0 {
+			t.Errorf("Keep %v: unexpected definitions of fwd: %v", keep, fwdSet.Definition)
+		}
+	}
+}
+
+func TestCrossReferencesWithMinCompleteness(t *testing.T) {
+	file := fileVName("file")
+	fwd, full, unknown := sig("fwd"), sig("full"), sig("unknown")
+	var ns []*node
+	ns = append(ns, &node{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "fn\n"), nil})
+	for _, n := range []struct {
+		vname    *spb.VName
+		complete string
+	}{{fwd, "incomplete"}, {full, "definition"}, {unknown, ""}} {
+		a := anchorVName(file, n.vname.Signature+"-def")
+		ns = append(ns, &node{a, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "2",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{edges.DefinesBinding: {n.vname}}})
+		fs := newFacts(facts.NodeKind, nodes.Function)
+		if n.complete != "" {
+			fs[facts.Complete] = n.complete
+		}
+		ns = append(ns, &node{n.vname, fs, map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {a},
+		}})
+	}
+	xs := newService(t, nodesToEntries(ns))
+
+	req := &xpb.CrossReferencesRequest{
+		Ticket:         []string{kytheuri.ToString(fwd), kytheuri.ToString(full), kytheuri.ToString(unknown)},
+		DefinitionKind: xpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+	}
+	tests := []struct {
+		min     facts.Completeness
+		defined []*spb.VName
+	}{
+		{facts.CompletenessIncomplete, []*spb.VName{fwd, full, unknown}},
+		{facts.CompletenessComplete, []*spb.VName{full, unknown}},
+		{facts.CompletenessDefinition, []*spb.VName{full, unknown}},
+	}
+	for _, test := range tests {
+		reply, _, err := xs.CrossReferencesWithOptions(ctx, req, &CrossReferencesOptions{FilterComplete: true, MinCompleteness: test.min})
+		if err != nil {
+			t.Fatalf("CrossReferencesWithOptions(%v) error: %v", test.min, err)
+		}
+		var found, expected []string
+		for ticket, set := range reply.CrossReferences {
+			if len(set.Definition) > 0 {
+				found = append(found, ticket)
+			}
+		}
+		for _, v := range test.defined {
+			expected = append(expected, kytheuri.ToString(v))
+		}
+		sort.Strings(found)
+		sort.Strings(expected)
+		if err := testutil.DeepEqual(expected, found); err != nil {
+			t.Errorf("Min %v: %v", test.min, err)
+		}
+	}
+}
+
+func TestCrossReferencesWithOverrides(t *testing.T) {
+	method, base, derived, root, param := sig("method"), sig("base"), sig("derived"), sig("root"), sig("param")
+	xs := newService(t, nodesToEntries([]*node{
+		{method, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Overrides:               {base},
+			edges.OverridesTransitive:     {root},
+			edges.Mirror(edges.Overrides): {derived},
+			edges.Param:                   {param},
+		}},
+		{base, newFacts(facts.NodeKind, nodes.Function), nil},
+		{derived, newFacts(facts.NodeKind, nodes.Function), nil},
+		{root, newFacts(facts.NodeKind, nodes.Function), nil},
+		{param, newFacts(facts.NodeKind, nodes.Variable), nil},
+	}))
+
+	ticket := kytheuri.ToString(method)
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket: []string{ticket},
+		Filter: []string{facts.NodeKind},
+	}, &CrossReferencesOptions{Overrides: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+
+	// Overrides are returned in GraphStore order.
+	expected := []*Override{
+		{Source: ticket, Ticket: kytheuri.ToString(derived), Kind: edges.Mirror(edges.Overrides)},
+		{Source: ticket, Ticket: kytheuri.ToString(base), Kind: edges.Overrides},
+		{Source: ticket, Ticket: kytheuri.ToString(root), Kind: edges.OverridesTransitive},
+	}
+	if err := testutil.DeepEqual(expected, res.Overrides); err != nil {
+		t.Fatalf("Overrides: %v", err)
+	}
+	if !res.Overrides[0].OverriddenBy() || res.Overrides[1].OverriddenBy() {
+		t.Errorf("Unexpected OverriddenBy results: %v", res.Overrides)
+	} else if !res.Overrides[2].Transitive() || res.Overrides[1].Transitive() {
+		t.Errorf("Unexpected Transitive results: %v", res.Overrides)
+	}
+
+	expectedRelated := []*xpb.CrossReferencesReply_RelatedNode{{
+		Ticket:       kytheuri.ToString(param),
+		RelationKind: edges.Param,
+	}}
+	if err := testutil.DeepEqual(expectedRelated, reply.CrossReferences[ticket].GetRelatedNode()); err != nil {
+		t.Errorf("RelatedNodes: %v", err)
+	}
+	for _, o := range expected {
+		if reply.Nodes[o.Ticket] == nil {
+			t.Errorf("Missing node for override %q", o.Ticket)
+		}
+	}
+}
+
+func TestCrossReferencesWithHierarchy(t *testing.T) {
+	code := func(name string) string {
+		rec, err := proto.Marshal(&xpb.MarkedSource{Kind: xpb.MarkedSource_IDENTIFIER, PreText: name})
+		if err != nil {
+			t.Fatalf("Error marshaling MarkedSource: %v", err)
+		}
+		return string(rec)
+	}
+	class, base, iface, derived, member := sig("class"), sig("base"), sig("iface"), sig("derived"), sig("member")
+	xs := newService(t, nodesToEntries([]*node{
+		{class, newFacts(facts.NodeKind, nodes.Record), map[string][]*spb.VName{
+			edges.ExtendsPublic:         {base},
+			edges.Extends:               {iface},
+			edges.Mirror(edges.Extends): {derived},
+			edges.Mirror(edges.ChildOf): {member},
+		}},
+		{base, newFacts(facts.NodeKind, nodes.Record, facts.Code, code("Base")), nil},
+		{iface, newFacts(facts.NodeKind, nodes.Interface, facts.Code, code("Iface")), nil},
+		{derived, newFacts(facts.NodeKind, nodes.Record), nil},
+		{member, newFacts(facts.NodeKind, nodes.Variable), nil},
+	}))
+
+	ticket := kytheuri.ToString(class)
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket: []string{ticket},
+		Filter: []string{facts.NodeKind},
+	}, &CrossReferencesOptions{Hierarchy: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+
+	// Hierarchy nodes are returned in GraphStore order.
+	expected := map[string][]*HierarchyNode{
+		ticket: {
+			{Ticket: kytheuri.ToString(derived), Kind: edges.Mirror(edges.Extends)},
+			{Ticket: kytheuri.ToString(iface), Kind: edges.Extends, Name: "Iface"},
+			{Ticket: kytheuri.ToString(base), Kind: edges.ExtendsPublic, Name: "Base"},
+		},
+	}
+	if err := testutil.DeepEqual(expected, res.Hierarchy); err != nil {
+		t.Fatalf("Hierarchy: %v", err)
+	}
+	if hs := res.Hierarchy[ticket]; !hs[0].Subtype() || hs[1].Subtype() || hs[2].Subtype() {
+		t.Errorf("Unexpected Subtype results: %v", hs)
+	}
+
+	expectedRelated := []*xpb.CrossReferencesReply_RelatedNode{{
+		Ticket:       kytheuri.ToString(member),
+		RelationKind: edges.Mirror(edges.ChildOf),
+	}}
+	if err := testutil.DeepEqual(expectedRelated, reply.CrossReferences[ticket].GetRelatedNode()); err != nil {
+		t.Errorf("RelatedNodes: %v", err)
+	}
+	for _, h := range expected[ticket] {
+		if reply.Nodes[h.Ticket] == nil {
+			t.Errorf("Missing node for hierarchy type %q", h.Ticket)
+		}
+	}
+}
+
+func TestCrossReferencesWithAliases(t *testing.T) {
+	talias, target, alias, name, param := sig("talias"), sig("target"), sig("alias"), sig("name"), sig("param")
+	xs := newService(t, nodesToEntries([]*node{
+		{talias, newFacts(facts.NodeKind, nodes.TAlias), map[string][]*spb.VName{
+			edges.Aliases:               {target},
+			edges.Mirror(edges.Aliases): {alias},
+			edges.Named:                 {name},
+			edges.Param:                 {param},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Record), nil},
+		{alias, newFacts(facts.NodeKind, nodes.TAlias), nil},
+		{name, newFacts(facts.NodeKind, nodes.Name), nil},
+		{param, newFacts(facts.NodeKind, nodes.Variable), nil},
+	}))
+
+	ticket := kytheuri.ToString(talias)
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket: []string{ticket},
+		Filter: []string{facts.NodeKind},
+	}, &CrossReferencesOptions{Aliases: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+
+	// Aliases are returned in GraphStore order.
+	expected := map[string][]*xpb.CrossReferencesReply_RelatedNode{
+		ticket: {
+			{Ticket: kytheuri.ToString(alias), RelationKind: edges.Mirror(edges.Aliases)},
+			{Ticket: kytheuri.ToString(target), RelationKind: edges.Aliases},
+			{Ticket: kytheuri.ToString(name), RelationKind: edges.Named},
+		},
+	}
+	if err := testutil.DeepEqual(expected, res.Aliases); err != nil {
+		t.Fatalf("Aliases: %v", err)
+	}
+
+	expectedRelated := []*xpb.CrossReferencesReply_RelatedNode{{
+		Ticket:       kytheuri.ToString(param),
+		RelationKind: edges.Param,
+	}}
+	if err := testutil.DeepEqual(expectedRelated, reply.CrossReferences[ticket].GetRelatedNode()); err != nil {
+		t.Errorf("RelatedNodes: %v", err)
+	}
+	for _, a := range expected[ticket] {
+		if reply.Nodes[a.Ticket] == nil {
+			t.Errorf("Missing node for alias %q", a.Ticket)
+		}
+	}
+}
+
+func TestCrossReferencesRelatedNodePaging(t *testing.T) {
+	xs := newService(t, testEntries)
+
+	ticket := kytheuri.ToString(sig("signature"))
+	req := &xpb.CrossReferencesRequest{
+		Ticket:   []string{ticket},
+		Filter:   []string{facts.NodeKind},
+		PageSize: 2,
+	}
+
+	var pages [][]*xpb.CrossReferencesReply_RelatedNode
+	for {
+		reply, err := xs.CrossReferences(ctx, req)
+		if err != nil {
+			t.Fatalf("CrossReferences error: %v", err)
+		}
+		var related []*xpb.CrossReferencesReply_RelatedNode
+		if xr := reply.CrossReferences[ticket]; xr != nil {
+			related = xr.RelatedNode
+		}
+		pages = append(pages, related)
+
+		if reply.NextPageToken == "" {
+			break
+		} else if len(pages) > 3 {
+			t.Fatalf("Too many pages: %v", pages)
+		}
+		req.PageToken = reply.NextPageToken
+	}
+
+	expected := [][]*xpb.CrossReferencesReply_RelatedNode{{
+		{Ticket: kytheuri.ToString(sig("sig2")), RelationKind: edges.Mirror("someEdgeKind")},
+		{Ticket: kytheuri.ToString(sig("sig2")), RelationKind: edges.Param},
+	}, {
+		{Ticket: kytheuri.ToString(sig("someParameter")), RelationKind: edges.Param, Ordinal: 1},
+	}}
+	if err := testutil.DeepEqual(expected, pages); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCrossReferencesWithParams(t *testing.T) {
+	param := func(kind, target string) *spb.Entry {
+		return &spb.Entry{Source: federatedTarget, Target: sig(target), EdgeKind: kind, FactName: "/"}
+	}
+	entries := append(federatedEntries("file"),
+		param(edges.Param+".2", "c"),
+		param(edges.Param, "y"),
+		param(edges.Param+".0", "a"),
+		param(edges.Param, "x"),
+		param(edges.Param+".1", "b"),
+		nodeFact(sig("a"), facts.NodeKind, nodes.Variable),
+		nodeFact(sig("x"), facts.NodeKind, nodes.Variable))
+	xs := newService(t, entries)
+
+	ticket := kytheuri.ToString(federatedTarget)
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket, kytheuri.ToString(sig("a"))},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		Filter:        []string{facts.NodeKind},
+	}, &CrossReferencesOptions{Params: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+
+	expected := map[string][]*Param{
+		ticket: {
+			{Ticket: kytheuri.ToString(sig("a")), Ordinal: 0, HasOrdinal: true},
+			{Ticket: kytheuri.ToString(sig("b")), Ordinal: 1, HasOrdinal: true},
+			{Ticket: kytheuri.ToString(sig("c")), Ordinal: 2, HasOrdinal: true},
+			{Ticket: kytheuri.ToString(sig("x"))},
+			{Ticket: kytheuri.ToString(sig("y"))},
+		},
+	}
+	if err := testutil.DeepEqual(expected, res.Params); err != nil {
+		t.Error(err)
+	}
+	for _, p := range []string{"a", "x"} {
+		if info := reply.Nodes[kytheuri.ToString(sig(p))]; string(info.GetFacts()[facts.NodeKind]) != nodes.Variable {
+			t.Errorf("Missing node kind for param %q: %v", p, reply.Nodes)
+		}
+	}
+}
+
+func TestCrossReferencesWithDocs(t *testing.T) {
+	target := federatedTarget
+	undocumented := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "undocumented"}
+	doc := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "doc"}
+	x, y := sig("x"), sig("y")
+	entries := append(federatedEntries("file"), nodesToEntries([]*node{
+		{doc, newFacts(
+			facts.NodeKind, nodes.Doc,
+			facts.Text, "Returns [x] and [y].",
+		), map[string][]*spb.VName{
+			edges.Documents: {target},
+		}},
+		{target, nil, map[string][]*spb.VName{
+			edges.Mirror(edges.Documents): {doc},
+		}},
+		{undocumented, newFacts(facts.NodeKind, nodes.Function), nil},
+	})...)
+	// The params are written out of order.
+	entries = append(entries,
+		edgeFact(doc, edges.Param, 1, y),
+		edgeFact(doc, edges.Param, 0, x))
+	xs := newService(t, entries)
+
+	ticket := kytheuri.ToString(target)
+	links := []*xpb.Link{
+		{Definition: []string{kytheuri.ToString(x)}},
+		{Definition: []string{kytheuri.ToString(y)}},
+	}
+	tests := []struct {
+		anchorText bool
+		expected   *xpb.Printable
+	}{
+		{true, &xpb.Printable{RawText: "Returns [x] and [y].", Link: links}},
+		{false, &xpb.Printable{Link: links}},
+	}
+	for _, test := range tests {
+		reply, res, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+			Ticket:        []string{ticket, kytheuri.ToString(undocumented)},
+			ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+			AnchorText:    test.anchorText,
+		}, &CrossReferencesOptions{Docs: true})
+		if err != nil {
+			t.Fatalf("CrossReferencesWithOptions error: %v", err)
+		} else if len(reply.CrossReferences[ticket].GetReference()) != 1 {
+			t.Errorf("Expected 1 reference; found %v", reply.CrossReferences)
+		}
+		if err := testutil.DeepEqual(map[string]*xpb.Printable{ticket: test.expected}, res.Docs); err != nil {
+			t.Errorf("AnchorText %v: %v", test.anchorText, err)
+		}
+	}
+}
+
+func TestCrossReferencesDecodeErrors(t *testing.T) {
+	good, bad := fileVName("good"), fileVName("bad")
+	goodAnchor, badAnchor := anchorVName(good, "anchor"), anchorVName(bad, "anchor")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		{good, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "xy\n",
+		), nil},
+		{bad, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "xy\n",
+			facts.TextEncoding, "not-an-encoding",
+		), nil},
+		{goodAnchor, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "2",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{badAnchor, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "2",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {goodAnchor, badAnchor},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	reply, res, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		AnchorText:    true,
+	}, &CrossReferencesOptions{Diagnostics: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	}
+
+	badTicket := kytheuri.ToString(badAnchor)
+	expected := map[string]*cpb.NodeInfo{
+		badTicket: {Facts: map[string][]byte{
+			DecodeErrorFact: []byte(fmt.Sprintf("file %q: %v: unsupported text encoding %q", kytheuri.ToString(bad), ErrInvalidArgument, "not-an-encoding")),
+		}},
+	}
+	if err := testutil.DeepEqual(expected, reply.Nodes); err != nil {
+		t.Error(err)
+	}
+	for _, ref := range reply.CrossReferences[ticket].GetReference() {
+		if ref.Anchor.Ticket != badTicket && (ref.Anchor.Text != "xy" || ref.Anchor.Snippet != "xy") {
+			t.Errorf("Expected decoded text and snippet for %q; found %v", ref.Anchor.Ticket, ref.Anchor)
+		}
+	}
+	if len(res.Diagnostics) == 0 {
+		t.Error("Expected diagnostics for decoding errors")
+	}
+	for _, d := range res.Diagnostics {
+		if d.Ticket != badTicket {
+			t.Errorf("Unexpected diagnostic: %v", d)
+		}
+	}
+}
+
+func TestCrossReferencesInvalidEncoding(t *testing.T) {
+	file := fileVName("file")
+	anchor := anchorVName(file, "anchor")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "line 1\nline 2\n",
+			facts.TextEncoding, "not-an-encoding",
+		), nil},
+		{anchor, newFacts(
+			facts.AnchorStart, "7",
+			facts.AnchorEnd, "11",
+			facts.SnippetStart, "7",
+			facts.SnippetEnd, "13",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {anchor},
+		}},
+	}))
 
-	testFileVName    = sig("testFileNode")
-	testFileContent  = "file_content"
-	testFileEncoding = "UTF-8"
+	ticket := kytheuri.ToString(target)
+	reply, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		AnchorText:    true,
+	})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
 
-	testAnchorVName       = sig("testAnchor")
-	testAnchorTargetVName = sig("someSemanticNode")
+	// The anchor is located, but neither its text nor its snippet is decoded.
+	refs := reply.CrossReferences[ticket].GetReference()
+	if len(refs) != 1 {
+		t.Fatalf("Expected 1 reference; found %v", refs)
+	} else if a := refs[0].Anchor; a.Start.LineNumber != 2 || a.End.ByteOffset != 11 || a.Text != "" || a.Snippet != "" {
+		t.Errorf("Expected undecoded anchor on line 2; found %v", a)
+	}
+	decodeErr := string(reply.Nodes[kytheuri.ToString(anchor)].GetFacts()[DecodeErrorFact])
+	if !strings.Contains(decodeErr, "unsupported text encoding") {
+		t.Errorf("Expected unsupported text encoding %s; found %q", DecodeErrorFact, decodeErr)
+	}
+}
 
-	testNodes = []*node{
-		{sig("orphanedNode"), newFacts(facts.NodeKind, "orphan"), nil},
-		{testFileVName, newFacts(
+func TestCrossReferencesLocationsOnly(t *testing.T) {
+	indexed, unindexed := fileVName("indexed"), fileVName("unindexed")
+	indexedAnchor, unindexedAnchor := anchorVName(indexed, "anchor"), anchorVName(unindexed, "anchor")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		// The indexed file's text is not needed and is deliberately missing.
+		{indexed, newFacts(
 			facts.NodeKind, nodes.File,
-			facts.Text, testFileContent,
-			facts.TextEncoding, testFileEncoding), map[string][]*spb.VName{
-			revChildOfEdgeKind: {testAnchorVName},
-		}},
-		{sig("sig2"), newFacts(facts.NodeKind, "test"), map[string][]*spb.VName{
-			"someEdgeKind": {sig("signature")},
-		}},
-		{sig("signature"), newFacts(facts.NodeKind, "test"), map[string][]*spb.VName{
-			edges.Mirror("someEdgeKind"): {sig("sig2")},
-			edges.Param:                  {sig("sig2"), sig("someParameter")},
+			facts.LineIndex, "3,3,0",
+		), nil},
+		{unindexed, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "xy\n",
+		), nil},
+		{indexedAnchor, newFacts(
+			facts.AnchorStart, "3",
+			facts.AnchorEnd, "5",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Defines: {target},
 		}},
-		{testAnchorVName, newFacts(
-			facts.AnchorEnd, "4",
-			facts.AnchorStart, "1",
+		{unindexedAnchor, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "2",
 			facts.NodeKind, nodes.Anchor,
 		), map[string][]*spb.VName{
-			edges.ChildOf: {testFileVName},
-			edges.Ref:     {testAnchorTargetVName},
+			edges.Ref: {target},
 		}},
-		{testAnchorTargetVName, newFacts(facts.NodeKind, "record"), map[string][]*spb.VName{
-			edges.Mirror(edges.Ref): {testAnchorVName},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Defines): {indexedAnchor},
+			edges.Mirror(edges.Ref):     {unindexedAnchor},
 		}},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	reply, _, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket:         []string{ticket},
+		DefinitionKind: xpb.CrossReferencesRequest_ALL_DEFINITIONS,
+		ReferenceKind:  xpb.CrossReferencesRequest_ALL_REFERENCES,
+		AnchorText:     true,
+	}, &CrossReferencesOptions{LocationsOnly: true})
+	if err != nil {
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
 	}
-	testEntries = nodesToEntries(testNodes)
-)
 
-func TestNodes(t *testing.T) {
-	xs := newService(t, testEntries)
+	expected := &xpb.CrossReferencesReply_CrossReferenceSet{
+		Ticket: ticket,
+		Definition: []*xpb.CrossReferencesReply_RelatedAnchor{{Anchor: &xpb.Anchor{
+			Ticket: kytheuri.ToString(indexedAnchor),
+			Kind:   edges.Defines,
+			Parent: kytheuri.ToString(indexed),
+			Start:  &xpb.Location_Point{ByteOffset: 3, LineNumber: 2},
+			End:    &xpb.Location_Point{ByteOffset: 5, LineNumber: 2, ColumnOffset: 2},
+		}}},
+		Reference: []*xpb.CrossReferencesReply_RelatedAnchor{{Anchor: &xpb.Anchor{
+			Ticket: kytheuri.ToString(unindexedAnchor),
+			Kind:   edges.Ref,
+			Parent: kytheuri.ToString(unindexed),
+			Start:  &xpb.Location_Point{ByteOffset: 0, LineNumber: 1},
+			End:    &xpb.Location_Point{ByteOffset: 2, LineNumber: 1, ColumnOffset: 2},
+		}}},
+	}
+	if err := testutil.DeepEqual(expected, reply.CrossReferences[ticket]); err != nil {
+		t.Error(err)
+	}
+}
 
-	reply, err := xs.Nodes(ctx, &gpb.NodesRequest{
-		Ticket: nodesToTickets(testNodes),
-	})
+func TestCrossReferencesDedupSnippets(t *testing.T) {
+	file := fileVName("file")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	ns := []*node{{file, newFacts(
+		facts.NodeKind, nodes.File,
+		facts.Text, "x = y + z\nother\n",
+	), nil}}
+	var anchors []*spb.VName
+	for _, span := range [][2]int{{0, 1}, {4, 5}, {8, 9}, {10, 15}} {
+		anchor := anchorVName(file, fmt.Sprintf("%d-%d", span[0], span[1]))
+		anchors = append(anchors, anchor)
+		ns = append(ns, &node{anchor, newFacts(
+			facts.AnchorStart, strconv.Itoa(span[0]),
+			facts.AnchorEnd, strconv.Itoa(span[1]),
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}})
+	}
+	ns = append(ns, &node{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+		edges.Mirror(edges.Ref): anchors,
+	}})
+	xs := newService(t, nodesToEntries(ns))
+
+	ticket := kytheuri.ToString(target)
+	reply, _, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+	}, &CrossReferencesOptions{DedupSnippets: true})
 	if err != nil {
-		t.Fatalf("Error fetching nodes for %+v: %v", nodesToTickets(testNodes), err)
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
 	}
-	expected := nodesToInfos(testNodes)
-	if err := testutil.DeepEqual(expected, reply.Nodes); err != nil {
-		t.Fatal(err)
+
+	refs := reply.CrossReferences[ticket].GetReference()
+	if len(refs) != len(anchors) {
+		t.Fatalf("Expected %d references; found %v", len(anchors), refs)
+	}
+	snippets := make(map[string]string)
+	for _, ref := range refs {
+		a := ref.Anchor
+		if a.SnippetStart == nil || a.SnippetEnd == nil {
+			t.Errorf("Missing snippet bounds for %q", a.Ticket)
+			continue
+		}
+		if a.Snippet != "" {
+			if dup, ok := reply.Nodes[a.Ticket].GetFacts()[DuplicateSnippetFact]; ok {
+				t.Errorf("Unexpected %s fact %q for %q", DuplicateSnippetFact, dup, a.Ticket)
+			}
+			snippets[a.Ticket] = a.Snippet
+		}
+	}
+	for _, ref := range refs {
+		a := ref.Anchor
+		if a.Snippet != "" {
+			continue
+		}
+		orig := string(reply.Nodes[a.Ticket].GetFacts()[DuplicateSnippetFact])
+		if snippets[orig] != "x = y + z" {
+			t.Errorf("Duplicate snippet for %q references %q with snippet %q", a.Ticket, orig, snippets[orig])
+		}
+	}
+
+	var found []string
+	for _, snippet := range snippets {
+		found = append(found, snippet)
+	}
+	sort.Strings(found)
+	if err := testutil.DeepEqual([]string{"other", "x = y + z"}, found); err != nil {
+		t.Errorf("Snippets: %v", err)
 	}
 }
 
-func TestEdges(t *testing.T) {
-	xs := newService(t, testEntries)
+func TestCrossReferencesZeroWidthAnchor(t *testing.T) {
+	file := fileVName("file")
+	implicit := anchorVName(file, "implicit")
+	explicit := anchorVName(file, "explicit")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "ab\ncd\n",
+		), nil},
+		{implicit, newFacts(
+			facts.AnchorStart, "4",
+			facts.AnchorEnd, "4",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{explicit, newFacts(
+			facts.AnchorStart, "3",
+			facts.AnchorEnd, "5",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.Ref: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {explicit, implicit},
+		}},
+	}))
 
-	reply, err := xs.Edges(ctx, &gpb.EdgesRequest{
-		Ticket: nodesToTickets(testNodes),
-		Filter: []string{"**"}, // every fact
+	ticket := kytheuri.ToString(target)
+	reply, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		AnchorText:    true,
 	})
 	if err != nil {
-		t.Fatalf("Error fetching edges for %+v: %v", nodesToTickets(testNodes), err)
+		t.Fatalf("CrossReferences error: %v", err)
 	}
 
-	expectedEdges := nodesToEdgeSets(testNodes)
-	if err := testutil.DeepEqual(expectedEdges, sortEdgeSets(reply.EdgeSets)); err != nil {
-		t.Error(err)
+	anchors := make(map[string]*xpb.Anchor)
+	for _, ref := range reply.CrossReferences[ticket].GetReference() {
+		anchors[ref.Anchor.Ticket] = ref.Anchor
+	}
+	zero, full := anchors[kytheuri.ToString(implicit)], anchors[kytheuri.ToString(explicit)]
+	if zero == nil || full == nil {
+		t.Fatalf("Missing references: %v", anchors)
 	}
 
-	nodesWithEdges := testNodes[1:]
-	expectedInfos := nodesToInfos(nodesWithEdges)
-	if err := testutil.DeepEqual(expectedInfos, reply.Nodes); err != nil {
+	expected := &xpb.Anchor{
+		Ticket:       kytheuri.ToString(implicit),
+		Kind:         edges.Ref,
+		Parent:       kytheuri.ToString(file),
+		Start:        &xpb.Location_Point{ByteOffset: 4, LineNumber: 2, ColumnOffset: 1},
+		End:          &xpb.Location_Point{ByteOffset: 4, LineNumber: 2, ColumnOffset: 1},
+		Snippet:      "cd",
+		SnippetStart: &xpb.Location_Point{ByteOffset: 3, LineNumber: 2},
+		SnippetEnd:   &xpb.Location_Point{ByteOffset: 5, LineNumber: 2, ColumnOffset: 2},
+	}
+	if err := testutil.DeepEqual(expected, zero); err != nil {
 		t.Error(err)
 	}
+	if full.Text != "cd" {
+		t.Errorf("Found anchor text %q; expected %q", full.Text, "cd")
+	}
+
+	if info := reply.Nodes[zero.Ticket]; string(info.GetFacts()[ZeroWidthFact]) != "true" {
+		t.Errorf("Missing %s fact for zero-width anchor: %v", ZeroWidthFact, reply.Nodes)
+	}
+	if info := reply.Nodes[full.Ticket]; info != nil {
+		t.Errorf("Unexpected node for anchor %q: %v", full.Ticket, info)
+	}
 }
 
-func TestDecorations(t *testing.T) {
-	xs := newService(t, testEntries)
+func TestCrossReferencesWithDeprecation(t *testing.T) {
+	ticket := kytheuri.ToString(federatedTarget)
+	req := &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+	}
 
-	reply, err := xs.Decorations(ctx, &xpb.DecorationsRequest{
-		Location: &xpb.Location{
-			Ticket: kytheuri.ToString(testFileVName),
+	tests := []struct {
+		entries  []*spb.Entry
+		expected map[string]string
+	}{
+		{federatedEntries("file"), map[string]string{}},
+		{
+			append(federatedEntries("file"), nodeFact(federatedTarget, facts.Deprecated, "use something else")),
+			map[string]string{ticket: "use something else"},
 		},
-		SourceText: true,
-		References: true,
-		Filter:     []string{"**"},
-	})
+		{
+			append(federatedEntries("file"), nodeFact(federatedTarget, facts.Deprecated, "")),
+			map[string]string{ticket: ""},
+		},
+	}
+
+	for _, test := range tests {
+		xs := newService(t, test.entries)
+		reply, res, err := xs.CrossReferencesWithOptions(ctx, req, &CrossReferencesOptions{Deprecation: true})
+		if err != nil {
+			t.Fatalf("CrossReferencesWithOptions error: %v", err)
+		} else if len(reply.CrossReferences[ticket].GetReference()) != 1 {
+			t.Errorf("Expected 1 reference; found %v", reply.CrossReferences)
+		}
+		if err := testutil.DeepEqual(test.expected, res.Deprecated); err != nil {
+			t.Error(err)
+		}
+
+		nodes, err := xs.Nodes(ctx, &gpb.NodesRequest{Ticket: []string{ticket}, Filter: []string{facts.Deprecated}})
+		if err != nil {
+			t.Fatalf("Nodes error: %v", err)
+		}
+		msg, ok := test.expected[ticket]
+		if found, foundOK := nodes.Nodes[ticket].GetFacts()[facts.Deprecated]; foundOK != ok || string(found) != msg {
+			t.Errorf("Nodes returned %s fact %q (%v); expected %q (%v)", facts.Deprecated, found, foundOK, msg, ok)
+		}
+	}
+}
+
+func TestCrossReferencesExportedOnly(t *testing.T) {
+	public := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "public"}
+	private := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "private"}
+	unknown := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "unknown"}
+	entries := append(federatedEntries("file"), nodesToEntries([]*node{
+		{federatedTarget, newFacts(facts.Visibility, facts.VisibilityPublic), map[string][]*spb.VName{
+			edges.Param: {public, private, unknown},
+		}},
+		{public, newFacts(facts.Visibility, facts.VisibilityPublic), nil},
+		{private, newFacts(facts.Visibility, "private"), nil},
+		{unknown, newFacts(facts.NodeKind, nodes.Variable), nil},
+	})...)
+	ticket := kytheuri.ToString(federatedTarget)
+	req := &xpb.CrossReferencesRequest{
+		Ticket:        []string{ticket, kytheuri.ToString(private)},
+		ReferenceKind: xpb.CrossReferencesRequest_ALL_REFERENCES,
+		Filter:        []string{facts.NodeKind},
+	}
+
+	tests := []struct {
+		exportedByDefault map[string]bool
+		expected          []*xpb.CrossReferencesReply_RelatedNode
+	}{
+		{nil, []*xpb.CrossReferencesReply_RelatedNode{
+			{Ticket: kytheuri.ToString(public), RelationKind: edges.Param},
+			{Ticket: kytheuri.ToString(unknown), RelationKind: edges.Param, Ordinal: 2},
+		}},
+		{map[string]bool{"lang": false}, []*xpb.CrossReferencesReply_RelatedNode{
+			{Ticket: kytheuri.ToString(public), RelationKind: edges.Param},
+		}},
+	}
+
+	for _, test := range tests {
+		xs := newService(t, entries)
+		xs.ExportedByDefault = test.exportedByDefault
+		reply, _, err := xs.CrossReferencesWithOptions(ctx, req, &CrossReferencesOptions{ExportedOnly: true})
+		if err != nil {
+			t.Fatalf("CrossReferencesWithOptions error: %v", err)
+		}
+		if _, ok := reply.CrossReferences[kytheuri.ToString(private)]; ok {
+			t.Errorf("Unexpected cross-references for unexported node: %v", reply.CrossReferences)
+		}
+		if len(reply.CrossReferences[ticket].GetReference()) != 1 {
+			t.Errorf("Expected 1 reference; found %v", reply.CrossReferences)
+		}
+		if err := testutil.DeepEqual(test.expected, reply.CrossReferences[ticket].GetRelatedNode()); err != nil {
+			t.Errorf("RelatedNodes: %v", err)
+		}
+	}
+
+	xs := newService(t, entries)
+	reply, _, err := xs.CrossReferencesWithOptions(ctx, &xpb.CrossReferencesRequest{
+		Ticket: []string{kytheuri.ToString(private)},
+		Filter: []string{facts.NodeKind},
+	}, &CrossReferencesOptions{ExportedOnly: true})
 	if err != nil {
-		t.Fatalf("Error fetching decorations for %+v: %v", testFileVName, err)
+		t.Fatalf("CrossReferencesWithOptions error: %v", err)
+	} else if len(reply.CrossReferences) != 0 {
+		t.Errorf("Expected no cross-references; found %v", reply.CrossReferences)
 	}
+}
 
-	if string(reply.SourceText) != testFileContent {
-		t.Errorf("Incorrect file content: %q; Expected: %q", string(reply.SourceText), testFileContent)
+func TestCrossReferencesMultiLineSnippet(t *testing.T) {
+	file := fileVName("file")
+	anchor := anchorVName(file, "anchor")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "function"}
+	entries := nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "a\nfunc f() {\n  x\n}\nb\n",
+		), nil},
+		{anchor, newFacts(
+			facts.AnchorStart, "2",
+			facts.AnchorEnd, "18",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.DefinesBinding: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {anchor},
+		}},
+	})
+
+	tests := []struct {
+		maxLines int
+		snippet  string
+		end      *xpb.Location_Point
+	}{
+		{0, "func f() {\n  x\n}", &xpb.Location_Point{ByteOffset: 18, LineNumber: 4, ColumnOffset: 1}},
+		{3, "func f() {\n  x\n}", &xpb.Location_Point{ByteOffset: 18, LineNumber: 4, ColumnOffset: 1}},
+		{2, "func f() {\n  x", &xpb.Location_Point{ByteOffset: 16, LineNumber: 3, ColumnOffset: 3}},
+		{1, "func f() {", &xpb.Location_Point{ByteOffset: 12, LineNumber: 2, ColumnOffset: 10}},
 	}
-	if reply.Encoding != testFileEncoding {
-		t.Errorf("Incorrect file encoding: %q; Expected: %q", reply.Encoding, testFileEncoding)
+
+	ticket := kytheuri.ToString(target)
+	for _, test := range tests {
+		xs := newService(t, entries)
+		xs.MaxSnippetLines = test.maxLines
+		reply, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+			Ticket:         []string{ticket},
+			DefinitionKind: xpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+		})
+		if err != nil {
+			t.Fatalf("CrossReferences error: %v", err)
+		}
+		defs := reply.CrossReferences[ticket].GetDefinition()
+		if len(defs) != 1 {
+			t.Fatalf("Expected 1 definition; found %v", defs)
+		}
+
+		a := defs[0].Anchor
+		if a.Snippet != test.snippet {
+			t.Errorf("MaxSnippetLines %d: found snippet %q; expected %q", test.maxLines, a.Snippet, test.snippet)
+		}
+		start := &xpb.Location_Point{ByteOffset: 2, LineNumber: 2}
+		if err := testutil.DeepEqual(start, a.SnippetStart); err != nil {
+			t.Errorf("MaxSnippetLines %d: SnippetStart: %v", test.maxLines, err)
+		}
+		if err := testutil.DeepEqual(test.end, a.SnippetEnd); err != nil {
+			t.Errorf("MaxSnippetLines %d: SnippetEnd: %v", test.maxLines, err)
+		}
 	}
+}
 
-	expectedRefs := []*xpb.DecorationsReply_Reference{
-		{
-			SourceTicket: kytheuri.ToString(testAnchorVName),
-			TargetTicket: kytheuri.ToString(testAnchorTargetVName),
-			Kind:         edges.Ref,
-			AnchorStart: &xpb.Location_Point{
-				ByteOffset:   1,
-				LineNumber:   1,
-				ColumnOffset: 1,
-			},
-			AnchorEnd: &xpb.Location_Point{
-				ByteOffset:   4,
-				LineNumber:   1,
-				ColumnOffset: 4,
-			},
-		},
+func TestCrossReferencesTrimSnippetIndentation(t *testing.T) {
+	file := fileVName("file")
+	call, block := anchorVName(file, "call"), anchorVName(file, "block")
+	fn := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "f"}
+	blk := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "block"}
+	entries := nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "a\n\t\t\t\tif x {\n\t\t\t\t\tf()\n\t\t\t\t}\n",
+		), nil},
+		{call, newFacts(
+			facts.AnchorStart, "18",
+			facts.AnchorEnd, "19",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{edges.Ref: {fn}}},
+		{block, newFacts(
+			facts.AnchorStart, "6",
+			facts.AnchorEnd, "27",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{edges.DefinesBinding: {blk}}},
+		{fn, newFacts(facts.NodeKind, nodes.Function), map[string][]*spb.VName{
+			edges.Mirror(edges.Ref): {call},
+		}},
+		{blk, newFacts(facts.NodeKind, nodes.Variable), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {block},
+		}},
+	})
+	req := &xpb.CrossReferencesRequest{
+		Ticket:         []string{kytheuri.ToString(fn), kytheuri.ToString(blk)},
+		DefinitionKind: xpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+		ReferenceKind:  xpb.CrossReferencesRequest_ALL_REFERENCES,
 	}
-	if err := testutil.DeepEqual(sortRefs(expectedRefs), sortRefs(reply.Reference)); err != nil {
-		t.Error(err)
+
+	tests := []struct {
+		trim       bool
+		ref, def   string
+		refSnippet *xpb.Location_Point
+		defSnippet *xpb.Location_Point
+	}{
+		{false, "\t\t\t\t\tf()", "\t\t\t\tif x {\n\t\t\t\t\tf()\n\t\t\t\t}",
+			&xpb.Location_Point{ByteOffset: 13, LineNumber: 3},
+			&xpb.Location_Point{ByteOffset: 2, LineNumber: 2}},
+		{true, "f()", "if x {\n\tf()\n}",
+			&xpb.Location_Point{ByteOffset: 18, LineNumber: 3, ColumnOffset: 5},
+			&xpb.Location_Point{ByteOffset: 6, LineNumber: 2, ColumnOffset: 4}},
 	}
+	for _, test := range tests {
+		xs := newService(t, entries)
+		xs.TrimSnippetIndentation = test.trim
+		reply, err := xs.CrossReferences(ctx, req)
+		if err != nil {
+			t.Fatalf("CrossReferences error: %v", err)
+		}
+		refs := reply.CrossReferences[kytheuri.ToString(fn)].GetReference()
+		defs := reply.CrossReferences[kytheuri.ToString(blk)].GetDefinition()
+		if len(refs) != 1 || len(defs) != 1 {
+			t.Fatalf("Expected 1 reference and 1 definition; found %v", reply.CrossReferences)
+		}
 
-	expectedNodes := nodesToInfos(testNodes[4:6])
-	if err := testutil.DeepEqual(expectedNodes, reply.Nodes); err != nil {
+		ref, def := refs[0].Anchor, defs[0].Anchor
+		if ref.Snippet != test.ref || def.Snippet != test.def {
+			t.Errorf("Trim %v: found snippets %q and %q; expected %q and %q", test.trim, ref.Snippet, def.Snippet, test.ref, test.def)
+		}
+		if err := testutil.DeepEqual(test.refSnippet, ref.SnippetStart); err != nil {
+			t.Errorf("Trim %v: reference SnippetStart: %v", test.trim, err)
+		}
+		if err := testutil.DeepEqual(test.defSnippet, def.SnippetStart); err != nil {
+			t.Errorf("Trim %v: definition SnippetStart: %v", test.trim, err)
+		}
+
+		// The anchors' own spans are unaffected.
+		expected := []*xpb.Location_Point{
+			{ByteOffset: 18, LineNumber: 3, ColumnOffset: 5},
+			{ByteOffset: 6, LineNumber: 2, ColumnOffset: 4},
+			{ByteOffset: 27, LineNumber: 4, ColumnOffset: 5},
+		}
+		if err := testutil.DeepEqual(expected, []*xpb.Location_Point{ref.Start, def.Start, def.End}); err != nil {
+			t.Errorf("Trim %v: anchor spans: %v", test.trim, err)
+		}
+	}
+}
+
+func TestCrossReferencesNonASCIISnippet(t *testing.T) {
+	file := fileVName("file")
+	anchor := anchorVName(file, "anchor")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "café"}
+	xs := newService(t, nodesToEntries([]*node{
+		{file, newFacts(
+			facts.NodeKind, nodes.File,
+			facts.Text, "😀\nné = café\nb\n",
+		), nil},
+		{anchor, newFacts(
+			facts.AnchorStart, "11",
+			facts.AnchorEnd, "16",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{
+			edges.DefinesBinding: {target},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Variable), map[string][]*spb.VName{
+			edges.Mirror(edges.DefinesBinding): {anchor},
+		}},
+	}))
+
+	ticket := kytheuri.ToString(target)
+	reply, err := xs.CrossReferences(ctx, &xpb.CrossReferencesRequest{
+		Ticket:         []string{ticket},
+		DefinitionKind: xpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+		AnchorText:     true,
+	})
+	if err != nil {
+		t.Fatalf("CrossReferences error: %v", err)
+	}
+	defs := reply.CrossReferences[ticket].GetDefinition()
+	if len(defs) != 1 {
+		t.Fatalf("Expected 1 definition; found %v", defs)
+	}
+
+	a := defs[0].Anchor
+	if a.Text != "café" || a.Snippet != "né = café" {
+		t.Errorf("Found text %q and snippet %q; expected %q and %q", a.Text, a.Snippet, "café", "né = café")
+	}
+	expected := []*xpb.Location_Point{
+		{ByteOffset: 11, LineNumber: 2, ColumnOffset: 6},
+		{ByteOffset: 5, LineNumber: 2},
+		{ByteOffset: 16, LineNumber: 2, ColumnOffset: 11},
+	}
+	if err := testutil.DeepEqual(expected, []*xpb.Location_Point{a.Start, a.SnippetStart, a.SnippetEnd}); err != nil {
 		t.Error(err)
 	}
 }
 
+func TestTrimSnippet(t *testing.T) {
+	tests := []struct {
+		text                   string
+		anchorStart, anchorEnd int32
+		maxWidth               int
+		start, end             int32
+	}{
+		{"short line", 0, 5, 200, 0, 10},
+		{"some long line", 5, 9, 0, 0, 14},
+		{"0123456789abcdefghij", 10, 12, 6, 8, 14},
+		{"0123456789abcdefghij", 0, 2, 6, 0, 6},
+		{"0123456789abcdefghij", 18, 20, 6, 14, 20},
+		{"ab\u00e9\u00e9\u00e9xyz", 5, 6, 4, 4, 6},
+		{"ab\u00e9\u00e9\u00e9xyz", 5, 6, 5, 4, 8},
+	}
+
+	for _, test := range tests {
+		start, end := trimSnippet([]byte(test.text), 0, int32(len(test.text)), test.anchorStart, test.anchorEnd, test.maxWidth)
+		if start != test.start || end != test.end {
+			t.Errorf("trimSnippet(%q, [%d:%d], %d): got [%d:%d]; expected [%d:%d]",
+				test.text, test.anchorStart, test.anchorEnd, test.maxWidth, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestCommonIndent(t *testing.T) {
+	tests := []struct {
+		text   string
+		indent int32
+	}{
+		{"no indent", 0},
+		{"    four", 4},
+		{"\t\tx\n\t\t\ty\n\t\tz", 2},
+		{"  x\n\n \n    y", 2},
+		{"\tx\n  y", 0},
+		{"   ", 0},
+	}
+	for _, test := range tests {
+		if indent := commonIndent([]byte(test.text)); indent != test.indent {
+			t.Errorf("commonIndent(%q): got %d; expected %d", test.text, indent, test.indent)
+		}
+	}
+}
+
 func TestDocumentation(t *testing.T) {
 	xs := newService(t, testEntries)
 
@@ -173,26 +4880,119 @@ func TestDocumentation(t *testing.T) {
 	}
 }
 
-func newService(t *testing.T, entries []*spb.Entry) *GraphStoreService {
-	gs := new(inmemory.GraphStore)
+func TestDocumentationDirect(t *testing.T) {
+	ms := &xpb.MarkedSource{
+		Kind:     xpb.MarkedSource_IDENTIFIER,
+		PreText:  "documented",
+		PostText: "()",
+	}
+	code, err := proto.Marshal(ms)
+	if err != nil {
+		t.Fatalf("Error marshaling MarkedSource: %v", err)
+	}
 
-	for req := range graphstore.BatchWrites(channelEntries(entries), 64) {
-		if err := gs.Write(ctx, req); err != nil {
-			t.Fatalf("Failed to write entries: %v", err)
-		}
+	file := fileVName("file")
+	def := anchorVName(file, "def")
+	target := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "documented"}
+	undocumented := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "undocumented"}
+	doc := &spb.VName{Corpus: "corpus", Language: "lang", Signature: "doc"}
+	x := sig("x")
+	entries := append(nodesToEntries([]*node{
+		{file, newFacts(facts.NodeKind, nodes.File, facts.Text, "documented()\n"), nil},
+		{def, newFacts(
+			facts.AnchorStart, "0",
+			facts.AnchorEnd, "10",
+			facts.NodeKind, nodes.Anchor,
+		), map[string][]*spb.VName{edges.DefinesBinding: {target}}},
+		{doc, newFacts(
+			facts.NodeKind, nodes.Doc,
+			facts.Text, "Returns [x].",
+		), map[string][]*spb.VName{
+			edges.Documents: {target},
+			edges.Param:     {x},
+		}},
+		{target, newFacts(facts.NodeKind, nodes.Function, facts.Code, string(code)), map[string][]*spb.VName{
+			edges.Mirror(edges.Documents):      {doc},
+			edges.Mirror(edges.DefinesBinding): {def},
+		}},
+		{undocumented, newFacts(facts.NodeKind, nodes.Variable, facts.Code, string(code)), nil},
+	}), edgeFact(file, revChildOfEdgeKind, 0, def))
+	xs := newService(t, entries)
+
+	ticket, undocumentedTicket := kytheuri.ToString(target), kytheuri.ToString(undocumented)
+	reply, err := xs.Documentation(ctx, &xpb.DocumentationRequest{
+		Ticket: []string{undocumentedTicket, ticket},
+		Filter: []string{facts.NodeKind},
+	})
+	if err != nil {
+		t.Fatalf("Documentation error: %v", err)
+	}
+
+	expected := []*xpb.DocumentationReply_Document{{
+		Ticket:       undocumentedTicket,
+		Text:         &xpb.Printable{},
+		MarkedSource: ms,
+	}, {
+		Ticket: ticket,
+		Text: &xpb.Printable{
+			RawText: "Returns [x].",
+			Link:    []*xpb.Link{{Definition: []string{kytheuri.ToString(x)}}},
+		},
+		MarkedSource: ms,
+	}}
+	if err := testutil.DeepEqual(expected, reply.Document); err != nil {
+		t.Errorf("Documents: %v", err)
+	}
+	// Definition locations are keyed by their anchors' tickets, as referenced
+	// by each linked node's Definition.
+	defTicket := kytheuri.ToString(def)
+	if loc := reply.DefinitionLocations[defTicket]; loc == nil {
+		t.Errorf("Missing definition location %q: %v", defTicket, reply.DefinitionLocations)
+	} else if loc.Parent != kytheuri.ToString(file) || loc.Start.ByteOffset != 0 || loc.End.ByteOffset != 10 {
+		t.Errorf("Unexpected definition location: %v", loc)
+	}
+	if loc, ok := reply.DefinitionLocations[ticket]; ok {
+		t.Errorf("Unexpected definition location keyed by node %q: %v", ticket, loc)
+	}
+	if info := reply.Nodes[ticket]; info == nil || info.Definition != defTicket {
+		t.Errorf("Expected definition %q for %q; found %v", defTicket, ticket, info)
+	} else if kind := string(info.Facts[facts.NodeKind]); kind != nodes.Function {
+		t.Errorf("Expected %q node kind for %q; found %v", nodes.Function, ticket, reply.Nodes)
 	}
-	return NewGraphStoreService(gs)
 }
 
-func channelEntries(entries []*spb.Entry) <-chan *spb.Entry {
-	ch := make(chan *spb.Entry)
-	go func() {
-		defer close(ch)
-		for _, entry := range entries {
-			ch <- entry
-		}
-	}()
-	return ch
+func TestDocumentationWithURIs(t *testing.T) {
+	code, err := proto.Marshal(&xpb.MarkedSource{Kind: xpb.MarkedSource_IDENTIFIER, PreText: "v"})
+	if err != nil {
+		t.Fatalf("Error marshaling MarkedSource: %v", err)
+	}
+	linked, unlinked := sig("linked"), sig("unlinked")
+	xs := newService(t, nodesToEntries([]*node{
+		{linked, newFacts(
+			facts.NodeKind, nodes.Variable,
+			facts.Code, string(code),
+			facts.DocURI, "https://example.com/docs#linked",
+		), nil},
+		{unlinked, newFacts(facts.NodeKind, nodes.Variable, facts.Code, string(code)), nil},
+	}))
+
+	linkedTicket, unlinkedTicket := kytheuri.ToString(linked), kytheuri.ToString(unlinked)
+	reply, uris, err := xs.DocumentationWithURIs(ctx, &xpb.DocumentationRequest{
+		Ticket: []string{linkedTicket, unlinkedTicket},
+	})
+	if err != nil {
+		t.Fatalf("DocumentationWithURIs error: %v", err)
+	} else if len(reply.Document) != 2 {
+		t.Errorf("Expected 2 documents; found %v", reply.Document)
+	}
+	expected := map[string]string{linkedTicket: "https://example.com/docs#linked"}
+	if err := testutil.DeepEqual(expected, uris); err != nil {
+		t.Error(err)
+	}
+}
+
+func newService(t *testing.T, entries []*spb.Entry) *GraphStoreService {
+	return NewGraphStoreService(NewMemGraphStore(entries...))
 }
 
 type node struct {
@@ -218,9 +5018,14 @@ func (n *node) EdgeSet() *gpb.EdgeSet {
 	for kind, targets := range n.Edges {
 		var edges []*gpb.EdgeSet_Group_Edge
 		for ordinal, target := range targets {
+			// The first target is written without an ordinal (see edgeFact).
+			ord := int32(ordinal)
+			if ord == 0 {
+				ord = NoOrdinal
+			}
 			edges = append(edges, &gpb.EdgeSet_Group_Edge{
 				TargetTicket: kytheuri.ToString(target),
-				Ordinal:      int32(ordinal),
+				Ordinal:      ord,
 			})
 		}
 		groups[kind] = &gpb.EdgeSet_Group{
@@ -274,6 +5079,20 @@ func nodesToEdgeSets(nodes []*node) map[string]*gpb.EdgeSet {
 	return sets
 }
 
+func fileVName(path string) *spb.VName {
+	return &spb.VName{Corpus: "corpus", Path: path}
+}
+
+func anchorVName(file *spb.VName, sig string) *spb.VName {
+	return &spb.VName{
+		Corpus:    file.Corpus,
+		Root:      file.Root,
+		Path:      file.Path,
+		Language:  "lang",
+		Signature: sig,
+	}
+}
+
 func sig(sig string) *spb.VName {
 	return &spb.VName{Signature: sig}
 }
@@ -30,6 +30,8 @@ const Prefix = schema.Prefix + "edge/"
 
 // Edge kind labels
 const (
+	Aliases                 = Prefix + "aliases"
+	AliasesRoot             = Prefix + "aliases/root"
 	ChildOf                 = Prefix + "childof"
 	Extends                 = Prefix + "extends"
 	ExtendsPrivate          = Prefix + "extends/private"
@@ -41,6 +43,7 @@ const (
 	ExtendsVirtual          = Prefix + "extends/virtual"
 	Named                   = Prefix + "named"
 	Overrides               = Prefix + "overrides"
+	OverridesTransitive     = Prefix + "overrides/transitive"
 	Param                   = Prefix + "param"
 	Typed                   = Prefix + "typed"
 )
@@ -98,6 +101,62 @@ func IsAnchorEdge(kind string) bool {
 		IsVariant(canon, Ref) || IsVariant(canon, RefCall)
 }
 
+// IsOverride reports whether kind, in either direction, is an overrides edge
+// kind or one of its variants.
+func IsOverride(kind string) bool { return IsVariant(Canonical(kind), Overrides) }
+
+// IsExtends reports whether kind, in either direction, is an extends edge kind
+// or one of its variants (e.g. extends/public).  Extends edges relate a type to
+// each of its supertypes, including the interfaces it implements.
+func IsExtends(kind string) bool { return IsVariant(Canonical(kind), Extends) }
+
+// IsImport reports whether kind, in either direction, is a ref/imports edge
+// kind or one of its variants.
+func IsImport(kind string) bool { return IsVariant(Canonical(kind), RefImports) }
+
+// IsAlias reports whether kind, in either direction, is an aliases or named
+// edge kind or one of their variants.
+func IsAlias(kind string) bool {
+	canon := Canonical(kind)
+	return IsVariant(canon, Aliases) || IsVariant(canon, Named)
+}
+
+// labels maps canonical edge kinds to their labels.
+var labels = map[string]string{
+	Aliases:             "alias",
+	AliasesRoot:         "alias",
+	ChildOf:             "child",
+	Completes:           "completion",
+	CompletesUniquely:   "completion",
+	Defines:             "definition",
+	DefinesBinding:      "binding",
+	Documents:           "documentation",
+	Extends:             "extends",
+	Named:               "name",
+	Overrides:           "override",
+	OverridesTransitive: "override",
+	Param:               "parameter",
+	Ref:                 "reference",
+	RefCall:             "call",
+	RefImports:          "import",
+	Typed:               "type",
+}
+
+// Label returns a stable, short, human-readable label for kind, such as
+// "call" for "/kythe/edge/ref/call", regardless of its direction or ordinal.
+// An extends kind's variants share its label.  A kind without a label is
+// returned in its canonical form without its ordinal.
+func Label(kind string) string {
+	canon, _, _ := ParseOrdinal(Canonical(kind))
+	if IsExtends(canon) {
+		canon = Extends
+	}
+	if label, ok := labels[canon]; ok {
+		return label
+	}
+	return canon
+}
+
 var ordinalKind = regexp.MustCompile(`^(.+)\.(\d+)$`)
 
 // ParseOrdinal reports whether kind has an ordinal suffix (.nnn), and if so,
@@ -128,6 +128,84 @@ func TestIsVariant(t *testing.T) {
 	}
 }
 
+func TestIsOverride(t *testing.T) {
+	tests := []struct {
+		kind string
+		want bool
+	}{
+		{Overrides, true},
+		{OverridesTransitive, true},
+		{Mirror(Overrides), true},
+		{Mirror(OverridesTransitive), true},
+		{Extends, false},
+		{Prefix + "overridesfoo", false},
+	}
+	for _, test := range tests {
+		if got := IsOverride(test.kind); got != test.want {
+			t.Errorf("IsOverride(%q): got %v, want %v", test.kind, got, test.want)
+		}
+	}
+}
+
+func TestIsExtends(t *testing.T) {
+	tests := []struct {
+		kind string
+		want bool
+	}{
+		{Extends, true},
+		{ExtendsPublic, true},
+		{ExtendsPrivateVirtual, true},
+		{Mirror(Extends), true},
+		{Mirror(ExtendsProtected), true},
+		{Overrides, false},
+		{Prefix + "extendsfoo", false},
+	}
+	for _, test := range tests {
+		if got := IsExtends(test.kind); got != test.want {
+			t.Errorf("IsExtends(%q): got %v, want %v", test.kind, got, test.want)
+		}
+	}
+}
+
+func TestIsImport(t *testing.T) {
+	tests := []struct {
+		kind string
+		want bool
+	}{
+		{RefImports, true},
+		{Mirror(RefImports), true},
+		{RefImports + "/module", true},
+		{Ref, false},
+		{RefCall, false},
+		{Prefix + "ref/importsfoo", false},
+	}
+	for _, test := range tests {
+		if got := IsImport(test.kind); got != test.want {
+			t.Errorf("IsImport(%q): got %v, want %v", test.kind, got, test.want)
+		}
+	}
+}
+
+func TestIsAlias(t *testing.T) {
+	tests := []struct {
+		kind string
+		want bool
+	}{
+		{Aliases, true},
+		{AliasesRoot, true},
+		{Named, true},
+		{Mirror(Aliases), true},
+		{Mirror(Named), true},
+		{Typed, false},
+		{Prefix + "aliasesfoo", false},
+	}
+	for _, test := range tests {
+		if got := IsAlias(test.kind); got != test.want {
+			t.Errorf("IsAlias(%q): got %v, want %v", test.kind, got, test.want)
+		}
+	}
+}
+
 func TestParamIndex(t *testing.T) {
 	tests := []string{"param.0", "param.1", "param.2", "param.3"}
 	for i, test := range tests {
@@ -137,3 +215,27 @@ func TestParamIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestLabel(t *testing.T) {
+	tests := []struct {
+		kind, want string
+	}{
+		{Ref, "reference"},
+		{RefCall, "call"},
+		{Mirror(RefCall), "call"},
+		{DefinesBinding, "binding"},
+		{RefImports, "import"},
+		{ExtendsPublicVirtual, "extends"},
+		{OverridesTransitive, "override"},
+		{ParamIndex(2), "parameter"},
+		{Mirror(ParamIndex(0)), "parameter"},
+		{Prefix + "unknown", Prefix + "unknown"},
+		{Mirror(Prefix + "unknown.1"), Prefix + "unknown"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := Label(test.kind); got != test.want {
+			t.Errorf("Label(%q): got %q, want %q", test.kind, got, test.want)
+		}
+	}
+}
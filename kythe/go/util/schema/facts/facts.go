@@ -17,23 +17,168 @@
 // Package facts defines constants for Kythe facts.
 package facts
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 const prefix = "/kythe/" // duplicated to avoid a circular import
 
 // Node fact labels
 const (
-	AnchorEnd    = prefix + "loc/end"
-	AnchorStart  = prefix + "loc/start"
-	Complete     = prefix + "complete"
-	Code         = prefix + "code"
-	ParamDefault = prefix + "param/default"
-	NodeKind     = prefix + "node/kind"
-	SnippetEnd   = prefix + "snippet/end"
-	SnippetStart = prefix + "snippet/start"
-	Subkind      = prefix + "subkind"
-	Text         = prefix + "text"
-	TextEncoding = prefix + "text/encoding"
+	AnchorEnd       = prefix + "loc/end"
+	AnchorStart     = prefix + "loc/start"
+	BuildConfig     = prefix + "build/config"
+	Complete        = prefix + "complete"
+	Code            = prefix + "code"
+	Deprecated      = prefix + "tag/deprecated"
+	DocURI          = prefix + "doc/uri"
+	Language        = prefix + "language"
+	LineIndex       = prefix + "text/line_index"
+	Message         = prefix + "message"
+	ParamDefault    = prefix + "param/default"
+	NodeKind        = prefix + "node/kind"
+	Severity        = prefix + "severity"
+	SnippetEnd      = prefix + "snippet/end"
+	SnippetFile     = prefix + "snippet/file"
+	SnippetStart    = prefix + "snippet/start"
+	Subkind         = prefix + "subkind"
+	TagAbstract     = prefix + "tag/abstract"
+	TagConst        = prefix + "tag/const"
+	TagStatic       = prefix + "tag/static"
+	Text            = prefix + "text"
+	TextCompression = prefix + "text/compression"
+	TextEncoding    = prefix + "text/encoding"
+	TextRef         = prefix + "text/ref"
+	Visibility      = prefix + "visibility"
 )
 
+// VisibilityPublic is the Visibility value of an exported node.  Any other
+// non-empty value (e.g. "private") denotes an unexported node.
+const VisibilityPublic = "public"
+
 // DefaultTextEncoding is the implicit value for TextEncoding if it is empty or
 // missing from a node with a Text fact.
 const DefaultTextEncoding = "UTF-8"
+
+// Completeness is the parsed value of a Complete fact.
+type Completeness int
+
+// Completeness values, in increasing order of completeness.
+const (
+	// CompletenessIncomplete denotes a node that is declared but not defined
+	// (e.g. a function prototype).
+	CompletenessIncomplete Completeness = iota
+
+	// CompletenessComplete denotes a node whose declaration is complete but
+	// which may still lack a definition (e.g. an extern variable).
+	CompletenessComplete
+
+	// CompletenessDefinition denotes a node's definition.
+	CompletenessDefinition
+)
+
+var completenessValues = []string{"incomplete", "complete", "definition"}
+
+// String returns the Complete fact value of c.
+func (c Completeness) String() string {
+	if c < 0 || int(c) >= len(completenessValues) {
+		return fmt.Sprintf("Completeness(%d)", int(c))
+	}
+	return completenessValues[c]
+}
+
+// ParseComplete parses a Complete fact value.  An error is returned if the
+// value is not one of "incomplete", "complete", or "definition".
+func ParseComplete(value []byte) (Completeness, error) {
+	for i, v := range completenessValues {
+		if string(value) == v {
+			return Completeness(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid %s value: %q", Complete, value)
+}
+
+// ParseOffset parses a byte offset fact value, such as that of an AnchorStart
+// or SnippetEnd fact.  An error is returned if the value is empty, is not a
+// decimal integer, or is negative.
+func ParseOffset(value []byte) (int, error) {
+	if len(value) == 0 {
+		return 0, errors.New("empty offset")
+	}
+	n, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 0, fmt.Errorf("error parsing offset %q: %v", value, err)
+	} else if n < 0 {
+		return 0, fmt.Errorf("invalid negative offset: %d", n)
+	}
+	return n, nil
+}
+
+// IsExported reports whether a node with the given Visibility fact value is
+// exported.  If the value is empty, ok is false and the node's visibility is
+// left to its language's default.
+func IsExported(visibility []byte) (exported, ok bool) {
+	if len(visibility) == 0 {
+		return false, false
+	}
+	return string(visibility) == VisibilityPublic, true
+}
+
+// ParseLineIndex parses a LineIndex fact value: the length in bytes of each
+// line of a file's Text, including its terminating newline, in decimal and
+// separated by commas.  The final line has no newline and may be empty, so the
+// value for the text "ab\ncd\n" is "3,3,0".
+func ParseLineIndex(value []byte) ([]int, error) {
+	if len(value) == 0 {
+		return nil, fmt.Errorf("empty %s", LineIndex)
+	}
+	fields := strings.Split(string(value), ",")
+	lines := make([]int, len(fields))
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s value %q: %v", LineIndex, f, err)
+		} else if n < 0 || (n == 0 && i < len(fields)-1) {
+			return nil, fmt.Errorf("invalid %s line length: %d", LineIndex, n)
+		}
+		lines[i] = n
+	}
+	return lines, nil
+}
+
+// ValidateAnchor parses the AnchorStart and AnchorEnd facts of an anchor node
+// with the given facts.  An error is returned if either fact is missing or is
+// not a valid offset (see ParseOffset), or if start > end.
+func ValidateAnchor(nodeFacts map[string][]byte) (start, end int, err error) {
+	return parseSpan(nodeFacts, AnchorStart, AnchorEnd)
+}
+
+// ValidateSnippet parses the SnippetStart and SnippetEnd facts of an anchor
+// node with the given facts, as ValidateAnchor does its AnchorStart and
+// AnchorEnd facts.
+func ValidateSnippet(nodeFacts map[string][]byte) (start, end int, err error) {
+	return parseSpan(nodeFacts, SnippetStart, SnippetEnd)
+}
+
+func parseSpan(nodeFacts map[string][]byte, startFact, endFact string) (start, end int, err error) {
+	startVal, endVal := string(nodeFacts[startFact]), string(nodeFacts[endFact])
+	if startVal == "" || endVal == "" {
+		return 0, 0, fmt.Errorf("missing location facts; found: %s=%q and %s=%q",
+			startFact, startVal, endFact, endVal)
+	}
+	start, err = ParseOffset(nodeFacts[startFact])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid %s value: %v", startFact, err)
+	}
+	end, err = ParseOffset(nodeFacts[endFact])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid %s value: %v", endFact, err)
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("invalid %s/%s span: %d-%d", startFact, endFact, start, end)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2017 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package facts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsExported(t *testing.T) {
+	tests := []struct {
+		visibility   string
+		exported, ok bool
+	}{
+		{"", false, false},
+		{VisibilityPublic, true, true},
+		{"private", false, true},
+		{"protected", false, true},
+	}
+	for _, test := range tests {
+		if exported, ok := IsExported([]byte(test.visibility)); exported != test.exported || ok != test.ok {
+			t.Errorf("IsExported(%q): found (%v, %v); expected (%v, %v)", test.visibility, exported, ok, test.exported, test.ok)
+		}
+	}
+}
+
+func TestParseLineIndex(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []int
+	}{
+		{"0", []int{0}},
+		{"3,3,0", []int{3, 3, 0}},
+		{"1,5,4", []int{1, 5, 4}},
+	}
+	for _, test := range tests {
+		found, err := ParseLineIndex([]byte(test.value))
+		if err != nil {
+			t.Errorf("ParseLineIndex(%q) error: %v", test.value, err)
+		} else if !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("ParseLineIndex(%q): found %v; expected %v", test.value, found, test.expected)
+		}
+	}
+
+	for _, value := range []string{"", "3,,0", "a,1", "3,-1,0", "3,0,2"} {
+		if found, err := ParseLineIndex([]byte(value)); err == nil {
+			t.Errorf("ParseLineIndex(%q): expected error; found %v", value, found)
+		}
+	}
+}
+
+func TestValidateAnchor(t *testing.T) {
+	tests := []struct {
+		start, end string
+		ok         bool
+
+		startOffset, endOffset int
+	}{
+		{"0", "4", true, 0, 4},
+		{"5", "5", true, 5, 5},
+		{"", "4", false, 0, 0},
+		{"0", "", false, 0, 0},
+		{"", "", false, 0, 0},
+		{"zero", "4", false, 0, 0},
+		{"0", "4.5", false, 0, 0},
+		{"-1", "4", false, 0, 0},
+		{"5", "4", false, 0, 0},
+	}
+
+	for _, test := range tests {
+		nodeFacts := make(map[string][]byte)
+		if test.start != "" {
+			nodeFacts[AnchorStart] = []byte(test.start)
+		}
+		if test.end != "" {
+			nodeFacts[AnchorEnd] = []byte(test.end)
+		}
+
+		start, end, err := ValidateAnchor(nodeFacts)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("ValidateAnchor(%q, %q): expected error; found [%d:%d]", test.start, test.end, start, end)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("ValidateAnchor(%q, %q): unexpected error: %v", test.start, test.end, err)
+			continue
+		}
+		if start != test.startOffset || end != test.endOffset {
+			t.Errorf("ValidateAnchor(%q, %q): found [%d:%d]; expected [%d:%d]",
+				test.start, test.end, start, end, test.startOffset, test.endOffset)
+		}
+	}
+}
+
+func TestValidateSnippet(t *testing.T) {
+	start, end, err := ValidateSnippet(map[string][]byte{
+		AnchorStart:  []byte("2"),
+		AnchorEnd:    []byte("3"),
+		SnippetStart: []byte("0"),
+		SnippetEnd:   []byte("10"),
+	})
+	if err != nil {
+		t.Fatalf("ValidateSnippet error: %v", err)
+	} else if start != 0 || end != 10 {
+		t.Errorf("ValidateSnippet: found [%d:%d]; expected [0:10]", start, end)
+	}
+}
+
+func TestParseComplete(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected Completeness
+	}{
+		{"incomplete", CompletenessIncomplete},
+		{"complete", CompletenessComplete},
+		{"definition", CompletenessDefinition},
+	}
+	for _, test := range tests {
+		found, err := ParseComplete([]byte(test.value))
+		if err != nil {
+			t.Errorf("ParseComplete(%q) error: %v", test.value, err)
+		} else if found != test.expected {
+			t.Errorf("ParseComplete(%q): found %v; expected %v", test.value, found, test.expected)
+		} else if s := found.String(); s != test.value {
+			t.Errorf("%v.String(): found %q; expected %q", found, s, test.value)
+		}
+	}
+
+	for _, value := range []string{"", "Definition", "defined", "definition "} {
+		if found, err := ParseComplete([]byte(value)); err == nil {
+			t.Errorf("ParseComplete(%q): expected error; found %v", value, found)
+		}
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"0", 0},
+		{"42", 42},
+		{"007", 7},
+	}
+	for _, test := range tests {
+		found, err := ParseOffset([]byte(test.value))
+		if err != nil {
+			t.Errorf("ParseOffset(%q) error: %v", test.value, err)
+		} else if found != test.expected {
+			t.Errorf("ParseOffset(%q): found %d; expected %d", test.value, found, test.expected)
+		}
+	}
+
+	for _, value := range []string{"", "-1", "4.5", "zero", " 4"} {
+		if found, err := ParseOffset([]byte(value)); err == nil {
+			t.Errorf("ParseOffset(%q): expected error; found %d", value, found)
+		}
+	}
+}
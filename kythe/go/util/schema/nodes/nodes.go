@@ -19,21 +19,22 @@ package nodes
 
 // Node kind labels
 const (
-	Anchor    = "anchor"
-	Constant  = "constant"
-	Doc       = "doc"
-	EnumK     = "enum"
-	File      = "file"
-	Function  = "function"
-	Interface = "interface"
-	Name      = "name"
-	Package   = "package"
-	Record    = "record"
-	TAlias    = "talias"
-	TApp      = "tapp"
-	TBuiltin  = "tbuiltin"
-	TNominal  = "tnominal"
-	Variable  = "variable"
+	Anchor     = "anchor"
+	Constant   = "constant"
+	Diagnostic = "diagnostic"
+	Doc        = "doc"
+	EnumK      = "enum"
+	File       = "file"
+	Function   = "function"
+	Interface  = "interface"
+	Name       = "name"
+	Package    = "package"
+	Record     = "record"
+	TAlias     = "talias"
+	TApp       = "tapp"
+	TBuiltin   = "tbuiltin"
+	TNominal   = "tnominal"
+	Variable   = "variable"
 )
 
 // Node subkinds
@@ -34,6 +34,17 @@ const (
 	SnippetLocFilter = "/kythe/snippet/*"
 )
 
+// CombinedKind returns the kind of a node with the given facts combined with
+// its subkind, if it has one, as "kind/subkind" (e.g. "record/class").  If the
+// node has no facts.NodeKind fact, "" is returned.
+func CombinedKind(nodeFacts map[string][]byte) string {
+	kind, subkind := string(nodeFacts[facts.NodeKind]), string(nodeFacts[facts.Subkind])
+	if kind == "" || subkind == "" {
+		return kind
+	}
+	return kind + "/" + subkind
+}
+
 // An Edge represents an edge.
 type Edge struct {
 	Source, Target *spb.VName
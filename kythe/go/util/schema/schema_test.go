@@ -74,3 +74,28 @@ func TestEdgeToEntry(t *testing.T) {
 		t.Errorf("ToEdge(%+v):\n--- got\n%s\n--- want\n%s", e, proto.MarshalTextString(got), proto.MarshalTextString(want))
 	}
 }
+
+func TestCombinedKind(t *testing.T) {
+	tests := []struct {
+		kind, subkind string
+		expected      string
+	}{
+		{"", "", ""},
+		{"", nodes.Class, ""},
+		{nodes.Function, "", nodes.Function},
+		{nodes.Record, nodes.Class, "record/class"},
+		{nodes.Record, nodes.Struct, "record/struct"},
+	}
+	for _, test := range tests {
+		nodeFacts := make(map[string][]byte)
+		if test.kind != "" {
+			nodeFacts[facts.NodeKind] = []byte(test.kind)
+		}
+		if test.subkind != "" {
+			nodeFacts[facts.Subkind] = []byte(test.subkind)
+		}
+		if found := CombinedKind(nodeFacts); found != test.expected {
+			t.Errorf("CombinedKind(%q, %q): found %q; expected %q", test.kind, test.subkind, found, test.expected)
+		}
+	}
+}